@@ -5,27 +5,41 @@ import (
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/crypto/bcrypt"
+	"go.mongodb.org/mongo-driver/bson"
 	"net/http"
 	"quickstart-go-jwt-mongodb/internal"
 	"quickstart-go-jwt-mongodb/models"
 	"quickstart-go-jwt-mongodb/repositories"
 	"quickstart-go-jwt-mongodb/server"
 	"quickstart-go-jwt-mongodb/services"
-	"sync"
 	"time"
 )
 
-type auth struct {
-	Username string `json:"username" validate:"required,email"`
-	Password string `json:"password"`
-}
+type (
+	auth struct {
+		Username string `json:"username" validate:"required,email"`
+		Password string `json:"password" validate:"required"`
+	}
+	// accountUpdate details users change on their own account. The email is not among them, it would need verifying
+	// again
+	accountUpdate struct {
+		FirstName       string          `json:"first_name"`
+		LastName        string          `json:"last_name"`
+		Phone           string          `json:"phone"`
+		DateOfBirth     time.Time       `json:"date_of_birth"`
+		Address         *models.Address `json:"address"`
+		Locale          string          `json:"locale" validate:"omitempty,bcp47_language_tag"`
+		Password        string          `json:"password"`
+		CurrentPassword string          `json:"current_password" validate:"required_with=Password"`
+	}
+)
 
 func CreateAccount(database internal.MongoDatabase, ctx context.Context) server.Controller {
 	return server.Controller{
-		Uri:    "/account/create",
-		Method: server.POST,
-		Secure: false,
+		Uri:       "/account/create",
+		Method:    server.POST,
+		Secure:    false,
+		RateLimit: server.RateLimit{Requests: 10, Window: time.Hour, Algorithm: server.SlidingWindow},
 		Callback: func(w http.ResponseWriter, req *http.Request) {
 			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 			defer cancel()
@@ -38,17 +52,31 @@ func CreateAccount(database internal.MongoDatabase, ctx context.Context) server.
 				return
 			}
 
+			// verification status and roles are owned by the server, never by the sign-up payload.
+			// Roles and organization memberships are granted through the admin endpoints
+			user.EmailVerified = false
+			user.Roles = nil
+			user.Memberships = nil
+			if user.Locale == "" {
+				user.Locale = preferredLocale(req)
+			}
+
 			userRepository := repositories.NewUserRepository(database)
 			if userRepository.FindOne(ctx, &user, repositories.Filter{Key: "email", Value: user.Email}) {
 				server.HttpError(w, errors.New(fmt.Sprintf("%s already exists", user.Email)))
 				return
 			}
+			if err = services.NewPasswordPolicy(models.LoadEnvironmentVariables()).Validate(user.PasswordRequestBody, user); err != nil {
+				server.HttpError(w, err)
+				return
+			}
 			password, err := generateHashPassword(user.PasswordRequestBody)
 			if err != nil {
 				server.HttpError(w, errors.New("unable to hash password. Please try again later"))
 				return
 			}
 			user.Password = password
+			user.PasswordChangedAt = time.Now()
 			objectId, err := userRepository.CreateOne(ctx, &user)
 			if err != nil {
 				server.HttpError(w, err)
@@ -56,49 +84,86 @@ func CreateAccount(database internal.MongoDatabase, ctx context.Context) server.
 			}
 			user.ID = objectId
 			user.PasswordRequestBody = ""
+			sendEmailVerification(ctx, database, user)
 			server.HttpResponse(w, http.StatusCreated, user)
 			return
 		},
 	}
 }
 
+// UpdateUser changes the caller's own account details. Fields left empty are kept, and the password is only changed
+// along with the current one, signing the user out of every session
 func UpdateUser(database internal.MongoDatabase, ctx context.Context) server.Controller {
 	return server.Controller{
-		Uri:    "/account/create",
-		Method: server.PUT,
-		Secure: true,
+		Uri:                 "/account/create",
+		Method:              server.PUT,
+		Secure:              true,
+		ForbidImpersonation: true,
 		Callback: func(w http.ResponseWriter, req *http.Request) {
 			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 			defer cancel()
-			var user = models.User{
-				BaseModel: models.NewBaseModel(),
+			principal, _ := server.CurrentPrincipal(req)
+			var body accountUpdate
+			if err := server.ParseReqToJson(req, &body); err != nil {
+				server.HttpError(w, err)
+				return
 			}
-			err := server.ParseReqToJson(req, &user)
+			user, err := currentUser(ctx, database, principal)
 			if err != nil {
 				server.HttpError(w, err)
 				return
 			}
 
+			update := bson.M{"updated_at": time.Now()}
+			for field, value := range map[string]string{"first_name": body.FirstName, "last_name": body.LastName, "phone": body.Phone, "locale": body.Locale} {
+				if value != "" {
+					update[field] = value
+				}
+			}
+			if !body.DateOfBirth.IsZero() {
+				update["date_of_birth"] = body.DateOfBirth
+			}
+			if body.Address != nil {
+				update["address"] = body.Address.Address
+			}
+
+			var passwordHash string
+			passwords := services.NewPasswordService(ctx, database, models.LoadEnvironmentVariables())
+			if body.Password != "" {
+				if _, err = verifyCredentials(ctx, req, database, user.Email, body.CurrentPassword); err != nil {
+					credentialsError(w, err)
+					return
+				}
+				if err = passwords.Validate(user, body.Password); err != nil {
+					server.HttpError(w, err)
+					return
+				}
+				if passwordHash, err = generateHashPassword(body.Password); err != nil {
+					server.HttpError(w, errors.New("unable to hash password. Please try again later"))
+					return
+				}
+			}
+
 			userRepository := repositories.NewUserRepository(database)
-			if userRepository.FindOne(ctx, &user, repositories.Filter{Key: "email", Value: user.Email}) {
-				server.HttpError(w, errors.New(fmt.Sprintf("%s already exists", user.Email)))
+			if _, err = userRepository.UpdateOne(ctx, bson.M{"$set": update}, repositories.Filter{Key: "_id", Value: user.ID}); err != nil {
+				log.Error("unable to update account", err)
+				server.HttpError(w, errors.New("unable to update account. Please try again later"))
 				return
 			}
-			password, err := generateHashPassword(user.PasswordRequestBody)
-			if err != nil {
-				server.HttpError(w, errors.New("unable to hash password. Please try again later"))
-				return
+			if passwordHash != "" {
+				if err = passwords.Change(user, passwordHash); err != nil {
+					log.Error("unable to change password", err)
+					server.HttpError(w, errors.New("unable to change password. Please try again later"))
+					return
+				}
+				auditPasswordChange(database, req, user)
+				clearRefreshTokenCookie(w)
 			}
-			user.Password = password
-			objectId, err := userRepository.CreateOne(ctx, &user)
-			if err != nil {
+			if user, err = currentUser(ctx, database, principal); err != nil {
 				server.HttpError(w, err)
 				return
 			}
-			user.ID = objectId
-			user.PasswordRequestBody = ""
-			server.HttpResponse(w, http.StatusCreated, user)
-			return
+			server.HttpResponse(w, http.StatusOK, user)
 		},
 	}
 }
@@ -108,10 +173,11 @@ func Authenticate(database internal.MongoDatabase, ctx context.Context) server.C
 		Uri:    "/account/auth",
 		Method: server.POST,
 		Secure: false,
+		// sign in lockout counts failures; this caps the attempts spread over many accounts too
+		RateLimit: server.RateLimit{Requests: 60, Window: time.Minute, Burst: 10},
 		Callback: func(w http.ResponseWriter, req *http.Request) {
 			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 			defer cancel()
-			var user models.User
 			var auth auth
 			err := server.ParseReqToJson(req, &auth)
 			if err != nil {
@@ -119,60 +185,35 @@ func Authenticate(database internal.MongoDatabase, ctx context.Context) server.C
 				return
 			}
 
-			userRepository := repositories.NewUserRepository(database)
-			tokenRepository := repositories.NewTokenRepository(database)
-			findOne := userRepository.FindOne(ctx, &user, repositories.Filter{Key: "email", Value: auth.Username})
-			if !findOne {
-				server.HttpError(w, errors.New(fmt.Sprintf("Invalid Username. %s does not exists", auth.Username)))
+			user, err := verifyCredentials(ctx, req, database, auth.Username, auth.Password)
+			if err != nil {
+				credentialsError(w, err)
 				return
 			}
-
-			if !checkPasswordHash(auth.Password, user.Password) {
-				server.HttpError(w, errors.New("invalid Credential supplied. Please check username/password"))
+			if unverifiedEmailRefused(user) {
+				server.Forbidden(w, services.ErrEmailNotVerified)
 				return
 			}
-
-			jwtService := services.NewJwtService(ctx, models.LoadEnvironmentVariables())
-			extraClaims := map[string]any{
-				"iss": req.Host,
+			if passwordExpired(user) {
+				server.Forbidden(w, services.ErrPasswordExpired)
+				return
 			}
-			var accessTokenStr string
-			var refreshTokenStr string
-			wg := sync.WaitGroup{}
-			wg.Add(2)
-			go func() {
-				defer wg.Done()
-				accessTokenStr, err = jwtService.GenerateJWT(user, 30*time.Minute, extraClaims)
-			}()
-
-			go func() {
-				defer wg.Done()
-				refreshTokenStr, err = jwtService.GenerateJWT(user.Email, 24*time.Hour, extraClaims)
-			}()
-			wg.Wait()
 
-			token := models.Token{
-				BaseModel:    models.NewBaseModel(),
-				AccessToken:  accessTokenStr,
-				RefreshToken: refreshTokenStr,
-			}
-			http.SetCookie(w, &http.Cookie{
-				Name:     "jwt",
-				Value:    refreshTokenStr,
-				Expires:  time.Now().Add(25 * time.Hour),
-				MaxAge:   60 * 60 * 24,
-				Secure:   true,
-				HttpOnly: true,
-				SameSite: http.SameSiteNoneMode,
-			})
-			tokenId, err := tokenRepository.CreateOne(ctx, token)
-			if err != nil {
-				log.Error("Unable to persist token generated", err)
+			if services.MfaEnabled(user) {
+				// the password alone is not enough: the client completes the login on /account/auth/mfa
+				challengeToken, err := services.NewMfaService(ctx, database).IssueChallenge(services.NewJwtService(ctx, models.LoadEnvironmentVariables()), user, []string{services.AmrPassword})
+				if err != nil {
+					log.Error("unable to issue mfa challenge", err)
+					server.HttpError(w, errors.New("unable to generated token. Please try again later"))
+					return
+				}
+				server.HttpResponse(w, http.StatusOK, mfaChallenge{MfaRequired: true, ChallengeToken: challengeToken})
+				return
 			}
-			token.ID = tokenId
 
+			token, err := issueTokens(ctx, w, req, database, user, nil, []string{services.AmrPassword})
 			if err != nil {
-				server.HttpError(w, errors.New("unable to generated token. Please try again later"))
+				server.HttpError(w, err)
 				return
 			}
 
@@ -190,50 +231,95 @@ func RefreshToken(database internal.MongoDatabase, ctx context.Context) server.C
 		Callback: func(w http.ResponseWriter, req *http.Request) {
 			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 			defer cancel()
-			cookie, err := req.Cookie("jwt")
+			cookie, err := req.Cookie(refreshTokenCookie)
 			var email string
 			if err != nil {
 				server.AccessDenied(w, errors.New("'jwt' cookie do not exist in cookie-header"))
 				return
 			}
 			jwtService := services.NewJwtService(ctx, models.LoadEnvironmentVariables())
-			jwt, err := jwtService.ClaimToken(cookie.Value, &email)
-			if err != nil {
+			if _, err = jwtService.ClaimToken(cookie.Value, &email); err != nil {
 				server.AccessDenied(w, errors.New("invalid jwt token supplied"))
 				return
 			}
-			expirationTime, _ := jwt.GetExpirationTime()
+
+			//Every refresh token is single use. Replaying a consumed one revokes its whole family
+			previous, err := services.NewSessionService(ctx, database).ConsumeRefreshToken(cookie.Value, "")
 			if err != nil {
-				return
-			}
-			if time.Now().After(expirationTime.Time) {
-				server.AccessDenied(w, errors.New("unauthorized. Token expired"))
+				server.AccessDenied(w, err)
 				return
 			}
 
 			userRepository := repositories.NewUserRepository(database)
 			var user models.User
-			userRepository.FindOne(ctx, &user, repositories.Filter{Key: "email", Value: email})
-
-			//Create a one-time only access token again
-			accessTokenStr, err := jwtService.GenerateJWT(user, 10*time.Hour)
-			token := models.Token{
-				BaseModel:   models.NewBaseModel(),
-				AccessToken: accessTokenStr,
+			if !userRepository.FindOne(ctx, &user, repositories.Filter{Key: "email", Value: email}) {
+				server.AccessDenied(w, errors.New("invalid jwt token supplied"))
+				return
 			}
 
-			tokenRepository := repositories.NewTokenRepository(database)
-			id, err := tokenRepository.CreateOne(ctx, token)
+			token, err := issueTokens(ctx, w, req, database, user, &previous, nil)
 			if err != nil {
+				server.HttpError(w, err)
 				return
 			}
-			token.ID = id
 			server.HttpResponse(w, http.StatusCreated, token)
 			return
 		},
 	}
 }
 
+// Logout revokes the session the access token was issued for, including its refresh token
+func Logout(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                  "/account/logout",
+		Method:               server.POST,
+		Secure:               true,
+		AllowWithoutMfa:      true,
+		AllowUnverifiedEmail: true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			sessionService := services.NewSessionService(ctx, database)
+			var err error
+			if sessionId := principal.StringClaim("sid"); sessionId != "" {
+				err = sessionService.RevokeFamily(sessionId)
+			} else {
+				err = sessionService.RevokeAccessToken(principal.StringClaim("jti"))
+			}
+			if err != nil {
+				server.HttpError(w, errors.New("unable to logout. Please try again later"))
+				return
+			}
+			clearRefreshTokenCookie(w)
+			server.HttpResponse(w, http.StatusOK, nil)
+		},
+	}
+}
+
+// LogoutAll revokes every session of the caller on every device
+func LogoutAll(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                  "/account/logout-all",
+		Method:               server.POST,
+		Secure:               true,
+		ForbidImpersonation:  true,
+		AllowWithoutMfa:      true,
+		AllowUnverifiedEmail: true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			if err := services.NewSessionService(ctx, database).RevokeUser(principal.User.ID); err != nil {
+				server.HttpError(w, errors.New("unable to logout. Please try again later"))
+				return
+			}
+			clearRefreshTokenCookie(w)
+			server.HttpResponse(w, http.StatusOK, nil)
+		},
+	}
+}
+
 // listCustomers - Empty '[]PermitRoles' is wildcard access to all users.
 // By simply excluding the PermitRole filed from the Controller struct, it permits all secured users to
 // access the page
@@ -258,11 +344,9 @@ func listCustomers(database internal.MongoDatabase) server.Controller {
 }
 
 func checkPasswordHash(password string, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+	return services.NewPasswordHasher(models.LoadEnvironmentVariables()).Verify(password, hash)
 }
 
 func generateHashPassword(plainText string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(plainText), bcrypt.DefaultCost)
-	return string(bytes), err
+	return services.NewPasswordHasher(models.LoadEnvironmentVariables()).Hash(plainText)
 }
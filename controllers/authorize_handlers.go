@@ -0,0 +1,246 @@
+package controllers
+
+import (
+	"context"
+	"crypto/subtle"
+	"embed"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"html/template"
+	"net/http"
+	"net/url"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/server"
+	"quickstart-go-jwt-mongodb/services"
+	"time"
+)
+
+type (
+	// authorizeRequest RFC 6749 section 4.1.1 authorization request, with RFC 7636 PKCE parameters
+	authorizeRequest struct {
+		ResponseType        string
+		ClientId            string
+		RedirectUri         string
+		Scope               string
+		State               string
+		CodeChallenge       string
+		CodeChallengeMethod string
+		Nonce               string // OpenID Connect replay protection, echoed in the ID token
+	}
+	authorizePage struct {
+		Request   authorizeRequest
+		Client    models.Client
+		CsrfToken string
+		Error     string
+		Fatal     string
+	}
+)
+
+const csrfCookie = "oauth_csrf"
+
+var (
+	//go:embed templates/authorize.html
+	authorizeTemplateFs embed.FS
+	authorizeTemplate   = template.Must(template.ParseFS(authorizeTemplateFs, "templates/authorize.html"))
+)
+
+// Authorize renders the login and consent page of the authorization code flow
+func Authorize(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/oauth/authorize",
+		Method: server.GET,
+		Secure: false,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			authRequest := newAuthorizeRequest(req.URL.Query())
+			client, ok := validateAuthorizeRequest(ctx, w, req, database, authRequest)
+			if !ok {
+				return
+			}
+			renderAuthorizePage(w, http.StatusOK, authorizePage{Request: authRequest, Client: client, CsrfToken: setCsrfCookie(w)})
+		},
+	}
+}
+
+// AuthorizeDecision handles the submitted login and consent form and redirects back to the client with a code
+func AuthorizeDecision(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/oauth/authorize",
+		Method: server.POST,
+		Secure: false,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := req.ParseForm(); err != nil {
+				renderAuthorizePage(w, http.StatusBadRequest, authorizePage{Fatal: "malformed request"})
+				return
+			}
+			authRequest := newAuthorizeRequest(req.PostForm)
+			client, ok := validateAuthorizeRequest(ctx, w, req, database, authRequest)
+			if !ok {
+				return
+			}
+			cookie, err := req.Cookie(csrfCookie)
+			if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(req.PostForm.Get("csrf_token"))) != 1 {
+				renderAuthorizePage(w, http.StatusForbidden, authorizePage{Fatal: "your sign in form has expired. Please start again from the application"})
+				return
+			}
+			if req.PostForm.Get("decision") != "approve" {
+				redirectWithError(w, req, authRequest, "access_denied", "the user denied the request")
+				return
+			}
+
+			user, err := verifyCredentials(ctx, req, database, req.PostForm.Get("username"), req.PostForm.Get("password"))
+			if err != nil {
+				status, message := http.StatusUnauthorized, services.ErrInvalidCredentials.Error()
+				var locked *services.LoginLockedError
+				if errors.As(err, &locked) {
+					status, message = http.StatusTooManyRequests, locked.Error()
+				} else if !errors.Is(err, services.ErrInvalidCredentials) {
+					log.Error("unable to verify credentials", err)
+					status, message = http.StatusInternalServerError, "unable to complete the request. Please try again later"
+				}
+				renderAuthorizePage(w, status, authorizePage{
+					Request:   authRequest,
+					Client:    client,
+					CsrfToken: setCsrfCookie(w),
+					Error:     message,
+				})
+				return
+			}
+			if unverifiedEmailRefused(user) {
+				renderAuthorizePage(w, http.StatusForbidden, authorizePage{
+					Request:   authRequest,
+					Client:    client,
+					CsrfToken: setCsrfCookie(w),
+					Error:     services.ErrEmailNotVerified.Error(),
+				})
+				return
+			}
+			if passwordExpired(user) {
+				renderAuthorizePage(w, http.StatusForbidden, authorizePage{
+					Request:   authRequest,
+					Client:    client,
+					CsrfToken: setCsrfCookie(w),
+					Error:     services.ErrPasswordExpired.Error(),
+				})
+				return
+			}
+			amr := []string{services.AmrPassword}
+			if services.MfaEnabled(user) {
+				if err = services.NewMfaService(ctx, database).Verify(user, req.PostForm.Get("otp")); err != nil {
+					renderAuthorizePage(w, http.StatusUnauthorized, authorizePage{
+						Request:   authRequest,
+						Client:    client,
+						CsrfToken: setCsrfCookie(w),
+						Error:     services.ErrInvalidMfaCode.Error(),
+					})
+					return
+				}
+				amr = append(amr, services.AmrOtp, services.AmrMfa)
+			}
+
+			code, err := services.NewAuthorizationCodeService(ctx, database).Create(models.AuthorizationCode{
+				ClientId:            client.ClientId,
+				UserId:              user.ID,
+				RedirectUri:         authRequest.RedirectUri,
+				Scope:               authRequest.Scope,
+				CodeChallenge:       authRequest.CodeChallenge,
+				CodeChallengeMethod: authRequest.CodeChallengeMethod,
+				Nonce:               authRequest.Nonce,
+				AuthTime:            time.Now(),
+				Amr:                 amr,
+			})
+			if err != nil {
+				log.Error("unable to persist authorization code", err)
+				redirectWithError(w, req, authRequest, "server_error", "unable to issue an authorization code")
+				return
+			}
+			redirectToClient(w, req, authRequest, url.Values{"code": {code}})
+		},
+	}
+}
+
+func newAuthorizeRequest(values url.Values) authorizeRequest {
+	return authorizeRequest{
+		ResponseType:        values.Get("response_type"),
+		ClientId:            values.Get("client_id"),
+		RedirectUri:         values.Get("redirect_uri"),
+		Scope:               values.Get("scope"),
+		State:               values.Get("state"),
+		CodeChallenge:       values.Get("code_challenge"),
+		CodeChallengeMethod: values.Get("code_challenge_method"),
+		Nonce:               values.Get("nonce"),
+	}
+}
+
+// validateAuthorizeRequest errors about the client or redirect URI are shown to the user, since redirecting to an
+// unverified URI would make this an open redirector. Every other error is reported back to the client
+func validateAuthorizeRequest(ctx context.Context, w http.ResponseWriter, req *http.Request, database internal.MongoDatabase, authRequest authorizeRequest) (models.Client, bool) {
+	client, found := services.NewClientService(ctx, database).Find(authRequest.ClientId)
+	if !found {
+		renderAuthorizePage(w, http.StatusBadRequest, authorizePage{Fatal: "unknown client"})
+		return client, false
+	}
+	if !services.ValidRedirectUri(client, authRequest.RedirectUri) {
+		renderAuthorizePage(w, http.StatusBadRequest, authorizePage{Fatal: "redirect_uri is not registered for this client"})
+		return client, false
+	}
+	if authRequest.ResponseType != "code" {
+		redirectWithError(w, req, authRequest, "unsupported_response_type", "only the authorization code flow is supported")
+		return client, false
+	}
+	if authRequest.CodeChallenge == "" || authRequest.CodeChallengeMethod != services.PkceMethodS256 {
+		redirectWithError(w, req, authRequest, "invalid_request", "PKCE with code_challenge_method=S256 is required")
+		return client, false
+	}
+	return client, true
+}
+
+func redirectWithError(w http.ResponseWriter, req *http.Request, authRequest authorizeRequest, code, description string) {
+	redirectToClient(w, req, authRequest, url.Values{"error": {code}, "error_description": {description}})
+}
+
+func redirectToClient(w http.ResponseWriter, req *http.Request, authRequest authorizeRequest, params url.Values) {
+	redirectUri, err := url.Parse(authRequest.RedirectUri)
+	if err != nil {
+		renderAuthorizePage(w, http.StatusBadRequest, authorizePage{Fatal: "invalid redirect_uri"})
+		return
+	}
+	query := redirectUri.Query()
+	for key := range params {
+		query.Set(key, params.Get(key))
+	}
+	if authRequest.State != "" {
+		query.Set("state", authRequest.State)
+	}
+	redirectUri.RawQuery = query.Encode()
+	http.Redirect(w, req, redirectUri.String(), http.StatusFound)
+}
+
+func renderAuthorizePage(w http.ResponseWriter, statusCode int, page authorizePage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	w.WriteHeader(statusCode)
+	if err := authorizeTemplate.Execute(w, page); err != nil {
+		log.Error("unable to render authorization page", err)
+	}
+}
+
+// setCsrfCookie double-submit token protecting the login form against cross-site submissions
+func setCsrfCookie(w http.ResponseWriter) string {
+	token := services.RandomToken(32)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		MaxAge:   int((15 * time.Minute).Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/server"
+	"quickstart-go-jwt-mongodb/services"
+	"time"
+)
+
+type impersonationRequest struct {
+	Reason string `json:"reason" validate:"required"`
+}
+
+// ImpersonateUser issues a short-lived access token acting as another user, for support staff reproducing their
+// issues. The token names the admin in its `act` claim; every request made with it is audited and controllers with
+// ForbidImpersonation refuse it
+func ImpersonateUser(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/admin/impersonate/{userId}",
+		Method:              server.POST,
+		Secure:              true,
+		RequiredPermissions: []string{PermissionImpersonateUsers},
+		Policy:              PolicyPlatformOnly,
+		ForbidImpersonation: true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			if principal.IsClient() {
+				server.Forbidden(w, errors.New("only users can impersonate"))
+				return
+			}
+			userId, err := primitive.ObjectIDFromHex(mux.Vars(req)["userId"])
+			if err != nil {
+				server.HttpError(w, services.ErrUserNotFound)
+				return
+			}
+			var body impersonationRequest
+			if err = server.ParseReqToJson(req, &body); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			user, err := services.NewImpersonationService(ctx, database).Target(principal.User.ID, userId, principal.Permissions)
+			if err != nil {
+				impersonationError(w, err)
+				return
+			}
+			token, err := mintImpersonationToken(ctx, req, database, user, principal.User, services.StringSliceClaim(principal.Claims, "amr"))
+			if err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			services.AuditInBackground(database, models.AuditLog{
+				Action:   "impersonation.start",
+				ActorId:  principal.User.ID.Hex(),
+				Outcome:  services.AuditAllowed,
+				Reason:   body.Reason,
+				Method:   req.Method,
+				Path:     req.URL.Path,
+				ClientIp: server.ClientIp(req),
+				Details:  map[string]interface{}{"subject": user.ID.Hex(), "access_token_id": token.AccessTokenId},
+			})
+			server.HttpResponse(w, http.StatusCreated, token)
+		},
+	}
+}
+
+// impersonationError reports validation errors as they are and hides database errors behind a generic message
+func impersonationError(w http.ResponseWriter, err error) {
+	for _, known := range []error{services.ErrUserNotFound, services.ErrImpersonateSelf} {
+		if errors.Is(err, known) {
+			server.HttpError(w, err)
+			return
+		}
+	}
+	if errors.Is(err, services.ErrImpersonationEscalate) {
+		server.Forbidden(w, err)
+		return
+	}
+	log.Error("impersonation failed", err)
+	server.HttpError(w, errors.New("unable to complete the request. Please try again later"))
+}
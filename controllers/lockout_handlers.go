@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"quickstart-go-jwt-mongodb/server"
+	"quickstart-go-jwt-mongodb/services"
+	"sync"
+	"time"
+)
+
+// dummyPasswordHash compared against when the email is unknown, so that answer takes as long as a wrong password
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, err := generateHashPassword(services.RandomToken(16))
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
+
+// UnlockAccount target of the link emailed when an account gets locked: lifts the lockout right away
+func UnlockAccount(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/account/unlock",
+		Method: server.GET,
+		Secure: false,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			token := req.URL.Query().Get("token")
+			if token == "" {
+				server.HttpError(w, services.ErrInvalidOneTimeToken)
+				return
+			}
+			if err := services.NewLoginLockoutService(ctx, database, models.LoadEnvironmentVariables()).Unlock(token); err != nil {
+				lockoutError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusOK, nil)
+		},
+	}
+}
+
+// UnlockUser lifts the lockout of a user's account, e.g. for a user who called support
+func UnlockUser(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/admin/users/{id}/lockout",
+		Method:              server.DELETE,
+		Secure:              true,
+		RequiredPermissions: []string{PermissionUnlockUsers},
+		Policy:              PolicyPlatformOnly,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			userId, err := primitive.ObjectIDFromHex(mux.Vars(req)["id"])
+			if err != nil {
+				server.HttpError(w, services.ErrUserNotFound)
+				return
+			}
+			if err = services.NewLoginLockoutService(ctx, database, models.LoadEnvironmentVariables()).UnlockUser(userId); err != nil {
+				lockoutError(w, err)
+				return
+			}
+			services.AuditInBackground(database, models.AuditLog{
+				Action:   "user.unlock",
+				ActorId:  principal.User.ID.Hex(),
+				Outcome:  services.AuditAllowed,
+				Method:   req.Method,
+				Path:     req.URL.Path,
+				ClientIp: server.ClientIp(req),
+				Details:  map[string]interface{}{"subject": userId.Hex()},
+			})
+			server.HttpResponse(w, http.StatusOK, nil)
+		},
+	}
+}
+
+// verifyCredentials the user email and password sign in as. Every password login goes through here: failures are
+// counted per account and per source IP, locked accounts and addresses are refused before the password is checked,
+// and an unknown email fails exactly like a wrong password. The user is emailed an unlock link when their account
+// gets locked, and their password hash is upgraded when PASSWORD_HASH_* changed since it was made
+func verifyCredentials(ctx context.Context, req *http.Request, database internal.MongoDatabase, email, password string) (models.User, error) {
+	var user models.User
+	lockout := services.NewLoginLockoutService(ctx, database, models.LoadEnvironmentVariables())
+	ip := server.ClientIp(req)
+	if err := lockout.Check(email, ip); err != nil {
+		return user, err
+	}
+
+	found := repositories.NewUserRepository(database).FindOne(ctx, &user, repositories.Filter{Key: "email", Value: email})
+	if !found {
+		checkPasswordHash(password, dummyPasswordHash())
+	}
+	if !found || !checkPasswordHash(password, user.Password) {
+		locked, err := lockout.RecordFailure(email, ip)
+		if err != nil {
+			log.Error("unable to record failed sign in", err)
+		}
+		if locked && found {
+			link, err := publicUrl("/account/unlock")
+			if err == nil {
+				err = lockout.SendUnlockEmail(user, link)
+			}
+			if err != nil {
+				log.Error("unable to send unlock email", err)
+			}
+		}
+		return models.User{}, services.ErrInvalidCredentials
+	}
+
+	if err := lockout.RecordSuccess(email); err != nil {
+		log.Error("unable to reset failed sign ins", err)
+	}
+	// hashes made with older algorithms or parameters are upgraded while the password is at hand
+	rehashed, err := services.NewPasswordService(ctx, database, models.LoadEnvironmentVariables()).Rehash(user, password)
+	if err != nil {
+		log.Error("unable to rehash password", err)
+	}
+	user.Password = rehashed
+	return user, nil
+}
+
+// credentialsError answers a failed verifyCredentials: 429 with Retry-After while locked, 401 otherwise
+func credentialsError(w http.ResponseWriter, err error) {
+	var locked *services.LoginLockedError
+	switch {
+	case errors.As(err, &locked):
+		server.TooManyRequests(w, locked.RetryAfter, err)
+	case errors.Is(err, services.ErrInvalidCredentials):
+		server.AccessDenied(w, err)
+	default:
+		log.Error("unable to verify credentials", err)
+		server.HttpError(w, errors.New("unable to complete the request. Please try again later"))
+	}
+}
+
+// lockoutError reports validation errors as they are and hides database errors behind a generic message
+func lockoutError(w http.ResponseWriter, err error) {
+	for _, known := range []error{services.ErrInvalidOneTimeToken, services.ErrUserNotFound} {
+		if errors.Is(err, known) {
+			server.HttpError(w, err)
+			return
+		}
+	}
+	log.Error("unlock failed", err)
+	server.HttpError(w, errors.New("unable to complete the request. Please try again later"))
+}
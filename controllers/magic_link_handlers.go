@@ -0,0 +1,146 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/server"
+	"quickstart-go-jwt-mongodb/services"
+	"time"
+)
+
+// magicLinkCookie holds the nonce binding a magic link to the browser that requested it
+const magicLinkCookie = "magic_link"
+
+var errMagicLinkUrlUnset = errors.New("magic link sign in is unavailable: MAGIC_LINK_URL is not set")
+
+type magicLinkRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// RequestMagicLink emails a single-use sign in link, only usable from the browser that asked for it. The answer is
+// the same whether or not the address has an account
+func RequestMagicLink(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:       "/account/auth/magic-link",
+		Method:    server.POST,
+		Secure:    false,
+		RateLimit: server.RateLimit{Requests: 10, Window: time.Minute},
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			var body magicLinkRequest
+			if err := server.ParseReqToJson(req, &body); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			envVar := models.LoadEnvironmentVariables()
+			link, err := magicLinkUrl(envVar)
+			if err != nil {
+				server.ServiceUnavailable(w, err)
+				return
+			}
+			// a request a throttle drops issues no link: the browser keeps the nonce its latest link is bound to
+			nonce := services.RandomToken(32)
+			if cookie, err := req.Cookie(magicLinkCookie); err == nil && cookie.Value != "" {
+				nonce = cookie.Value
+			}
+			// the cookie is set for unknown addresses too, so responses do not tell whether an account exists
+			http.SetCookie(w, &http.Cookie{
+				Name:     magicLinkCookie,
+				Value:    nonce,
+				MaxAge:   int(services.MagicLinkLifetime.Seconds()),
+				Secure:   true,
+				HttpOnly: true,
+				SameSite: http.SameSiteNoneMode,
+			})
+			if err = services.NewMagicLinkService(ctx, database, envVar).Request(body.Email, link, nonce); err != nil {
+				// failures are not reported either, they would tell the address has an account
+				log.Error("unable to send magic link", err)
+			}
+			server.HttpResponse(w, http.StatusAccepted, nil)
+		},
+	}
+}
+
+// MagicLinkCallback exchanges the token of a magic link for the access/refresh pair, or for an MFA challenge when the
+// user enabled MFA. It only succeeds in the browser holding the nonce cookie set when the link was requested
+func MagicLinkCallback(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/account/auth/magic-link/callback",
+		Method: server.GET,
+		Secure: false,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			var nonce string
+			if cookie, err := req.Cookie(magicLinkCookie); err == nil {
+				nonce = cookie.Value
+			}
+			envVar := models.LoadEnvironmentVariables()
+			user, err := services.NewMagicLinkService(ctx, database, envVar).Login(req.URL.Query().Get("token"), nonce)
+			if err != nil {
+				magicLinkError(w, err)
+				return
+			}
+			clearMagicLinkCookie(w)
+
+			amr := []string{services.AmrMagicLink}
+			if services.MfaEnabled(user) {
+				// the mailbox alone is not enough: the client completes the login on /account/auth/mfa
+				challengeToken, err := services.NewMfaService(ctx, database).IssueChallenge(services.NewJwtService(ctx, envVar), user, amr)
+				if err != nil {
+					log.Error("unable to issue mfa challenge", err)
+					server.HttpError(w, errors.New("unable to generated token. Please try again later"))
+					return
+				}
+				server.HttpResponse(w, http.StatusOK, mfaChallenge{MfaRequired: true, ChallengeToken: challengeToken})
+				return
+			}
+
+			token, err := issueTokens(ctx, w, req, database, user, nil, amr)
+			if err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusCreated, token)
+		},
+	}
+}
+
+// magicLinkUrl page magic links open, MAGIC_LINK_URL. It receives the token as the `token` query parameter and passes
+// it on to /account/auth/magic-link/callback, with the browser's cookies. There is no default: the callback answers
+// with JSON tokens, which are no page to open from an email
+func magicLinkUrl(envVar models.EnvVar) (string, error) {
+	if envVar.MagicLinkUrl == "" {
+		return "", errMagicLinkUrlUnset
+	}
+	return envVar.MagicLinkUrl, nil
+}
+
+// clearMagicLinkCookie instructs the browser to drop the nonce of a used magic link
+func clearMagicLinkCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     magicLinkCookie,
+		Value:    "",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+	})
+}
+
+// magicLinkError reports link errors as they are and hides database errors behind a generic message
+func magicLinkError(w http.ResponseWriter, err error) {
+	for _, known := range []error{services.ErrInvalidOneTimeToken, services.ErrOneTimeTokenBinding, services.ErrUserNotFound} {
+		if errors.Is(err, known) {
+			server.HttpError(w, err)
+			return
+		}
+	}
+	log.Error("magic link login failed", err)
+	server.HttpError(w, errors.New("unable to complete the request. Please try again later"))
+}
@@ -0,0 +1,252 @@
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/skip2/go-qrcode"
+	"net/http"
+	"net/url"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"quickstart-go-jwt-mongodb/server"
+	"quickstart-go-jwt-mongodb/services"
+	"time"
+)
+
+type (
+	mfaChallenge struct {
+		MfaRequired    bool   `json:"mfa_required"`
+		ChallengeToken string `json:"challenge_token"`
+	}
+	mfaLogin struct {
+		ChallengeToken string `json:"challenge_token" validate:"required"`
+		Code           string `json:"code" validate:"required"`
+	}
+	mfaCode struct {
+		Code string `json:"code" validate:"required"`
+	}
+	mfaEnrollment struct {
+		Secret     string `json:"secret"`
+		OtpAuthUri string `json:"otpauth_uri"`
+		QrCode     string `json:"qr_code"` //PNG data URI of OtpAuthUri
+	}
+	mfaStatus struct {
+		Enabled           bool `json:"enabled"`
+		Required          bool `json:"required"`
+		RecoveryCodesLeft int  `json:"recovery_codes_left"`
+	}
+	recoveryCodes struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+)
+
+// AuthenticateMfa second step of a login for users with MFA enabled: exchanges the challenge token returned by
+// /account/auth (or the magic link callback) and a code from the user's authenticator (or a recovery code) for the access/refresh pair
+func AuthenticateMfa(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/account/auth/mfa",
+		Method: server.POST,
+		Secure: false,
+		// a challenge allows a few guesses only; this caps the guesses spread over many challenges
+		RateLimit: server.RateLimit{Requests: 60, Window: time.Minute, Burst: 10},
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			var body mfaLogin
+			if err := server.ParseReqToJson(req, &body); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			jwtService := services.NewJwtService(ctx, models.LoadEnvironmentVariables())
+			user, amr, err := services.NewMfaService(ctx, database).CompleteChallenge(jwtService, body.ChallengeToken, body.Code)
+			if err != nil {
+				mfaError(w, err)
+				return
+			}
+			token, err := issueTokens(ctx, w, req, database, user, nil, amr)
+			if err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusCreated, token)
+		},
+	}
+}
+
+// MfaStatus whether the caller has MFA enabled and whether their roles require it
+func MfaStatus(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:             "/account/mfa",
+		Method:          server.GET,
+		Secure:          true,
+		AllowWithoutMfa: true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			var user models.User
+			if !repositories.NewUserRepository(database).FindOne(ctx, &user, repositories.Filter{Key: "_id", Value: principal.User.ID}) {
+				server.HttpError(w, services.ErrUserNotFound)
+				return
+			}
+			authorization, err := services.NewRbacService(ctx, database).Resolve(principal.Roles)
+			if err != nil {
+				mfaError(w, err)
+				return
+			}
+			status := mfaStatus{Enabled: services.MfaEnabled(user), Required: authorization.RequireMfa}
+			if status.Enabled {
+				status.RecoveryCodesLeft = len(user.Mfa.RecoveryCodes)
+			}
+			server.HttpResponse(w, http.StatusOK, status)
+		},
+	}
+}
+
+// EnrollMfa starts the enrollment: returns a new secret, as an otpauth:// URI and as a QR code to scan. MFA is only
+// enabled once ConfirmMfa receives a code generated from it
+func EnrollMfa(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/account/mfa/enroll",
+		Method:              server.POST,
+		Secure:              true,
+		ForbidImpersonation: true,
+		AllowWithoutMfa:     true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			secret, err := services.NewMfaService(ctx, database).BeginEnrollment(principal.User.ID)
+			if err != nil {
+				mfaError(w, err)
+				return
+			}
+			uri := services.TotpUri(mfaIssuer(), principal.User.Email, secret)
+			png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+			if err != nil {
+				mfaError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusOK, mfaEnrollment{
+				Secret:     secret,
+				OtpAuthUri: uri,
+				QrCode:     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+			})
+		},
+	}
+}
+
+// ConfirmMfa enables MFA with the first code from the authenticator and returns the recovery codes, shown only once
+func ConfirmMfa(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/account/mfa/confirm",
+		Method:              server.POST,
+		Secure:              true,
+		ForbidImpersonation: true,
+		AllowWithoutMfa:     true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			var body mfaCode
+			if err := server.ParseReqToJson(req, &body); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			codes, err := services.NewMfaService(ctx, database).ConfirmEnrollment(principal.User.ID, body.Code)
+			if err != nil {
+				mfaError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusOK, recoveryCodes{RecoveryCodes: codes})
+		},
+	}
+}
+
+// RegenerateRecoveryCodes replaces the caller's recovery codes, e.g. once most of them have been used
+func RegenerateRecoveryCodes(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/account/mfa/recovery-codes",
+		Method:              server.POST,
+		Secure:              true,
+		ForbidImpersonation: true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			var body mfaCode
+			if err := server.ParseReqToJson(req, &body); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			codes, err := services.NewMfaService(ctx, database).RegenerateRecoveryCodes(principal.User.ID, body.Code)
+			if err != nil {
+				mfaError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusOK, recoveryCodes{RecoveryCodes: codes})
+		},
+	}
+}
+
+// DisableMfa turns MFA off, unless the caller's roles require it
+func DisableMfa(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/account/mfa",
+		Method:              server.DELETE,
+		Secure:              true,
+		ForbidImpersonation: true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			var body mfaCode
+			if err := server.ParseReqToJson(req, &body); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			authorization, err := services.NewRbacService(ctx, database).Resolve(principal.Roles)
+			if err != nil {
+				mfaError(w, err)
+				return
+			}
+			if authorization.RequireMfa {
+				server.Forbidden(w, services.ErrMfaRequired)
+				return
+			}
+			if err = services.NewMfaService(ctx, database).Disable(principal.User.ID, body.Code); err != nil {
+				mfaError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusOK, nil)
+		},
+	}
+}
+
+// mfaIssuer label authenticator apps show next to the account, MFA_ISSUER or the host of ISSUER_URL. Never the
+// request's Host header, which would let a client choose the name shown in the user's app
+func mfaIssuer() string {
+	if issuer := models.LoadEnvironmentVariables().MfaIssuer; issuer != "" {
+		return issuer
+	}
+	issuer, err := url.Parse(issuerUrl())
+	if err != nil {
+		return ""
+	}
+	return issuer.Hostname()
+}
+
+// mfaError reports validation errors as they are and hides database errors behind a generic message
+func mfaError(w http.ResponseWriter, err error) {
+	for _, known := range []error{services.ErrMfaNotEnabled, services.ErrMfaAlreadyEnabled, services.ErrMfaNotEnrolling, services.ErrInvalidMfaCode, services.ErrMfaChallengeFailed, services.ErrUserNotFound} {
+		if errors.Is(err, known) {
+			server.HttpError(w, err)
+			return
+		}
+	}
+	log.Error("mfa operation failed", err)
+	server.HttpError(w, errors.New("unable to complete the request. Please try again later"))
+}
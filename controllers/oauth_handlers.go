@@ -0,0 +1,366 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"quickstart-go-jwt-mongodb/server"
+	"quickstart-go-jwt-mongodb/services"
+	"time"
+)
+
+type (
+	// oauthError RFC 6749 section 5.2 error response
+	oauthError struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description,omitempty"`
+	}
+	// introspection RFC 7662 section 2.2 introspection response
+	introspection struct {
+		Active    bool     `json:"active"`
+		Scope     string   `json:"scope,omitempty"`
+		ClientId  string   `json:"client_id,omitempty"`
+		Username  string   `json:"username,omitempty"`
+		TokenType string   `json:"token_type,omitempty"`
+		Exp       int64    `json:"exp,omitempty"`
+		Iat       int64    `json:"iat,omitempty"`
+		Sub       string   `json:"sub,omitempty"`
+		Iss       string   `json:"iss,omitempty"`
+		Jti       string   `json:"jti,omitempty"`
+		Roles     []string `json:"roles,omitempty"`
+	}
+	// tokenResponse RFC 6749 section 5.1 access token response
+	tokenResponse struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int64  `json:"expires_in"`
+		RefreshToken string `json:"refresh_token,omitempty"`
+		Scope        string `json:"scope,omitempty"`
+		IdToken      string `json:"id_token,omitempty"`
+	}
+	registeredClient struct {
+		models.Client
+		ClientSecret string `json:"client_secret,omitempty"`
+	}
+)
+
+// RegisterClient registers an OAuth client. The client secret is only ever returned in this response
+func RegisterClient(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/admin/oauth/clients",
+		Method:              server.POST,
+		Secure:              true,
+		RequiredPermissions: []string{PermissionManageOAuthClients},
+		Policy:              PolicyPlatformOnly,
+		ForbidImpersonation: true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			var client models.Client
+			if err := server.ParseReqToJson(req, &client); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			client, secret, err := services.NewClientService(ctx, database).Register(client)
+			if errors.Is(err, services.ErrRoleNotFound) {
+				server.HttpError(w, err)
+				return
+			}
+			if err != nil {
+				log.Error("unable to register client", err)
+				server.HttpError(w, errors.New("unable to register client. Please try again later"))
+				return
+			}
+			server.HttpResponse(w, http.StatusCreated, registeredClient{Client: client, ClientSecret: secret})
+		},
+	}
+}
+
+// OAuthToken token endpoint. Supports the `authorization_code` (PKCE required), `refresh_token` and
+// `client_credentials` grants
+func OAuthToken(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/oauth/token",
+		Method: server.POST,
+		Secure: false,
+		// client secrets and refresh tokens are guessed here as much as passwords are on /account/auth
+		RateLimit: server.RateLimit{Requests: 60, Window: time.Minute, Burst: 10},
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			client, ok := authenticateClient(ctx, w, req, database, true)
+			if !ok {
+				return
+			}
+			switch req.PostForm.Get("grant_type") {
+			case "authorization_code":
+				exchangeAuthorizationCode(ctx, w, req, database, client)
+			case "refresh_token":
+				exchangeRefreshToken(ctx, w, req, database, client)
+			case services.GrantClientCredentials:
+				exchangeClientCredentials(ctx, w, req, database, client)
+			default:
+				server.JsonResponse(w, http.StatusBadRequest, oauthError{Error: "unsupported_grant_type"})
+			}
+		},
+	}
+}
+
+// IntrospectToken RFC 7662 token introspection for resource servers that cannot verify tokens themselves
+func IntrospectToken(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/oauth/introspect",
+		Method: server.POST,
+		Secure: false,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if _, ok := authenticateClient(ctx, w, req, database, false); !ok {
+				return
+			}
+			token := req.PostForm.Get("token")
+			if token == "" {
+				server.JsonResponse(w, http.StatusBadRequest, oauthError{Error: "invalid_request", ErrorDescription: "token is required"})
+				return
+			}
+			server.JsonResponse(w, http.StatusOK, introspectToken(ctx, database, token))
+		},
+	}
+}
+
+// RevokeToken RFC 7009 token revocation. Revoking either token of a pair ends the whole session. A client can only
+// revoke tokens issued to it. Per the RFC, unknown or already invalid tokens, and tokens of other clients, are not an
+// error
+func RevokeToken(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/oauth/revoke",
+		Method: server.POST,
+		Secure: false,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			client, ok := authenticateClient(ctx, w, req, database, true)
+			if !ok {
+				return
+			}
+			token := req.PostForm.Get("token")
+			if token == "" {
+				server.JsonResponse(w, http.StatusBadRequest, oauthError{Error: "invalid_request", ErrorDescription: "token is required"})
+				return
+			}
+
+			var subject json.RawMessage
+			jwtService := services.NewJwtService(ctx, models.LoadEnvironmentVariables())
+			claims, err := jwtService.ClaimToken(token, &subject)
+			if err != nil {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			mapClaims := claims.(jwt.MapClaims)
+			if issuedTo, _ := mapClaims["client_id"].(string); issuedTo != client.ClientId {
+				// clients may only revoke their own tokens. First-party sessions end with /account/logout
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			sessionService := services.NewSessionService(ctx, database)
+			sessionId, _ := mapClaims["sid"].(string)
+			tokenType, _ := mapClaims["typ"].(string)
+			switch {
+			case sessionId != "":
+				err = sessionService.RevokeFamily(sessionId)
+			case tokenType == refreshTokenType:
+				err = sessionService.RevokeRefreshToken(token)
+			default:
+				jti, _ := mapClaims["jti"].(string)
+				err = sessionService.RevokeAccessToken(jti)
+			}
+			if err != nil && !errors.Is(err, services.ErrInvalidRefreshToken) {
+				server.JsonResponse(w, http.StatusServiceUnavailable, oauthError{Error: "temporarily_unavailable"})
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		},
+	}
+}
+
+// authenticateClient authenticates the calling client with HTTP Basic (client_secret_basic) or form
+// parameters (client_secret_post), writing the RFC 6749 error response when it fails.
+// When allowPublic is set, public clients identify themselves with their client_id alone
+func authenticateClient(ctx context.Context, w http.ResponseWriter, req *http.Request, database internal.MongoDatabase, allowPublic bool) (models.Client, bool) {
+	if err := req.ParseForm(); err != nil {
+		server.JsonResponse(w, http.StatusBadRequest, oauthError{Error: "invalid_request", ErrorDescription: "malformed form body"})
+		return models.Client{}, false
+	}
+	clientId, clientSecret, basic := req.BasicAuth()
+	if basic {
+		// RFC 6749 section 2.3.1: credentials are form-urlencoded before being placed in the Basic header
+		clientId, _ = url.QueryUnescape(clientId)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientId, clientSecret = req.PostForm.Get("client_id"), req.PostForm.Get("client_secret")
+	}
+	clientService := services.NewClientService(ctx, database)
+	if allowPublic {
+		if client, found := clientService.Find(clientId); found && client.Public {
+			return client, true
+		}
+	}
+	client, err := clientService.Authenticate(clientId, clientSecret)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		server.JsonResponse(w, http.StatusUnauthorized, oauthError{Error: "invalid_client", ErrorDescription: err.Error()})
+		return models.Client{}, false
+	}
+	return client, true
+}
+
+func introspectToken(ctx context.Context, database internal.MongoDatabase, token string) introspection {
+	var inactive = introspection{Active: false}
+	var subject json.RawMessage
+	jwtService := services.NewJwtService(ctx, models.LoadEnvironmentVariables())
+	claims, err := jwtService.ClaimToken(token, &subject)
+	if err != nil {
+		return inactive
+	}
+	mapClaims := claims.(jwt.MapClaims)
+	sessionService := services.NewSessionService(ctx, database)
+
+	var result = introspection{Active: true, TokenType: "Bearer"}
+	result.Scope, _ = mapClaims["scope"].(string)
+	result.ClientId, _ = mapClaims["client_id"].(string)
+	result.Iss, _ = mapClaims["iss"].(string)
+	result.Jti, _ = mapClaims["jti"].(string)
+	if exp, err := mapClaims.GetExpirationTime(); err == nil && exp != nil {
+		result.Exp = exp.Unix()
+	}
+	if iat, err := mapClaims.GetIssuedAt(); err == nil && iat != nil {
+		result.Iat = iat.Unix()
+	}
+
+	if tokenType, _ := mapClaims["typ"].(string); tokenType == refreshTokenType {
+		if !sessionService.IsRefreshTokenActive(token) {
+			return inactive
+		}
+		var email string
+		if json.Unmarshal(subject, &email) != nil {
+			return inactive
+		}
+		result.TokenType = refreshTokenType
+		result.Sub, result.Username = email, email
+		return result
+	}
+
+	sessionId, _ := mapClaims["sid"].(string)
+	revoked, err := sessionService.IsRevoked(sessionId, result.Jti)
+	if err != nil || revoked {
+		return inactive
+	}
+	if grantType, _ := mapClaims[services.ClaimGrantType].(string); grantType == services.GrantClientCredentials {
+		result.Sub = result.ClientId
+		result.Roles = services.StringSliceClaim(mapClaims, "roles")
+		return result
+	}
+	var user models.User
+	if json.Unmarshal(subject, &user) != nil {
+		return inactive
+	}
+	result.Sub, result.Username, result.Roles = user.ID.Hex(), user.Email, user.Roles
+	return result
+}
+
+func exchangeAuthorizationCode(ctx context.Context, w http.ResponseWriter, req *http.Request, database internal.MongoDatabase, client models.Client) {
+	codeService := services.NewAuthorizationCodeService(ctx, database)
+	code, err := codeService.Consume(req.PostForm.Get("code"), client.ClientId, req.PostForm.Get("redirect_uri"), req.PostForm.Get("code_verifier"))
+	if err != nil {
+		server.JsonResponse(w, http.StatusBadRequest, oauthError{Error: "invalid_grant", ErrorDescription: err.Error()})
+		return
+	}
+	var user models.User
+	if !repositories.NewUserRepository(database).FindOne(ctx, &user, repositories.Filter{Key: "_id", Value: code.UserId}) {
+		server.JsonResponse(w, http.StatusBadRequest, oauthError{Error: "invalid_grant", ErrorDescription: "user no longer exists"})
+		return
+	}
+	token, err := mintTokens(ctx, req, database, user, grant{clientId: client.ClientId, scope: code.Scope, amr: code.Amr})
+	if err != nil {
+		server.JsonResponse(w, http.StatusInternalServerError, oauthError{Error: "server_error", ErrorDescription: err.Error()})
+		return
+	}
+	if err = codeService.Bind(code, token.FamilyId); err != nil {
+		log.Error("unable to bind authorization code to its session", err)
+	}
+	response := newTokenResponse(token)
+	if response.IdToken, err = mintIdToken(ctx, user, client.ClientId, code.Scope, code.Nonce, code.AuthTime); err != nil {
+		server.JsonResponse(w, http.StatusInternalServerError, oauthError{Error: "server_error", ErrorDescription: err.Error()})
+		return
+	}
+	server.JsonResponse(w, http.StatusOK, response)
+}
+
+func exchangeRefreshToken(ctx context.Context, w http.ResponseWriter, req *http.Request, database internal.MongoDatabase, client models.Client) {
+	refreshToken := req.PostForm.Get("refresh_token")
+	var email string
+	jwtService := services.NewJwtService(ctx, models.LoadEnvironmentVariables())
+	if _, err := jwtService.ClaimToken(refreshToken, &email); err != nil {
+		server.JsonResponse(w, http.StatusBadRequest, oauthError{Error: "invalid_grant", ErrorDescription: "invalid refresh token"})
+		return
+	}
+	// checks the token was issued to client before consuming it
+	previous, err := services.NewSessionService(ctx, database).ConsumeRefreshToken(refreshToken, client.ClientId)
+	if err != nil {
+		server.JsonResponse(w, http.StatusBadRequest, oauthError{Error: "invalid_grant", ErrorDescription: err.Error()})
+		return
+	}
+	var user models.User
+	if !repositories.NewUserRepository(database).FindOne(ctx, &user, repositories.Filter{Key: "_id", Value: previous.UserId}) {
+		server.JsonResponse(w, http.StatusBadRequest, oauthError{Error: "invalid_grant", ErrorDescription: "user no longer exists"})
+		return
+	}
+	token, err := mintTokens(ctx, req, database, user, grant{previous: &previous})
+	if err != nil {
+		server.JsonResponse(w, http.StatusInternalServerError, oauthError{Error: "server_error", ErrorDescription: err.Error()})
+		return
+	}
+	// OpenID Connect Core section 12.2: a refreshed ID token keeps the original auth_time and carries no nonce
+	response := newTokenResponse(token)
+	if response.IdToken, err = mintIdToken(ctx, user, client.ClientId, token.Scope, "", token.SessionStartedAt); err != nil {
+		server.JsonResponse(w, http.StatusInternalServerError, oauthError{Error: "server_error", ErrorDescription: err.Error()})
+		return
+	}
+	server.JsonResponse(w, http.StatusOK, response)
+}
+
+func exchangeClientCredentials(ctx context.Context, w http.ResponseWriter, req *http.Request, database internal.MongoDatabase, client models.Client) {
+	if client.Public {
+		server.JsonResponse(w, http.StatusBadRequest, oauthError{Error: "unauthorized_client", ErrorDescription: "public clients cannot use the client_credentials grant"})
+		return
+	}
+	scopes, err := services.GrantedScopes(client, req.PostForm.Get("scope"))
+	if err != nil {
+		server.JsonResponse(w, http.StatusBadRequest, oauthError{Error: "invalid_scope", ErrorDescription: err.Error()})
+		return
+	}
+	token, err := mintClientToken(ctx, req, database, client, scopes)
+	if err != nil {
+		server.JsonResponse(w, http.StatusInternalServerError, oauthError{Error: "server_error", ErrorDescription: err.Error()})
+		return
+	}
+	server.JsonResponse(w, http.StatusOK, newTokenResponse(token))
+}
+
+func newTokenResponse(token models.Token) tokenResponse {
+	return tokenResponse{
+		AccessToken:  token.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(accessTokenLifetime.Seconds()),
+		RefreshToken: token.RefreshToken,
+		Scope:        token.Scope,
+	}
+}
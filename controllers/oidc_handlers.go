@@ -0,0 +1,119 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"net/http"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"quickstart-go-jwt-mongodb/server"
+	"quickstart-go-jwt-mongodb/services"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	scopeOpenId  = "openid"
+	scopeProfile = "profile"
+	scopeEmail   = "email"
+)
+
+var errPublicUrlUnset = errors.New("PUBLIC_BASE_URL or ISSUER_URL must be set for emails carrying links to be sent")
+
+// UserInfo OpenID Connect userinfo endpoint. Tokens issued to OAuth clients must carry the `openid` scope and only
+// receive the claims of the scopes granted; first-party tokens receive every standard claim
+func UserInfo(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/userinfo",
+		Method: server.GET,
+		Secure: true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			if principal.IsClient() {
+				server.AccessDenied(w, errors.New("userinfo is only available for tokens issued to a user"))
+				return
+			}
+			scopes := strings.Fields(principal.StringClaim("scope"))
+			if principal.ClientId != "" && !slices.Contains(scopes, scopeOpenId) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+				server.JsonResponse(w, http.StatusForbidden, oauthError{Error: "insufficient_scope"})
+				return
+			}
+			if principal.ClientId == "" {
+				scopes = []string{scopeOpenId, scopeProfile, scopeEmail}
+			}
+
+			var user models.User
+			if !repositories.NewUserRepository(database).FindOne(ctx, &user, repositories.Filter{Key: "_id", Value: principal.User.ID}) {
+				server.AccessDenied(w, errors.New("user no longer exists"))
+				return
+			}
+			server.JsonResponse(w, http.StatusOK, userClaims(user, scopes))
+		},
+	}
+}
+
+// mintIdToken OpenID Connect ID token. Only issued when the `openid` scope was granted; an empty string is returned
+// otherwise. `sub` is the stable user id rather than the JSON encoded user carried by access tokens
+func mintIdToken(ctx context.Context, user models.User, clientId, scope, nonce string, authTime time.Time) (string, error) {
+	scopes := strings.Fields(scope)
+	if !slices.Contains(scopes, scopeOpenId) {
+		return "", nil
+	}
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":       issuerUrl(),
+		"aud":       clientId,
+		"iat":       jwt.NewNumericDate(now),
+		"exp":       jwt.NewNumericDate(now.Add(accessTokenLifetime)),
+		"auth_time": authTime.Unix(),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	for name, value := range userClaims(user, scopes) {
+		claims[name] = value
+	}
+	return services.NewJwtService(ctx, models.LoadEnvironmentVariables()).SignClaims(claims)
+}
+
+// userClaims OpenID Connect standard claims of user released for the granted scopes
+func userClaims(user models.User, scopes []string) map[string]any {
+	claims := map[string]any{"sub": user.ID.Hex()}
+	if slices.Contains(scopes, scopeProfile) {
+		claims["given_name"] = user.FirstName
+		claims["family_name"] = user.LastName
+		claims["name"] = strings.TrimSpace(user.FirstName + " " + user.LastName)
+	}
+	if slices.Contains(scopes, scopeEmail) {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.EmailVerified
+	}
+	return claims
+}
+
+// issuerUrl `iss` of every token, ISSUER_URL, which main requires. It is never derived from the request: its Host
+// header is chosen by the client, who could stamp their own issuer into tokens and cached discovery documents
+func issuerUrl() string {
+	return strings.TrimRight(models.LoadEnvironmentVariables().Issuer, "/")
+}
+
+// publicUrl absolute URL of path for links sent by email, from PUBLIC_BASE_URL or else ISSUER_URL. Like issuerUrl it
+// is never derived from the request, whose Host header could have a victim's link, and the token in it, point to the
+// client's own server
+func publicUrl(path string) (string, error) {
+	envVar := models.LoadEnvironmentVariables()
+	base := envVar.PublicBaseUrl
+	if base == "" {
+		base = envVar.Issuer
+	}
+	if base == "" {
+		return "", errPublicUrlUnset
+	}
+	return strings.TrimRight(base, "/") + path, nil
+}
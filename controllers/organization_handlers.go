@@ -0,0 +1,245 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"quickstart-go-jwt-mongodb/server"
+	"quickstart-go-jwt-mongodb/services"
+	"time"
+)
+
+type (
+	membershipRequest struct {
+		Roles []string `json:"roles"`
+	}
+	member struct {
+		Id        string   `json:"id"`
+		Email     string   `json:"email"`
+		FirstName string   `json:"first_name"`
+		LastName  string   `json:"last_name"`
+		Roles     []string `json:"roles"`
+	}
+)
+
+var errNoOrganization = errors.New("no organization selected. Sign in to an organization or set the X-Tenant-ID header")
+
+func CreateOrganization(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/admin/organizations",
+		Method:              server.POST,
+		Secure:              true,
+		RequiredPermissions: []string{PermissionManageOrganizations},
+		Policy:              PolicyPlatformOnly,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			var organization models.Organization
+			if err := server.ParseReqToJson(req, &organization); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			organization, err := services.NewOrganizationService(ctx, database).Create(organization)
+			if err != nil {
+				organizationError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusCreated, organization)
+		},
+	}
+}
+
+func ListOrganizations(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/admin/organizations",
+		Method:              server.GET,
+		Secure:              true,
+		RequiredPermissions: []string{PermissionManageOrganizations},
+		Policy:              PolicyPlatformOnly,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			currentPage, perPage := pagination(req)
+			organizations, err := services.NewOrganizationService(ctx, database).List(currentPage, perPage)
+			if err != nil {
+				organizationError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusOK, organizations)
+		},
+	}
+}
+
+// AppointOrganizationMember adds a user to any organization, typically its first administrator
+func AppointOrganizationMember(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/admin/organizations/{slug}/members/{userId}",
+		Method:              server.PUT,
+		Secure:              true,
+		RequiredPermissions: []string{PermissionManageOrganizations},
+		Policy:              PolicyPlatformOnly,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			setMember(w, req, database, mux.Vars(req)["slug"])
+		},
+	}
+}
+
+func DismissOrganizationMember(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/admin/organizations/{slug}/members/{userId}",
+		Method:              server.DELETE,
+		Secure:              true,
+		RequiredPermissions: []string{PermissionManageOrganizations},
+		Policy:              PolicyPlatformOnly,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			removeMember(w, req, database, mux.Vars(req)["slug"])
+		},
+	}
+}
+
+// ListMembers members of the caller's organization
+func ListMembers(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/organization/members",
+		Method:              server.GET,
+		Secure:              true,
+		RequiredPermissions: []string{PermissionManageMembers},
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			tenant := server.CurrentTenant(req)
+			if tenant == "" {
+				server.HttpError(w, errNoOrganization)
+				return
+			}
+			currentPage, perPage := pagination(req)
+			users, err := services.NewOrganizationService(ctx, database).Members(tenant, currentPage, perPage)
+			if err != nil {
+				organizationError(w, err)
+				return
+			}
+			var members = make([]member, 0, len(users))
+			for i := range users {
+				roles, _ := services.MembershipRoles(users[i], tenant)
+				members = append(members, member{
+					Id:        users[i].ID.Hex(),
+					Email:     users[i].Email,
+					FirstName: users[i].FirstName,
+					LastName:  users[i].LastName,
+					Roles:     roles,
+				})
+			}
+			server.HttpResponse(w, http.StatusOK, members)
+		},
+	}
+}
+
+// SetMember adds a user to the caller's organization or changes the roles they hold in it
+func SetMember(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/organization/members/{userId}",
+		Method:              server.PUT,
+		Secure:              true,
+		RequiredPermissions: []string{PermissionManageMembers},
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			setMember(w, req, database, server.CurrentTenant(req))
+		},
+	}
+}
+
+func RemoveMember(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/organization/members/{userId}",
+		Method:              server.DELETE,
+		Secure:              true,
+		RequiredPermissions: []string{PermissionManageMembers},
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			removeMember(w, req, database, server.CurrentTenant(req))
+		},
+	}
+}
+
+// ListMyOrganizations organizations the caller can sign in to, with the roles they hold in each
+func ListMyOrganizations(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/account/organizations",
+		Method: server.GET,
+		Secure: true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			var user models.User
+			if !repositories.NewUserRepository(database).FindOne(ctx, &user, repositories.Filter{Key: "_id", Value: principal.User.ID}) {
+				server.HttpError(w, services.ErrUserNotFound)
+				return
+			}
+			var memberships = user.Memberships
+			if memberships == nil {
+				memberships = []models.Membership{}
+			}
+			server.HttpResponse(w, http.StatusOK, memberships)
+		},
+	}
+}
+
+func setMember(w http.ResponseWriter, req *http.Request, database internal.MongoDatabase, tenant string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if tenant == "" {
+		server.HttpError(w, errNoOrganization)
+		return
+	}
+	userId, err := primitive.ObjectIDFromHex(mux.Vars(req)["userId"])
+	if err != nil {
+		server.HttpError(w, services.ErrUserNotFound)
+		return
+	}
+	var body membershipRequest
+	if err = server.ParseReqToJson(req, &body); err != nil {
+		server.HttpError(w, err)
+		return
+	}
+	if err = services.NewOrganizationService(ctx, database).SetMember(tenant, userId, body.Roles); err != nil {
+		organizationError(w, err)
+		return
+	}
+	server.HttpResponse(w, http.StatusOK, nil)
+}
+
+func removeMember(w http.ResponseWriter, req *http.Request, database internal.MongoDatabase, tenant string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if tenant == "" {
+		server.HttpError(w, errNoOrganization)
+		return
+	}
+	userId, err := primitive.ObjectIDFromHex(mux.Vars(req)["userId"])
+	if err != nil {
+		server.HttpError(w, services.ErrUserNotFound)
+		return
+	}
+	if err = services.NewOrganizationService(ctx, database).RemoveMember(tenant, userId); err != nil {
+		organizationError(w, err)
+		return
+	}
+	server.HttpResponse(w, http.StatusOK, nil)
+}
+
+// organizationError reports validation errors as they are and hides database errors behind a generic message
+func organizationError(w http.ResponseWriter, err error) {
+	for _, known := range []error{services.ErrOrganizationExists, services.ErrOrganizationNotFound, services.ErrInvalidTenantSlug, services.ErrNotMember, services.ErrUserNotFound, services.ErrRoleNotFound} {
+		if errors.Is(err, known) {
+			server.HttpError(w, err)
+			return
+		}
+	}
+	log.Error("organization operation failed", err)
+	server.HttpError(w, errors.New("unable to complete the request. Please try again later"))
+}
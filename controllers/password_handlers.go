@@ -0,0 +1,197 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/server"
+	"quickstart-go-jwt-mongodb/services"
+	"time"
+)
+
+type (
+	forgotPassword struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+	resetPassword struct {
+		Token    string `json:"token" validate:"required"`
+		Password string `json:"password" validate:"required"`
+	}
+	changePassword struct {
+		Email       string `json:"email" validate:"required,email"`
+		Password    string `json:"password" validate:"required"`
+		NewPassword string `json:"new_password" validate:"required"`
+		Code        string `json:"code"` // of the user's authenticator, when they enabled MFA
+	}
+)
+
+// ForgotPassword emails a password reset link. The answer is the same whether or not the address has an account, and
+// is given before looking the address up, so neither its content nor its timing tells
+func ForgotPassword(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/account/password/forgot",
+		Method: server.POST,
+		Secure: false,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			var body forgotPassword
+			if err := server.ParseReqToJson(req, &body); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			envVar := models.LoadEnvironmentVariables()
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				defer cancel()
+				link, err := passwordResetUrl(envVar)
+				if err == nil {
+					err = services.NewPasswordResetService(ctx, database, envVar).Request(body.Email, link)
+				}
+				if err != nil {
+					// failures are not reported either, they would tell the address has an account
+					log.Error("unable to send password reset", err)
+				}
+			}()
+			server.HttpResponse(w, http.StatusAccepted, nil)
+		},
+	}
+}
+
+// ResetPassword sets a new password with the token of a reset link and signs the user out of every session
+func ResetPassword(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/account/password/reset",
+		Method: server.POST,
+		Secure: false,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			var body resetPassword
+			if err := server.ParseReqToJson(req, &body); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			envVar := models.LoadEnvironmentVariables()
+			passwordReset := services.NewPasswordResetService(ctx, database, envVar)
+			// the policy is checked first so a rejected password does not use up the link
+			user, err := passwordReset.User(body.Token)
+			if err != nil {
+				passwordResetError(w, err)
+				return
+			}
+			if err = services.NewPasswordPolicy(envVar).Validate(body.Password, user); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			password, err := generateHashPassword(body.Password)
+			if err != nil {
+				server.HttpError(w, errors.New("unable to hash password. Please try again later"))
+				return
+			}
+			userId, err := passwordReset.Reset(body.Token, password)
+			if err != nil {
+				passwordResetError(w, err)
+				return
+			}
+			services.AuditInBackground(database, models.AuditLog{
+				Action:   "password.reset",
+				ActorId:  userId.Hex(),
+				Outcome:  services.AuditAllowed,
+				Method:   req.Method,
+				Path:     req.URL.Path,
+				ClientIp: server.ClientIp(req),
+			})
+			clearRefreshTokenCookie(w)
+			server.HttpResponse(w, http.StatusOK, nil)
+		},
+	}
+}
+
+// ChangePassword replaces the password of a user who knows it, and of their MFA code when enabled, then signs them
+// out of every session. It does not take an access token, so users whose password expired can change it before
+// signing in
+func ChangePassword(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:       "/account/password/change",
+		Method:    server.POST,
+		Secure:    false,
+		RateLimit: server.RateLimit{Requests: 10, Window: time.Minute},
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			var body changePassword
+			if err := server.ParseReqToJson(req, &body); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			user, err := verifyCredentials(ctx, req, database, body.Email, body.Password)
+			if err != nil {
+				credentialsError(w, err)
+				return
+			}
+			if services.MfaEnabled(user) {
+				if err = services.NewMfaService(ctx, database).Verify(user, body.Code); err != nil {
+					mfaError(w, err)
+					return
+				}
+			}
+			passwords := services.NewPasswordService(ctx, database, models.LoadEnvironmentVariables())
+			if err = passwords.Validate(user, body.NewPassword); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			password, err := generateHashPassword(body.NewPassword)
+			if err != nil {
+				server.HttpError(w, errors.New("unable to hash password. Please try again later"))
+				return
+			}
+			if err = passwords.Change(user, password); err != nil {
+				log.Error("unable to change password", err)
+				server.HttpError(w, errors.New("unable to change password. Please try again later"))
+				return
+			}
+			auditPasswordChange(database, req, user)
+			clearRefreshTokenCookie(w)
+			server.HttpResponse(w, http.StatusOK, nil)
+		},
+	}
+}
+
+// passwordExpired whether PASSWORD_MAX_AGE keeps user from signing in until they change their password
+func passwordExpired(user models.User) bool {
+	return services.NewPasswordPolicy(models.LoadEnvironmentVariables()).Expired(user)
+}
+
+func auditPasswordChange(database internal.MongoDatabase, req *http.Request, user models.User) {
+	services.AuditInBackground(database, models.AuditLog{
+		Action:   "password.change",
+		ActorId:  user.ID.Hex(),
+		Outcome:  services.AuditAllowed,
+		Method:   req.Method,
+		Path:     req.URL.Path,
+		ClientIp: server.ClientIp(req),
+	})
+}
+
+// passwordResetUrl page the reset link opens, PASSWORD_RESET_URL. It receives the token as the `token` query
+// parameter and posts it, along with the new password, to /account/password/reset
+func passwordResetUrl(envVar models.EnvVar) (string, error) {
+	if envVar.PasswordResetUrl != "" {
+		return envVar.PasswordResetUrl, nil
+	}
+	return publicUrl("/account/password/reset")
+}
+
+// passwordResetError reports validation errors as they are and hides database errors behind a generic message
+func passwordResetError(w http.ResponseWriter, err error) {
+	for _, known := range []error{services.ErrInvalidOneTimeToken, services.ErrUserNotFound} {
+		if errors.Is(err, known) {
+			server.HttpError(w, err)
+			return
+		}
+	}
+	log.Error("password reset failed", err)
+	server.HttpError(w, errors.New("unable to complete the request. Please try again later"))
+}
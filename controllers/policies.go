@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"embed"
+	"path"
+	"quickstart-go-jwt-mongodb/services"
+	"strings"
+)
+
+// Policies referenced by Controller.Policy. Declarative ones are the JSON files of the policies directory, named after
+// the file (see services.RulePolicy for the rule language)
+const (
+	PolicyResourceOwner = "resource-owner"
+	PolicyOfficeHours   = "office-hours"
+	PolicyPlatformOnly  = "platform-only"
+)
+
+//go:embed policies/*.json
+var policiesFs embed.FS
+
+// RegisterPolicies registers the Go predicate and declarative policies used by the controllers
+func RegisterPolicies() error {
+	services.RegisterPolicy(PolicyResourceOwner, resourceOwnerPolicy)
+	services.RegisterPolicy(PolicyPlatformOnly, platformOnlyPolicy)
+
+	files, err := policiesFs.ReadDir("policies")
+	if err != nil {
+		return err
+	}
+	for i := range files {
+		document, err := policiesFs.ReadFile(path.Join("policies", files[i].Name()))
+		if err != nil {
+			return err
+		}
+		if err = services.RegisterRulePolicy(strings.TrimSuffix(files[i].Name(), ".json"), document); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resourceOwnerPolicy only lets users reach resources whose `owner_id` is their own user id
+func resourceOwnerPolicy(input services.PolicyInput) services.Decision {
+	if input.Resource == nil {
+		return services.Deny("resource not found")
+	}
+	if owner, _ := input.Resource["owner_id"].(string); owner == "" || owner != input.UserId {
+		return services.Deny("resource belongs to another user")
+	}
+	return services.Allow("resource owner")
+}
+
+// platformOnlyPolicy keeps deployment-wide administration (role catalogue, OAuth clients, organizations) away from
+// tokens issued inside an organization, whose roles only apply to that organization
+func platformOnlyPolicy(input services.PolicyInput) services.Decision {
+	if tenant, _ := input.Claims["tenant"].(string); tenant != "" {
+		return services.Deny("only available outside an organization")
+	}
+	return services.Allow("platform token")
+}
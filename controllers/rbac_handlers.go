@@ -0,0 +1,284 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/server"
+	"quickstart-go-jwt-mongodb/services"
+	"time"
+)
+
+type (
+	permissionsRequest struct {
+		Permissions []string `json:"permissions" validate:"required,min=1"`
+	}
+	roleMfaRequest struct {
+		Required bool `json:"required"`
+	}
+	rolesRequest struct {
+		Roles []string `json:"roles" validate:"required,min=1"`
+		// NotBefore and ExpiresAt make the assignment time-bound: the roles are granted for that window only
+		NotBefore *time.Time `json:"not_before"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+)
+
+func ListRoles(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/admin/roles",
+		Method:              server.GET,
+		Secure:              true,
+		RequiredPermissions: []string{PermissionManageRbac},
+		Policy:              PolicyPlatformOnly,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			roles, err := services.NewRbacService(ctx, database).ListRoles()
+			if err != nil {
+				rbacError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusOK, roles)
+		},
+	}
+}
+
+// CreateRole creates a role, optionally inheriting existing roles and holding existing permissions
+func CreateRole(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/admin/roles",
+		Method:              server.POST,
+		Secure:              true,
+		RequiredPermissions: []string{PermissionManageRbac},
+		Policy:              PolicyPlatformOnly,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			var role models.Role
+			if err := server.ParseReqToJson(req, &role); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			role, err := services.NewRbacService(ctx, database).CreateRole(role)
+			if err != nil {
+				rbacError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusCreated, role)
+		},
+	}
+}
+
+func AttachRolePermissions(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/admin/roles/{name}/permissions",
+		Method:              server.POST,
+		Secure:              true,
+		RequiredPermissions: []string{PermissionManageRbac},
+		Policy:              PolicyPlatformOnly,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			var body permissionsRequest
+			if err := server.ParseReqToJson(req, &body); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			if err := services.NewRbacService(ctx, database).AttachPermissions(mux.Vars(req)["name"], body.Permissions); err != nil {
+				rbacError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusOK, nil)
+		},
+	}
+}
+
+// RequireRoleMfa sets whether holders of the role must sign in with a second factor. Their sessions opened with a
+// password only are refused from the next request, except for enrolling in MFA
+func RequireRoleMfa(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/admin/roles/{name}/mfa",
+		Method:              server.PUT,
+		Secure:              true,
+		RequiredPermissions: []string{PermissionManageRbac},
+		Policy:              PolicyPlatformOnly,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			var body roleMfaRequest
+			if err := server.ParseReqToJson(req, &body); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			if err := services.NewRbacService(ctx, database).RequireMfa(mux.Vars(req)["name"], body.Required); err != nil {
+				rbacError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusOK, nil)
+		},
+	}
+}
+
+func DetachRolePermission(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/admin/roles/{name}/permissions/{permission}",
+		Method:              server.DELETE,
+		Secure:              true,
+		RequiredPermissions: []string{PermissionManageRbac},
+		Policy:              PolicyPlatformOnly,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			vars := mux.Vars(req)
+			if err := services.NewRbacService(ctx, database).DetachPermission(vars["name"], vars["permission"]); err != nil {
+				rbacError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusOK, nil)
+		},
+	}
+}
+
+func ListPermissions(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/admin/permissions",
+		Method:              server.GET,
+		Secure:              true,
+		RequiredPermissions: []string{PermissionManageRbac},
+		Policy:              PolicyPlatformOnly,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			permissions, err := services.NewRbacService(ctx, database).ListPermissions()
+			if err != nil {
+				rbacError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusOK, permissions)
+		},
+	}
+}
+
+func CreatePermission(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/admin/permissions",
+		Method:              server.POST,
+		Secure:              true,
+		RequiredPermissions: []string{PermissionManageRbac},
+		Policy:              PolicyPlatformOnly,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			var permission models.Permission
+			if err := server.ParseReqToJson(req, &permission); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			permission, err := services.NewRbacService(ctx, database).CreatePermission(permission)
+			if err != nil {
+				rbacError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusCreated, permission)
+		},
+	}
+}
+
+// AssignUserRoles grants roles to a user, permanently or, when expires_at is set, for a limited time. They apply from
+// the user's next login or token refresh
+func AssignUserRoles(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/admin/users/{id}/roles",
+		Method:              server.POST,
+		Secure:              true,
+		RequiredPermissions: []string{PermissionManageRbac},
+		Policy:              PolicyPlatformOnly,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			userId, err := primitive.ObjectIDFromHex(mux.Vars(req)["id"])
+			if err != nil {
+				server.HttpError(w, services.ErrUserNotFound)
+				return
+			}
+			var body rolesRequest
+			if err = server.ParseReqToJson(req, &body); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			if body.ExpiresAt != nil {
+				assignTimeBoundRoles(w, req, ctx, database, userId, body)
+				return
+			}
+			if err = services.NewRbacService(ctx, database).AssignRoles(userId, body.Roles); err != nil {
+				rbacError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusOK, nil)
+		},
+	}
+}
+
+func UnassignUserRole(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/admin/users/{id}/roles/{role}",
+		Method:              server.DELETE,
+		Secure:              true,
+		RequiredPermissions: []string{PermissionManageRbac},
+		Policy:              PolicyPlatformOnly,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			vars := mux.Vars(req)
+			userId, err := primitive.ObjectIDFromHex(vars["id"])
+			if err != nil {
+				server.HttpError(w, services.ErrUserNotFound)
+				return
+			}
+			if err = services.NewRbacService(ctx, database).UnassignRole(userId, vars["role"]); err != nil {
+				rbacError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusOK, nil)
+		},
+	}
+}
+
+// assignTimeBoundRoles grants the roles of body to the user for the window it sets, instead of assigning them for good
+func assignTimeBoundRoles(w http.ResponseWriter, req *http.Request, ctx context.Context, database internal.MongoDatabase, userId primitive.ObjectID, body rolesRequest) {
+	principal, _ := server.CurrentPrincipal(req)
+	var notBefore time.Time
+	if body.NotBefore != nil {
+		notBefore = *body.NotBefore
+	}
+	roleGrantService := services.NewRoleGrantService(ctx, database, "")
+	var roleGrants []models.RoleGrant
+	for _, role := range body.Roles {
+		roleGrant, err := roleGrantService.Grant(userId, role, notBefore, *body.ExpiresAt, principal.User.ID)
+		if err != nil {
+			roleGrantError(w, err)
+			return
+		}
+		auditRoleGrant(database, req, principal, "role_grant.assign", roleGrant.ID, role)
+		roleGrants = append(roleGrants, roleGrant)
+	}
+	server.HttpResponse(w, http.StatusCreated, roleGrants)
+}
+
+// rbacError reports validation errors as they are and hides database errors behind a generic message
+func rbacError(w http.ResponseWriter, err error) {
+	for _, known := range []error{services.ErrRoleExists, services.ErrRoleNotFound, services.ErrPermissionExists, services.ErrPermissionNotFound, services.ErrUserNotFound, services.ErrRoleInheritsItself} {
+		if errors.Is(err, known) {
+			server.HttpError(w, err)
+			return
+		}
+	}
+	log.Error("rbac operation failed", err)
+	server.HttpError(w, errors.New("unable to complete the request. Please try again later"))
+}
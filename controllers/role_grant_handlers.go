@@ -0,0 +1,219 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/server"
+	"quickstart-go-jwt-mongodb/services"
+	"time"
+)
+
+type (
+	roleRequest struct {
+		Role          string     `json:"role" validate:"required"`
+		NotBefore     *time.Time `json:"not_before"`
+		ExpiresAt     time.Time  `json:"expires_at" validate:"required"`
+		Justification string     `json:"justification" validate:"required"`
+	}
+	decisionRequest struct {
+		Note string `json:"note"`
+	}
+)
+
+// RequestRole asks for a role for a limited time. The grant only takes effect once an approver accepts it, from the
+// requester's next login or token refresh
+func RequestRole(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/account/role-requests",
+		Method:              server.POST,
+		Secure:              true,
+		ForbidImpersonation: true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			var body roleRequest
+			if err := server.ParseReqToJson(req, &body); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			var notBefore time.Time
+			if body.NotBefore != nil {
+				notBefore = *body.NotBefore
+			}
+			roleGrant, err := services.NewRoleGrantService(ctx, database, principal.Tenant).Request(principal.User.ID, body.Role, notBefore, body.ExpiresAt, body.Justification)
+			if err != nil {
+				roleGrantError(w, err)
+				return
+			}
+			auditRoleGrant(database, req, principal, "role_grant.request", roleGrant.ID, body.Role)
+			server.HttpResponse(w, http.StatusCreated, roleGrant)
+		},
+	}
+}
+
+// ListMyRoleRequests the caller's role requests and grants, whatever their status
+func ListMyRoleRequests(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/account/role-requests",
+		Method: server.GET,
+		Secure: true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			currentPage, perPage := pagination(req)
+			roleGrants, err := services.NewRoleGrantService(ctx, database, principal.Tenant).ListForUser(principal.User.ID, currentPage, perPage)
+			if err != nil {
+				roleGrantError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusOK, roleGrants)
+		},
+	}
+}
+
+// ListRoleRequests role requests and grants of the caller's organization (or of the platform), filtered by `status`
+func ListRoleRequests(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:         "/admin/role-requests",
+		Method:      server.GET,
+		Secure:      true,
+		PermitRoles: []string{grantApproverRole()},
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			currentPage, perPage := pagination(req)
+			roleGrants, err := services.NewRoleGrantService(ctx, database, principal.Tenant).List(req.URL.Query().Get("status"), currentPage, perPage)
+			if err != nil {
+				roleGrantError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusOK, roleGrants)
+		},
+	}
+}
+
+func ApproveRoleRequest(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/admin/role-requests/{id}/approve",
+		Method:              server.POST,
+		Secure:              true,
+		PermitRoles:         []string{grantApproverRole()},
+		ForbidImpersonation: true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			decideRoleRequest(w, req, database, models.GrantApproved)
+		},
+	}
+}
+
+func DenyRoleRequest(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/admin/role-requests/{id}/deny",
+		Method:              server.POST,
+		Secure:              true,
+		PermitRoles:         []string{grantApproverRole()},
+		ForbidImpersonation: true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			decideRoleRequest(w, req, database, models.GrantDenied)
+		},
+	}
+}
+
+// RevokeRoleGrant ends a grant before it expires. Tokens listing the role stop honouring it within seconds
+func RevokeRoleGrant(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:         "/admin/role-grants/{id}",
+		Method:      server.DELETE,
+		Secure:      true,
+		PermitRoles: []string{grantApproverRole()},
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			id, err := primitive.ObjectIDFromHex(mux.Vars(req)["id"])
+			if err != nil {
+				server.HttpError(w, services.ErrGrantNotFound)
+				return
+			}
+			if err = services.NewRoleGrantService(ctx, database, principal.Tenant).Revoke(id, principal.User.ID); err != nil {
+				roleGrantError(w, err)
+				return
+			}
+			auditRoleGrant(database, req, principal, "role_grant.revoke", id, "")
+			server.HttpResponse(w, http.StatusOK, nil)
+		},
+	}
+}
+
+func decideRoleRequest(w http.ResponseWriter, req *http.Request, database internal.MongoDatabase, status string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	principal, _ := server.CurrentPrincipal(req)
+	id, err := primitive.ObjectIDFromHex(mux.Vars(req)["id"])
+	if err != nil {
+		server.HttpError(w, services.ErrGrantNotFound)
+		return
+	}
+	var body decisionRequest
+	if err = server.ParseReqToJson(req, &body); err != nil {
+		server.HttpError(w, err)
+		return
+	}
+	roleGrantService := services.NewRoleGrantService(ctx, database, principal.Tenant)
+	if status == models.GrantApproved {
+		err = roleGrantService.Approve(id, principal.User.ID, body.Note)
+	} else {
+		err = roleGrantService.Deny(id, principal.User.ID, body.Note)
+	}
+	if err != nil {
+		roleGrantError(w, err)
+		return
+	}
+	auditRoleGrant(database, req, principal, "role_grant."+status, id, "")
+	server.HttpResponse(w, http.StatusOK, nil)
+}
+
+// grantApproverRole role allowed to decide role requests, ROLE_GRANT_APPROVER_ROLE or supervisors by default
+func grantApproverRole() string {
+	if role := models.LoadEnvironmentVariables().RoleGrantApproverRole; role != "" {
+		return role
+	}
+	return Role1
+}
+
+func auditRoleGrant(database internal.MongoDatabase, req *http.Request, principal server.Principal, action string, grantId primitive.ObjectID, role string) {
+	details := map[string]interface{}{"grant_id": grantId.Hex()}
+	if role != "" {
+		details["role"] = role
+	}
+	services.AuditInBackground(database, models.AuditLog{
+		Action:   action,
+		ActorId:  principal.User.ID.Hex(),
+		Outcome:  services.AuditAllowed,
+		Method:   req.Method,
+		Path:     req.URL.Path,
+		ClientIp: server.ClientIp(req),
+		Details:  details,
+		TenantId: principal.Tenant,
+	})
+}
+
+// roleGrantError reports validation errors as they are and hides database errors behind a generic message
+func roleGrantError(w http.ResponseWriter, err error) {
+	for _, known := range []error{services.ErrGrantNotFound, services.ErrGrantNotPending, services.ErrGrantSelfApproval, services.ErrGrantDuplicate, services.ErrInvalidGrantRange, services.ErrRoleNotFound, services.ErrGrantTooLong} {
+		if errors.Is(err, known) {
+			server.HttpError(w, err)
+			return
+		}
+	}
+	log.Error("role grant operation failed", err)
+	server.HttpError(w, errors.New("unable to complete the request. Please try again later"))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/http"
 	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
 	"quickstart-go-jwt-mongodb/server"
 )
 
@@ -13,6 +14,52 @@ const (
 	Role2 = "SALES_PERSON"
 )
 
+// Permissions checked by Controller.RequiredPermissions. Seeded into the `permissions` collection at startup
+const (
+	PermissionManageRbac          = "rbac:manage"
+	PermissionManageOAuthClients  = "oauth-clients:manage"
+	PermissionManageOrganizations = "organizations:manage"
+	PermissionManageMembers       = "members:manage"
+	PermissionReadCustomers       = "customers:read"
+	PermissionWriteCustomers      = "customers:write"
+	PermissionReadReports         = "reports:read"
+	PermissionImpersonateUsers    = "users:impersonate"
+	PermissionUnlockUsers         = "users:unlock"
+)
+
+// DefaultPermissions and DefaultRoles are created at startup when missing. Afterwards they are managed through the
+// /admin/roles and /admin/permissions endpoints
+var (
+	DefaultPermissions = []models.Permission{
+		{Name: PermissionManageRbac, Description: "Manage roles, permissions and role assignments"},
+		{Name: PermissionManageOAuthClients, Description: "Register OAuth clients"},
+		{Name: PermissionManageOrganizations, Description: "Create organizations and appoint their members"},
+		{Name: PermissionManageMembers, Description: "Manage the members of the caller's organization"},
+		{Name: PermissionReadCustomers, Description: "Read customers"},
+		{Name: PermissionWriteCustomers, Description: "Create and update customers"},
+		{Name: PermissionReadReports, Description: "Read reports"},
+		{Name: PermissionImpersonateUsers, Description: "Act as another user to reproduce their issues"},
+		{Name: PermissionUnlockUsers, Description: "Lift the sign in lockout of users"},
+	}
+	DefaultRoles = []models.Role{
+		{Name: Role2, Permissions: []string{PermissionReadCustomers, PermissionWriteCustomers}},
+		{Name: Role1, Inherits: []string{Role2}, Permissions: []string{PermissionReadReports, PermissionManageRbac, PermissionManageOAuthClients, PermissionManageOrganizations, PermissionManageMembers, PermissionImpersonateUsers, PermissionUnlockUsers}},
+	}
+)
+
+// Fine-grained scopes. Integration tokens can be limited to these without being granted a whole role
+const (
+	ScopeCustomersRead  = "customers:read"
+	ScopeCustomersWrite = "customers:write"
+	ScopeReportsRead    = "reports:read"
+)
+
+// RoleScopes scopes a user token carries for each role, unless the token was issued with an explicit scope
+var RoleScopes = map[string][]string{
+	Role1: {ScopeCustomersRead, ScopeCustomersWrite, ScopeReportsRead},
+	Role2: {ScopeCustomersRead, ScopeCustomersWrite},
+}
+
 func SecuredRole1Only(database internal.MongoDatabase, ctx context.Context) server.Controller {
 	return server.Controller{
 		Uri:         "/secured/role-1",
@@ -48,3 +95,41 @@ func SecuredRole1And2Only(database internal.MongoDatabase, ctx context.Context)
 		},
 	}
 }
+
+func SecuredCustomersRead(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:            "/secured/customers",
+		Method:         server.GET,
+		Secure:         true,
+		RequiredScopes: []string{ScopeCustomersRead},
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			_, _ = w.Write([]byte("Access granted!"))
+		},
+	}
+}
+
+func SecuredReportsOrCustomersWrite(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:            "/secured/reports-or-customers-write",
+		Method:         server.GET,
+		Secure:         true,
+		RequiredScopes: []string{ScopeReportsRead, ScopeCustomersWrite},
+		ScopeMatch:     server.AnyScope,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			_, _ = w.Write([]byte("Access granted!"))
+		},
+	}
+}
+
+func SecuredOfficeHours(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:         "/secured/office-hours",
+		Method:      server.GET,
+		Secure:      true,
+		PermitRoles: []string{Role1},
+		Policy:      PolicyOfficeHours,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			_, _ = w.Write([]byte("Access granted!"))
+		},
+	}
+}
@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/server"
+	"quickstart-go-jwt-mongodb/services"
+	"strconv"
+	"time"
+)
+
+const defaultPageSize = 20
+
+type session struct {
+	Id         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	ClientIp   string    `json:"client_ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+// ListSessions devices/browsers the caller is currently logged in from. Supports `page` and `per_page` query params
+func ListSessions(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/account/sessions",
+		Method: server.GET,
+		Secure: true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			currentPage, perPage := pagination(req)
+			tokens, err := services.NewSessionService(ctx, database).ActiveSessions(principal.User.ID, currentPage, perPage)
+			if err != nil {
+				server.HttpError(w, errors.New("unable to list sessions. Please try again later"))
+				return
+			}
+			var sessions = make([]session, 0, len(tokens))
+			for i := range tokens {
+				sessions = append(sessions, newSession(tokens[i], principal))
+			}
+			server.HttpResponse(w, http.StatusOK, sessions)
+		},
+	}
+}
+
+// ShowSession details of one of the caller's sessions. Ownership is enforced by the `resource-owner` policy
+func ShowSession(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/account/sessions/{id}",
+		Method: server.GET,
+		Secure: true,
+		Policy: PolicyResourceOwner,
+		LoadResource: func(req *http.Request) (map[string]interface{}, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			token, found := services.NewSessionService(ctx, database).FindSession(mux.Vars(req)["id"])
+			if !found {
+				return nil, nil
+			}
+			return map[string]interface{}{"id": token.FamilyId, "owner_id": token.UserId.Hex()}, nil
+		},
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			token, found := services.NewSessionService(ctx, database).FindSession(mux.Vars(req)["id"])
+			if !found {
+				server.HttpError(w, services.ErrSessionNotFound)
+				return
+			}
+			server.HttpResponse(w, http.StatusOK, newSession(token, principal))
+		},
+	}
+}
+
+// RevokeSession logs the caller out of one of their sessions, e.g. a lost device
+func RevokeSession(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/account/sessions/{id}",
+		Method:              server.DELETE,
+		Secure:              true,
+		ForbidImpersonation: true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			sessionId := mux.Vars(req)["id"]
+			if err := services.NewSessionService(ctx, database).RevokeSession(principal.User.ID, sessionId); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			if sessionId == principal.StringClaim("sid") {
+				clearRefreshTokenCookie(w)
+			}
+			server.HttpResponse(w, http.StatusOK, nil)
+		},
+	}
+}
+
+func pagination(req *http.Request) (int, int) {
+	currentPage, err := strconv.Atoi(req.URL.Query().Get("page"))
+	if err != nil || currentPage < 1 {
+		currentPage = 1
+	}
+	perPage, err := strconv.Atoi(req.URL.Query().Get("per_page"))
+	if err != nil || perPage < 1 || perPage > 100 {
+		perPage = defaultPageSize
+	}
+	return currentPage, perPage
+}
+
+func newSession(token models.Token, principal server.Principal) session {
+	return session{
+		Id:         token.FamilyId,
+		UserAgent:  token.UserAgent,
+		ClientIp:   token.ClientIp,
+		CreatedAt:  token.SessionStartedAt,
+		LastUsedAt: token.LastUsedAt,
+		ExpiresAt:  token.ExpiresAt,
+		Current:    token.FamilyId == principal.StringClaim("sid"),
+	}
+}
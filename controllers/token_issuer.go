@@ -0,0 +1,276 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"quickstart-go-jwt-mongodb/server"
+	"quickstart-go-jwt-mongodb/services"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	accessTokenLifetime  = 30 * time.Minute
+	refreshTokenLifetime = services.RefreshTokenLifetime
+	refreshTokenCookie   = "jwt"
+	refreshTokenType     = "refresh"
+	// impersonationTokenLifetime impersonation tokens cannot be refreshed; the admin impersonates again when needed
+	impersonationTokenLifetime = 15 * time.Minute
+)
+
+// grant describes the session the tokens being minted belong to
+type grant struct {
+	previous *models.Token // consumed refresh token being rotated. nil starts a new session (refresh family)
+	clientId string        // OAuth client the tokens are issued to. Empty for first-party logins
+	scope    string
+	amr      []string // how the user authenticated, e.g. services.AmrPassword. Carried over from previous on rotation
+}
+
+// issueTokens mints an access/refresh pair for user, persists it as a session record and sets the refresh token
+// cookie. previous is the consumed refresh token being rotated, or nil to start a new session authenticated by amr.
+// Every first-party login path must end here so sessions are tracked the same way
+func issueTokens(ctx context.Context, w http.ResponseWriter, req *http.Request, database internal.MongoDatabase, user models.User, previous *models.Token, amr []string) (models.Token, error) {
+	token, err := mintTokens(ctx, req, database, user, grant{previous: previous, amr: amr})
+	if err != nil {
+		return token, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshTokenCookie,
+		Value:    token.RefreshToken,
+		Expires:  time.Now().Add(refreshTokenLifetime + time.Hour),
+		MaxAge:   int(refreshTokenLifetime.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+	})
+	return token, nil
+}
+
+// mintTokens signs and persists an access/refresh pair without touching cookies. OAuth clients receive the
+// refresh token in the token endpoint response instead
+func mintTokens(ctx context.Context, req *http.Request, database internal.MongoDatabase, user models.User, grant grant) (models.Token, error) {
+	now := time.Now()
+	familyId, sessionStartedAt := services.NewFamilyId(), now
+	if grant.previous != nil {
+		familyId, sessionStartedAt = grant.previous.FamilyId, grant.previous.SessionStartedAt
+		if sessionStartedAt.IsZero() {
+			sessionStartedAt = grant.previous.CreatedAt
+		}
+		grant.clientId, grant.scope, grant.amr = grant.previous.ClientId, grant.previous.Scope, grant.previous.Amr
+	}
+	tenant, err := sessionTenant(req, grant.previous)
+	if err != nil {
+		return models.Token{}, err
+	}
+	if tenant != "" {
+		// inside an organization the user holds the roles of their membership, not their global ones
+		roles, member := services.MembershipRoles(user, tenant)
+		if !member {
+			return models.Token{}, services.ErrNotMember
+		}
+		user.Roles = roles
+	}
+	user.Memberships = nil // a token speaks for one organization at most
+	grantClaim, lifetime := activeGrants(ctx, database, &user, tenant)
+	if grant.clientId != "" {
+		// a client never gets more than the user could: the identity scopes plus those of the user's roles
+		permitted := append([]string{scopeOpenId, scopeProfile, scopeEmail}, services.ScopesForRoles(user.Roles)...)
+		grant.scope = services.NarrowScopes(grant.scope, permitted)
+	}
+
+	jwtService := services.NewJwtService(ctx, models.LoadEnvironmentVariables())
+	extraClaims := map[string]any{
+		"iss": issuerUrl(),
+		"sid": familyId,
+	}
+	if grant.clientId != "" {
+		extraClaims["client_id"] = grant.clientId
+	}
+	if tenant != "" {
+		extraClaims["tenant"] = tenant
+	}
+	if len(grantClaim) > 0 {
+		extraClaims[services.ClaimGrants] = grantClaim
+	}
+	if len(grant.amr) > 0 {
+		extraClaims["amr"] = grant.amr
+	}
+	if grant.clientId != "" {
+		// written even when empty, otherwise the token would carry every scope of the user's roles
+		extraClaims["scope"] = grant.scope
+	}
+	accessTokenId := services.RandomToken(16)
+	accessTokenStr, err := jwtService.GenerateJWT(user, lifetime, extraClaims, map[string]any{
+		"jti": accessTokenId,
+	})
+	if err != nil {
+		return models.Token{}, errors.New("unable to generated token. Please try again later")
+	}
+	refreshTokenStr, err := jwtService.GenerateJWT(user.Email, refreshTokenLifetime, extraClaims, map[string]any{
+		"typ": refreshTokenType,
+	})
+	if err != nil {
+		return models.Token{}, errors.New("unable to generated token. Please try again later")
+	}
+
+	token := models.Token{
+		BaseModel:        models.NewBaseModel(),
+		AccessToken:      accessTokenStr,
+		RefreshToken:     refreshTokenStr,
+		UserId:           user.ID,
+		AccessTokenId:    accessTokenId,
+		FamilyId:         familyId,
+		ExpiresAt:        now.Add(refreshTokenLifetime),
+		UserAgent:        req.UserAgent(),
+		ClientIp:         server.ClientIp(req),
+		SessionStartedAt: sessionStartedAt,
+		LastUsedAt:       now,
+		ClientId:         grant.clientId,
+		Scope:            grant.scope,
+		Tenant:           tenant,
+		Amr:              grant.amr,
+	}
+	tokenRepository := repositories.NewTokenRepository(database)
+	tokenId, err := tokenRepository.CreateOne(ctx, token)
+	if err != nil {
+		log.Error("Unable to persist token generated", err)
+		return models.Token{}, errors.New("unable to generated token. Please try again later")
+	}
+	token.ID = tokenId
+	return token, nil
+}
+
+// activeGrants adds the roles of the user's active time-bound grants to user.Roles and returns them as the `grants`
+// claim, along with an access token lifetime that does not outlive the earliest grant. A failed lookup only costs the
+// user their temporary roles
+func activeGrants(ctx context.Context, database internal.MongoDatabase, user *models.User, tenant string) (map[string]any, time.Duration) {
+	lifetime := accessTokenLifetime
+	roleGrants, err := services.NewRoleGrantService(ctx, database, tenant).ActiveGrants(user.ID)
+	if err != nil {
+		log.Error("unable to load role grants", err)
+		return nil, lifetime
+	}
+	grantClaim := map[string]any{}
+	for i := range roleGrants {
+		if slices.Contains(user.Roles, roleGrants[i].Role) {
+			continue // held permanently, or through another grant already
+		}
+		user.Roles = append(slices.Clip(user.Roles), roleGrants[i].Role)
+		grantClaim[roleGrants[i].Role] = roleGrants[i].ID.Hex()
+		if remaining := time.Until(roleGrants[i].ExpiresAt); remaining < lifetime {
+			lifetime = remaining
+		}
+	}
+	return grantClaim, lifetime
+}
+
+// sessionTenant organization a session belongs to. A new session takes the tenant of the request; a rotated one keeps
+// its original tenant and cannot be refreshed from another organization
+func sessionTenant(req *http.Request, previous *models.Token) (string, error) {
+	tenant := server.CurrentTenant(req)
+	if previous == nil {
+		return tenant, nil
+	}
+	if tenant != "" && tenant != previous.Tenant {
+		return "", errors.New("session was not opened for this organization")
+	}
+	return previous.Tenant, nil
+}
+
+// mintClientToken access token for a client acting on its own behalf (client_credentials grant). Its `sub` is the
+// client id and its roles are the client's. No refresh token is issued; the client simply authenticates again
+func mintClientToken(ctx context.Context, req *http.Request, database internal.MongoDatabase, client models.Client, scopes []string) (models.Token, error) {
+	now := time.Now()
+	jwtService := services.NewJwtService(ctx, models.LoadEnvironmentVariables())
+	accessTokenId := services.RandomToken(16)
+	claims := map[string]any{
+		"iss":                   issuerUrl(),
+		"jti":                   accessTokenId,
+		"client_id":             client.ClientId,
+		"roles":                 client.Roles,
+		services.ClaimGrantType: services.GrantClientCredentials,
+	}
+	if len(scopes) > 0 {
+		claims["scope"] = strings.Join(scopes, " ")
+	}
+	accessTokenStr, err := jwtService.GenerateJWT(client.ClientId, accessTokenLifetime, claims)
+	if err != nil {
+		return models.Token{}, errors.New("unable to generated token. Please try again later")
+	}
+
+	token := models.Token{
+		BaseModel:        models.NewBaseModel(),
+		AccessToken:      accessTokenStr,
+		AccessTokenId:    accessTokenId,
+		ExpiresAt:        now.Add(accessTokenLifetime),
+		UserAgent:        req.UserAgent(),
+		ClientIp:         server.ClientIp(req),
+		SessionStartedAt: now,
+		LastUsedAt:       now,
+		ClientId:         client.ClientId,
+		Scope:            strings.Join(scopes, " "),
+	}
+	tokenId, err := repositories.NewTokenRepository(database).CreateOne(ctx, token)
+	if err != nil {
+		log.Error("Unable to persist token generated", err)
+		return models.Token{}, errors.New("unable to generated token. Please try again later")
+	}
+	token.ID = tokenId
+	return token, nil
+}
+
+// mintImpersonationToken access token whose subject is user but whose `act` claim names actor, the admin
+// impersonating them. It carries the user's platform roles only and no refresh token is issued. The admin's authentication methods are kept, so the user's MFA requirement is met only if the admin met theirs
+func mintImpersonationToken(ctx context.Context, req *http.Request, database internal.MongoDatabase, user, actor models.User, amr []string) (models.Token, error) {
+	now := time.Now()
+	user.Memberships = nil
+	jwtService := services.NewJwtService(ctx, models.LoadEnvironmentVariables())
+	accessTokenId := services.RandomToken(16)
+	accessTokenStr, err := jwtService.GenerateJWT(user, impersonationTokenLifetime, map[string]any{
+		"iss":               issuerUrl(),
+		"jti":               accessTokenId,
+		services.ClaimActor: services.ActorClaim(actor),
+		"amr":               amr,
+	})
+	if err != nil {
+		return models.Token{}, errors.New("unable to generated token. Please try again later")
+	}
+
+	token := models.Token{
+		BaseModel:        models.NewBaseModel(),
+		AccessToken:      accessTokenStr,
+		UserId:           user.ID,
+		AccessTokenId:    accessTokenId,
+		ExpiresAt:        now.Add(impersonationTokenLifetime),
+		UserAgent:        req.UserAgent(),
+		ClientIp:         server.ClientIp(req),
+		SessionStartedAt: now,
+		LastUsedAt:       now,
+		ActorId:          actor.ID,
+	}
+	tokenId, err := repositories.NewTokenRepository(database).CreateOne(ctx, token)
+	if err != nil {
+		log.Error("Unable to persist token generated", err)
+		return models.Token{}, errors.New("unable to generated token. Please try again later")
+	}
+	token.ID = tokenId
+	return token, nil
+}
+
+// clearRefreshTokenCookie instructs the browser to drop the refresh token cookie
+func clearRefreshTokenCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshTokenCookie,
+		Value:    "",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+	})
+}
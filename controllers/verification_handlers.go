@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/server"
+	"quickstart-go-jwt-mongodb/services"
+	"strings"
+	"time"
+)
+
+type (
+	resendVerification struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+	// emailVerified answer to the unauthenticated verification link, which must not disclose the account
+	emailVerified struct {
+		EmailVerified bool `json:"email_verified"`
+	}
+)
+
+// VerifyEmail target of the link emailed on account creation: marks the user's address as verified
+func VerifyEmail(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/account/verify",
+		Method: server.GET,
+		Secure: false,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			token := req.URL.Query().Get("token")
+			if token == "" {
+				server.HttpError(w, services.ErrInvalidOneTimeToken)
+				return
+			}
+			if _, err := services.NewEmailVerificationService(ctx, database, models.LoadEnvironmentVariables()).Verify(token); err != nil {
+				verificationError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusOK, emailVerified{EmailVerified: true})
+		},
+	}
+}
+
+// ResendVerification emails another verification link. It answers the same whether or not the address has an
+// unverified account, and sends at most one email a minute and five an hour
+func ResendVerification(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/account/verify/resend",
+		Method: server.POST,
+		Secure: false,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			var body resendVerification
+			if err := server.ParseReqToJson(req, &body); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			link, err := verifyEmailUrl()
+			if err != nil {
+				verificationError(w, err)
+				return
+			}
+			if err = services.NewEmailVerificationService(ctx, database, models.LoadEnvironmentVariables()).Resend(body.Email, link); err != nil {
+				verificationError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusAccepted, nil)
+		},
+	}
+}
+
+// sendEmailVerification emails user the link to verify their address. A failure is logged only: the user can ask
+// for another link
+func sendEmailVerification(ctx context.Context, database internal.MongoDatabase, user models.User) {
+	link, err := verifyEmailUrl()
+	if err == nil {
+		err = services.NewEmailVerificationService(ctx, database, models.LoadEnvironmentVariables()).Send(user, link)
+	}
+	if err != nil {
+		log.Error("unable to send email verification", err)
+	}
+}
+
+// unverifiedEmailRefused whether EMAIL_VERIFICATION_POLICY keeps user from signing in
+func unverifiedEmailRefused(user models.User) bool {
+	return !user.EmailVerified &&
+		services.EmailVerificationPolicy(models.LoadEnvironmentVariables().EmailVerificationPolicy) == services.EmailVerificationRefuse
+}
+
+// preferredLocale first language of the Accept-Language header, e.g. `fr-CA` for `fr-CA,fr;q=0.9,en;q=0.8`
+func preferredLocale(req *http.Request) string {
+	locale, _, _ := strings.Cut(req.Header.Get("Accept-Language"), ",")
+	locale, _, _ = strings.Cut(locale, ";")
+	if locale = strings.TrimSpace(locale); locale == "*" || len(locale) > 35 {
+		return ""
+	}
+	return locale
+}
+
+func verifyEmailUrl() (string, error) {
+	return publicUrl("/account/verify")
+}
+
+// verificationError reports validation errors as they are and hides database and mail errors behind a generic message
+func verificationError(w http.ResponseWriter, err error) {
+	for _, known := range []error{services.ErrInvalidOneTimeToken, services.ErrUserNotFound} {
+		if errors.Is(err, known) {
+			server.HttpError(w, err)
+			return
+		}
+	}
+	log.Error("email verification failed", err)
+	server.HttpError(w, errors.New("unable to complete the request. Please try again later"))
+}
@@ -0,0 +1,301 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"quickstart-go-jwt-mongodb/server"
+	"quickstart-go-jwt-mongodb/services"
+	"strings"
+	"time"
+)
+
+type (
+	passkeyRegistrationBegin struct {
+		SessionId string                       `json:"session_id"`
+		Options   *protocol.CredentialCreation `json:"options"` //argument of navigator.credentials.create()
+	}
+	passkeyRegistrationFinish struct {
+		SessionId  string          `json:"session_id" validate:"required"`
+		Name       string          `json:"name" validate:"required,max=64"`
+		Credential json.RawMessage `json:"credential" validate:"required"` //PublicKeyCredential returned by the browser
+	}
+	passkeyLoginOptions struct {
+		SessionId string                        `json:"session_id"`
+		Options   *protocol.CredentialAssertion `json:"options"` //argument of navigator.credentials.get()
+	}
+	passkeyLoginFinish struct {
+		SessionId  string          `json:"session_id" validate:"required"`
+		Credential json.RawMessage `json:"credential" validate:"required"`
+	}
+	passkeyView struct {
+		Id         string     `json:"id"` //base64url, as in the browser's PublicKeyCredential.id
+		Name       string     `json:"name"`
+		Transports []string   `json:"transports"`
+		Synced     bool       `json:"synced"`
+		CreatedAt  time.Time  `json:"created_at"`
+		LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	}
+)
+
+// BeginPasskeyRegistration starts registering a passkey (WebAuthn credential) for the caller
+func BeginPasskeyRegistration(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/account/webauthn/register/begin",
+		Method:              server.POST,
+		Secure:              true,
+		ForbidImpersonation: true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			relyingParty, err := webAuthnRelyingParty()
+			if err != nil {
+				webAuthnError(w, err)
+				return
+			}
+			service := services.NewWebAuthnService(ctx, database, relyingParty)
+			user, err := currentUser(ctx, database, principal)
+			if err != nil {
+				webAuthnError(w, err)
+				return
+			}
+			options, sessionId, err := service.BeginRegistration(user)
+			if err != nil {
+				webAuthnError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusOK, passkeyRegistrationBegin{SessionId: sessionId, Options: options})
+		},
+	}
+}
+
+// FinishPasskeyRegistration verifies the authenticator's response and stores the passkey
+func FinishPasskeyRegistration(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/account/webauthn/register/finish",
+		Method:              server.POST,
+		Secure:              true,
+		ForbidImpersonation: true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			var body passkeyRegistrationFinish
+			if err := server.ParseReqToJson(req, &body); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			relyingParty, err := webAuthnRelyingParty()
+			if err != nil {
+				webAuthnError(w, err)
+				return
+			}
+			service := services.NewWebAuthnService(ctx, database, relyingParty)
+			user, err := currentUser(ctx, database, principal)
+			if err != nil {
+				webAuthnError(w, err)
+				return
+			}
+			credential, err := service.FinishRegistration(user, body.SessionId, body.Name, bytes.NewReader(body.Credential))
+			if err != nil {
+				webAuthnError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusCreated, newPasskeyView(credential))
+		},
+	}
+}
+
+// ListPasskeys passkeys the caller registered
+func ListPasskeys(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/account/webauthn/credentials",
+		Method: server.GET,
+		Secure: true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			user, err := currentUser(ctx, database, principal)
+			if err != nil {
+				webAuthnError(w, err)
+				return
+			}
+			views := make([]passkeyView, 0, len(user.WebAuthnCredentials))
+			for _, credential := range user.WebAuthnCredentials {
+				views = append(views, newPasskeyView(credential))
+			}
+			server.HttpResponse(w, http.StatusOK, views)
+		},
+	}
+}
+
+// RemovePasskey deletes one of the caller's passkeys, by its base64url id
+func RemovePasskey(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:                 "/account/webauthn/credentials/{id}",
+		Method:              server.DELETE,
+		Secure:              true,
+		ForbidImpersonation: true,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			principal, _ := server.CurrentPrincipal(req)
+			credentialId, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(mux.Vars(req)["id"], "="))
+			if err != nil {
+				server.HttpError(w, services.ErrCredentialNotFound)
+				return
+			}
+			if err = services.NewWebAuthnService(ctx, database, nil).RemoveCredential(principal.User.ID, credentialId); err != nil {
+				webAuthnError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusOK, nil)
+		},
+	}
+}
+
+// BeginPasskeyLogin starts a passkey login. No account is named: the browser offers every passkey it holds for this
+// site and the one chosen identifies the user
+func BeginPasskeyLogin(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/account/webauthn/login/begin",
+		Method: server.POST,
+		Secure: false,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			relyingParty, err := webAuthnRelyingParty()
+			if err != nil {
+				webAuthnError(w, err)
+				return
+			}
+			service := services.NewWebAuthnService(ctx, database, relyingParty)
+			options, sessionId, err := service.BeginLogin()
+			if err != nil {
+				webAuthnError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusOK, passkeyLoginOptions{SessionId: sessionId, Options: options})
+		},
+	}
+}
+
+// FinishPasskeyLogin verifies the assertion and issues the same access/refresh pair as /account/auth. Passkeys that
+// verified the user (PIN, biometrics) satisfy roles requiring MFA; other passkeys of users who enabled MFA get an MFA
+// challenge, completed on /account/auth/mfa, like a password login
+func FinishPasskeyLogin(database internal.MongoDatabase, ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/account/webauthn/login/finish",
+		Method: server.POST,
+		Secure: false,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			var body passkeyLoginFinish
+			if err := server.ParseReqToJson(req, &body); err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			relyingParty, err := webAuthnRelyingParty()
+			if err != nil {
+				webAuthnError(w, err)
+				return
+			}
+			service := services.NewWebAuthnService(ctx, database, relyingParty)
+			user, credential, err := service.FinishLogin(body.SessionId, bytes.NewReader(body.Credential))
+			if err != nil {
+				webAuthnError(w, err)
+				return
+			}
+			if unverifiedEmailRefused(user) {
+				server.Forbidden(w, services.ErrEmailNotVerified)
+				return
+			}
+			if services.WebAuthnNeedsSecondFactor(user, credential) {
+				challengeToken, err := services.NewMfaService(ctx, database).IssueChallenge(services.NewJwtService(ctx, models.LoadEnvironmentVariables()), user, services.WebAuthnAmr(credential))
+				if err != nil {
+					log.Error("unable to issue mfa challenge", err)
+					server.HttpError(w, errors.New("unable to generated token. Please try again later"))
+					return
+				}
+				server.HttpResponse(w, http.StatusOK, mfaChallenge{MfaRequired: true, ChallengeToken: challengeToken})
+				return
+			}
+			token, err := issueTokens(ctx, w, req, database, user, nil, services.WebAuthnAmr(credential))
+			if err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			server.HttpResponse(w, http.StatusCreated, token)
+		},
+	}
+}
+
+// webAuthnRelyingParty relying party from WEBAUTHN_RP_ID, WEBAUTHN_RP_ORIGINS and WEBAUTHN_RP_NAME. Without them the
+// relying party is the host of ISSUER_URL, which only works while the API and the web app share an origin
+func webAuthnRelyingParty() (*webauthn.WebAuthn, error) {
+	envVar := models.LoadEnvironmentVariables()
+	issuer, err := url.Parse(issuerUrl())
+	if err != nil {
+		return nil, err
+	}
+	config := &webauthn.Config{
+		RPID:          envVar.WebAuthnRpId,
+		RPDisplayName: envVar.WebAuthnRpName,
+		RPOrigins:     strings.FieldsFunc(envVar.WebAuthnRpOrigins, func(r rune) bool { return r == ',' || r == ' ' }),
+	}
+	if config.RPID == "" {
+		config.RPID = issuer.Hostname()
+	}
+	if config.RPDisplayName == "" {
+		config.RPDisplayName = config.RPID
+	}
+	if len(config.RPOrigins) == 0 {
+		config.RPOrigins = []string{issuer.Scheme + "://" + issuer.Host}
+	}
+	return webauthn.New(config)
+}
+
+func currentUser(ctx context.Context, database internal.MongoDatabase, principal server.Principal) (models.User, error) {
+	var user models.User
+	if !repositories.NewUserRepository(database).FindOne(ctx, &user, repositories.Filter{Key: "_id", Value: principal.User.ID}) {
+		return user, services.ErrUserNotFound
+	}
+	return user, nil
+}
+
+func newPasskeyView(credential models.WebAuthnCredential) passkeyView {
+	return passkeyView{
+		Id:         base64.RawURLEncoding.EncodeToString(credential.Id),
+		Name:       credential.Name,
+		Transports: credential.Transports,
+		Synced:     credential.BackupState,
+		CreatedAt:  credential.CreatedAt,
+		LastUsedAt: credential.LastUsedAt,
+	}
+}
+
+// webAuthnError reports validation errors as they are and hides database errors behind a generic message
+func webAuthnError(w http.ResponseWriter, err error) {
+	for _, known := range []error{services.ErrWebAuthnSession, services.ErrWebAuthnVerification, services.ErrWebAuthnCloned, services.ErrCredentialNotFound, services.ErrUserNotFound} {
+		if errors.Is(err, known) {
+			server.HttpError(w, err)
+			return
+		}
+	}
+	log.Error("webauthn operation failed", err)
+	server.HttpError(w, errors.New("unable to complete the request. Please try again later"))
+}
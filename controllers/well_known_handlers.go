@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/server"
+	"quickstart-go-jwt-mongodb/services"
+)
+
+// JsonWebKeySet publishes the public signing keys so other services can verify access tokens without the secret.
+// The key set is served as a bare RFC 7517 document (not wrapped in server.ResponseBody) as JWKS clients expect
+func JsonWebKeySet(ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/.well-known/jwks.json",
+		Method: server.GET,
+		Secure: false,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			jwtService := services.NewJwtService(ctx, models.LoadEnvironmentVariables())
+			w.Header().Set("Content-Type", "application/jwk-set+json")
+			w.Header().Set("Cache-Control", "public, max-age=300")
+			if err := json.NewEncoder(w).Encode(jwtService.PublicKeys()); err != nil {
+				log.Error("error sending server response")
+			}
+		},
+	}
+}
+
+type openIdConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JwksUri                           string   `json:"jwks_uri"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IdTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+}
+
+// OpenIdConfiguration OpenID Connect discovery document, letting OIDC relying parties configure themselves from the
+// issuer URL alone
+func OpenIdConfiguration(ctx context.Context) server.Controller {
+	return server.Controller{
+		Uri:    "/.well-known/openid-configuration",
+		Method: server.GET,
+		Secure: false,
+		Callback: func(w http.ResponseWriter, req *http.Request) {
+			issuer := issuerUrl()
+			jwtService := services.NewJwtService(ctx, models.LoadEnvironmentVariables())
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "public, max-age=300")
+			if err := json.NewEncoder(w).Encode(openIdConfiguration{
+				Issuer:                            issuer,
+				AuthorizationEndpoint:             issuer + "/oauth/authorize",
+				TokenEndpoint:                     issuer + "/oauth/token",
+				UserinfoEndpoint:                  issuer + "/userinfo",
+				JwksUri:                           issuer + "/.well-known/jwks.json",
+				IntrospectionEndpoint:             issuer + "/oauth/introspect",
+				RevocationEndpoint:                issuer + "/oauth/revoke",
+				ResponseTypesSupported:            []string{"code"},
+				GrantTypesSupported:               []string{"authorization_code", "refresh_token", services.GrantClientCredentials},
+				SubjectTypesSupported:             []string{"public"},
+				IdTokenSigningAlgValuesSupported:  []string{jwtService.SigningAlgorithm()},
+				ScopesSupported:                   []string{scopeOpenId, scopeProfile, scopeEmail},
+				TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+				ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "name", "given_name", "family_name", "email", "email_verified"},
+				CodeChallengeMethodsSupported:     []string{services.PkceMethodS256},
+			}); err != nil {
+				log.Error("error sending server response")
+			}
+		},
+	}
+}
@@ -3,11 +3,13 @@ package main
 import (
 	"context"
 	log "github.com/sirupsen/logrus"
+	"net/url"
 	"quickstart-go-jwt-mongodb/internal"
 	"quickstart-go-jwt-mongodb/middleware"
 	"quickstart-go-jwt-mongodb/models"
 	"quickstart-go-jwt-mongodb/route"
 	"quickstart-go-jwt-mongodb/server"
+	"quickstart-go-jwt-mongodb/services"
 	"time"
 )
 
@@ -20,16 +22,44 @@ func main() {
 	)
 	parentHttpCtx, cancel := context.WithDeadline(context.Background(), time.Now().Add(40*time.Second))
 	httpRequestHandler = server.NewHttpRequestHandler(parentHttpCtx, environmentVariables)
+	backgroundCtx, stopBackgroundJobs := context.WithCancel(context.Background())
 
 	defer func() {
 		log.Debug("HTTP PORT TERMINATING...CLOSING RESOURCES!!!")
+		stopBackgroundJobs()
 		mongoClient.CloseClient()
 		cancel()
 	}()
 
+	if _, err := server.TrustedProxies(environmentVariables.TrustedProxies); err != nil {
+		log.Fatalf("unable to read TRUSTED_PROXIES. %v", err)
+	}
+	if err := services.CheckPasswordPolicy(environmentVariables); err != nil {
+		log.Fatalf("invalid password policy. %v", err)
+	}
+	// never derived from the request: tokens, discovery documents and emailed links would carry the client's Host
+	if issuer, err := url.Parse(environmentVariables.Issuer); err != nil || issuer.Scheme == "" || issuer.Host == "" {
+		log.Fatalf("ISSUER_URL must be the public URL of this service, e.g. https://auth.example.com. Got %q", environmentVariables.Issuer)
+	}
 	mongoClient = internal.NewMongoDbConn(environmentVariables)
 	var mongoDb internal.MongoDatabase = mongoClient.Database
 
+	if _, err := services.StartKeyRing(backgroundCtx, mongoDb, environmentVariables); err != nil {
+		log.Fatalf("unable to load jwt signing keys. %v", err)
+	}
+	seedCtx, cancelSeed := context.WithTimeout(backgroundCtx, 30*time.Second)
+	if err := route.SeedAuthorization(seedCtx, mongoDb, environmentVariables); err != nil {
+		log.Fatalf("unable to seed roles and permissions. %v", err)
+	}
+	cancelSeed()
+	services.StartGrantSweeper(backgroundCtx, mongoDb)
+	services.StartLoginThrottleSweeper(backgroundCtx, mongoDb, environmentVariables)
+	services.StartMailWorker(backgroundCtx, mongoDb, services.NewMailTransport(environmentVariables))
+	rateLimiter, err := services.StartRateLimiter(backgroundCtx, mongoDb, environmentVariables)
+	if err != nil {
+		log.Fatalf("unable to start the rate limiter. %v", err)
+	}
+
 	if r := recover(); r != nil {
 		log.Warnf("[RECOVERY_FROM_FAILURE] %v", r)
 	}
@@ -39,7 +69,10 @@ func main() {
 	//Use middleware to intermediate every requests
 	httpRequestHandler.HandleMiddlewares(
 		middleware.HeadersMiddleware(),
-		middleware.SecureMiddleware(httpRequestHandler.GetControllers(), environmentVariables),
+		middleware.GlobalRateLimitMiddleware(rateLimiter),
+		middleware.TenantMiddleware(mongoDb, environmentVariables),
+		middleware.SecureMiddleware(httpRequestHandler.GetControllers(), mongoDb, environmentVariables),
+		middleware.RateLimitMiddleware(httpRequestHandler.GetControllers(), rateLimiter, environmentVariables),
 	)
 
 	httpRequestHandler.Serve()
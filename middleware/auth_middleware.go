@@ -2,10 +2,14 @@ package middleware
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
 	"net/http"
+	"quickstart-go-jwt-mongodb/internal"
 	"quickstart-go-jwt-mongodb/models"
 	"quickstart-go-jwt-mongodb/server"
 	"quickstart-go-jwt-mongodb/services"
@@ -19,21 +23,16 @@ const (
 	HeaderScheme = "Bearer"
 )
 
-func SecureMiddleware(controllers []server.Controller, envVar models.EnvVar) mux.MiddlewareFunc {
+func SecureMiddleware(controllers []server.Controller, database internal.MongoDatabase, envVar models.EnvVar) mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 
 			if req.Method == http.MethodOptions {
 				next.ServeHTTP(w, req)
+				return
 			}
 			//Check if the ControllerRegistry is not Secured. Otherwise, continue with security validation checks
-			var currentHttpRequest server.Controller
-			for i := range controllers {
-				if fmt.Sprintf("%s%s", envVar.BaseUrlPrefix, controllers[i].Uri) == req.URL.Path {
-					currentHttpRequest = controllers[i]
-					break
-				}
-			}
+			currentHttpRequest := matchController(controllers, req, envVar)
 
 			//non-secured page should be served their corresponding server handler
 			if !currentHttpRequest.Secure {
@@ -47,17 +46,23 @@ func SecureMiddleware(controllers []server.Controller, envVar models.EnvVar) mux
 				return
 			}
 
-			var user models.User
+			var subject json.RawMessage
 			jwtTokenizedStr := strings.Trim(strings.TrimLeft(req.Header[HeaderName][0], HeaderScheme), " ")
 			ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
 			defer cancel()
-			jwt := services.NewJwtService(ctx, envVar)
-			claims, err := jwt.ClaimToken(jwtTokenizedStr, &user)
+			jwtService := services.NewJwtService(ctx, envVar)
+			claims, err := jwtService.ClaimToken(jwtTokenizedStr, &subject)
 			if err != nil {
 				server.AccessDenied(w, errors.New(fmt.Sprintf("access denied. %v", err)))
 				return
 			}
 
+			if typ, ok := claims.(jwt.MapClaims)["typ"]; ok {
+				// refresh and MFA challenge tokens are signed with the same keys but are not access tokens
+				server.AccessDenied(w, errors.New(fmt.Sprintf("access denied. '%v' tokens cannot be used as access tokens", typ)))
+				return
+			}
+
 			expirationTime, _ := claims.GetExpirationTime()
 
 			if time.Now().After(expirationTime.Time) {
@@ -66,18 +71,248 @@ func SecureMiddleware(controllers []server.Controller, envVar models.EnvVar) mux
 				return
 			}
 
+			principal, err := newPrincipal(subject, claims.(jwt.MapClaims))
+			if err != nil {
+				server.AccessDenied(w, errors.New(fmt.Sprintf("access denied. %v", err)))
+				return
+			}
+			if principal.IsImpersonated() {
+				// every request made while impersonating is audited, together with how it was answered
+				recorder := &statusRecorder{ResponseWriter: w}
+				w = recorder
+				defer auditImpersonation(database, req, principal, recorder)
+				if currentHttpRequest.ForbidImpersonation {
+					server.Forbidden(w, errors.New("this action is not allowed while impersonating a user"))
+					return
+				}
+			}
+			revoked, err := services.NewSessionService(ctx, database).IsRevoked(principal.StringClaim("sid"), principal.StringClaim("jti"))
+			if err != nil {
+				log.Error("unable to check session revocation", err)
+				server.ServiceUnavailable(w, errors.New("unable to verify session. Please try again later"))
+				return
+			}
+			if revoked {
+				server.AccessDenied(w, services.ErrSessionRevoked)
+				return
+			}
+			// a token only works inside the organization it was issued for; tenant tokens hold that tenant's roles
+			principal.Tenant = principal.StringClaim("tenant")
+			if tenant := server.CurrentTenant(req); tenant != "" && tenant != principal.Tenant {
+				server.AccessDenied(w, errors.New("access denied. Token was not issued for this organization"))
+				return
+			}
+			if principal.Tenant != "" {
+				req = server.WithTenant(req, principal.Tenant)
+			}
+
+			if grantClaim, ok := principal.Claims[services.ClaimGrants].(map[string]interface{}); ok {
+				// roles held through a time-bound grant stop working as soon as the grant expires or is revoked
+				principal.Roles, err = services.NewRoleGrantService(ctx, database, principal.Tenant).DropInactiveGrants(principal.Roles, grantClaim)
+				if err != nil {
+					server.AccessDenied(w, errors.New("unable to verify role grants. Please try again later"))
+					return
+				}
+			}
+
+			authorization, err := services.NewRbacService(ctx, database).Resolve(principal.Roles)
+			if err != nil {
+				server.AccessDenied(w, errors.New("unable to verify permissions. Please try again later"))
+				return
+			}
+			principal.Roles, principal.Permissions = authorization.Roles, authorization.Permissions
+			req = server.WithPrincipal(req, principal)
+
+			if authorization.RequireMfa && !principal.IsClient() && !currentHttpRequest.AllowWithoutMfa &&
+				!slices.Contains(services.StringSliceClaim(principal.Claims, "amr"), services.AmrMfa) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`%s error="insufficient_user_authentication"`, HeaderScheme))
+				server.Forbidden(w, errors.New(fmt.Sprintf("%v. Enroll on /account/mfa/enroll and sign in again", services.ErrMfaRequired)))
+				return
+			}
+
+			if !principal.IsClient() && !principal.User.EmailVerified && !currentHttpRequest.AllowUnverifiedEmail &&
+				services.EmailVerificationPolicy(envVar.EmailVerificationPolicy) == services.EmailVerificationRestrict {
+				server.Forbidden(w, services.ErrEmailNotVerified)
+				return
+			}
+
 			//Empty 'PermitRoles' signifies wild card ACL. Authorization check isn't required. Just authentication
-			if len(currentHttpRequest.PermitRoles) == 0 {
-				next.ServeHTTP(w, req)
+			if len(currentHttpRequest.PermitRoles) > 0 && !slices.ContainsFunc(principal.Roles, func(role string) bool {
+				return slices.Contains(currentHttpRequest.PermitRoles, role)
+			}) {
+				server.AccessDenied(w, errors.New(fmt.Sprintf("unauthorised accces to this URL")))
 				return
 			}
-			for i := range user.Roles {
-				if slices.Contains(currentHttpRequest.PermitRoles, user.Roles[i]) {
-					next.ServeHTTP(w, req)
+			for _, permission := range currentHttpRequest.RequiredPermissions {
+				if !slices.Contains(principal.Permissions, permission) {
+					server.Forbidden(w, errors.New(fmt.Sprintf("missing permission '%s'", permission)))
 					return
 				}
 			}
-			server.AccessDenied(w, errors.New(fmt.Sprintf("unauthorised accces to this URL")))
+			if !matchScopes(tokenScopes(principal), currentHttpRequest.RequiredScopes, currentHttpRequest.ScopeMatch) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`%s error="insufficient_scope", scope="%s"`, HeaderScheme, strings.Join(currentHttpRequest.RequiredScopes, " ")))
+				server.Forbidden(w, errors.New("insufficient scope to access this URL"))
+				return
+			}
+			if currentHttpRequest.Policy != "" {
+				decision, err := evaluatePolicy(req, currentHttpRequest, principal)
+				if err != nil {
+					log.Error("unable to load the resource of policy ", currentHttpRequest.Policy, err)
+					server.AccessDenied(w, errors.New("unable to verify access. Please try again later"))
+					return
+				}
+				auditPolicyDecision(database, req, currentHttpRequest.Policy, principal, decision)
+				if !decision.Allow {
+					server.Forbidden(w, errors.New(fmt.Sprintf("access denied by policy '%s'. %s", currentHttpRequest.Policy, decision.Reason)))
+					return
+				}
+			}
+			next.ServeHTTP(w, req)
 		})
 	}
 }
+
+// matchController finds the Controller serving req. The matched route's path template is compared rather than the raw
+// path so controllers with path variables (e.g. `/account/sessions/{id}`) are matched too
+func matchController(controllers []server.Controller, req *http.Request, envVar models.EnvVar) server.Controller {
+	path := req.URL.Path
+	if route := mux.CurrentRoute(req); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			path = template
+		}
+	}
+	for i := range controllers {
+		if fmt.Sprintf("%s%s", envVar.BaseUrlPrefix, controllers[i].Uri) == path && string(controllers[i].Method) == req.Method {
+			return controllers[i]
+		}
+	}
+	return server.Controller{}
+}
+
+// newPrincipal user tokens carry the JSON encoded models.User as `sub`. Machine tokens (client_credentials grant) carry
+// the client id instead, and their roles in the `roles` claim
+func newPrincipal(subject json.RawMessage, claims jwt.MapClaims) (server.Principal, error) {
+	principal := server.Principal{Claims: claims}
+	principal.ClientId, _ = claims["client_id"].(string)
+	if grantType, _ := claims[services.ClaimGrantType].(string); grantType == services.GrantClientCredentials {
+		principal.Roles = services.StringSliceClaim(claims, "roles")
+		return principal, nil
+	}
+	if err := json.Unmarshal(subject, &principal.User); err != nil {
+		return principal, errors.New("invalid token subject")
+	}
+	principal.Roles = principal.User.Roles
+	if actor, ok := claims[services.ClaimActor].(map[string]interface{}); ok {
+		principal.ActorId, _ = actor["sub"].(string)
+	}
+	return principal, nil
+}
+
+// tokenScopes scopes granted to the token. Tokens issued before the `scope` claim was introduced fall back to the
+// scopes of their roles
+func tokenScopes(principal server.Principal) []string {
+	if _, ok := principal.Claims["scope"]; !ok {
+		return services.ScopesForRoles(principal.Roles)
+	}
+	return strings.Fields(principal.StringClaim("scope"))
+}
+
+// matchScopes reports whether granted satisfies the required scopes. No required scopes always matches
+func matchScopes(granted, required []string, match server.ScopeMatch) bool {
+	if len(required) == 0 {
+		return true
+	}
+	contains := func(scope string) bool { return slices.Contains(granted, scope) }
+	if match == server.AnyScope {
+		return slices.ContainsFunc(required, contains)
+	}
+	for i := range required {
+		if !contains(required[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func evaluatePolicy(req *http.Request, controller server.Controller, principal server.Principal) (services.Decision, error) {
+	input := services.PolicyInput{
+		ClientId:    principal.ClientId,
+		Roles:       principal.Roles,
+		Permissions: principal.Permissions,
+		Claims:      principal.Claims,
+		Method:      req.Method,
+		Path:        req.URL.Path,
+		PathVars:    mux.Vars(req),
+		ClientIp:    server.ClientIp(req),
+		Time:        time.Now(),
+	}
+	if !principal.User.ID.IsZero() {
+		input.UserId = principal.User.ID.Hex()
+	}
+	if controller.LoadResource != nil {
+		resource, err := controller.LoadResource(req)
+		if err != nil {
+			return services.Decision{}, err
+		}
+		input.Resource = resource
+	}
+	return services.EvaluatePolicy(controller.Policy, input), nil
+}
+
+func auditPolicyDecision(database internal.MongoDatabase, req *http.Request, policy string, principal server.Principal, decision services.Decision) {
+	entry := models.AuditLog{
+		Action:   "policy.evaluate",
+		ActorId:  principal.ClientId,
+		Outcome:  services.AuditDenied,
+		Reason:   decision.Reason,
+		Method:   req.Method,
+		Path:     req.URL.Path,
+		ClientIp: server.ClientIp(req),
+		Details:  map[string]interface{}{"policy": policy},
+		TenantId: principal.Tenant,
+	}
+	if !principal.User.ID.IsZero() {
+		entry.ActorId = principal.User.ID.Hex()
+	}
+	if decision.Allow {
+		entry.Outcome = services.AuditAllowed
+	}
+	services.AuditInBackground(database, entry)
+}
+
+// statusRecorder remembers the status code a handler answered with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	if r.status == 0 {
+		r.status = statusCode
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func auditImpersonation(database internal.MongoDatabase, req *http.Request, principal server.Principal, recorder *statusRecorder) {
+	entry := models.AuditLog{
+		Action:   "impersonation.request",
+		ActorId:  principal.ActorId,
+		Outcome:  services.AuditAllowed,
+		Method:   req.Method,
+		Path:     req.URL.Path,
+		ClientIp: server.ClientIp(req),
+		Details:  map[string]interface{}{"subject": principal.User.ID.Hex(), "status": recorder.status},
+		TenantId: principal.Tenant,
+	}
+	if recorder.status >= http.StatusBadRequest {
+		entry.Outcome = services.AuditDenied
+	}
+	services.AuditInBackground(database, entry)
+}
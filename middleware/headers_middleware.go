@@ -10,7 +10,8 @@ func HeadersMiddleware() mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			w.Header().Add("Access-Control-Allow-Origin", "*")
-			w.Header().Add("Access-Control-Allow-Headers", "Content-Type, Accept, Authorization, Accept-Language")
+			w.Header().Add("Access-Control-Allow-Headers", "Content-Type, Accept, Authorization, Accept-Language, X-Tenant-ID")
+			w.Header().Add("Access-Control-Expose-Headers", "RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, RateLimit-Policy, Retry-After")
 			w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST, DELETE, HEAD, OPTION")
 			w.Header().Add("Content-Type", "application/json")
 			w.Header().Add("Access-Control-Max-Age", "86000") //browser cache cors preflight request for 14secs
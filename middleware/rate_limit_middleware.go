@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/server"
+	"quickstart-go-jwt-mongodb/services"
+	"strconv"
+	"time"
+)
+
+var errRateLimited = errors.New("too many requests. Please slow down")
+
+// GlobalRateLimitMiddleware applies RATE_LIMIT to every request, per client IP. Must run before SecureMiddleware so
+// floods are refused before any token is verified
+func GlobalRateLimitMiddleware(limiter *services.RateLimiter) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			rule, ok := limiter.Global()
+			if !ok || req.Method == http.MethodOptions {
+				next.ServeHTTP(w, req)
+				return
+			}
+			if !takeRateLimit(w, limiter, "global|ip:"+server.ClientIp(req), rule) {
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// RateLimitMiddleware applies the RateLimit of the Controller serving the request. Must run after SecureMiddleware,
+// which identifies the user or client requests are counted for
+func RateLimitMiddleware(controllers []server.Controller, limiter *services.RateLimiter, envVar models.EnvVar) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == http.MethodOptions {
+				next.ServeHTTP(w, req)
+				return
+			}
+			controller := matchController(controllers, req, envVar)
+			rule := services.RateLimitRule{
+				Requests:      controller.RateLimit.Requests,
+				Window:        controller.RateLimit.Window,
+				Burst:         controller.RateLimit.Burst,
+				SlidingWindow: controller.RateLimit.Algorithm == server.SlidingWindow,
+			}
+			if !rule.Enabled() {
+				next.ServeHTTP(w, req)
+				return
+			}
+			key := fmt.Sprintf("%s %s|%s", controller.Method, controller.Uri, rateLimitCaller(req, controller.RateLimit.Key))
+			if !takeRateLimit(w, limiter, key, rule) {
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// rateLimitCaller whom requests are counted for: the user or the client of the access token when asked for and
+// available, the client IP otherwise
+func rateLimitCaller(req *http.Request, key server.RateLimitKey) string {
+	principal, _ := server.CurrentPrincipal(req)
+	if key == server.RateLimitByUser && !principal.User.ID.IsZero() {
+		return "user:" + principal.User.ID.Hex()
+	}
+	if (key == server.RateLimitByUser || key == server.RateLimitByClient) && principal.ClientId != "" {
+		return "client:" + principal.ClientId
+	}
+	return "ip:" + server.ClientIp(req)
+}
+
+// takeRateLimit counts a request of key against rule and sets the RateLimit headers, answering 429 when the rule
+// refuses it. The request is let through when the store cannot be reached: losing the limit beats losing the API
+func takeRateLimit(w http.ResponseWriter, limiter *services.RateLimiter, key string, rule services.RateLimitRule) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	result, err := limiter.Take(ctx, key, rule)
+	if err != nil {
+		log.Error("unable to check rate limit ", key, err)
+		return true
+	}
+	setRateLimitHeaders(w, rule, result)
+	if !result.Allowed {
+		server.TooManyRequests(w, result.RetryAfter, errRateLimited)
+		return false
+	}
+	return true
+}
+
+// setRateLimitHeaders RateLimit-* headers (draft-ietf-httpapi-ratelimit-headers) of result, unless a limit already
+// checked for this request leaves fewer requests and this one is allowed
+func setRateLimitHeaders(w http.ResponseWriter, rule services.RateLimitRule, result services.RateLimitResult) {
+	header := w.Header()
+	if remaining, err := strconv.Atoi(header.Get("RateLimit-Remaining")); err == nil && remaining < result.Remaining && result.Allowed {
+		return
+	}
+	header.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.Reset.Seconds()))))
+	header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rule.Requests, int(math.Ceil(rule.Window.Seconds()))))
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net"
+	"net/http"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/server"
+	"quickstart-go-jwt-mongodb/services"
+	"strings"
+	"time"
+)
+
+const TenantHeaderName = "X-Tenant-ID"
+
+// TenantMiddleware scopes the request to the organization named by the subdomain of TENANT_BASE_DOMAIN, the
+// X-Tenant-ID header or the `{tenant}` path variable. Sources that disagree are rejected, as are unknown organizations.
+// Must run before SecureMiddleware, which checks the caller's token was issued for the same organization
+func TenantMiddleware(database internal.MongoDatabase, envVar models.EnvVar) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == http.MethodOptions {
+				next.ServeHTTP(w, req)
+				return
+			}
+			tenant, err := resolveTenant(req, envVar)
+			if err != nil {
+				server.HttpError(w, err)
+				return
+			}
+			if tenant == "" {
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+			defer cancel()
+			exists, err := services.NewOrganizationService(ctx, database).Exists(tenant)
+			if err != nil {
+				server.HttpError(w, errors.New("unable to resolve organization. Please try again later"))
+				return
+			}
+			if !exists {
+				server.HttpError(w, services.ErrOrganizationNotFound)
+				return
+			}
+			next.ServeHTTP(w, server.WithTenant(req, tenant))
+		})
+	}
+}
+
+func resolveTenant(req *http.Request, envVar models.EnvVar) (string, error) {
+	var tenant string
+	candidates := []string{
+		subdomainTenant(req.Host, envVar.TenantBaseDomain),
+		strings.ToLower(strings.TrimSpace(req.Header.Get(TenantHeaderName))),
+		mux.Vars(req)["tenant"],
+	}
+	for _, candidate := range candidates {
+		if candidate == "" {
+			continue
+		}
+		if tenant != "" && tenant != candidate {
+			return "", errors.New(fmt.Sprintf("conflicting organizations %s and %s in request", tenant, candidate))
+		}
+		tenant = candidate
+	}
+	return tenant, nil
+}
+
+// subdomainTenant `acme` for host `acme.example.com` when baseDomain is `example.com`
+func subdomainTenant(host, baseDomain string) string {
+	if baseDomain == "" {
+		return ""
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(host)
+	subdomain, found := strings.CutSuffix(host, "."+strings.ToLower(baseDomain))
+	if !found || strings.Contains(subdomain, ".") {
+		return ""
+	}
+	return subdomain
+}
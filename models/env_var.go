@@ -8,14 +8,94 @@ type EnvVar struct {
 	MongoDbName,
 	BaseUrlPrefix,
 	JwtSecret,
+	JwtSigningAlg,
+	JwtPrivateKeyPath,
+	JwtKeyId,
+	JwtKeyRotationInterval,
+	JwtKeyGracePeriod,
+	JwtKeyEncryptionKey,
+	Issuer,
+	PublicBaseUrl,
+	BootstrapAdminEmail,
+	TenantBaseDomain,
+	RoleGrantApproverRole,
+	RoleGrantMaxDuration,
+	MfaIssuer,
+	WebAuthnRpId,
+	WebAuthnRpName,
+	WebAuthnRpOrigins,
+	EmailVerificationPolicy,
+	PasswordResetUrl,
+	MagicLinkUrl,
+	SmtpHost,
+	SmtpPort,
+	SmtpUsername,
+	SmtpPassword,
+	MailFrom,
+	MailOutboxDir,
+	RateLimit,
+	RateLimitStore,
+	TrustedProxies,
+	PasswordMinLength,
+	PasswordMaxLength,
+	PasswordRequiredClasses,
+	PasswordHistory,
+	PasswordMaxAge,
+	PasswordBreachedList,
+	PasswordHashAlgorithm,
+	PasswordBcryptCost,
+	PasswordArgon2Memory,
+	PasswordArgon2Iterations,
+	PasswordArgon2Parallelism,
 	Value string
 }
 
 func LoadEnvironmentVariables() EnvVar {
 	return EnvVar{
-		HttpPort:      os.Getenv("HTTP_PORT"),
-		MongoDbUri:    os.Getenv("MONGO_DB_URI"),
-		MongoDbName:   os.Getenv("MONGO_DB_NAME"),
-		BaseUrlPrefix: os.Getenv("BASE_URI_PREFIX"),
+		HttpPort:                os.Getenv("HTTP_PORT"),
+		MongoDbUri:              os.Getenv("MONGO_DB_URI"),
+		MongoDbName:             os.Getenv("MONGO_DB_NAME"),
+		BaseUrlPrefix:           os.Getenv("BASE_URI_PREFIX"),
+		JwtSecret:               os.Getenv("JWT_SECRET"),
+		JwtSigningAlg:           os.Getenv("JWT_SIGNING_ALG"),
+		JwtPrivateKeyPath:       os.Getenv("JWT_PRIVATE_KEY_PATH"),
+		JwtKeyId:                os.Getenv("JWT_KEY_ID"),
+		JwtKeyRotationInterval:  os.Getenv("JWT_KEY_ROTATION_INTERVAL"),
+		JwtKeyGracePeriod:       os.Getenv("JWT_KEY_GRACE_PERIOD"),
+		JwtKeyEncryptionKey:     os.Getenv("JWT_KEY_ENCRYPTION_KEY"),
+		Issuer:                  os.Getenv("ISSUER_URL"),
+		PublicBaseUrl:           os.Getenv("PUBLIC_BASE_URL"),
+		BootstrapAdminEmail:     os.Getenv("BOOTSTRAP_ADMIN_EMAIL"),
+		TenantBaseDomain:        os.Getenv("TENANT_BASE_DOMAIN"),
+		RoleGrantApproverRole:   os.Getenv("ROLE_GRANT_APPROVER_ROLE"),
+		RoleGrantMaxDuration:    os.Getenv("ROLE_GRANT_MAX_DURATION"),
+		MfaIssuer:               os.Getenv("MFA_ISSUER"),
+		WebAuthnRpId:            os.Getenv("WEBAUTHN_RP_ID"),
+		WebAuthnRpName:          os.Getenv("WEBAUTHN_RP_NAME"),
+		WebAuthnRpOrigins:       os.Getenv("WEBAUTHN_RP_ORIGINS"),
+		EmailVerificationPolicy: os.Getenv("EMAIL_VERIFICATION_POLICY"),
+		PasswordResetUrl:        os.Getenv("PASSWORD_RESET_URL"),
+		MagicLinkUrl:            os.Getenv("MAGIC_LINK_URL"),
+		SmtpHost:                os.Getenv("SMTP_HOST"),
+		SmtpPort:                os.Getenv("SMTP_PORT"),
+		SmtpUsername:            os.Getenv("SMTP_USERNAME"),
+		SmtpPassword:            os.Getenv("SMTP_PASSWORD"),
+		MailFrom:                os.Getenv("MAIL_FROM"),
+		MailOutboxDir:           os.Getenv("MAIL_OUTBOX_DIR"),
+		RateLimit:               os.Getenv("RATE_LIMIT"),
+		RateLimitStore:          os.Getenv("RATE_LIMIT_STORE"),
+		TrustedProxies:          os.Getenv("TRUSTED_PROXIES"),
+		PasswordMinLength:       os.Getenv("PASSWORD_MIN_LENGTH"),
+		PasswordMaxLength:       os.Getenv("PASSWORD_MAX_LENGTH"),
+		PasswordRequiredClasses: os.Getenv("PASSWORD_REQUIRED_CLASSES"),
+		PasswordHistory:         os.Getenv("PASSWORD_HISTORY"),
+		PasswordMaxAge:          os.Getenv("PASSWORD_MAX_AGE"),
+		PasswordBreachedList:    os.Getenv("PASSWORD_BREACHED_LIST"),
+
+		PasswordHashAlgorithm:     os.Getenv("PASSWORD_HASH_ALGORITHM"),
+		PasswordBcryptCost:        os.Getenv("PASSWORD_BCRYPT_COST"),
+		PasswordArgon2Memory:      os.Getenv("PASSWORD_ARGON2_MEMORY"),
+		PasswordArgon2Iterations:  os.Getenv("PASSWORD_ARGON2_ITERATIONS"),
+		PasswordArgon2Parallelism: os.Getenv("PASSWORD_ARGON2_PARALLELISM"),
 	}
 }
@@ -7,7 +7,7 @@ import (
 
 type (
 	BaseModel struct {
-		ID        primitive.ObjectID `json:"id"` //ID Generated by Mongo driver
+		ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"` //ID Generated by Mongo driver
 		CreatedAt time.Time          `bson:"created_at" json:"created_at"`
 		UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
 		DeletedAt time.Time          `bson:"deleted_at" json:"deleted_at,omitempty"`
@@ -26,13 +26,246 @@ type (
 		DateOfBirth         time.Time `bson:"date_of_birth,omitempty" json:"date_of_birth,omitempty"`
 		Roles               []string  `bson:"roles,omitempty" json:"roles"`
 		Address             Address   `bson:"address,inline,omitempty" json:"address,omitempty"`
+		EmailVerified       bool      `bson:"email_verified" json:"email_verified"`
+		// PasswordChangedAt when the password was last set, from which PASSWORD_MAX_AGE counts
+		PasswordChangedAt time.Time `bson:"password_changed_at,omitempty" json:"-"`
+		// PasswordHistory hashes of the passwords replaced most recently, latest first
+		PasswordHistory []string `bson:"password_history,omitempty" json:"-"`
+		// Locale language tag mails to the user are written in, e.g. `fr`. Taken from Accept-Language at sign up
+		Locale string `bson:"locale,omitempty" json:"locale,omitempty" validate:"omitempty,bcp47_language_tag"`
+		// Memberships organizations the user belongs to, with the roles held in each
+		Memberships []Membership `bson:"memberships,omitempty" json:"memberships,omitempty"`
+		Mfa         *Mfa         `bson:"mfa,omitempty" json:"-"`
+		// WebAuthnCredentials passkeys and security keys the user signs in with
+		WebAuthnCredentials []WebAuthnCredential `bson:"webauthn_credentials,omitempty" json:"-"`
+	}
+	// WebAuthnCredential public key credential registered through a WebAuthn ceremony
+	WebAuthnCredential struct {
+		Id              []byte     `bson:"id"`
+		Name            string     `bson:"name,omitempty"` //chosen by the user, e.g. "work laptop"
+		PublicKey       []byte     `bson:"public_key"`     //COSE encoded
+		AttestationType string     `bson:"attestation_type,omitempty"`
+		Transports      []string   `bson:"transports,omitempty"`
+		Aaguid          []byte     `bson:"aaguid,omitempty"`
+		SignCount       uint32     `bson:"sign_count"`
+		UserVerified    bool       `bson:"user_verified"`
+		BackupEligible  bool       `bson:"backup_eligible"`
+		BackupState     bool       `bson:"backup_state"`
+		CreatedAt       time.Time  `bson:"created_at"`
+		LastUsedAt      *time.Time `bson:"last_used_at,omitempty"`
+	}
+	// WebAuthnSession challenge of a WebAuthn ceremony in progress, redeemed once by the ceremony's second step
+	WebAuthnSession struct {
+		BaseModel   `bson:"-,inline"`
+		SessionHash string             `bson:"session_hash"`
+		Ceremony    string             `bson:"ceremony"`
+		UserId      primitive.ObjectID `bson:"user_id,omitempty"` //empty for a passkey login, where the user is not known yet
+		Data        []byte             `bson:"data"`              //JSON encoded webauthn.SessionData
+		ExpiresAt   time.Time          `bson:"expires_at"`
+	}
+	// MailMessage mail waiting in the `mail_queue` collection to be delivered, or delivered. A failed attempt is
+	// retried at NextAttemptAt, with a growing delay, until the message is sent or gives up as failed. Text and Html
+	// are removed once sent
+	MailMessage struct {
+		BaseModel     `bson:"-,inline"`
+		To            string     `bson:"to"`
+		Subject       string     `bson:"subject"`
+		Text          string     `bson:"text"`
+		Html          string     `bson:"html,omitempty"`
+		Status        string     `bson:"status"`
+		Attempts      int        `bson:"attempts"`
+		NextAttemptAt time.Time  `bson:"next_attempt_at"`
+		LastError     string     `bson:"last_error,omitempty"`
+		SentAt        *time.Time `bson:"sent_at,omitempty"`
+	}
+	// LoginThrottle failed sign in attempts of an account (`account:{email}`) or a source IP (`ip:{address}`).
+	// Failures reset after a day without any; past a threshold the key is locked until LockedUntil
+	LoginThrottle struct {
+		Key           string    `bson:"_id"`
+		Failures      int       `bson:"failures"`
+		LastFailureAt time.Time `bson:"last_failure_at"`
+		LockedUntil   time.Time `bson:"locked_until,omitempty"`
+	}
+	// RateLimitCounter requests counted against a rate limit for one caller. Tokens is the state of a token bucket,
+	// WindowStart, Count and Previous that of a sliding window. Allowed tells whether the last request was let through
+	RateLimitCounter struct {
+		Key         string    `bson:"_id"`
+		Tokens      float64   `bson:"tokens,omitempty"`
+		UpdatedAt   time.Time `bson:"updated_at,omitempty"`
+		WindowStart time.Time `bson:"window_start,omitempty"`
+		Count       int       `bson:"count,omitempty"`
+		Previous    int       `bson:"previous,omitempty"`
+		Allowed     bool      `bson:"allowed"`
+		ExpiresAt   time.Time `bson:"expires_at"`
+	}
+	// OneTimeToken single-use token emailed to a user, e.g. to verify their address. Only the hash of the signed
+	// token's `jti` is stored; ConsumedAt is set when it is redeemed or superseded by a newer one
+	OneTimeToken struct {
+		BaseModel  `bson:"-,inline"`
+		TokenHash  string             `bson:"token_hash"`
+		Purpose    string             `bson:"purpose"`
+		UserId     primitive.ObjectID `bson:"user_id"`
+		ExpiresAt  time.Time          `bson:"expires_at"`
+		ConsumedAt *time.Time         `bson:"consumed_at"`
+	}
+	// Mfa TOTP (RFC 6238) second factor of a user. Never serialised into tokens or responses
+	Mfa struct {
+		Enabled       bool       `bson:"enabled"`
+		Secret        string     `bson:"secret,omitempty"`         //base32 shared secret, set once enrollment is confirmed
+		PendingSecret string     `bson:"pending_secret,omitempty"` //secret awaiting its first code during enrollment
+		RecoveryCodes []string   `bson:"recovery_codes,omitempty"` //SHA-256 of the unused recovery codes
+		LastUsedStep  int64      `bson:"last_used_step"`           //time step of the last accepted code, so a code works once
+		EnabledAt     *time.Time `bson:"enabled_at,omitempty"`
+		// ChallengeId and ChallengeAttempts track the pending login challenge, which allows a few wrong codes only
+		ChallengeId       string `bson:"challenge_id,omitempty"`
+		ChallengeAttempts int    `bson:"challenge_attempts"`
+	}
+
+	// Organization tenant hosted on this deployment. Slug identifies it in subdomains, the X-Tenant-ID header,
+	// `{tenant}` path variables, the `tenant` claim and the `tenant_id` of tenant-scoped documents
+	Organization struct {
+		BaseModel `bson:"-,inline"`
+		Slug      string `bson:"slug" json:"slug" validate:"required"`
+		Name      string `bson:"name" json:"name" validate:"required"`
+	}
+	Membership struct {
+		Tenant string   `bson:"tenant" json:"tenant"`
+		Roles  []string `bson:"roles" json:"roles"`
 	}
 
 	Token struct {
+		BaseModel     `bson:"-,inline"`
+		AccessToken   string             `bson:"access_token" json:"access_token"`
+		RefreshToken  string             `bson:"refresh_token,omitempty" json:"-"` //Refresh token shouldn't be viewed on the client-side
+		UserId        primitive.ObjectID `bson:"user_id,omitempty" json:"-"`
+		AccessTokenId string             `bson:"access_token_id,omitempty" json:"-"` //jti of AccessToken
+		// FamilyId groups every refresh token rotated from the same login. Replaying a consumed one revokes the family
+		FamilyId   string     `bson:"family_id" json:"-"`
+		ExpiresAt  time.Time  `bson:"expires_at" json:"-"`
+		ConsumedAt *time.Time `bson:"consumed_at" json:"-"`
+		RevokedAt  *time.Time `bson:"revoked_at" json:"-"`
+		// Session details, carried over from one refresh token to the next within a family
+		UserAgent        string    `bson:"user_agent,omitempty" json:"-"`
+		ClientIp         string    `bson:"client_ip,omitempty" json:"-"`
+		SessionStartedAt time.Time `bson:"session_started_at" json:"-"`
+		LastUsedAt       time.Time `bson:"last_used_at" json:"-"`
+		// OAuth client and scope the tokens were issued to. Empty for first-party logins
+		ClientId string `bson:"client_id,omitempty" json:"-"`
+		Scope    string `bson:"scope,omitempty" json:"-"`
+		// Tenant the session was opened for. Empty for sessions outside any organization
+		Tenant string `bson:"tenant,omitempty" json:"-"`
+		// Amr authentication methods (RFC 8176) used at login, carried over on refresh. e.g. `pwd`, `otp`
+		Amr []string `bson:"amr,omitempty" json:"-"`
+		// ActorId admin the token was issued to while impersonating UserId. Empty for the user's own sessions
+		ActorId primitive.ObjectID `bson:"actor_id,omitempty" json:"-"`
+	}
+
+	// Client OAuth client registered to call the /oauth/* endpoints. The secret is only ever stored hashed.
+	// Public clients (SPAs, mobile apps) cannot keep a secret and must use PKCE instead
+	Client struct {
 		BaseModel    `bson:"-,inline"`
-		AccessToken  string `bson:"access_token" json:"access_token"`
-		RefreshToken string `bson:"refresh_token,omitempty" json:"-"` //Refresh token shouldn't be viewed on the client-side
+		ClientId     string   `bson:"client_id" json:"client_id"`
+		Name         string   `bson:"name" json:"name" validate:"required"`
+		SecretHash   string   `bson:"secret_hash,omitempty" json:"-"`
+		Public       bool     `bson:"public" json:"public"`
+		RedirectUris []string `bson:"redirect_uris" json:"redirect_uris" validate:"dive,url"`
+		// Machine identity of confidential clients using the client_credentials grant
+		AllowedScopes []string `bson:"allowed_scopes,omitempty" json:"allowed_scopes,omitempty"`
+		Roles         []string `bson:"roles,omitempty" json:"roles,omitempty"`
+	}
+
+	// AuthorizationCode single use code handed to the client's redirect URI by /oauth/authorize
+	AuthorizationCode struct {
+		BaseModel           `bson:"-,inline"`
+		CodeHash            string             `bson:"code_hash"`
+		ClientId            string             `bson:"client_id"`
+		UserId              primitive.ObjectID `bson:"user_id"`
+		RedirectUri         string             `bson:"redirect_uri"`
+		Scope               string             `bson:"scope"`
+		CodeChallenge       string             `bson:"code_challenge"`
+		CodeChallengeMethod string             `bson:"code_challenge_method"`
+		Nonce               string             `bson:"nonce,omitempty"`
+		AuthTime            time.Time          `bson:"auth_time"`
+		Amr                 []string           `bson:"amr,omitempty"`
+		ExpiresAt           time.Time          `bson:"expires_at"`
+		ConsumedAt          *time.Time         `bson:"consumed_at"`
+		FamilyId            string             `bson:"family_id,omitempty"` //session the code was exchanged for
 	}
+
+	// SigningKey JWT key persisted in the `signing_keys` collection so every instance shares the same key ring.
+	// PrivateKey holds a PKCS#8 PEM for asymmetric algorithms, or the base64 encoded secret for HMAC, encrypted with
+	// JWT_KEY_ENCRYPTION_KEY
+	SigningKey struct {
+		BaseModel   `bson:"-,inline"`
+		Kid         string    `bson:"kid" json:"kid"`
+		Algorithm   string    `bson:"algorithm" json:"algorithm"`
+		PrivateKey  string    `bson:"private_key" json:"-"`
+		Status      string    `bson:"status" json:"status"`
+		ActivatedAt time.Time `bson:"activated_at" json:"activated_at"`
+		RetiredAt   time.Time `bson:"retired_at,omitempty" json:"retired_at,omitempty"`
+	}
+
+	// Role named set of permissions, stored in the `roles` collection. A role also holds every permission of the
+	// roles it inherits, e.g. SUPERVISOR inherits SALES_PERSON
+	Role struct {
+		BaseModel   `bson:"-,inline"`
+		Name        string   `bson:"name" json:"name" validate:"required"`
+		Description string   `bson:"description,omitempty" json:"description,omitempty"`
+		Inherits    []string `bson:"inherits" json:"inherits"`
+		Permissions []string `bson:"permissions" json:"permissions"`
+		// RequireMfa holders of the role, or of a role inheriting it, must sign in with a second factor
+		RequireMfa bool `bson:"require_mfa" json:"require_mfa"`
+	}
+
+	// AuditLog security relevant event, stored in the `audit_logs` collection
+	AuditLog struct {
+		BaseModel `bson:"-,inline"`
+		Action    string                 `bson:"action" json:"action"`
+		ActorId   string                 `bson:"actor_id,omitempty" json:"actor_id,omitempty"` //user id, or client id for machine tokens
+		Outcome   string                 `bson:"outcome" json:"outcome"`
+		Reason    string                 `bson:"reason,omitempty" json:"reason,omitempty"`
+		Method    string                 `bson:"method,omitempty" json:"method,omitempty"`
+		Path      string                 `bson:"path,omitempty" json:"path,omitempty"`
+		ClientIp  string                 `bson:"client_ip,omitempty" json:"client_ip,omitempty"`
+		Details   map[string]interface{} `bson:"details,omitempty" json:"details,omitempty"`
+		TenantId  string                 `bson:"tenant_id,omitempty" json:"tenant_id,omitempty"`
+	}
+
+	// RoleGrant time-bound role assignment, stored in the `role_grants` collection. Either requested by the user and
+	// decided by an approver, or granted directly by an administrator. Active while approved and within its window
+	RoleGrant struct {
+		BaseModel     `bson:"-,inline"`
+		UserId        primitive.ObjectID `bson:"user_id" json:"user_id"`
+		Role          string             `bson:"role" json:"role" validate:"required"`
+		TenantId      string             `bson:"tenant_id" json:"tenant_id,omitempty"` //organization the role applies in. Empty for platform roles
+		NotBefore     time.Time          `bson:"not_before" json:"not_before"`
+		ExpiresAt     time.Time          `bson:"expires_at" json:"expires_at"`
+		Status        string             `bson:"status" json:"status"`
+		Justification string             `bson:"justification,omitempty" json:"justification,omitempty"`
+		DecidedBy     primitive.ObjectID `bson:"decided_by,omitempty" json:"decided_by,omitempty"`
+		DecidedAt     *time.Time         `bson:"decided_at,omitempty" json:"decided_at,omitempty"`
+		DecisionNote  string             `bson:"decision_note,omitempty" json:"decision_note,omitempty"`
+	}
+
+	// Permission action a Controller can require, stored in the `permissions` collection
+	Permission struct {
+		BaseModel   `bson:"-,inline"`
+		Name        string `bson:"name" json:"name" validate:"required"`
+		Description string `bson:"description,omitempty" json:"description,omitempty"`
+	}
+)
+
+const (
+	SigningKeyActive  = "active"
+	SigningKeyRetired = "retired"
+)
+
+const (
+	GrantPending  = "pending"
+	GrantApproved = "approved"
+	GrantDenied   = "denied"
+	GrantRevoked  = "revoked"
+	GrantExpired  = "expired"
 )
 
 func NewBaseModel() BaseModel {
@@ -0,0 +1,7 @@
+package repositories
+
+import "quickstart-go-jwt-mongodb/internal"
+
+func NewAuditLogRepository(mongoDb internal.MongoDatabase) CrudOperation {
+	return newCollectionRepo(mongoDb, "audit_logs")
+}
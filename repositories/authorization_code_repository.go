@@ -0,0 +1,7 @@
+package repositories
+
+import "quickstart-go-jwt-mongodb/internal"
+
+func NewAuthorizationCodeRepository(mongoDb internal.MongoDatabase) CrudOperation {
+	return newCollectionRepo(mongoDb, "authorization_codes")
+}
@@ -0,0 +1,7 @@
+package repositories
+
+import "quickstart-go-jwt-mongodb/internal"
+
+func NewClientRepository(mongoDb internal.MongoDatabase) CrudOperation {
+	return newCollectionRepo(mongoDb, "oauth_clients")
+}
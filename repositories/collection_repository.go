@@ -0,0 +1,106 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"quickstart-go-jwt-mongodb/internal"
+)
+
+// collectionRepo plain CrudOperation over a single collection, shared by repositories without custom behaviour
+type collectionRepo struct {
+	mongoDb    internal.MongoDatabase
+	collection string
+	sort       bson.D // order of FindPaginate pages. Natural order when nil
+}
+
+func newCollectionRepo(mongoDb internal.MongoDatabase, collection string) *collectionRepo {
+	return &collectionRepo{
+		mongoDb:    mongoDb,
+		collection: collection,
+	}
+}
+
+func (c *collectionRepo) FindPaginate(context context.Context, currentPage, perPage int, results interface{}, filters ...Filter) error {
+	if currentPage < 1 {
+		currentPage = 1
+	}
+	findOptions := options.Find().SetSkip(int64((currentPage - 1) * perPage)).SetLimit(int64(perPage))
+	if c.sort != nil {
+		findOptions.SetSort(c.sort)
+	}
+	find, err := c.mongoDb.Collection(c.collection).Find(context, filterToBsonFilter(filters...), findOptions)
+	if err != nil {
+		return err
+	}
+	return find.All(context, results)
+}
+
+func (c *collectionRepo) FindAll(context context.Context, results interface{}, filters ...Filter) error {
+	find, err := c.mongoDb.Collection(c.collection).Find(context, filterToBsonFilter(filters...))
+	if err != nil {
+		return err
+	}
+	return find.All(context, results)
+}
+
+func (c *collectionRepo) FindOne(context context.Context, model interface{}, filters ...Filter) bool {
+	singleResult := c.mongoDb.Collection(c.collection).FindOne(context, filterToBsonFilter(filters...))
+	err := singleResult.Decode(model)
+	if err != nil {
+		return false
+	}
+	return !errors.Is(singleResult.Err(), mongo.ErrNoDocuments)
+}
+
+func (c *collectionRepo) CreateOne(context context.Context, model interface{}) (primitive.ObjectID, error) {
+	id, err := c.mongoDb.Collection(c.collection).InsertOne(context, model)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return id.InsertedID.(primitive.ObjectID), nil
+}
+
+func (c *collectionRepo) CreateMany(context context.Context, model []interface{}) ([]primitive.ObjectID, error) {
+	result, err := c.mongoDb.Collection(c.collection).InsertMany(context, model)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, 0, len(result.InsertedIDs))
+	for i := range result.InsertedIDs {
+		ids = append(ids, result.InsertedIDs[i].(primitive.ObjectID))
+	}
+	return ids, nil
+}
+
+func (c *collectionRepo) UpdateOne(context context.Context, update interface{}, filters ...Filter) (int64, error) {
+	result, err := c.mongoDb.Collection(c.collection).UpdateOne(context, filterToBsonFilter(filters...), update)
+	if err != nil {
+		return 0, err
+	}
+	return result.MatchedCount, nil
+}
+
+func (c *collectionRepo) UpdateMany(context context.Context, update interface{}, filters ...Filter) (int64, error) {
+	result, err := c.mongoDb.Collection(c.collection).UpdateMany(context, filterToBsonFilter(filters...), update)
+	if err != nil {
+		return 0, err
+	}
+	return result.MatchedCount, nil
+}
+
+func (c *collectionRepo) UpsertOne(context context.Context, model interface{}, update interface{}, filters ...Filter) error {
+	upsertOptions := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	return c.mongoDb.Collection(c.collection).FindOneAndUpdate(context, filterToBsonFilter(filters...), update, upsertOptions).Decode(model)
+}
+
+func (c *collectionRepo) DeleteMany(context context.Context, filters ...Filter) (int64, error) {
+	result, err := c.mongoDb.Collection(c.collection).DeleteMany(context, filterToBsonFilter(filters...))
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
@@ -16,6 +16,14 @@ type CrudOperation interface {
 	FindOne(context context.Context, model interface{}, filters ...Filter) bool
 	FindAll(context context.Context, results interface{}, filters ...Filter) error
 	FindPaginate(context context.Context, currentPage, perPage int, results interface{}, filters ...Filter) error
+	// UpdateOne applies a MongoDB update document (e.g. bson.M{"$set": ...}) and returns the matched count
+	UpdateOne(context context.Context, update interface{}, filters ...Filter) (int64, error)
+	UpdateMany(context context.Context, update interface{}, filters ...Filter) (int64, error)
+	// UpsertOne applies update to the document matching filters, creating it from the filters' equality fields when
+	// there is none, and decodes the resulting document into model. Concurrent upserts may race to create the
+	// document: the loser gets a duplicate key error only when the collection has a unique index on the filters
+	UpsertOne(context context.Context, model interface{}, update interface{}, filters ...Filter) error
+	DeleteMany(context context.Context, filters ...Filter) (int64, error)
 }
 
 func filterToBsonFilter(filters ...Filter) bson.D {
@@ -0,0 +1,7 @@
+package repositories
+
+import "quickstart-go-jwt-mongodb/internal"
+
+func NewLoginThrottleRepository(mongoDb internal.MongoDatabase) CrudOperation {
+	return newCollectionRepo(mongoDb, "login_throttles")
+}
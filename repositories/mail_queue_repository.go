@@ -0,0 +1,7 @@
+package repositories
+
+import "quickstart-go-jwt-mongodb/internal"
+
+func NewMailQueueRepository(mongoDb internal.MongoDatabase) CrudOperation {
+	return newCollectionRepo(mongoDb, "mail_queue")
+}
@@ -0,0 +1,145 @@
+package repositories
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TenantKey field holding the tenant of tenant-scoped documents
+const TenantKey = "tenant_id"
+
+var ErrTenantRequired = errors.New("tenant is required")
+
+// tenantRepo confines a CrudOperation to a single tenant, or to the platform's own documents
+type tenantRepo struct {
+	repository CrudOperation
+	tenant     string
+	platform   bool // scoped to documents of no tenant, the empty `tenant_id`
+}
+
+// ForTenant confines repository to tenant: every query is ANDed with `tenant_id` and every created document is
+// stamped with it. Filters on `tenant_id` given by the caller are dropped so they can never widen the scope, and an
+// empty tenant fails every operation rather than falling back to unscoped queries
+func ForTenant(repository CrudOperation, tenant string) CrudOperation {
+	return &tenantRepo{
+		repository: repository,
+		tenant:     tenant,
+	}
+}
+
+// ForPlatform confines repository to the documents of no organization, those with an empty `tenant_id`, the same
+// way ForTenant confines it to one organization
+func ForPlatform(repository CrudOperation) CrudOperation {
+	return &tenantRepo{
+		repository: repository,
+		platform:   true,
+	}
+}
+
+func (t *tenantRepo) CreateOne(context context.Context, model interface{}) (primitive.ObjectID, error) {
+	document, err := t.stamp(model)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return t.repository.CreateOne(context, document)
+}
+
+func (t *tenantRepo) CreateMany(context context.Context, models []interface{}) ([]primitive.ObjectID, error) {
+	documents := make([]interface{}, 0, len(models))
+	for i := range models {
+		document, err := t.stamp(models[i])
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, document)
+	}
+	return t.repository.CreateMany(context, documents)
+}
+
+func (t *tenantRepo) FindOne(context context.Context, model interface{}, filters ...Filter) bool {
+	if t.unscoped() {
+		return false
+	}
+	return t.repository.FindOne(context, model, t.scope(filters)...)
+}
+
+func (t *tenantRepo) FindAll(context context.Context, results interface{}, filters ...Filter) error {
+	if t.unscoped() {
+		return ErrTenantRequired
+	}
+	return t.repository.FindAll(context, results, t.scope(filters)...)
+}
+
+func (t *tenantRepo) FindPaginate(context context.Context, currentPage, perPage int, results interface{}, filters ...Filter) error {
+	if t.unscoped() {
+		return ErrTenantRequired
+	}
+	return t.repository.FindPaginate(context, currentPage, perPage, results, t.scope(filters)...)
+}
+
+func (t *tenantRepo) UpdateOne(context context.Context, update interface{}, filters ...Filter) (int64, error) {
+	if t.unscoped() {
+		return 0, ErrTenantRequired
+	}
+	return t.repository.UpdateOne(context, update, t.scope(filters)...)
+}
+
+func (t *tenantRepo) UpdateMany(context context.Context, update interface{}, filters ...Filter) (int64, error) {
+	if t.unscoped() {
+		return 0, ErrTenantRequired
+	}
+	return t.repository.UpdateMany(context, update, t.scope(filters)...)
+}
+
+func (t *tenantRepo) UpsertOne(context context.Context, model interface{}, update interface{}, filters ...Filter) error {
+	if t.unscoped() {
+		return ErrTenantRequired
+	}
+	return t.repository.UpsertOne(context, model, update, t.scope(filters)...)
+}
+
+func (t *tenantRepo) DeleteMany(context context.Context, filters ...Filter) (int64, error) {
+	if t.unscoped() {
+		return 0, ErrTenantRequired
+	}
+	return t.repository.DeleteMany(context, t.scope(filters)...)
+}
+
+func (t *tenantRepo) scope(filters []Filter) []Filter {
+	scoped := make([]Filter, 0, len(filters)+1)
+	for i := range filters {
+		if filters[i].Key != TenantKey {
+			scoped = append(scoped, filters[i])
+		}
+	}
+	return append(scoped, Filter{Key: TenantKey, Value: t.tenant})
+}
+
+// unscoped whether no tenant was given to a repository meant for one
+func (t *tenantRepo) unscoped() bool {
+	return t.tenant == "" && !t.platform
+}
+
+// stamp converts model to a document carrying this repository's tenant, whatever tenant it claimed
+func (t *tenantRepo) stamp(model interface{}) (bson.D, error) {
+	if t.unscoped() {
+		return nil, ErrTenantRequired
+	}
+	raw, err := bson.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	var document bson.D
+	if err = bson.Unmarshal(raw, &document); err != nil {
+		return nil, err
+	}
+	stamped := make(bson.D, 0, len(document)+1)
+	for i := range document {
+		if document[i].Key != TenantKey {
+			stamped = append(stamped, document[i])
+		}
+	}
+	return append(stamped, bson.E{Key: TenantKey, Value: t.tenant}), nil
+}
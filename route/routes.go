@@ -2,21 +2,113 @@ package route
 
 import (
 	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
 	"quickstart-go-jwt-mongodb/controllers"
 	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
 	"quickstart-go-jwt-mongodb/server"
+	"quickstart-go-jwt-mongodb/services"
 )
 
 func Routes(httpHandler server.RequestHandler, database internal.MongoDatabase, ctx context.Context) {
+	services.RoleScopes = controllers.RoleScopes
+	if err := controllers.RegisterPolicies(); err != nil {
+		log.Fatalf("unable to register policies. %v", err)
+	}
 
 	httpHandler.ControllerRegistry(controllers.Homepage(ctx))
 	httpHandler.ControllerRegistry(controllers.HealthCheck(ctx))
+	httpHandler.ControllerRegistry(controllers.JsonWebKeySet(ctx))
+	httpHandler.ControllerRegistry(controllers.OpenIdConfiguration(ctx))
 
 	httpHandler.ControllerRegistry(controllers.Authenticate(database, ctx))
+	httpHandler.ControllerRegistry(controllers.AuthenticateMfa(database, ctx))
+	httpHandler.ControllerRegistry(controllers.RequestMagicLink(database, ctx))
+	httpHandler.ControllerRegistry(controllers.MagicLinkCallback(database, ctx))
 	httpHandler.ControllerRegistry(controllers.RefreshToken(database, ctx))
 	httpHandler.ControllerRegistry(controllers.CreateAccount(database, ctx))
+	httpHandler.ControllerRegistry(controllers.UpdateUser(database, ctx))
+	httpHandler.ControllerRegistry(controllers.VerifyEmail(database, ctx))
+	httpHandler.ControllerRegistry(controllers.ResendVerification(database, ctx))
+	httpHandler.ControllerRegistry(controllers.ForgotPassword(database, ctx))
+	httpHandler.ControllerRegistry(controllers.ResetPassword(database, ctx))
+	httpHandler.ControllerRegistry(controllers.ChangePassword(database, ctx))
+	httpHandler.ControllerRegistry(controllers.UnlockAccount(database, ctx))
+	httpHandler.ControllerRegistry(controllers.Logout(database, ctx))
+	httpHandler.ControllerRegistry(controllers.LogoutAll(database, ctx))
+	httpHandler.ControllerRegistry(controllers.ListSessions(database, ctx))
+	httpHandler.ControllerRegistry(controllers.ShowSession(database, ctx))
+	httpHandler.ControllerRegistry(controllers.RevokeSession(database, ctx))
+	httpHandler.ControllerRegistry(controllers.UserInfo(database, ctx))
+	httpHandler.ControllerRegistry(controllers.MfaStatus(database, ctx))
+	httpHandler.ControllerRegistry(controllers.EnrollMfa(database, ctx))
+	httpHandler.ControllerRegistry(controllers.ConfirmMfa(database, ctx))
+	httpHandler.ControllerRegistry(controllers.RegenerateRecoveryCodes(database, ctx))
+	httpHandler.ControllerRegistry(controllers.DisableMfa(database, ctx))
+	httpHandler.ControllerRegistry(controllers.BeginPasskeyRegistration(database, ctx))
+	httpHandler.ControllerRegistry(controllers.FinishPasskeyRegistration(database, ctx))
+	httpHandler.ControllerRegistry(controllers.ListPasskeys(database, ctx))
+	httpHandler.ControllerRegistry(controllers.RemovePasskey(database, ctx))
+	httpHandler.ControllerRegistry(controllers.BeginPasskeyLogin(database, ctx))
+	httpHandler.ControllerRegistry(controllers.FinishPasskeyLogin(database, ctx))
+
+	httpHandler.ControllerRegistry(controllers.RegisterClient(database, ctx))
+	httpHandler.ControllerRegistry(controllers.Authorize(database, ctx))
+	httpHandler.ControllerRegistry(controllers.AuthorizeDecision(database, ctx))
+	httpHandler.ControllerRegistry(controllers.OAuthToken(database, ctx))
+	httpHandler.ControllerRegistry(controllers.IntrospectToken(database, ctx))
+	httpHandler.ControllerRegistry(controllers.RevokeToken(database, ctx))
+
+	httpHandler.ControllerRegistry(controllers.ListRoles(database, ctx))
+	httpHandler.ControllerRegistry(controllers.CreateRole(database, ctx))
+	httpHandler.ControllerRegistry(controllers.AttachRolePermissions(database, ctx))
+	httpHandler.ControllerRegistry(controllers.DetachRolePermission(database, ctx))
+	httpHandler.ControllerRegistry(controllers.RequireRoleMfa(database, ctx))
+	httpHandler.ControllerRegistry(controllers.ListPermissions(database, ctx))
+	httpHandler.ControllerRegistry(controllers.CreatePermission(database, ctx))
+	httpHandler.ControllerRegistry(controllers.AssignUserRoles(database, ctx))
+	httpHandler.ControllerRegistry(controllers.UnassignUserRole(database, ctx))
+	httpHandler.ControllerRegistry(controllers.UnlockUser(database, ctx))
+
+	httpHandler.ControllerRegistry(controllers.CreateOrganization(database, ctx))
+	httpHandler.ControllerRegistry(controllers.ListOrganizations(database, ctx))
+	httpHandler.ControllerRegistry(controllers.AppointOrganizationMember(database, ctx))
+	httpHandler.ControllerRegistry(controllers.DismissOrganizationMember(database, ctx))
+	httpHandler.ControllerRegistry(controllers.ListMembers(database, ctx))
+	httpHandler.ControllerRegistry(controllers.SetMember(database, ctx))
+	httpHandler.ControllerRegistry(controllers.RemoveMember(database, ctx))
+	httpHandler.ControllerRegistry(controllers.ListMyOrganizations(database, ctx))
+	httpHandler.ControllerRegistry(controllers.RequestRole(database, ctx))
+	httpHandler.ControllerRegistry(controllers.ListMyRoleRequests(database, ctx))
+	httpHandler.ControllerRegistry(controllers.ListRoleRequests(database, ctx))
+	httpHandler.ControllerRegistry(controllers.ApproveRoleRequest(database, ctx))
+	httpHandler.ControllerRegistry(controllers.DenyRoleRequest(database, ctx))
+	httpHandler.ControllerRegistry(controllers.RevokeRoleGrant(database, ctx))
+	httpHandler.ControllerRegistry(controllers.ImpersonateUser(database, ctx))
 
 	httpHandler.ControllerRegistry(controllers.SecuredRole1Only(database, ctx))
 	httpHandler.ControllerRegistry(controllers.SecuredRole2Only(database, ctx))
 	httpHandler.ControllerRegistry(controllers.SecuredRole1And2Only(database, ctx))
+	httpHandler.ControllerRegistry(controllers.SecuredCustomersRead(database, ctx))
+	httpHandler.ControllerRegistry(controllers.SecuredReportsOrCustomersWrite(database, ctx))
+	httpHandler.ControllerRegistry(controllers.SecuredOfficeHours(database, ctx))
+}
+
+// SeedAuthorization creates the default roles and permissions missing from the database, and grants SUPERVISOR to
+// BOOTSTRAP_ADMIN_EMAIL so someone can reach the admin API
+func SeedAuthorization(ctx context.Context, database internal.MongoDatabase, envVar models.EnvVar) error {
+	rbacService := services.NewRbacService(ctx, database)
+	if err := rbacService.Seed(controllers.DefaultRoles, controllers.DefaultPermissions); err != nil {
+		return err
+	}
+	if envVar.BootstrapAdminEmail == "" {
+		return nil
+	}
+	err := rbacService.AssignRolesByEmail(envVar.BootstrapAdminEmail, []string{controllers.Role1})
+	if errors.Is(err, services.ErrUserNotFound) {
+		log.Warnf("bootstrap admin %s has no account yet. Restart once it has signed up", envVar.BootstrapAdminEmail)
+		return nil
+	}
+	return err
 }
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"quickstart-go-jwt-mongodb/models"
+)
+
+// Principal authenticated caller of a secured Controller, populated by the security middleware.
+// For machine tokens (client_credentials grant) User is empty and ClientId identifies the caller
+type Principal struct {
+	User     models.User
+	ClientId string
+	Roles    []string // effective roles, including the inherited ones
+	// Permissions granted by Roles
+	Permissions []string
+	Tenant      string // organization the token was issued for. Empty outside any organization
+	// ActorId admin acting as User, from the `act` claim of impersonation tokens. Empty unless impersonating
+	ActorId string
+	Claims  map[string]interface{}
+}
+
+type (
+	principalCtxKey struct{}
+	tenantCtxKey    struct{}
+)
+
+// WithPrincipal returns a shallow copy of req carrying the authenticated caller
+func WithPrincipal(req *http.Request, principal Principal) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), principalCtxKey{}, principal))
+}
+
+// CurrentPrincipal authenticated caller of a secured Controller. ok is false on non-secured controllers
+func CurrentPrincipal(req *http.Request) (Principal, bool) {
+	principal, ok := req.Context().Value(principalCtxKey{}).(Principal)
+	return principal, ok
+}
+
+// StringClaim claim value or "" when absent or not a string
+func (p Principal) StringClaim(name string) string {
+	value, _ := p.Claims[name].(string)
+	return value
+}
+
+// IsImpersonated reports whether an admin is acting as User
+func (p Principal) IsImpersonated() bool {
+	return p.ActorId != ""
+}
+
+// IsClient reports whether the caller is an OAuth client acting on its own behalf rather than a user
+func (p Principal) IsClient() bool {
+	return p.ClientId != "" && p.User.ID.IsZero()
+}
+
+// WithTenant returns a shallow copy of req scoped to the organization tenant
+func WithTenant(req *http.Request, tenant string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), tenantCtxKey{}, tenant))
+}
+
+// CurrentTenant organization the request is scoped to, resolved from the subdomain, the X-Tenant-ID header, the
+// `{tenant}` path variable or the caller's token. Empty outside any organization
+func CurrentTenant(req *http.Request) string {
+	tenant, _ := req.Context().Value(tenantCtxKey{}).(string)
+	return tenant
+}
@@ -7,21 +7,63 @@ import (
 	"github.com/go-playground/validator/v10"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
+	"math"
+	"net"
 	"net/http"
+	"net/netip"
 	"quickstart-go-jwt-mongodb/models"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type (
-	Verb    string
-	Request = http.Request
+	Verb string
+	// ScopeMatch how a Controller's RequiredScopes are matched against the token's `scope` claim
+	ScopeMatch string
+	// RateLimitKey whom a Controller's RateLimit counts requests of
+	RateLimitKey string
+	// RateLimitAlgorithm how a Controller's RateLimit spreads requests over its window
+	RateLimitAlgorithm string
+	Request            = http.Request
+	// RateLimit at most Requests per Window for each caller told apart by Key. The token bucket algorithm (the
+	// default) lets a caller spend Burst requests at once, Requests by default, refilled evenly over the Window; the
+	// sliding window algorithm never lets more than Requests through within any Window. No Requests means no limit
+	RateLimit struct {
+		Requests  int
+		Window    time.Duration
+		Burst     int
+		Key       RateLimitKey
+		Algorithm RateLimitAlgorithm
+	}
 	// Controller Declare how HTTP needs to be handled
 	Controller struct {
 		Uri         string
 		Method      Verb
 		Secure      bool
 		PermitRoles []string
-		Callback    func(w http.ResponseWriter, req *http.Request)
+		// RequiredPermissions permissions the caller's roles must grant, all of them. Roles inherit the permissions of
+		// the roles they extend
+		RequiredPermissions []string
+		// RequiredScopes scopes the access token must carry, checked in addition to PermitRoles.
+		// ScopeMatch selects whether all of them (the default) or any one of them is required
+		RequiredScopes []string
+		ScopeMatch     ScopeMatch
+		// Policy name of a policy registered with services.RegisterPolicy, evaluated after every other check.
+		// LoadResource optionally loads the resource the request targets so the policy can inspect it; return nil
+		// when it does not exist
+		Policy       string
+		LoadResource func(req *http.Request) (map[string]interface{}, error)
+		// ForbidImpersonation refuses impersonation tokens, for actions only the user themselves may take
+		ForbidImpersonation bool
+		// AllowWithoutMfa serves callers whose roles require MFA but who signed in without it, so they can enroll
+		AllowWithoutMfa bool
+		// AllowUnverifiedEmail serves users who have not verified their email yet when EMAIL_VERIFICATION_POLICY
+		// is `restrict`
+		AllowUnverifiedEmail bool
+		// RateLimit requests served to each caller, on top of the global per-IP RATE_LIMIT
+		RateLimit RateLimit
+		Callback  func(w http.ResponseWriter, req *http.Request)
 	}
 	ResponseBody struct {
 		IsError bool        `json:"is_error"`
@@ -53,6 +95,25 @@ const (
 	DELETE Verb = "DELETE"
 )
 
+const (
+	AllScopes ScopeMatch = ""
+	AnyScope  ScopeMatch = "any"
+)
+
+const (
+	// RateLimitByIp counts requests per client IP
+	RateLimitByIp RateLimitKey = ""
+	// RateLimitByUser counts requests per user of the access token, falling back to the client and then the IP
+	RateLimitByUser RateLimitKey = "user"
+	// RateLimitByClient counts requests per OAuth client of the access token, falling back to the IP
+	RateLimitByClient RateLimitKey = "client"
+)
+
+const (
+	TokenBucket   RateLimitAlgorithm = ""
+	SlidingWindow RateLimitAlgorithm = "sliding_window"
+)
+
 func NewHttpRequestHandler(httpTimeoutCtx context.Context, envVar models.EnvVar) RequestHandler {
 	return &Handler{
 		router:          mux.NewRouter().PathPrefix(envVar.BaseUrlPrefix).Subrouter(),
@@ -101,6 +162,79 @@ func ParseReqToJson(req *Request, obj interface{}) error {
 	return validator.New().Struct(obj)
 }
 
+// ClientIp originating address of the request. X-Forwarded-For and X-Real-IP are only honoured on requests from
+// TRUSTED_PROXIES: clients can send them too, and proxies append to X-Forwarded-For rather than replace it, so the
+// client is its right-most hop that is not a trusted proxy
+func ClientIp(req *Request) string {
+	remote := remoteIp(req)
+	proxies, _ := TrustedProxies(models.LoadEnvironmentVariables().TrustedProxies)
+	if !isTrustedProxy(proxies, remote) {
+		return remote
+	}
+	var hops []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) == 0 {
+		hops = req.Header.Values("X-Real-IP")
+	}
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// not written by a trusted proxy: the hops already read are all that can be relied upon
+			break
+		}
+		client = hop.Unmap().String()
+		if !isTrustedProxy(proxies, client) {
+			break
+		}
+	}
+	return client
+}
+
+// TrustedProxies parses TRUSTED_PROXIES, comma separated addresses and CIDR ranges of the reverse proxies in front of
+// the service
+func TrustedProxies(value string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, entry := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+func isTrustedProxy(proxies []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range proxies {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIp(req *Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.Unmap().String()
+	}
+	return host
+}
+
 func HttpResponse(w http.ResponseWriter, statusCode int, obj interface{}) {
 	err := json.NewEncoder(w).Encode(ResponseBody{
 		IsError: false,
@@ -113,6 +247,17 @@ func HttpResponse(w http.ResponseWriter, statusCode int, obj interface{}) {
 	w.WriteHeader(statusCode)
 }
 
+// JsonResponse writes obj as-is (without the ResponseBody envelope), for endpoints whose response format is fixed by a
+// standard such as OAuth 2.0 or OpenID Connect
+func JsonResponse(w http.ResponseWriter, statusCode int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	if json.NewEncoder(w).Encode(obj) != nil {
+		log.Error("error sending server response")
+	}
+}
+
 func HttpError(w http.ResponseWriter, err error) {
 	w.WriteHeader(http.StatusUnauthorized)
 	if json.NewEncoder(w).Encode(ResponseBody{
@@ -124,6 +269,40 @@ func HttpError(w http.ResponseWriter, err error) {
 	w.WriteHeader(http.StatusBadRequest)
 }
 
+// Forbidden the caller is authenticated but not allowed to perform the request
+func Forbidden(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusForbidden)
+	if json.NewEncoder(w).Encode(ResponseBody{
+		IsError: true,
+		Message: fmt.Sprintf("%s", err),
+	}) != nil {
+		log.Error("error sending server response")
+	}
+}
+
+// TooManyRequests the caller must wait retryAfter before trying again
+func TooManyRequests(w http.ResponseWriter, retryAfter time.Duration, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	if json.NewEncoder(w).Encode(ResponseBody{
+		IsError: true,
+		Message: fmt.Sprintf("%s", err),
+	}) != nil {
+		log.Error("error sending server response")
+	}
+}
+
+// ServiceUnavailable the request cannot be answered safely right now, e.g. the database is unreachable
+func ServiceUnavailable(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if json.NewEncoder(w).Encode(ResponseBody{
+		IsError: true,
+		Message: fmt.Sprintf("%s", err),
+	}) != nil {
+		log.Error("error sending server response")
+	}
+}
+
 func AccessDenied(w http.ResponseWriter, err error) {
 	w.WriteHeader(http.StatusUnauthorized)
 	if json.NewEncoder(w).Encode(ResponseBody{
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIp(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies string
+		remoteAddr     string
+		forwardedFor   []string
+		realIp         string
+		want           string
+	}{
+		{"no trusted proxy", "", "198.51.100.1:5000", []string{"203.0.113.7"}, "203.0.113.9", "198.51.100.1"},
+		{"untrusted peer", "10.0.0.0/8", "198.51.100.1:5000", []string{"203.0.113.7"}, "", "198.51.100.1"},
+		{"forged first hop", "10.0.0.0/8", "10.0.0.5:5000", []string{"192.0.2.1, 203.0.113.7"}, "", "203.0.113.7"},
+		{"chain of proxies", "10.0.0.0/8, 192.0.2.10", "10.0.0.5:5000", []string{"203.0.113.7, 192.0.2.10, 10.1.1.1"}, "", "203.0.113.7"},
+		{"repeated headers", "10.0.0.0/8", "10.0.0.5:5000", []string{"192.0.2.1", "203.0.113.7"}, "", "203.0.113.7"},
+		{"only proxies", "10.0.0.0/8", "10.0.0.5:5000", []string{"10.2.2.2, 10.1.1.1"}, "", "10.2.2.2"},
+		{"hop that is no address", "10.0.0.0/8", "10.0.0.5:5000", []string{"203.0.113.7, unknown"}, "", "10.0.0.5"},
+		{"real ip header", "10.0.0.5", "10.0.0.5:5000", nil, "203.0.113.7", "203.0.113.7"},
+		{"no forwarding header", "10.0.0.0/8", "10.0.0.5:5000", nil, "", "10.0.0.5"},
+		{"ipv6 proxy", "2001:db8::/32", "[2001:db8::1]:443", []string{"2001:db8:ffff::1, 203.0.113.7"}, "", "203.0.113.7"},
+		{"ipv4 mapped peer", "10.0.0.0/8", "[::ffff:10.0.0.5]:443", []string{"203.0.113.7"}, "", "203.0.113.7"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("TRUSTED_PROXIES", test.trustedProxies)
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = test.remoteAddr
+			for _, forwardedFor := range test.forwardedFor {
+				req.Header.Add("X-Forwarded-For", forwardedFor)
+			}
+			if test.realIp != "" {
+				req.Header.Set("X-Real-IP", test.realIp)
+			}
+			if ip := ClientIp(req); ip != test.want {
+				t.Fatalf("client ip %s, want %s", ip, test.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	proxies, err := TrustedProxies("10.0.0.0/8, 192.0.2.10 2001:db8::/32")
+	if err != nil || len(proxies) != 3 {
+		t.Fatalf("parsed %v (%v), want 3 ranges", proxies, err)
+	}
+	for _, invalid := range []string{"10.0.0.0/33", "proxy.internal", "10.0.0"} {
+		if _, err = TrustedProxies(invalid); err == nil {
+			t.Errorf("%q accepted", invalid)
+		}
+	}
+}
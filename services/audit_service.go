@@ -0,0 +1,50 @@
+package services
+
+import (
+	"context"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	AuditAllowed = "allowed"
+	AuditDenied  = "denied"
+)
+
+type auditService struct {
+	ctx                context.Context
+	auditLogRepository repositories.CrudOperation
+}
+
+func NewAuditService(ctx context.Context, database internal.MongoDatabase) *auditService {
+	return &auditService{
+		ctx:                ctx,
+		auditLogRepository: repositories.NewAuditLogRepository(database),
+	}
+}
+
+// Record writes entry. Entries of an organization (TenantId) are kept in that tenant's scope
+func (a *auditService) Record(entry models.AuditLog) error {
+	entry.BaseModel = models.NewBaseModel()
+	repository := a.auditLogRepository
+	if entry.TenantId != "" {
+		repository = repositories.ForTenant(repository, entry.TenantId)
+	}
+	_, err := repository.CreateOne(a.ctx, entry)
+	return err
+}
+
+// AuditInBackground records entry without holding up the request being served. Failures are logged
+func AuditInBackground(database internal.MongoDatabase, entry models.AuditLog) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := NewAuditService(ctx, database).Record(entry); err != nil {
+			log.Error("unable to write audit log", err)
+		}
+	}()
+}
@@ -0,0 +1,114 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type authorizationCodeService struct {
+	ctx            context.Context
+	codeRepository repositories.CrudOperation
+	sessions       *sessionService
+}
+
+const (
+	authorizationCodeLifetime = 10 * time.Minute
+	PkceMethodS256            = "S256"
+)
+
+var (
+	ErrInvalidGrant = errors.New("authorization code is invalid, expired or already used")
+	// RFC 7636 section 4.1
+	codeVerifierPattern = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+)
+
+func NewAuthorizationCodeService(ctx context.Context, database internal.MongoDatabase) *authorizationCodeService {
+	return &authorizationCodeService{
+		ctx:            ctx,
+		codeRepository: repositories.NewAuthorizationCodeRepository(database),
+		sessions:       NewSessionService(ctx, database),
+	}
+}
+
+// Create stores the code hashed and returns the plain code for the redirect
+func (a *authorizationCodeService) Create(code models.AuthorizationCode) (string, error) {
+	plain := RandomToken(32)
+	code.BaseModel = models.NewBaseModel()
+	code.CodeHash = HashToken(plain)
+	code.ExpiresAt = time.Now().Add(authorizationCodeLifetime)
+	if _, err := a.codeRepository.CreateOne(a.ctx, code); err != nil {
+		return "", err
+	}
+	return plain, nil
+}
+
+// Consume redeems a code for the client. A code can only be redeemed once; redeeming it again revokes the session
+// it was first exchanged for (RFC 6749 section 4.1.2)
+func (a *authorizationCodeService) Consume(plain, clientId, redirectUri, codeVerifier string) (models.AuthorizationCode, error) {
+	var code models.AuthorizationCode
+	if plain == "" || !a.codeRepository.FindOne(a.ctx, &code, repositories.Filter{Key: "code_hash", Value: HashToken(plain)}) {
+		return code, ErrInvalidGrant
+	}
+	now := time.Now()
+	matched, err := a.codeRepository.UpdateOne(a.ctx,
+		bson.M{"$set": bson.M{"consumed_at": now, "updated_at": now}},
+		repositories.Filter{Key: "_id", Value: code.ID},
+		repositories.Filter{Key: "consumed_at", Value: nil},
+	)
+	if err != nil {
+		return code, err
+	}
+	if matched == 0 {
+		log.Warnf("authorization code replayed by client %s", clientId)
+		if code.FamilyId != "" {
+			if err = a.sessions.RevokeFamily(code.FamilyId); err != nil {
+				log.Error("unable to revoke session of replayed authorization code", err)
+			}
+		}
+		return code, ErrInvalidGrant
+	}
+	if now.After(code.ExpiresAt) || code.ClientId != clientId || code.RedirectUri != redirectUri {
+		return code, ErrInvalidGrant
+	}
+	if !VerifyPkce(code.CodeChallenge, code.CodeChallengeMethod, codeVerifier) {
+		return code, errors.New("code_verifier does not match the code_challenge")
+	}
+	return code, nil
+}
+
+// Bind records the session a code was exchanged for, so a replay of the code can revoke it
+func (a *authorizationCodeService) Bind(code models.AuthorizationCode, familyId string) error {
+	_, err := a.codeRepository.UpdateOne(a.ctx,
+		bson.M{"$set": bson.M{"family_id": familyId}},
+		repositories.Filter{Key: "_id", Value: code.ID},
+	)
+	return err
+}
+
+// VerifyPkce RFC 7636 S256 check. The plain method is deliberately not supported
+func VerifyPkce(codeChallenge, method, codeVerifier string) bool {
+	if method != PkceMethodS256 || codeChallenge == "" || !codeVerifierPattern.MatchString(codeVerifier) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(codeVerifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(codeChallenge)) == 1
+}
+
+// HashToken digest used to store bearer secrets (codes, reset tokens, ...) so a database leak does not expose them
+func HashToken(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
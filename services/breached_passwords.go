@@ -0,0 +1,94 @@
+package services
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// sha1PrefixLength hex characters of the SHA-1 hash naming a range of the Pwned Passwords k-anonymity model
+const sha1PrefixLength = 5
+
+var (
+	breachedHashesMu sync.Mutex
+	// breachedHashes full hash lists loaded from files, by path
+	breachedHashes = map[string]map[string]struct{}{}
+)
+
+// passwordBreached looks the SHA-1 hash of password up in list, a Pwned Passwords download kept on disk so passwords
+// never leave the server. list is either a directory of range files, `{PREFIX}.txt` holding the `SUFFIX:COUNT`
+// lines the range API would answer for the first 5 hex characters of a hash, or a single file of `HASH[:COUNT]`
+// lines, loaded in memory on first use
+func passwordBreached(list, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	info, err := os.Stat(list)
+	if err != nil {
+		return false, err
+	}
+	if !info.IsDir() {
+		hashes, err := loadBreachedHashes(list)
+		if err != nil {
+			return false, err
+		}
+		_, found := hashes[hash]
+		return found, nil
+	}
+
+	rangeFile, err := os.Open(filepath.Join(list, hash[:sha1PrefixLength]+".txt"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer rangeFile.Close()
+	found := false
+	err = scanBreachedHashes(rangeFile, func(suffix string) bool {
+		found = suffix == hash[sha1PrefixLength:]
+		return !found
+	})
+	return found, err
+}
+
+func loadBreachedHashes(path string) (map[string]struct{}, error) {
+	breachedHashesMu.Lock()
+	defer breachedHashesMu.Unlock()
+	if hashes, ok := breachedHashes[path]; ok {
+		return hashes, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hashes := map[string]struct{}{}
+	if err = scanBreachedHashes(file, func(hash string) bool {
+		hashes[hash] = struct{}{}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+	breachedHashes[path] = hashes
+	return hashes, nil
+}
+
+// scanBreachedHashes calls yield with the uppercased hash of every `HASH[:COUNT]` line of reader until it returns false
+func scanBreachedHashes(reader io.Reader, yield func(hash string) bool) error {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		hash, _, _ := strings.Cut(scanner.Text(), ":")
+		if hash = strings.ToUpper(strings.TrimSpace(hash)); hash != "" && !yield(hash) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type clientService struct {
+	ctx              context.Context
+	rbac             *rbacService
+	clientRepository repositories.CrudOperation
+}
+
+const (
+	// ClaimGrantType marks tokens issued to a client acting on its own behalf; their `sub` is the client id
+	ClaimGrantType         = "gty"
+	GrantClientCredentials = "client_credentials"
+)
+
+var (
+	ErrInvalidClient = errors.New("invalid client credentials")
+	ErrInvalidScope  = errors.New("requested scope exceeds the scopes allowed for this client")
+)
+
+// dummyClientSecretHash keeps the time taken to reject an unknown client id equal to a wrong secret
+var dummyClientSecretHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-client-secret"), bcrypt.DefaultCost)
+
+func NewClientService(ctx context.Context, database internal.MongoDatabase) *clientService {
+	return &clientService{
+		ctx:              ctx,
+		rbac:             NewRbacService(ctx, database),
+		clientRepository: repositories.NewClientRepository(database),
+	}
+}
+
+// Register creates a client and returns its plain text secret, which cannot be recovered afterwards.
+// Public clients get no secret. The roles the client acts with must exist in the `roles` collection
+func (c *clientService) Register(client models.Client) (models.Client, string, error) {
+	if err := c.rbac.rolesExist(client.Roles); err != nil {
+		return client, "", err
+	}
+	var secret string
+	client.BaseModel = models.NewBaseModel()
+	client.ClientId = RandomToken(16)
+	client.SecretHash = ""
+	if !client.Public {
+		secret = RandomToken(32)
+		hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+		if err != nil {
+			return client, "", err
+		}
+		client.SecretHash = string(hash)
+	}
+	id, err := c.clientRepository.CreateOne(c.ctx, client)
+	if err != nil {
+		return client, "", err
+	}
+	client.ID = id
+	return client, secret, nil
+}
+
+// Find looks a client up by its public client id
+func (c *clientService) Find(clientId string) (models.Client, bool) {
+	var client models.Client
+	if clientId == "" {
+		return client, false
+	}
+	return client, c.clientRepository.FindOne(c.ctx, &client, repositories.Filter{Key: "client_id", Value: clientId})
+}
+
+// Authenticate verifies a confidential client's id and secret
+func (c *clientService) Authenticate(clientId, secret string) (models.Client, error) {
+	client, found := c.Find(clientId)
+	if !found || client.SecretHash == "" {
+		_ = bcrypt.CompareHashAndPassword(dummyClientSecretHash, []byte(secret))
+		return models.Client{}, ErrInvalidClient
+	}
+	if bcrypt.CompareHashAndPassword([]byte(client.SecretHash), []byte(secret)) != nil {
+		return models.Client{}, ErrInvalidClient
+	}
+	return client, nil
+}
+
+// ValidRedirectUri redirect URIs must exactly match one registered for the client (RFC 6749 section 3.1.2.3)
+func ValidRedirectUri(client models.Client, redirectUri string) bool {
+	return redirectUri != "" && slices.Contains(client.RedirectUris, redirectUri)
+}
+
+// GrantedScopes validates the space-delimited scope requested by a client against its allowed scopes.
+// An empty request is granted every allowed scope
+func GrantedScopes(client models.Client, requested string) ([]string, error) {
+	if strings.TrimSpace(requested) == "" {
+		return client.AllowedScopes, nil
+	}
+	scopes := strings.Fields(requested)
+	for i := range scopes {
+		if !slices.Contains(client.AllowedScopes, scopes[i]) {
+			return nil, ErrInvalidScope
+		}
+	}
+	return scopes, nil
+}
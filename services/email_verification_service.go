@@ -0,0 +1,107 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type emailVerificationService struct {
+	ctx            context.Context
+	mailer         Mailer
+	tokens         *oneTimeTokenService
+	userRepository repositories.CrudOperation
+}
+
+const (
+	// EmailVerificationOff, EmailVerificationRestrict and EmailVerificationRefuse values of EMAIL_VERIFICATION_POLICY:
+	// how Authenticate treats users who have not verified their email yet. Restricted users sign in, but only reach
+	// controllers setting AllowUnverifiedEmail; refused users cannot sign in with their password at all
+	EmailVerificationOff      = "off"
+	EmailVerificationRestrict = "restrict"
+	EmailVerificationRefuse   = "refuse"
+
+	// TokenTypeEmailVerification `typ` of the token emailed to verify an address
+	TokenTypeEmailVerification = "email_verification"
+
+	emailVerificationLifetime = 24 * time.Hour
+)
+
+var ErrEmailNotVerified = errors.New("email address not verified. Follow the link emailed to you, or ask for another one on /account/verify/resend")
+
+func NewEmailVerificationService(ctx context.Context, database internal.MongoDatabase, envVar models.EnvVar) *emailVerificationService {
+	return &emailVerificationService{
+		ctx:            ctx,
+		mailer:         NewMailer(database),
+		tokens:         NewOneTimeTokenService(ctx, database, NewJwtService(ctx, envVar)),
+		userRepository: repositories.NewUserRepository(database),
+	}
+}
+
+// EmailVerificationPolicy policy named by value, EMAIL_VERIFICATION_POLICY. Unset or unknown values turn it off, as
+// accounts created before verification existed are all unverified
+func EmailVerificationPolicy(value string) string {
+	switch policy := strings.ToLower(strings.TrimSpace(value)); policy {
+	case EmailVerificationRestrict, EmailVerificationRefuse:
+		return policy
+	default:
+		return EmailVerificationOff
+	}
+}
+
+// Send emails user a link to verifyUrl carrying a new verification token
+func (e *emailVerificationService) Send(user models.User, verifyUrl string) error {
+	token, err := e.tokens.Issue(TokenTypeEmailVerification, user.ID, emailVerificationLifetime)
+	if err != nil {
+		return err
+	}
+	mail, err := RenderMail(MailEmailVerification, user.Locale, MailData{
+		Name:     user.FirstName,
+		Link:     verifyUrl + "?token=" + url.QueryEscape(token),
+		ValidFor: emailVerificationLifetime,
+	})
+	if err != nil {
+		return err
+	}
+	mail.To = user.Email
+	return e.mailer.Send(e.ctx, mail)
+}
+
+// Resend sends another link to the unverified account registered with email. Unknown and verified addresses are
+// ignored without error, and so are throttled requests, so the endpoint cannot be used to find out who has an account
+func (e *emailVerificationService) Resend(email, verifyUrl string) error {
+	var user models.User
+	if !e.userRepository.FindOne(e.ctx, &user, repositories.Filter{Key: "email", Value: email}) || user.EmailVerified {
+		return nil
+	}
+	if err := e.Send(user, verifyUrl); !errors.Is(err, ErrOneTimeTokenThrottled) {
+		return err
+	}
+	return nil
+}
+
+// Verify redeems token and marks the address it was sent to as verified
+func (e *emailVerificationService) Verify(token string) (models.User, error) {
+	var user models.User
+	userId, err := e.tokens.Consume(TokenTypeEmailVerification, token)
+	if err != nil {
+		return user, err
+	}
+	if _, err = e.userRepository.UpdateOne(e.ctx,
+		bson.M{"$set": bson.M{"email_verified": true, "updated_at": time.Now()}},
+		repositories.Filter{Key: "_id", Value: userId},
+	); err != nil {
+		return user, err
+	}
+	if !e.userRepository.FindOne(e.ctx, &user, repositories.Filter{Key: "_id", Value: userId}) {
+		return user, ErrUserNotFound
+	}
+	return user, nil
+}
@@ -0,0 +1,61 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type impersonationService struct {
+	ctx            context.Context
+	database       internal.MongoDatabase
+	userRepository repositories.CrudOperation
+}
+
+// ClaimActor RFC 8693 actor claim. Impersonation tokens name the admin acting as `sub` in it
+const ClaimActor = "act"
+
+var (
+	ErrImpersonateSelf       = errors.New("you cannot impersonate yourself")
+	ErrImpersonationEscalate = errors.New("you cannot impersonate a user holding permissions you do not have")
+)
+
+func NewImpersonationService(ctx context.Context, database internal.MongoDatabase) *impersonationService {
+	return &impersonationService{
+		ctx:            ctx,
+		database:       database,
+		userRepository: repositories.NewUserRepository(database),
+	}
+}
+
+// Target loads the user actorId wants to impersonate. Impersonating must never widen what the actor can do, so the
+// target's platform roles may not grant any permission outside actorPermissions
+func (i *impersonationService) Target(actorId, userId primitive.ObjectID, actorPermissions []string) (models.User, error) {
+	var user models.User
+	if actorId == userId {
+		return user, ErrImpersonateSelf
+	}
+	if !i.userRepository.FindOne(i.ctx, &user, repositories.Filter{Key: "_id", Value: userId}) {
+		return user, ErrUserNotFound
+	}
+	authorization, err := NewRbacService(i.ctx, i.database).Resolve(user.Roles)
+	if err != nil {
+		return user, err
+	}
+	for _, permission := range authorization.Permissions {
+		if !slices.Contains(actorPermissions, permission) {
+			return user, ErrImpersonationEscalate
+		}
+	}
+	return user, nil
+}
+
+// ActorClaim value of the `act` claim for an impersonation by actor
+func ActorClaim(actor models.User) map[string]any {
+	return map[string]any{"sub": actor.ID.Hex(), "email": actor.Email}
+}
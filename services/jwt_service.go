@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"quickstart-go-jwt-mongodb/models"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -13,38 +14,60 @@ import (
 )
 
 type jwtService struct {
-	ctx           context.Context
-	jwtSigningKey string
+	ctx     context.Context
+	keyRing *KeyRing
 }
 
-var (
-	JwtSigningAlg = jwt.SigningMethodHS256
-)
-
 func NewJwtService(ctx context.Context, envVar models.EnvVar) *jwtService {
+	ring, err := currentKeyRing(envVar)
+	if err != nil {
+		log.Error("unable to load jwt signing key", err)
+	}
 	return &jwtService{
-		ctx:           ctx,
-		jwtSigningKey: envVar.JwtSecret,
+		ctx:     ctx,
+		keyRing: ring,
 	}
 }
 
 // GenerateJWT to generate a JWT Payload
-// sub must not be a JSON string. This would be done by the GenerateJWT method
+// sub must not be a JSON string. This would be done by the GenerateJWT method.
+// Unless a `scope` claim is supplied, the scopes of the subject's roles are written (see RoleScopes)
 func (j *jwtService) GenerateJWT(sub interface{}, expiresAt time.Duration, extraClaims ...map[string]any) (string, error) {
-	token := jwt.New(JwtSigningAlg)
-	claims := token.Claims.(jwt.MapClaims)
-
 	marshal, err := json.Marshal(sub)
-	claims["sub"] = string(marshal)
-	claims["iat"] = jwt.NewNumericDate(time.Now())
-	claims["exp"] = jwt.NewNumericDate(time.Now().Add(expiresAt))
+	if err != nil {
+		log.Error("error encoding jwt subject", err)
+		return "", errors.New("error creating jwt token")
+	}
+	claims := jwt.MapClaims{
+		"sub": string(marshal),
+		"iat": jwt.NewNumericDate(time.Now()),
+		"exp": jwt.NewNumericDate(time.Now().Add(expiresAt)),
+		"jti": RandomToken(16),
+	}
 	for i := range extraClaims {
 		for k, v := range extraClaims[i] {
 			claims[k] = v
 		}
 	}
+	if _, ok := claims["scope"]; !ok {
+		if scopes := ScopesForRoles(subjectRoles(sub, claims)); len(scopes) > 0 {
+			claims["scope"] = strings.Join(scopes, " ")
+		}
+	}
+	return j.SignClaims(claims)
+}
+
+// SignClaims signs claims as they are with the active key. Used for tokens whose `sub` is not JSON encoded,
+// such as OpenID Connect ID tokens
+func (j *jwtService) SignClaims(claims jwt.MapClaims) (string, error) {
+	if j.keyRing == nil || j.keyRing.Active() == nil {
+		return "", errors.New("error creating jwt token. No signing key configured")
+	}
+	signingKey := j.keyRing.Active()
+	token := jwt.NewWithClaims(signingKey.Method, claims)
+	token.Header["kid"] = signingKey.Kid
 
-	tokenStr, err := token.SignedString([]byte(j.jwtSigningKey))
+	tokenStr, err := token.SignedString(signingKey.signingKey())
 
 	if err != nil {
 		log.Error("error creating jwt token", err)
@@ -53,18 +76,68 @@ func (j *jwtService) GenerateJWT(sub interface{}, expiresAt time.Duration, extra
 	return tokenStr, nil
 }
 
+// SigningAlgorithm algorithm of the active signing key
+func (j *jwtService) SigningAlgorithm() string {
+	if j.keyRing == nil || j.keyRing.Active() == nil {
+		return ""
+	}
+	return j.keyRing.Active().Method.Alg()
+}
+
 func (j *jwtService) ClaimToken(tokenizedString string, sub interface{}) (jwt.Claims, error) {
+	if j.keyRing == nil {
+		return nil, errors.New("no signing key configured")
+	}
 	jwtToken, err := jwt.Parse(tokenizedString, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("There was an error in parsing")
+		kid, _ := t.Header["kid"].(string)
+		key, ok := j.keyRing.Lookup(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %s", kid)
+		}
+		if t.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
 		}
-		return j.jwtSigningKey, nil
+		return key.verificationKey(), nil
 	})
+	if err != nil {
+		return nil, err
+	}
 	claims, ok := jwtToken.Claims.(jwt.MapClaims)
+	if !ok || !jwtToken.Valid {
+		return nil, errors.New("invalid jwt token")
+	}
 	subStr, err := claims.GetSubject()
-	err = json.Unmarshal([]byte(subStr), sub)
-	if ok && jwtToken.Valid {
-		return claims, nil
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal([]byte(subStr), sub); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// PublicKeys JWKS of the keys that can verify tokens issued by this service
+func (j *jwtService) PublicKeys() JsonWebKeySet {
+	var keySet = JsonWebKeySet{Keys: []JsonWebKey{}}
+	if j.keyRing == nil {
+		return keySet
+	}
+	for _, key := range j.keyRing.VerificationKeys() {
+		if jwk, ok := key.JWK(); ok {
+			keySet.Keys = append(keySet.Keys, jwk)
+		}
+	}
+	return keySet
+}
+
+// StringSliceClaim reads an array claim. JSON arrays decode as []interface{} in jwt.MapClaims
+func StringSliceClaim(claims jwt.MapClaims, name string) []string {
+	values, _ := claims[name].([]interface{})
+	var result []string
+	for i := range values {
+		if value, ok := values[i].(string); ok {
+			result = append(result, value)
+		}
 	}
-	return nil, err
+	return result
 }
@@ -0,0 +1,399 @@
+package services
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// KeyRing one active signing key plus the retired keys that can still verify tokens until their grace period ends.
+// A static ring (no repository) holds only the key configured through the environment and never rotates
+type KeyRing struct {
+	mu               sync.RWMutex
+	active           *SigningKey
+	activatedAt      time.Time
+	keys             map[string]*SigningKey
+	verifyUntil      map[string]time.Time
+	repository       repositories.CrudOperation
+	algorithm        string
+	rotationInterval time.Duration
+	gracePeriod      time.Duration
+	// keyEncryption AES-256-GCM cipher of JWT_KEY_ENCRYPTION_KEY, sealing private keys before they are stored
+	keyEncryption cipher.AEAD
+}
+
+const (
+	defaultKeyGracePeriod  = 48 * time.Hour
+	defaultRotationAlg     = "RS256"
+	keyRingRefreshInterval = time.Minute
+	// sealedKeyPrefix marks private keys stored encrypted, followed by the base64 nonce and ciphertext
+	sealedKeyPrefix = "aes256gcm:"
+
+	// RefreshTokenLifetime lifetime of first-party refresh tokens
+	RefreshTokenLifetime = 24 * time.Hour
+	// longestTokenLifetime longest lifetime of a token the ring signs. A shorter JWT_KEY_GRACE_PERIOD would purge
+	// retired keys while tokens they signed are still valid
+	longestTokenLifetime = max(RefreshTokenLifetime, emailVerificationLifetime, accountUnlockLifetime, passwordResetLifetime,
+		MagicLinkLifetime)
+)
+
+// errUnsealedKey private key stored before keys were encrypted
+var errUnsealedKey = errors.New("private key stored unencrypted")
+
+var (
+	keyRingMu sync.RWMutex
+	keyRing   *KeyRing
+)
+
+func NewStaticKeyRing(key *SigningKey) *KeyRing {
+	return &KeyRing{
+		active:      key,
+		activatedAt: time.Now(),
+		keys:        map[string]*SigningKey{key.Kid: key},
+		verifyUntil: map[string]time.Time{},
+	}
+}
+
+// StartKeyRing installs the process-wide key ring. When JWT_KEY_ROTATION_INTERVAL is set, keys are persisted in the
+// `signing_keys` collection, encrypted with JWT_KEY_ENCRYPTION_KEY, and rotated in the background until ctx is
+// cancelled. The key configured through the environment (if any) becomes the first active key, so tokens issued before
+// rotation was enabled stay valid
+func StartKeyRing(ctx context.Context, database internal.MongoDatabase, envVar models.EnvVar) (*KeyRing, error) {
+	bootstrapKey, bootstrapErr := LoadSigningKey(envVar)
+	if envVar.JwtKeyRotationInterval == "" {
+		if bootstrapErr != nil {
+			return nil, bootstrapErr
+		}
+		ring := NewStaticKeyRing(bootstrapKey)
+		setKeyRing(ring)
+		return ring, nil
+	}
+
+	rotationInterval, err := time.ParseDuration(envVar.JwtKeyRotationInterval)
+	if err != nil || rotationInterval <= 0 {
+		return nil, fmt.Errorf("invalid `JWT_KEY_ROTATION_INTERVAL` %q", envVar.JwtKeyRotationInterval)
+	}
+	gracePeriod := defaultKeyGracePeriod
+	if envVar.JwtKeyGracePeriod != "" {
+		gracePeriod, err = time.ParseDuration(envVar.JwtKeyGracePeriod)
+		if err != nil || gracePeriod < 0 {
+			return nil, fmt.Errorf("invalid `JWT_KEY_GRACE_PERIOD` %q", envVar.JwtKeyGracePeriod)
+		}
+	}
+	if gracePeriod < longestTokenLifetime {
+		return nil, fmt.Errorf("`JWT_KEY_GRACE_PERIOD` %s is shorter than the %s tokens live", gracePeriod, longestTokenLifetime)
+	}
+	keyEncryption, err := newKeyEncryption(envVar.JwtKeyEncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid `JWT_KEY_ENCRYPTION_KEY`. %v", err)
+	}
+	algorithm := envVar.JwtSigningAlg
+	if algorithm == "" && bootstrapKey != nil {
+		algorithm = bootstrapKey.Method.Alg()
+	}
+	if algorithm == "" {
+		algorithm = defaultRotationAlg
+	}
+
+	ring := &KeyRing{
+		keys:             map[string]*SigningKey{},
+		verifyUntil:      map[string]time.Time{},
+		repository:       repositories.NewSigningKeyRepository(database),
+		algorithm:        algorithm,
+		rotationInterval: rotationInterval,
+		gracePeriod:      gracePeriod,
+		keyEncryption:    keyEncryption,
+	}
+	if err = ring.refresh(ctx); err != nil {
+		return nil, err
+	}
+	if ring.Active() == nil {
+		if bootstrapKey != nil {
+			err = ring.persist(ctx, bootstrapKey)
+		} else {
+			err = ring.Rotate(ctx)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err = ring.refresh(ctx); err != nil {
+			return nil, err
+		}
+	}
+	setKeyRing(ring)
+	go ring.schedule(ctx)
+	return ring, nil
+}
+
+// currentKeyRing falls back to a static ring built from the environment when StartKeyRing has not been called
+func currentKeyRing(envVar models.EnvVar) (*KeyRing, error) {
+	keyRingMu.RLock()
+	ring := keyRing
+	keyRingMu.RUnlock()
+	if ring != nil {
+		return ring, nil
+	}
+	key, err := LoadSigningKey(envVar)
+	if err != nil {
+		return nil, err
+	}
+	ring = NewStaticKeyRing(key)
+	setKeyRing(ring)
+	return ring, nil
+}
+
+func setKeyRing(ring *KeyRing) {
+	keyRingMu.Lock()
+	defer keyRingMu.Unlock()
+	keyRing = ring
+}
+
+// Active key used to sign new tokens
+func (r *KeyRing) Active() *SigningKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.active
+}
+
+// Lookup verification key by `kid`. Tokens without a `kid` (issued before key ids were stamped) use the active key
+func (r *KeyRing) Lookup(kid string) (*SigningKey, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if kid == "" {
+		return r.active, r.active != nil
+	}
+	key, ok := r.keys[kid]
+	if !ok {
+		return nil, false
+	}
+	if until, retired := r.verifyUntil[kid]; retired && time.Now().After(until) {
+		return nil, false
+	}
+	return key, true
+}
+
+// VerificationKeys every key still able to verify tokens, active key first
+func (r *KeyRing) VerificationKeys() []*SigningKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var keys []*SigningKey
+	if r.active != nil {
+		keys = append(keys, r.active)
+	}
+	for kid, key := range r.keys {
+		if r.active != nil && kid == r.active.Kid {
+			continue
+		}
+		if until, retired := r.verifyUntil[kid]; retired && time.Now().After(until) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Rotate retires the active key and activates a freshly generated one. When several instances race, only the one that
+// flips the active key's status wins; the others pick the new key up on their next refresh
+func (r *KeyRing) Rotate(ctx context.Context) error {
+	if r.repository == nil {
+		return errors.New("static key ring cannot be rotated")
+	}
+	if current := r.Active(); current != nil {
+		now := time.Now()
+		matched, err := r.repository.UpdateOne(ctx,
+			bson.M{"$set": bson.M{"status": models.SigningKeyRetired, "retired_at": now, "updated_at": now}},
+			repositories.Filter{Key: "kid", Value: current.Kid},
+			repositories.Filter{Key: "status", Value: models.SigningKeyActive},
+		)
+		if err != nil {
+			return err
+		}
+		if matched == 0 {
+			return r.refresh(ctx)
+		}
+	}
+	key, err := GenerateSigningKey(r.algorithm)
+	if err != nil {
+		return err
+	}
+	if err = r.persist(ctx, key); err != nil {
+		return err
+	}
+	log.Infof("rotated jwt signing key. New active kid %s", key.Kid)
+	return r.refresh(ctx)
+}
+
+func (r *KeyRing) persist(ctx context.Context, key *SigningKey) error {
+	privateKey, err := key.MarshalPrivateKey()
+	if err != nil {
+		return err
+	}
+	sealed, err := r.sealPrivateKey(key.Kid, key.Method.Alg(), privateKey)
+	if err != nil {
+		return err
+	}
+	_, err = r.repository.CreateOne(ctx, models.SigningKey{
+		BaseModel:   models.NewBaseModel(),
+		Kid:         key.Kid,
+		Algorithm:   key.Method.Alg(),
+		PrivateKey:  sealed,
+		Status:      models.SigningKeyActive,
+		ActivatedAt: time.Now(),
+	})
+	return err
+}
+
+// refresh reloads the ring from Mongo and purges keys whose grace period has ended
+func (r *KeyRing) refresh(ctx context.Context) error {
+	graceCutoff := time.Now().Add(-r.gracePeriod)
+	if _, err := r.repository.DeleteMany(ctx,
+		repositories.Filter{Key: "status", Value: models.SigningKeyRetired},
+		repositories.Filter{Key: "retired_at", Value: bson.M{"$lt": graceCutoff}},
+	); err != nil {
+		log.Error("unable to purge expired jwt signing keys", err)
+	}
+
+	var records []models.SigningKey
+	if err := r.repository.FindAll(ctx, &records); err != nil {
+		return err
+	}
+	var (
+		active      *SigningKey
+		activatedAt time.Time
+		keys        = map[string]*SigningKey{}
+		verifyUntil = map[string]time.Time{}
+	)
+	for i := range records {
+		privateKey, err := r.openPrivateKey(records[i].Kid, records[i].Algorithm, records[i].PrivateKey)
+		if errors.Is(err, errUnsealedKey) {
+			privateKey, err = records[i].PrivateKey, nil
+			r.seal(ctx, records[i])
+		}
+		if err != nil {
+			log.Errorf("unable to decrypt jwt signing key %s. %v", records[i].Kid, err)
+			continue
+		}
+		key, err := UnmarshalSigningKey(records[i].Algorithm, records[i].Kid, privateKey)
+		if err != nil {
+			log.Errorf("unable to load jwt signing key %s. %v", records[i].Kid, err)
+			continue
+		}
+		keys[key.Kid] = key
+		if records[i].Status == models.SigningKeyRetired {
+			verifyUntil[key.Kid] = records[i].RetiredAt.Add(r.gracePeriod)
+			continue
+		}
+		if active == nil || records[i].ActivatedAt.After(activatedAt) {
+			active, activatedAt = key, records[i].ActivatedAt
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = keys
+	r.verifyUntil = verifyUntil
+	if active != nil {
+		r.active, r.activatedAt = active, activatedAt
+	} else if r.active != nil {
+		// another instance is mid-rotation; keep signing with the previous key until the new one shows up
+		r.keys[r.active.Kid] = r.active
+	}
+	return nil
+}
+
+// seal encrypts record, a key persisted unencrypted before JWT_KEY_ENCRYPTION_KEY existed, in place
+func (r *KeyRing) seal(ctx context.Context, record models.SigningKey) {
+	sealed, err := r.sealPrivateKey(record.Kid, record.Algorithm, record.PrivateKey)
+	if err == nil {
+		_, err = r.repository.UpdateOne(ctx,
+			bson.M{"$set": bson.M{"private_key": sealed, "updated_at": time.Now()}},
+			repositories.Filter{Key: "kid", Value: record.Kid},
+			repositories.Filter{Key: "private_key", Value: record.PrivateKey},
+		)
+	}
+	if err != nil {
+		log.Errorf("unable to encrypt jwt signing key %s. %v", record.Kid, err)
+	}
+}
+
+// sealPrivateKey encrypts privateKey for storage. kid and alg are authenticated with it, so a stored key cannot be
+// passed off as another one
+func (r *KeyRing) sealPrivateKey(kid, alg, privateKey string) (string, error) {
+	nonce := make([]byte, r.keyEncryption.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := r.keyEncryption.Seal(nonce, nonce, []byte(privateKey), []byte(kid+" "+alg))
+	return sealedKeyPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// openPrivateKey reverse of sealPrivateKey. errUnsealedKey when stored is not encrypted
+func (r *KeyRing) openPrivateKey(kid, alg, stored string) (string, error) {
+	encoded, found := strings.CutPrefix(stored, sealedKeyPrefix)
+	if !found {
+		return "", errUnsealedKey
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < r.keyEncryption.NonceSize() {
+		return "", errors.New("malformed encrypted private key")
+	}
+	nonceSize := r.keyEncryption.NonceSize()
+	privateKey, err := r.keyEncryption.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(kid+" "+alg))
+	if err != nil {
+		return "", errors.New("private key not encrypted with `JWT_KEY_ENCRYPTION_KEY`")
+	}
+	return string(privateKey), nil
+}
+
+// newKeyEncryption AES-256-GCM cipher of value, a base64 encoded 32 bytes key
+func newKeyEncryption(value string) (cipher.AEAD, error) {
+	if value == "" {
+		return nil, errors.New("required to store signing keys. Generate one with `openssl rand -base64 32`")
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("expected 32 bytes, base64 encoded")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (r *KeyRing) schedule(ctx context.Context) {
+	ticker := time.NewTicker(keyRingRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.refresh(ctx); err != nil {
+				log.Error("unable to refresh jwt key ring", err)
+				continue
+			}
+			r.mu.RLock()
+			due := time.Since(r.activatedAt) >= r.rotationInterval
+			r.mu.RUnlock()
+			if due {
+				if err := r.Rotate(ctx); err != nil {
+					log.Error("unable to rotate jwt signing key", err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"quickstart-go-jwt-mongodb/models"
+	"strings"
+	"testing"
+)
+
+var testKeyEncryptionKey = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+func TestSealPrivateKey(t *testing.T) {
+	keyEncryption, err := newKeyEncryption(testKeyEncryptionKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring := &KeyRing{keyEncryption: keyEncryption}
+	key, err := GenerateSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, err := key.MarshalPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := ring.sealPrivateKey(key.Kid, "ES256", privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, sealedKeyPrefix) || strings.Contains(sealed, "PRIVATE KEY") {
+		t.Fatalf("stored as %q", sealed)
+	}
+	if opened, err := ring.openPrivateKey(key.Kid, "ES256", sealed); err != nil || opened != privateKey {
+		t.Fatalf("opened %q (%v)", opened, err)
+	}
+
+	otherKeyEncryption, _ := newKeyEncryption(base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210")))
+	tampered := []byte(sealed)
+	tampered[len(tampered)-2] ^= 1
+	tests := []struct {
+		name   string
+		ring   *KeyRing
+		kid    string
+		alg    string
+		stored string
+	}{
+		{"other kid", ring, "other", "ES256", sealed},
+		{"other algorithm", ring, key.Kid, "ES384", sealed},
+		{"other encryption key", &KeyRing{keyEncryption: otherKeyEncryption}, key.Kid, "ES256", sealed},
+		{"tampered", ring, key.Kid, "ES256", string(tampered)},
+		{"truncated", ring, key.Kid, "ES256", sealedKeyPrefix + "AAAA"},
+		{"not base64", ring, key.Kid, "ES256", sealedKeyPrefix + "*"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := test.ring.openPrivateKey(test.kid, test.alg, test.stored); err == nil || errors.Is(err, errUnsealedKey) {
+				t.Fatalf("opened, error %v", err)
+			}
+		})
+	}
+	if _, err := ring.openPrivateKey(key.Kid, "ES256", privateKey); !errors.Is(err, errUnsealedKey) {
+		t.Fatalf("unencrypted key: error %v", err)
+	}
+}
+
+func TestStartKeyRingRefusesUnsafeSettings(t *testing.T) {
+	tests := []struct {
+		name   string
+		envVar models.EnvVar
+	}{
+		{"no encryption key", models.EnvVar{JwtKeyRotationInterval: "168h"}},
+		{"short encryption key", models.EnvVar{JwtKeyRotationInterval: "168h", JwtKeyEncryptionKey: base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))}},
+		{"encryption key not base64", models.EnvVar{JwtKeyRotationInterval: "168h", JwtKeyEncryptionKey: "not a key"}},
+		{"grace period shorter than refresh tokens", models.EnvVar{JwtKeyRotationInterval: "168h", JwtKeyGracePeriod: "1h",
+			JwtKeyEncryptionKey: testKeyEncryptionKey}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// refused before the database is used
+			if _, err := StartKeyRing(context.Background(), nil, test.envVar); err == nil {
+				t.Fatal("started")
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type (
+	loginLockoutService struct {
+		ctx                context.Context
+		mailer             Mailer
+		tokens             *oneTimeTokenService
+		throttleRepository repositories.CrudOperation
+		userRepository     repositories.CrudOperation
+	}
+	// loginThrottlePolicy how many failures a key tolerates before being locked, and for how long. Every failure
+	// past the threshold doubles the lockout, up to maxLockout
+	loginThrottlePolicy struct {
+		prefix     string
+		threshold  int
+		firstLock  time.Duration
+		maxLockout time.Duration
+	}
+	// LoginLockedError sign in refused without checking the password, because of earlier failures
+	LoginLockedError struct {
+		RetryAfter time.Duration
+	}
+)
+
+const (
+	// TokenTypeAccountUnlock `typ` of the token emailed to lift the lockout of an account
+	TokenTypeAccountUnlock = "account_unlock"
+
+	accountUnlockLifetime = time.Hour
+	// loginFailureWindow failures are forgotten after this long without a new one
+	loginFailureWindow = 24 * time.Hour
+)
+
+var (
+	// ErrInvalidCredentials the one answer to a wrong password and an unknown email alike
+	ErrInvalidCredentials = errors.New("invalid Credential supplied. Please check username/password")
+
+	accountThrottle = loginThrottlePolicy{prefix: "account:", threshold: 5, firstLock: time.Minute, maxLockout: time.Hour}
+	// ipThrottle is looser: offices and mobile carriers put many users behind one address
+	ipThrottle = loginThrottlePolicy{prefix: "ip:", threshold: 20, firstLock: time.Minute, maxLockout: time.Hour}
+)
+
+func (e *LoginLockedError) Error() string {
+	return fmt.Sprintf("too many failed sign in attempts. Try again in %s", e.RetryAfter.Round(time.Second))
+}
+
+func NewLoginLockoutService(ctx context.Context, database internal.MongoDatabase, envVar models.EnvVar) *loginLockoutService {
+	return &loginLockoutService{
+		ctx:                ctx,
+		mailer:             NewMailer(database),
+		tokens:             NewOneTimeTokenService(ctx, database, NewJwtService(ctx, envVar)),
+		throttleRepository: repositories.NewLoginThrottleRepository(database),
+		userRepository:     repositories.NewUserRepository(database),
+	}
+}
+
+// Check returns a *LoginLockedError when the account named by email, or the source ip, is locked. It does not
+// depend on whether the account exists, so a lockout tells nothing about it
+func (l *loginLockoutService) Check(email, ip string) error {
+	var retryAfter time.Duration
+	for _, key := range []string{accountThrottle.key(email), ipThrottle.key(ip)} {
+		var throttle models.LoginThrottle
+		if l.throttleRepository.FindOne(l.ctx, &throttle, repositories.Filter{Key: "_id", Value: key}) {
+			retryAfter = max(retryAfter, time.Until(throttle.LockedUntil))
+		} else if err := l.ctx.Err(); err != nil {
+			return err
+		}
+	}
+	if retryAfter > 0 {
+		return &LoginLockedError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// RecordFailure counts a failed sign in against the account and the source ip, locking them past their thresholds.
+// It reports whether this failure locked the account
+func (l *loginLockoutService) RecordFailure(email, ip string) (bool, error) {
+	accountFailures, err := l.fail(accountThrottle, email)
+	if err != nil {
+		return false, err
+	}
+	if _, err = l.fail(ipThrottle, ip); err != nil {
+		return false, err
+	}
+	return accountFailures == accountThrottle.threshold, nil
+}
+
+// RecordSuccess forgets the failures of the account. Those of the source ip keep counting, so an attacker cannot
+// reset them with an account of their own
+func (l *loginLockoutService) RecordSuccess(email string) error {
+	_, err := l.throttleRepository.DeleteMany(l.ctx, repositories.Filter{Key: "_id", Value: accountThrottle.key(email)})
+	return err
+}
+
+// SendUnlockEmail emails user a link to unlockUrl lifting the lockout of their account
+func (l *loginLockoutService) SendUnlockEmail(user models.User, unlockUrl string) error {
+	token, err := l.tokens.Issue(TokenTypeAccountUnlock, user.ID, accountUnlockLifetime)
+	if err != nil {
+		return err
+	}
+	mail, err := RenderMail(MailAccountUnlock, user.Locale, MailData{
+		Name:     user.FirstName,
+		Link:     unlockUrl + "?token=" + url.QueryEscape(token),
+		ValidFor: accountUnlockLifetime,
+	})
+	if err != nil {
+		return err
+	}
+	mail.To = user.Email
+	return l.mailer.Send(l.ctx, mail)
+}
+
+// Unlock redeems an unlock token and lifts the lockout of the account it was issued to
+func (l *loginLockoutService) Unlock(token string) error {
+	userId, err := l.tokens.Consume(TokenTypeAccountUnlock, token)
+	if err != nil {
+		return err
+	}
+	return l.UnlockUser(userId)
+}
+
+// UnlockUser lifts the lockout of the user's account and forgets its failures
+func (l *loginLockoutService) UnlockUser(userId primitive.ObjectID) error {
+	var user models.User
+	if !l.userRepository.FindOne(l.ctx, &user, repositories.Filter{Key: "_id", Value: userId}) {
+		if err := l.ctx.Err(); err != nil {
+			return err
+		}
+		return ErrUserNotFound
+	}
+	return l.RecordSuccess(user.Email)
+}
+
+// fail counts a failure of value under policy and returns the failures counted within the window, this one included
+func (l *loginLockoutService) fail(policy loginThrottlePolicy, value string) (int, error) {
+	now := time.Now()
+	// one pipeline update, so concurrent failures are all counted: failures older than the window start over
+	update := bson.A{bson.M{"$set": bson.M{
+		"failures": bson.M{"$cond": bson.A{
+			bson.M{"$lt": bson.A{bson.M{"$ifNull": bson.A{"$last_failure_at", time.Time{}}}, now.Add(-loginFailureWindow)}},
+			1,
+			bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$failures", 0}}, 1}},
+		}},
+		"last_failure_at": now,
+	}}}
+	var throttle models.LoginThrottle
+	err := l.throttleRepository.UpsertOne(l.ctx, &throttle, update, repositories.Filter{Key: "_id", Value: policy.key(value)})
+	if mongo.IsDuplicateKeyError(err) {
+		// a concurrent failure created the document first; it exists now
+		err = l.throttleRepository.UpsertOne(l.ctx, &throttle, update, repositories.Filter{Key: "_id", Value: policy.key(value)})
+	}
+	if err != nil {
+		return 0, err
+	}
+	if lockout := policy.lockout(throttle.Failures); lockout > 0 {
+		if _, err = l.throttleRepository.UpdateOne(l.ctx,
+			bson.M{"$max": bson.M{"locked_until": now.Add(lockout)}},
+			repositories.Filter{Key: "_id", Value: throttle.Key},
+		); err != nil {
+			return 0, err
+		}
+		if throttle.Failures == policy.threshold {
+			log.Warnf("sign in locked for %s after %d failures", throttle.Key, throttle.Failures)
+		}
+	}
+	return throttle.Failures, nil
+}
+
+// StartLoginThrottleSweeper deletes stale failure counters every hour until ctx is done
+func StartLoginThrottleSweeper(ctx context.Context, database internal.MongoDatabase, envVar models.EnvVar) {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sweepCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+				if _, err := NewLoginLockoutService(sweepCtx, database, envVar).PurgeStale(); err != nil {
+					log.Error("unable to purge stale login throttles", err)
+				}
+				cancel()
+			}
+		}
+	}()
+}
+
+// PurgeStale deletes the counters of keys without a failure within the window
+func (l *loginLockoutService) PurgeStale() (int64, error) {
+	return l.throttleRepository.DeleteMany(l.ctx,
+		repositories.Filter{Key: "last_failure_at", Value: bson.M{"$lt": time.Now().Add(-loginFailureWindow)}},
+	)
+}
+
+func (p loginThrottlePolicy) key(value string) string {
+	return p.prefix + strings.ToLower(strings.TrimSpace(value))
+}
+
+// lockout how long failures lock the key: nothing below the threshold, then firstLock doubling with every failure
+func (p loginThrottlePolicy) lockout(failures int) time.Duration {
+	if failures < p.threshold {
+		return 0
+	}
+	lockout := p.firstLock
+	for i := p.threshold; i < failures && lockout < p.maxLockout; i++ {
+		lockout *= 2
+	}
+	return min(lockout, p.maxLockout)
+}
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"testing"
+	"time"
+)
+
+// TestLoginLockout against the MongoDB of MONGO_TEST_URI, which runs the pipeline counting failures
+func TestLoginLockout(t *testing.T) {
+	throttles := repositories.NewLoginThrottleRepository(testMongoDatabase(t))
+	lockout := &loginLockoutService{ctx: context.Background(), throttleRepository: throttles}
+	stored := func(key string) models.LoginThrottle {
+		var throttle models.LoginThrottle
+		if !throttles.FindOne(context.Background(), &throttle, repositories.Filter{Key: "_id", Value: key}) {
+			t.Fatalf("no failures counted for %s", key)
+		}
+		return throttle
+	}
+
+	for i := 1; i < accountThrottle.threshold; i++ {
+		if locked, err := lockout.RecordFailure("Ada@example.com", "192.0.2.1"); err != nil || locked {
+			t.Fatalf("failure %d: locked %v (%v)", i, locked, err)
+		}
+	}
+	if err := lockout.Check("ada@example.com", "192.0.2.1"); err != nil {
+		t.Fatalf("locked below the threshold: %v", err)
+	}
+	if locked, err := lockout.RecordFailure("ada@example.com", "192.0.2.1"); err != nil || !locked {
+		t.Fatalf("failure %d: locked %v (%v)", accountThrottle.threshold, locked, err)
+	}
+	// from any address
+	var locked *LoginLockedError
+	if err := lockout.Check("ada@example.com", "198.51.100.7"); !errors.As(err, &locked) ||
+		locked.RetryAfter <= 0 || locked.RetryAfter > accountThrottle.firstLock {
+		t.Fatalf("got %v, want locked for up to %s", err, accountThrottle.firstLock)
+	}
+
+	// failures older than the window start over
+	accountKey := accountThrottle.key("ada@example.com")
+	stale := time.Now().Add(-loginFailureWindow - time.Hour)
+	if _, err := throttles.UpdateOne(context.Background(),
+		bson.M{"$set": bson.M{"last_failure_at": stale, "locked_until": stale}},
+		repositories.Filter{Key: "_id", Value: accountKey},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if locked, err := lockout.RecordFailure("ada@example.com", "192.0.2.1"); err != nil || locked {
+		t.Fatalf("failure after the window: locked %v (%v)", locked, err)
+	}
+	if failures := stored(accountKey).Failures; failures != 1 {
+		t.Fatalf("%d failures counted after the window, want 1", failures)
+	}
+
+	// a success forgets the failures of the account, not those of the address
+	if err := lockout.RecordSuccess("ada@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	var throttle models.LoginThrottle
+	if throttles.FindOne(context.Background(), &throttle, repositories.Filter{Key: "_id", Value: accountKey}) {
+		t.Fatal("failures of the account kept after a success")
+	}
+	if failures := stored(ipThrottle.key("192.0.2.1")).Failures; failures != accountThrottle.threshold+1 {
+		t.Fatalf("%d failures counted for the address, want %d", failures, accountThrottle.threshold+1)
+	}
+}
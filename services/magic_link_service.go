@@ -0,0 +1,90 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type magicLinkService struct {
+	ctx            context.Context
+	mailer         Mailer
+	tokens         *oneTimeTokenService
+	userRepository repositories.CrudOperation
+}
+
+const (
+	// TokenTypeMagicLink `typ` of the token emailed to sign in without a password
+	TokenTypeMagicLink = "magic_link"
+	// AmrMagicLink authentication method recorded in the `amr` claim of a magic link login. RFC 8176 has no value for
+	// a link sent by email
+	AmrMagicLink = "email"
+
+	MagicLinkLifetime = 15 * time.Minute
+)
+
+func NewMagicLinkService(ctx context.Context, database internal.MongoDatabase, envVar models.EnvVar) *magicLinkService {
+	return &magicLinkService{
+		ctx:            ctx,
+		mailer:         NewMailer(database),
+		tokens:         NewOneTimeTokenService(ctx, database, NewJwtService(ctx, envVar)),
+		userRepository: repositories.NewUserRepository(database),
+	}
+}
+
+// Request emails the account registered with email a link to callbackUrl carrying a sign in token bound to nonce,
+// which only the requesting browser holds. Unknown addresses and throttled requests are ignored without error, so
+// callers cannot tell whether an account exists
+func (m *magicLinkService) Request(email, callbackUrl, nonce string) error {
+	var user models.User
+	if !m.userRepository.FindOne(m.ctx, &user, repositories.Filter{Key: "email", Value: email}) {
+		return nil
+	}
+	token, err := m.tokens.IssueBound(TokenTypeMagicLink, user.ID, MagicLinkLifetime, nonce)
+	if errors.Is(err, ErrOneTimeTokenThrottled) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	mail, err := RenderMail(MailMagicLink, user.Locale, MailData{
+		Name:     user.FirstName,
+		Link:     callbackUrl + "?token=" + url.QueryEscape(token),
+		ValidFor: MagicLinkLifetime,
+	})
+	if err != nil {
+		return err
+	}
+	mail.To = user.Email
+	return m.mailer.Send(m.ctx, mail)
+}
+
+// Login redeems token, presented along with the nonce of the browser it was requested from, and returns the user it
+// was issued to. The link reached their mailbox, so their email counts as verified from now on
+func (m *magicLinkService) Login(token, nonce string) (models.User, error) {
+	var user models.User
+	userId, err := m.tokens.ConsumeBound(TokenTypeMagicLink, token, nonce)
+	if err != nil {
+		return user, err
+	}
+	if _, err = m.userRepository.UpdateOne(m.ctx,
+		bson.M{"$set": bson.M{"email_verified": true, "updated_at": time.Now()}},
+		repositories.Filter{Key: "_id", Value: userId},
+		repositories.Filter{Key: "email_verified", Value: false},
+	); err != nil {
+		return user, err
+	}
+	if !m.userRepository.FindOne(m.ctx, &user, repositories.Filter{Key: "_id", Value: userId}) {
+		if err = m.ctx.Err(); err != nil {
+			return user, err
+		}
+		return user, ErrUserNotFound
+	}
+	return user, nil
+}
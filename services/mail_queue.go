@@ -0,0 +1,188 @@
+package services
+
+import (
+	"context"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type (
+	// queueMailer persists mails in the `mail_queue` collection for StartMailWorker to deliver
+	queueMailer struct {
+		database internal.MongoDatabase
+	}
+	mailQueueService struct {
+		ctx             context.Context
+		transport       Mailer
+		queueRepository repositories.CrudOperation
+	}
+)
+
+const (
+	MailPending = "pending"
+	MailSent    = "sent"
+	MailFailed  = "failed"
+
+	mailWorkerInterval = 15 * time.Second
+	mailBatchSize      = 50
+	// mailMaxAttempts with the backoff below, a message is retried for about 8 hours before giving up
+	mailMaxAttempts  = 10
+	mailFirstBackoff = 30 * time.Second
+	mailMaxBackoff   = 6 * time.Hour
+	// mailSendLease how long a worker owns the message it is delivering. If the worker dies meanwhile, the message
+	// becomes due again once the lease runs out
+	mailSendLease = 2 * time.Minute
+	// mailRetention sent messages are kept this long, without their bodies, then deleted. Failed ones are kept for
+	// inspection
+	mailRetention = 7 * 24 * time.Hour
+)
+
+// mailQueued wakes the worker up as soon as a mail is queued rather than on its next tick
+var mailQueued = make(chan struct{}, 1)
+
+func NewQueueMailer(database internal.MongoDatabase) Mailer {
+	return queueMailer{database: database}
+}
+
+func (q queueMailer) Send(ctx context.Context, mail Mail) error {
+	if _, err := mailAddress(mail.To); err != nil {
+		return err
+	}
+	_, err := repositories.NewMailQueueRepository(q.database).CreateOne(ctx, models.MailMessage{
+		BaseModel:     models.NewBaseModel(),
+		To:            mail.To,
+		Subject:       mail.Subject,
+		Text:          mail.Text,
+		Html:          mail.Html,
+		Status:        MailPending,
+		NextAttemptAt: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	select {
+	case mailQueued <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func NewMailQueueService(ctx context.Context, database internal.MongoDatabase, transport Mailer) *mailQueueService {
+	return &mailQueueService{
+		ctx:             ctx,
+		transport:       transport,
+		queueRepository: repositories.NewMailQueueRepository(database),
+	}
+}
+
+// DeliverDue sends the queued messages that are due and returns how many were sent. Several instances may run it
+// concurrently: a message is claimed before being sent, so each delivery attempt happens once
+func (m *mailQueueService) DeliverDue() (int, error) {
+	var due []models.MailMessage
+	if err := m.queueRepository.FindPaginate(m.ctx, 1, mailBatchSize, &due,
+		repositories.Filter{Key: "status", Value: MailPending},
+		repositories.Filter{Key: "next_attempt_at", Value: bson.M{"$lte": time.Now()}},
+	); err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, message := range due {
+		claimed, err := m.queueRepository.UpdateOne(m.ctx,
+			bson.M{"$set": bson.M{"next_attempt_at": time.Now().Add(mailSendLease)}, "$inc": bson.M{"attempts": 1}},
+			repositories.Filter{Key: "_id", Value: message.ID},
+			repositories.Filter{Key: "status", Value: MailPending},
+			repositories.Filter{Key: "next_attempt_at", Value: message.NextAttemptAt},
+		)
+		if err != nil {
+			return sent, err
+		}
+		if claimed == 0 {
+			continue // another worker got it first
+		}
+		message.Attempts++
+		delivered, err := m.deliver(message)
+		if err != nil {
+			return sent, err
+		}
+		if delivered {
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// deliver sends message, claimed by the caller, records the outcome and reports whether it was sent
+func (m *mailQueueService) deliver(message models.MailMessage) (bool, error) {
+	sendCtx, cancel := context.WithTimeout(m.ctx, mailSendLease/2)
+	sendErr := m.transport.Send(sendCtx, Mail{To: message.To, Subject: message.Subject, Text: message.Text, Html: message.Html})
+	cancel()
+
+	now := time.Now()
+	// the body of a sent message is dropped: it may hold a link with a live token, e.g. a password reset
+	update := bson.M{
+		"$set":   bson.M{"status": MailSent, "sent_at": now, "updated_at": now},
+		"$unset": bson.M{"text": "", "html": ""},
+	}
+	if sendErr != nil {
+		log.Warnf("mail %s to %s failed (attempt %d): %v", message.ID.Hex(), message.To, message.Attempts, sendErr)
+		failure := bson.M{"last_error": sendErr.Error(), "updated_at": now}
+		if message.Attempts >= mailMaxAttempts {
+			failure["status"] = MailFailed
+			log.Errorf("mail %s to %s gave up after %d attempts", message.ID.Hex(), message.To, message.Attempts)
+		} else {
+			failure["next_attempt_at"] = now.Add(mailBackoff(message.Attempts))
+		}
+		update = bson.M{"$set": failure}
+	}
+	_, err := m.queueRepository.UpdateOne(m.ctx, update, repositories.Filter{Key: "_id", Value: message.ID})
+	return sendErr == nil, err
+}
+
+// PurgeSent deletes messages sent longer than mailRetention ago
+func (m *mailQueueService) PurgeSent() (int64, error) {
+	return m.queueRepository.DeleteMany(m.ctx,
+		repositories.Filter{Key: "status", Value: MailSent},
+		repositories.Filter{Key: "sent_at", Value: bson.M{"$lt": time.Now().Add(-mailRetention)}},
+	)
+}
+
+// StartMailWorker delivers queued mails through transport until ctx is done
+func StartMailWorker(ctx context.Context, database internal.MongoDatabase, transport Mailer) {
+	go func() {
+		ticker := time.NewTicker(mailWorkerInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-mailQueued:
+			}
+			workCtx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+			queue := NewMailQueueService(workCtx, database, transport)
+			if sent, err := queue.DeliverDue(); err != nil {
+				log.Error("unable to deliver queued mails", err)
+			} else if sent > 0 {
+				log.Infof("%d mails sent", sent)
+			}
+			if _, err := queue.PurgeSent(); err != nil {
+				log.Error("unable to purge sent mails", err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// mailBackoff delay before the next attempt once attempts have failed: 30s, 1m, 2m, ... up to mailMaxBackoff
+func mailBackoff(attempts int) time.Duration {
+	backoff := mailFirstBackoff
+	for i := 1; i < attempts && backoff < mailMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, mailMaxBackoff)
+}
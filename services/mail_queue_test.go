@@ -0,0 +1,214 @@
+package services
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// racingRepository lets another worker claim every message between DeliverDue reading the batch and claiming it
+type racingRepository struct {
+	repositories.CrudOperation
+}
+
+func (r racingRepository) FindPaginate(ctx context.Context, currentPage, perPage int, results interface{}, filters ...repositories.Filter) error {
+	if err := r.CrudOperation.FindPaginate(ctx, currentPage, perPage, results, filters...); err != nil {
+		return err
+	}
+	_, err := r.CrudOperation.UpdateMany(ctx,
+		bson.M{"$set": bson.M{"next_attempt_at": time.Now().Add(mailSendLease)}, "$inc": bson.M{"attempts": 1}},
+	)
+	return err
+}
+
+// newTestMailQueue queue of the messages of queue delivering into an outbox directory. A broken outbox, a file in
+// place of the directory, fails every delivery
+func newTestMailQueue(t *testing.T, queue repositories.CrudOperation, broken bool) (*mailQueueService, string) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	if broken {
+		if err := os.WriteFile(dir, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &mailQueueService{
+		ctx:             context.Background(),
+		transport:       outboxMailer{dir: dir, from: defaultMailFrom},
+		queueRepository: queue,
+	}, dir
+}
+
+func queueTestMail(t *testing.T, queue repositories.CrudOperation, message models.MailMessage) primitive.ObjectID {
+	message.BaseModel = models.NewBaseModel()
+	message.To, message.Subject = "ada@example.com", "Reset your password"
+	message.Text, message.Html = "https://example.com/reset?token=secret", "<a href=\"https://example.com/reset?token=secret\">Reset</a>"
+	if message.Status == "" {
+		message.Status = MailPending
+	}
+	id, err := queue.CreateOne(context.Background(), message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func storedMail(t *testing.T, queue repositories.CrudOperation, id primitive.ObjectID) models.MailMessage {
+	var message models.MailMessage
+	if !queue.FindOne(context.Background(), &message, repositories.Filter{Key: "_id", Value: id}) {
+		t.Fatalf("mail %s not found", id.Hex())
+	}
+	return message
+}
+
+func outboxFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestMailBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		backoff  time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{9, 128 * time.Minute},
+		{10, 256 * time.Minute},
+		{11, mailMaxBackoff},
+		{50, mailMaxBackoff},
+	}
+	for _, test := range tests {
+		if backoff := mailBackoff(test.attempts); backoff != test.backoff {
+			t.Errorf("backoff after %d attempts = %s, want %s", test.attempts, backoff, test.backoff)
+		}
+	}
+}
+
+func TestDeliverDueSendsAndRedactsMessages(t *testing.T) {
+	forEachStore(t, repositories.NewMailQueueRepository, func(t *testing.T, queue repositories.CrudOperation) {
+		service, dir := newTestMailQueue(t, queue, false)
+		id := queueTestMail(t, queue, models.MailMessage{NextAttemptAt: time.Now().Add(-time.Second)})
+		later := queueTestMail(t, queue, models.MailMessage{NextAttemptAt: time.Now().Add(time.Hour)})
+
+		sent, err := service.DeliverDue()
+		if err != nil || sent != 1 {
+			t.Fatalf("sent %d (%v), want 1", sent, err)
+		}
+		files := outboxFiles(t, dir)
+		if len(files) != 1 {
+			t.Fatalf("%d mails in the outbox, want 1", len(files))
+		}
+		if content, _ := os.ReadFile(files[0]); !strings.Contains(string(content), "Subject: Reset your password") {
+			t.Fatalf("outbox mail without its subject:\n%s", content)
+		}
+
+		message := storedMail(t, queue, id)
+		if message.Status != MailSent || message.SentAt == nil || message.Attempts != 1 {
+			t.Fatalf("sent mail stored as %+v", message)
+		}
+		if message.Text != "" || message.Html != "" {
+			t.Fatal("body of a sent mail kept")
+		}
+		if message := storedMail(t, queue, later); message.Status != MailPending || message.Attempts != 0 {
+			t.Fatalf("mail not due yet was attempted: %+v", message)
+		}
+
+		if sent, _ = service.DeliverDue(); sent != 0 {
+			t.Fatalf("sent %d mails twice", sent)
+		}
+	})
+}
+
+func TestDeliverDueSkipsMessagesClaimedByAnotherWorker(t *testing.T) {
+	forEachStore(t, repositories.NewMailQueueRepository, func(t *testing.T, queue repositories.CrudOperation) {
+		service, dir := newTestMailQueue(t, queue, false)
+		service.queueRepository = racingRepository{queue}
+		id := queueTestMail(t, queue, models.MailMessage{NextAttemptAt: time.Now().Add(-time.Second)})
+
+		sent, err := service.DeliverDue()
+		if err != nil || sent != 0 {
+			t.Fatalf("sent %d (%v), want 0", sent, err)
+		}
+		if files := outboxFiles(t, dir); len(files) != 0 {
+			t.Fatalf("%d mails delivered by the worker that lost the claim", len(files))
+		}
+		if message := storedMail(t, queue, id); message.Attempts != 1 || message.Status != MailPending {
+			t.Fatalf("claimed mail stored as %+v", message)
+		}
+	})
+}
+
+func TestDeliverDueRetriesThenGivesUp(t *testing.T) {
+	forEachStore(t, repositories.NewMailQueueRepository, func(t *testing.T, queue repositories.CrudOperation) {
+		service, _ := newTestMailQueue(t, queue, true)
+		id := queueTestMail(t, queue, models.MailMessage{NextAttemptAt: time.Now().Add(-time.Second)})
+
+		before := time.Now().Truncate(time.Millisecond) // as precise as stored times
+		if sent, err := service.DeliverDue(); err != nil || sent != 0 {
+			t.Fatalf("sent %d (%v), want 0", sent, err)
+		}
+		message := storedMail(t, queue, id)
+		if message.Status != MailPending || message.Attempts != 1 || message.LastError == "" {
+			t.Fatalf("failed mail stored as %+v", message)
+		}
+		if retry := message.NextAttemptAt.Sub(before); retry < mailFirstBackoff || retry > mailFirstBackoff+time.Second {
+			t.Fatalf("retried in %s, want %s", retry, mailFirstBackoff)
+		}
+
+		queue.UpdateOne(context.Background(),
+			bson.M{"$set": bson.M{"attempts": mailMaxAttempts - 1, "next_attempt_at": time.Now().Add(-time.Second)}},
+			repositories.Filter{Key: "_id", Value: id},
+		)
+		if _, err := service.DeliverDue(); err != nil {
+			t.Fatal(err)
+		}
+		message = storedMail(t, queue, id)
+		if message.Status != MailFailed || message.Attempts != mailMaxAttempts {
+			t.Fatalf("mail stored as %+v after its last attempt, want failed", message)
+		}
+		if message.Text == "" {
+			t.Fatal("body of a failed mail dropped, it is kept for inspection")
+		}
+		if sent, _ := service.DeliverDue(); sent != 0 || storedMail(t, queue, id).Attempts != mailMaxAttempts {
+			t.Fatal("failed mail attempted again")
+		}
+	})
+}
+
+func TestPurgeSent(t *testing.T) {
+	forEachStore(t, repositories.NewMailQueueRepository, func(t *testing.T, queue repositories.CrudOperation) {
+		service, _ := newTestMailQueue(t, queue, false)
+		sentAt := func(age time.Duration) *time.Time {
+			at := time.Now().Add(-age)
+			return &at
+		}
+		expired := queueTestMail(t, queue, models.MailMessage{Status: MailSent, SentAt: sentAt(mailRetention + time.Hour)})
+		kept := []primitive.ObjectID{
+			queueTestMail(t, queue, models.MailMessage{Status: MailSent, SentAt: sentAt(mailRetention - time.Hour)}),
+			queueTestMail(t, queue, models.MailMessage{Status: MailFailed, SentAt: sentAt(mailRetention + time.Hour)}),
+			queueTestMail(t, queue, models.MailMessage{NextAttemptAt: time.Now().Add(-mailRetention - time.Hour)}),
+		}
+
+		if purged, err := service.PurgeSent(); err != nil || purged != 1 {
+			t.Fatalf("purged %d (%v), want 1", purged, err)
+		}
+		var message models.MailMessage
+		if queue.FindOne(context.Background(), &message, repositories.Filter{Key: "_id", Value: expired}) {
+			t.Fatal("mail sent before the retention period kept")
+		}
+		for _, id := range kept {
+			storedMail(t, queue, id)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package services
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// MailData values mail templates are rendered with
+type MailData struct {
+	Name     string
+	Link     string
+	ValidFor time.Duration
+}
+
+const (
+	MailEmailVerification = "email_verification"
+	MailPasswordReset     = "password_reset"
+	MailAccountUnlock     = "account_unlock"
+	MailMagicLink         = "magic_link"
+
+	// defaultMailLocale every template exists in this locale; other locales fall back to it
+	defaultMailLocale = "en"
+)
+
+var (
+	//go:embed mail_templates/*
+	mailTemplatesFs embed.FS
+
+	mailTemplateFuncs = map[string]any{
+		"hours":   func(d time.Duration) int { return int(d.Hours()) },
+		"minutes": func(d time.Duration) int { return int(d.Minutes()) },
+	}
+)
+
+// RenderMail mail named name, in the locale closest to locale: `pt-BR` uses the `pt-br` templates, then the `pt`
+// ones, then the English ones. A template is a `{name}.{locale}.txt` file, whose `subject` block is the subject, and
+// an optional `{name}.{locale}.html` sibling for the HTML body
+func RenderMail(name, locale string, data MailData) (Mail, error) {
+	for _, candidate := range mailLocales(locale) {
+		base := fmt.Sprintf("mail_templates/%s.%s", name, candidate)
+		source, err := mailTemplatesFs.ReadFile(base + ".txt")
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return Mail{}, err
+		}
+		text, err := texttemplate.New(name).Funcs(mailTemplateFuncs).Parse(string(source))
+		if err != nil {
+			return Mail{}, err
+		}
+		var mail Mail
+		if mail.Subject, err = executeText(text, "subject", data); err != nil {
+			return Mail{}, err
+		}
+		if mail.Text, err = executeText(text, name, data); err != nil {
+			return Mail{}, err
+		}
+		if source, err = mailTemplatesFs.ReadFile(base + ".html"); err == nil {
+			html, err := htmltemplate.New(name).Funcs(mailTemplateFuncs).Parse(string(source))
+			if err != nil {
+				return Mail{}, err
+			}
+			var buffer bytes.Buffer
+			if err = html.Execute(&buffer, data); err != nil {
+				return Mail{}, err
+			}
+			mail.Html = buffer.String()
+		}
+		return mail, nil
+	}
+	return Mail{}, fmt.Errorf("no mail template named %s", name)
+}
+
+func executeText(template *texttemplate.Template, name string, data MailData) (string, error) {
+	var buffer bytes.Buffer
+	if err := template.ExecuteTemplate(&buffer, name, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buffer.String()), nil
+}
+
+// mailLocales locales to look templates up in, most specific first. Anything but a language tag is ignored
+func mailLocales(locale string) []string {
+	locale = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+	if strings.ContainsFunc(locale, func(r rune) bool { return (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' }) {
+		locale = ""
+	}
+	var locales []string
+	for locale != "" {
+		locales = append(locales, locale)
+		dash := strings.LastIndex(locale, "-")
+		if dash < 0 {
+			break
+		}
+		locale = locale[:dash]
+	}
+	return append(locales, defaultMailLocale)
+}
@@ -0,0 +1,227 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type (
+	// Mail message sent to a user. Html is optional; Text is always sent, as the alternative for clients not
+	// rendering HTML
+	Mail struct {
+		To      string
+		Subject string
+		Text    string
+		Html    string
+	}
+	// Mailer delivers mails to users. Implementations must be safe for concurrent use
+	Mailer interface {
+		Send(ctx context.Context, mail Mail) error
+	}
+	// logMailer writes mails to the log instead of sending them, for development
+	logMailer struct{}
+	// outboxMailer writes every mail as an .eml file into a directory, for development and tests. Any mail client
+	// opens them
+	outboxMailer struct {
+		dir  string
+		from string
+	}
+	// smtpMailer sends mails through an SMTP server, upgrading the connection with STARTTLS when it is offered
+	smtpMailer struct {
+		addr string
+		auth smtp.Auth
+		from string
+	}
+)
+
+const defaultMailFrom = "no-reply@localhost"
+
+// NewMailer mailer the application sends through: mails are queued in the database and delivered by
+// StartMailWorker, so an unavailable mail server delays them instead of losing them
+func NewMailer(database internal.MongoDatabase) Mailer {
+	return NewQueueMailer(database)
+}
+
+// NewMailTransport mailer delivering the queued mails: SMTP when SMTP_HOST is set, otherwise .eml files in
+// MAIL_OUTBOX_DIR when set, otherwise the log
+func NewMailTransport(envVar models.EnvVar) Mailer {
+	from := envVar.MailFrom
+	if from == "" {
+		from = defaultMailFrom
+	}
+	switch {
+	case envVar.SmtpHost != "":
+		port := envVar.SmtpPort
+		if port == "" {
+			port = "587"
+		}
+		var auth smtp.Auth
+		if envVar.SmtpUsername != "" {
+			auth = smtp.PlainAuth("", envVar.SmtpUsername, envVar.SmtpPassword, envVar.SmtpHost)
+		}
+		return smtpMailer{addr: net.JoinHostPort(envVar.SmtpHost, port), auth: auth, from: from}
+	case envVar.MailOutboxDir != "":
+		return outboxMailer{dir: envVar.MailOutboxDir, from: from}
+	default:
+		return NewLogMailer()
+	}
+}
+
+func NewLogMailer() Mailer {
+	return logMailer{}
+}
+
+func (logMailer) Send(_ context.Context, mail Mail) error {
+	log.WithFields(log.Fields{"to": mail.To, "subject": mail.Subject}).Info("mail not sent, no mail server configured:\n", mail.Text)
+	return nil
+}
+
+func (o outboxMailer) Send(_ context.Context, mail Mail) error {
+	message, err := composeMessage(o.from, mail)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(o.dir, 0o750); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), randomHex(4))
+	return os.WriteFile(filepath.Join(o.dir, name), message, 0o640)
+}
+
+func (s smtpMailer) Send(ctx context.Context, mail Mail) error {
+	message, err := composeMessage(s.from, mail)
+	if err != nil {
+		return err
+	}
+	sender, err := mailAddress(s.from)
+	if err != nil {
+		return err
+	}
+	recipient, err := mailAddress(mail.To)
+	if err != nil {
+		return err
+	}
+	// smtp.SendMail has no deadline of its own: a hung server would block the caller forever
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.addr, s.auth, sender, []string{recipient}, message)
+	}()
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// composeMessage RFC 5322 message of mail: text only, or multipart/alternative when it has an HTML body
+func composeMessage(from string, mail Mail) ([]byte, error) {
+	if _, err := mailAddress(mail.To); err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	header := textproto.MIMEHeader{}
+	header.Set("From", from)
+	header.Set("To", mail.To)
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", mail.Subject))
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("Message-ID", fmt.Sprintf("<%s@%s>", randomHex(16), mailDomain(from)))
+	header.Set("MIME-Version", "1.0")
+
+	if mail.Html == "" {
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		writeHeader(&buffer, header)
+		if err := writeQuotedPrintable(&buffer, mail.Text); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, alternative := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", mail.Text},
+		{"text/html; charset=utf-8", mail.Html},
+	} {
+		part, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {alternative.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = writeQuotedPrintable(part, alternative.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	header.Set("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	writeHeader(&buffer, header)
+	buffer.Write(body.Bytes())
+	return buffer.Bytes(), nil
+}
+
+func writeHeader(buffer *bytes.Buffer, header textproto.MIMEHeader) {
+	for _, key := range []string{"From", "To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"} {
+		if value := header.Get(key); value != "" {
+			buffer.WriteString(key + ": " + value + "\r\n")
+		}
+	}
+	buffer.WriteString("\r\n")
+}
+
+func writeQuotedPrintable(w io.Writer, content string) error {
+	writer := quotedprintable.NewWriter(w)
+	if _, err := writer.Write([]byte(strings.ReplaceAll(content, "\n", "\r\n"))); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// mailAddress bare address of a `Name <address>` or plain address
+func mailAddress(address string) (string, error) {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid mail address %q: %w", address, err)
+	}
+	return parsed.Address, nil
+}
+
+func mailDomain(from string) string {
+	if address, err := mailAddress(from); err == nil {
+		if at := strings.LastIndex(address, "@"); at >= 0 {
+			return address[at+1:]
+		}
+	}
+	return "localhost"
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
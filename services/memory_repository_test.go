@@ -0,0 +1,405 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"quickstart-go-jwt-mongodb/repositories"
+	"reflect"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryRepository in-memory repositories.CrudOperation for unit tests. Documents go through a BSON round trip, so
+// queries and updates see the types MongoDB stores (times as primitive.DateTime, integers as int32 or int64). It only
+// does plain CRUD: equality and comparison filters on fields of nested documents, and `$set`, `$unset` and `$inc`
+// updates. Anything else panics or fails; tests of pipeline updates and array operators run against a real MongoDB
+// (see testMongoDatabase)
+type memoryRepository struct {
+	mu        sync.Mutex
+	documents []bson.M
+}
+
+func newMemoryRepository() *memoryRepository {
+	return &memoryRepository{}
+}
+
+func (m *memoryRepository) CreateOne(_ context.Context, model interface{}) (primitive.ObjectID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.insert(model)
+}
+
+func (m *memoryRepository) CreateMany(_ context.Context, models []interface{}) ([]primitive.ObjectID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := make([]primitive.ObjectID, 0, len(models))
+	for i := range models {
+		id, err := m.insert(models[i])
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (m *memoryRepository) FindOne(_ context.Context, model interface{}, filters ...repositories.Filter) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, document := range m.documents {
+		if matchesFilters(document, filters) {
+			return decodeDocument(document, model) == nil
+		}
+	}
+	return false
+}
+
+func (m *memoryRepository) FindAll(ctx context.Context, results interface{}, filters ...repositories.Filter) error {
+	return m.FindPaginate(ctx, 1, math.MaxInt32, results, filters...)
+}
+
+func (m *memoryRepository) FindPaginate(_ context.Context, currentPage, perPage int, results interface{}, filters ...repositories.Filter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	slice := reflect.ValueOf(results).Elem()
+	slice.Set(reflect.MakeSlice(slice.Type(), 0, 0))
+	skip := (max(currentPage, 1) - 1) * perPage
+	for _, document := range m.documents {
+		if !matchesFilters(document, filters) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		if slice.Len() == perPage {
+			break
+		}
+		element := reflect.New(slice.Type().Elem())
+		if err := decodeDocument(document, element.Interface()); err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, element.Elem()))
+	}
+	return nil
+}
+
+func (m *memoryRepository) UpdateOne(_ context.Context, update interface{}, filters ...repositories.Filter) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, document := range m.documents {
+		if matchesFilters(document, filters) {
+			return 1, applyUpdate(document, update)
+		}
+	}
+	return 0, nil
+}
+
+func (m *memoryRepository) UpdateMany(_ context.Context, update interface{}, filters ...repositories.Filter) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var matched int64
+	for _, document := range m.documents {
+		if matchesFilters(document, filters) {
+			if err := applyUpdate(document, update); err != nil {
+				return matched, err
+			}
+			matched++
+		}
+	}
+	return matched, nil
+}
+
+func (m *memoryRepository) UpsertOne(_ context.Context, model interface{}, update interface{}, filters ...repositories.Filter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, document := range m.documents {
+		if matchesFilters(document, filters) {
+			if err := applyUpdate(document, update); err != nil {
+				return err
+			}
+			return decodeDocument(document, model)
+		}
+	}
+	document := bson.M{}
+	for _, filter := range filters {
+		if value := normalizeValue(filter.Value); !isOperatorDocument(value) {
+			setPath(document, filter.Key, value)
+		}
+	}
+	if err := applyUpdate(document, update); err != nil {
+		return err
+	}
+	if _, ok := document["_id"]; !ok {
+		document["_id"] = primitive.NewObjectID()
+	}
+	m.documents = append(m.documents, document)
+	return decodeDocument(document, model)
+}
+
+func (m *memoryRepository) DeleteMany(_ context.Context, filters ...repositories.Filter) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.documents[:0]
+	var deleted int64
+	for _, document := range m.documents {
+		if matchesFilters(document, filters) {
+			deleted++
+		} else {
+			kept = append(kept, document)
+		}
+	}
+	m.documents = kept
+	return deleted, nil
+}
+
+func (m *memoryRepository) insert(model interface{}) (primitive.ObjectID, error) {
+	document, ok := normalizeValue(model).(bson.M)
+	if !ok {
+		return primitive.NilObjectID, fmt.Errorf("cannot insert %T", model)
+	}
+	id, ok := document["_id"].(primitive.ObjectID)
+	if _, set := document["_id"]; !set || (ok && id.IsZero()) {
+		id = primitive.NewObjectID()
+		document["_id"] = id
+	}
+	m.documents = append(m.documents, document)
+	return id, nil
+}
+
+// normalizeValue value as MongoDB would store it, documents as bson.M and arrays as bson.A
+func normalizeValue(value interface{}) interface{} {
+	raw, err := bson.Marshal(bson.M{"v": value})
+	if err != nil {
+		panic(err)
+	}
+	var wrapper bson.M
+	if err = bson.Unmarshal(raw, &wrapper); err != nil {
+		panic(err)
+	}
+	return asDocuments(wrapper["v"])
+}
+
+// asDocuments converts the primitive.D the driver may decode nested documents into to bson.M, recursively
+func asDocuments(value interface{}) interface{} {
+	switch v := value.(type) {
+	case primitive.D:
+		document := bson.M{}
+		for _, element := range v {
+			document[element.Key] = asDocuments(element.Value)
+		}
+		return document
+	case bson.M:
+		for key := range v {
+			v[key] = asDocuments(v[key])
+		}
+		return v
+	case bson.A:
+		for i := range v {
+			v[i] = asDocuments(v[i])
+		}
+		return v
+	default:
+		return value
+	}
+}
+
+func decodeDocument(document bson.M, model interface{}) error {
+	raw, err := bson.Marshal(document)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, model)
+}
+
+func isOperatorDocument(value interface{}) bool {
+	document, ok := value.(bson.M)
+	if !ok || len(document) == 0 {
+		return false
+	}
+	for key := range document {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+func getPath(document bson.M, path string) (interface{}, bool) {
+	var value interface{} = document
+	for _, key := range strings.Split(path, ".") {
+		parent, ok := value.(bson.M)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = parent[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func setPath(document bson.M, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		child, ok := document[key].(bson.M)
+		if !ok {
+			child = bson.M{}
+			document[key] = child
+		}
+		document = child
+	}
+	document[keys[len(keys)-1]] = value
+}
+
+func unsetPath(document bson.M, path string) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		child, ok := document[key].(bson.M)
+		if !ok {
+			return
+		}
+		document = child
+	}
+	delete(document, keys[len(keys)-1])
+}
+
+func matchesFilters(document bson.M, filters []repositories.Filter) bool {
+	for _, filter := range filters {
+		value, found := getPath(document, filter.Key)
+		if !matchesCondition(value, found, normalizeValue(filter.Value)) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesCondition(value interface{}, found bool, condition interface{}) bool {
+	if !isOperatorDocument(condition) {
+		return valuesEqual(value, condition)
+	}
+	for operator, operand := range condition.(bson.M) {
+		var ok bool
+		switch operator {
+		case "$ne":
+			ok = !valuesEqual(value, operand)
+		case "$lt", "$lte", "$gt", "$gte":
+			order, comparable := compareValues(value, operand)
+			ok = found && comparable && map[string]bool{
+				"$lt": order < 0, "$lte": order <= 0, "$gt": order > 0, "$gte": order >= 0,
+			}[operator]
+		default:
+			panic("memoryRepository: unsupported query operator " + operator)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// valuesEqual equality of scalar values, null also matching a missing field
+func valuesEqual(a, b interface{}) bool {
+	if _, isArray := a.(bson.A); isArray {
+		panic("memoryRepository: unsupported query on an array")
+	}
+	if order, comparable := compareValues(a, b); comparable {
+		return order == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compareValues orders values of the same BSON type, numbers of any type with each other. comparable is false
+// between other types
+func compareValues(a, b interface{}) (int, bool) {
+	if a == nil || b == nil {
+		return 0, a == nil && b == nil
+	}
+	if x, ok := toNumber(a); ok {
+		y, ok := toNumber(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	switch x := a.(type) {
+	case primitive.DateTime:
+		if y, ok := b.(primitive.DateTime); ok {
+			return compareValues(int64(x), int64(y))
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			if x == y {
+				return 0, true
+			}
+			if !x {
+				return -1, true
+			}
+			return 1, true
+		}
+	case primitive.ObjectID:
+		if y, ok := b.(primitive.ObjectID); ok {
+			return bytes.Compare(x[:], y[:]), true
+		}
+	}
+	return 0, false
+}
+
+// applyUpdate applies the `$set`, `$unset` and `$inc` of an update document to document
+func applyUpdate(document bson.M, update interface{}) error {
+	operators, ok := normalizeValue(update).(bson.M)
+	if !ok {
+		return fmt.Errorf("memoryRepository: unsupported update %T", update)
+	}
+	for operator, operand := range operators {
+		for path, value := range operand.(bson.M) {
+			switch operator {
+			case "$set":
+				setPath(document, path, value)
+			case "$unset":
+				unsetPath(document, path)
+			case "$inc":
+				current, _ := getPath(document, path)
+				setPath(document, path, addNumbers(current, value))
+			default:
+				return fmt.Errorf("memoryRepository: unsupported update operator %s", operator)
+			}
+		}
+	}
+	return nil
+}
+
+// addNumbers sum keeping integers as int64, like MongoDB does until a double is involved. A missing value counts as 0
+func addNumbers(a, b interface{}) interface{} {
+	x, _ := toNumber(a)
+	y, _ := toNumber(b)
+	if isInteger(a) || a == nil {
+		if isInteger(b) {
+			return int64(x + y)
+		}
+	}
+	return x + y
+}
+
+func isInteger(value interface{}) bool {
+	switch value.(type) {
+	case int32, int64, int:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,297 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type mfaService struct {
+	ctx            context.Context
+	userRepository repositories.CrudOperation
+}
+
+const (
+	// AmrPassword, AmrOtp and AmrMfa authentication methods (RFC 8176) recorded in the `amr` claim. AmrMfa is present
+	// whenever a second factor was used, whichever it was
+	AmrPassword = "pwd"
+	AmrOtp      = "otp"
+	AmrMfa      = "mfa"
+	// TokenTypeMfaChallenge `typ` of the token returned by a password login that still needs a second factor
+	TokenTypeMfaChallenge = "mfa_challenge"
+
+	mfaChallengeLifetime    = 5 * time.Minute
+	mfaChallengeMaxAttempts = 5
+	recoveryCodeCount       = 10
+)
+
+var (
+	ErrMfaNotEnabled      = errors.New("multi-factor authentication is not enabled")
+	ErrMfaAlreadyEnabled  = errors.New("multi-factor authentication is already enabled")
+	ErrMfaNotEnrolling    = errors.New("start the enrollment before confirming it")
+	ErrInvalidMfaCode     = errors.New("invalid authentication code")
+	ErrMfaChallengeFailed = errors.New("sign in challenge expired or used too many times. Please sign in again")
+	ErrMfaRequired        = errors.New("your roles require multi-factor authentication")
+)
+
+// recoveryCodeAlphabet Crockford's base32, which leaves out letters easily mistaken for digits
+const recoveryCodeAlphabet = "0123456789abcdefghjkmnpqrstvwxyz"
+
+func NewMfaService(ctx context.Context, database internal.MongoDatabase) *mfaService {
+	return &mfaService{
+		ctx:            ctx,
+		userRepository: repositories.NewUserRepository(database),
+	}
+}
+
+// BeginEnrollment generates a new secret for the user, effective once ConfirmEnrollment receives a code from it.
+// Starting again replaces the secret awaiting confirmation
+func (m *mfaService) BeginEnrollment(userId primitive.ObjectID) (string, error) {
+	secret := NewTotpSecret()
+	matched, err := m.userRepository.UpdateOne(m.ctx,
+		bson.M{"$set": bson.M{"mfa.pending_secret": secret, "updated_at": time.Now()}},
+		repositories.Filter{Key: "_id", Value: userId},
+		repositories.Filter{Key: "mfa.enabled", Value: bson.M{"$ne": true}},
+	)
+	if err != nil {
+		return "", err
+	}
+	if matched == 0 {
+		return "", ErrMfaAlreadyEnabled
+	}
+	return secret, nil
+}
+
+// ConfirmEnrollment enables MFA once code proves the user's authenticator holds the pending secret, and returns the
+// recovery codes. They are only stored hashed and cannot be shown again
+func (m *mfaService) ConfirmEnrollment(userId primitive.ObjectID, code string) ([]string, error) {
+	user, err := m.user(userId)
+	if err != nil {
+		return nil, err
+	}
+	if user.Mfa != nil && user.Mfa.Enabled {
+		return nil, ErrMfaAlreadyEnabled
+	}
+	if user.Mfa == nil || user.Mfa.PendingSecret == "" {
+		return nil, ErrMfaNotEnrolling
+	}
+	step, ok := ValidateTotp(user.Mfa.PendingSecret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidMfaCode
+	}
+	codes, hashes := newRecoveryCodes()
+	now := time.Now()
+	matched, err := m.userRepository.UpdateOne(m.ctx,
+		bson.M{"$set": bson.M{"mfa": models.Mfa{
+			Enabled:       true,
+			Secret:        user.Mfa.PendingSecret,
+			RecoveryCodes: hashes,
+			LastUsedStep:  step,
+			EnabledAt:     &now,
+		}, "updated_at": now}},
+		repositories.Filter{Key: "_id", Value: userId},
+		repositories.Filter{Key: "mfa.pending_secret", Value: user.Mfa.PendingSecret},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if matched == 0 {
+		return nil, ErrMfaNotEnrolling
+	}
+	return codes, nil
+}
+
+// Disable turns MFA off. code must be valid, so a stolen session alone cannot remove the second factor
+func (m *mfaService) Disable(userId primitive.ObjectID, code string) error {
+	user, err := m.user(userId)
+	if err != nil {
+		return err
+	}
+	if err = m.Verify(user, code); err != nil {
+		return err
+	}
+	_, err = m.userRepository.UpdateOne(m.ctx,
+		bson.M{"$unset": bson.M{"mfa": ""}, "$set": bson.M{"updated_at": time.Now()}},
+		repositories.Filter{Key: "_id", Value: userId},
+	)
+	return err
+}
+
+// RegenerateRecoveryCodes replaces every recovery code of the user after checking code
+func (m *mfaService) RegenerateRecoveryCodes(userId primitive.ObjectID, code string) ([]string, error) {
+	user, err := m.user(userId)
+	if err != nil {
+		return nil, err
+	}
+	if err = m.Verify(user, code); err != nil {
+		return nil, err
+	}
+	codes, hashes := newRecoveryCodes()
+	_, err = m.userRepository.UpdateOne(m.ctx,
+		bson.M{"$set": bson.M{"mfa.recovery_codes": hashes, "updated_at": time.Now()}},
+		repositories.Filter{Key: "_id", Value: userId},
+	)
+	return codes, err
+}
+
+// Verify checks code, either from the user's authenticator or one of their recovery codes. Each code is accepted
+// once: an authenticator code must be more recent than the last one used and a recovery code is removed
+func (m *mfaService) Verify(user models.User, code string) error {
+	if user.Mfa == nil || !user.Mfa.Enabled {
+		return ErrMfaNotEnabled
+	}
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if step, ok := ValidateTotp(user.Mfa.Secret, code, time.Now()); ok {
+		matched, err := m.userRepository.UpdateOne(m.ctx,
+			bson.M{"$set": bson.M{"mfa.last_used_step": step}},
+			repositories.Filter{Key: "_id", Value: user.ID},
+			repositories.Filter{Key: "mfa.last_used_step", Value: bson.M{"$lt": step}},
+		)
+		if err != nil {
+			return err
+		}
+		if matched == 0 {
+			return ErrInvalidMfaCode
+		}
+		return nil
+	}
+	hash := HashToken(normalizeRecoveryCode(code))
+	if !slices.Contains(user.Mfa.RecoveryCodes, hash) {
+		return ErrInvalidMfaCode
+	}
+	matched, err := m.userRepository.UpdateOne(m.ctx,
+		bson.M{"$pull": bson.M{"mfa.recovery_codes": hash}, "$set": bson.M{"updated_at": time.Now()}},
+		repositories.Filter{Key: "_id", Value: user.ID},
+		repositories.Filter{Key: "mfa.recovery_codes", Value: hash},
+	)
+	if err != nil {
+		return err
+	}
+	if matched == 0 {
+		return ErrInvalidMfaCode
+	}
+	return nil
+}
+
+// IssueChallenge short-lived token a login returns when the user has MFA enabled, amr being how they passed the first
+// step. It is exchanged, with a code, by CompleteChallenge. Only the latest challenge of a user is valid
+func (m *mfaService) IssueChallenge(jwtService *jwtService, user models.User, amr []string) (string, error) {
+	challengeId := RandomToken(16)
+	if _, err := m.userRepository.UpdateOne(m.ctx,
+		bson.M{"$set": bson.M{"mfa.challenge_id": challengeId, "mfa.challenge_attempts": 0}},
+		repositories.Filter{Key: "_id", Value: user.ID},
+	); err != nil {
+		return "", err
+	}
+	return jwtService.GenerateJWT(user.ID.Hex(), mfaChallengeLifetime, map[string]any{
+		"typ": TokenTypeMfaChallenge,
+		"jti": challengeId,
+		"amr": amr,
+	})
+}
+
+// CompleteChallenge checks code against the user the challenge token was issued to and returns them, along with the
+// authentication methods of the whole login. A challenge tolerates a few wrong codes, then the user has to sign in
+// again
+func (m *mfaService) CompleteChallenge(jwtService *jwtService, challengeToken, code string) (models.User, []string, error) {
+	var subject string
+	claims, err := jwtService.ClaimToken(challengeToken, &subject)
+	if err != nil {
+		return models.User{}, nil, ErrMfaChallengeFailed
+	}
+	typ, _ := claims.(jwt.MapClaims)["typ"].(string)
+	challengeId, _ := claims.(jwt.MapClaims)["jti"].(string)
+	userId, err := primitive.ObjectIDFromHex(subject)
+	if typ != TokenTypeMfaChallenge || challengeId == "" || err != nil {
+		return models.User{}, nil, ErrMfaChallengeFailed
+	}
+	var amr []string
+	methods, _ := claims.(jwt.MapClaims)["amr"].([]any)
+	for _, method := range methods {
+		if method, ok := method.(string); ok {
+			amr = append(amr, method)
+		}
+	}
+	if len(amr) == 0 {
+		// challenges issued before the first step was recorded all followed a password
+		amr = []string{AmrPassword}
+	}
+	matched, err := m.userRepository.UpdateOne(m.ctx,
+		bson.M{"$inc": bson.M{"mfa.challenge_attempts": 1}},
+		repositories.Filter{Key: "_id", Value: userId},
+		repositories.Filter{Key: "mfa.challenge_id", Value: challengeId},
+		repositories.Filter{Key: "mfa.challenge_attempts", Value: bson.M{"$lt": mfaChallengeMaxAttempts}},
+	)
+	if err != nil {
+		return models.User{}, nil, err
+	}
+	if matched == 0 {
+		return models.User{}, nil, ErrMfaChallengeFailed
+	}
+	user, err := m.user(userId)
+	if err != nil {
+		return user, nil, err
+	}
+	if err = m.Verify(user, code); err != nil {
+		return user, nil, err
+	}
+	_, err = m.userRepository.UpdateOne(m.ctx,
+		bson.M{"$unset": bson.M{"mfa.challenge_id": ""}},
+		repositories.Filter{Key: "_id", Value: userId},
+		repositories.Filter{Key: "mfa.challenge_id", Value: challengeId},
+	)
+	return user, append(amr, AmrOtp, AmrMfa), err
+}
+
+// MfaEnabled reports whether user signs in with a second factor
+func MfaEnabled(user models.User) bool {
+	return user.Mfa != nil && user.Mfa.Enabled
+}
+
+func (m *mfaService) user(userId primitive.ObjectID) (models.User, error) {
+	var user models.User
+	if !m.userRepository.FindOne(m.ctx, &user, repositories.Filter{Key: "_id", Value: userId}) {
+		if err := m.ctx.Err(); err != nil {
+			return user, err
+		}
+		return user, ErrUserNotFound
+	}
+	return user, nil
+}
+
+// newRecoveryCodes recovery codes formatted `xxxxx-xxxxx` for the user, and their hashes for storage
+func newRecoveryCodes() ([]string, []string) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for len(codes) < recoveryCodeCount {
+		raw := make([]byte, 10)
+		if _, err := rand.Read(raw); err != nil {
+			panic(err)
+		}
+		code := make([]byte, 0, 11)
+		for i := range raw {
+			if i == 5 {
+				code = append(code, '-')
+			}
+			code = append(code, recoveryCodeAlphabet[int(raw[i])%len(recoveryCodeAlphabet)])
+		}
+		codes = append(codes, string(code))
+		hashes = append(hashes, HashToken(normalizeRecoveryCode(string(code))))
+	}
+	return codes, hashes
+}
+
+// normalizeRecoveryCode accepts recovery codes typed in any case, without the dash or with look-alikes
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", "o", "0", "i", "1", "l", "1").Replace(strings.ToLower(code))
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/repositories"
+	"testing"
+	"time"
+)
+
+// testMongoDatabase a database of its own on the MongoDB server of MONGO_TEST_URI, dropped when the test ends. Tests
+// of behaviour only a real server has (pipeline and conditional updates, array operators) are skipped without it.
+func testMongoDatabase(t *testing.T) internal.MongoDatabase {
+	t.Helper()
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		_ = client.Disconnect(context.Background())
+		t.Fatal(err)
+	}
+	database := client.Database("test_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		if err := database.Drop(context.Background()); err != nil {
+			t.Error(err)
+		}
+		_ = client.Disconnect(context.Background())
+	})
+	return database
+}
+
+// forEachStore runs test with an in-memory repository, then with the repository newRepository makes of the MongoDB of
+// MONGO_TEST_URI, so conditional updates are checked against the server too
+func forEachStore(t *testing.T, newRepository func(internal.MongoDatabase) repositories.CrudOperation, test func(t *testing.T, repository repositories.CrudOperation)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryRepository())
+	})
+	t.Run("mongo", func(t *testing.T) {
+		test(t, newRepository(testMongoDatabase(t)))
+	})
+}
@@ -0,0 +1,195 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type oneTimeTokenService struct {
+	ctx             context.Context
+	jwtService      *jwtService
+	tokenRepository repositories.CrudOperation
+}
+
+// oneTimeTokenThrottle limits how often tokens of one purpose are issued to a user, so mailing them cannot be used to
+// flood an inbox
+type oneTimeTokenThrottle struct {
+	interval  time.Duration // minimum time between two tokens
+	perWindow int           // tokens allowed within window
+	window    time.Duration
+}
+
+var (
+	ErrInvalidOneTimeToken   = errors.New("link is invalid, expired or was already used")
+	ErrOneTimeTokenThrottled = errors.New("too many requests. Please wait before asking for another email")
+	ErrOneTimeTokenBinding   = errors.New("link must be opened in the browser it was requested from")
+
+	defaultOneTimeTokenThrottle = oneTimeTokenThrottle{interval: time.Minute, perWindow: 5, window: time.Hour}
+)
+
+func NewOneTimeTokenService(ctx context.Context, database internal.MongoDatabase, jwtService *jwtService) *oneTimeTokenService {
+	return &oneTimeTokenService{
+		ctx:             ctx,
+		jwtService:      jwtService,
+		tokenRepository: repositories.NewOneTimeTokenRepository(database),
+	}
+}
+
+// Issue signed token for purpose, redeemable once by Consume within lifetime. Earlier unused tokens of the same
+// purpose stop working, so only the latest email sent is valid
+func (o *oneTimeTokenService) Issue(purpose string, userId primitive.ObjectID, lifetime time.Duration) (string, error) {
+	return o.issue(purpose, userId, lifetime, "")
+}
+
+// IssueBound token like Issue, only redeemable by ConsumeBound along with binding, a secret kept by the device the
+// token was requested from. The token carries a hash of binding, never binding itself
+func (o *oneTimeTokenService) IssueBound(purpose string, userId primitive.ObjectID, lifetime time.Duration, binding string) (string, error) {
+	return o.issue(purpose, userId, lifetime, binding)
+}
+
+func (o *oneTimeTokenService) issue(purpose string, userId primitive.ObjectID, lifetime time.Duration, binding string) (string, error) {
+	if err := o.throttle(purpose, userId, defaultOneTimeTokenThrottle); err != nil {
+		return "", err
+	}
+	tokenId := RandomToken(32)
+	claims := map[string]any{
+		"typ": purpose,
+		"jti": tokenId,
+	}
+	if binding != "" {
+		claims["bnd"] = HashToken(binding)
+	}
+	token, err := o.jwtService.GenerateJWT(userId.Hex(), lifetime, claims)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if _, err = o.tokenRepository.UpdateMany(o.ctx,
+		bson.M{"$set": bson.M{"consumed_at": now}},
+		repositories.Filter{Key: "user_id", Value: userId},
+		repositories.Filter{Key: "purpose", Value: purpose},
+		repositories.Filter{Key: "consumed_at", Value: nil},
+	); err != nil {
+		return "", err
+	}
+	_, err = o.tokenRepository.CreateOne(o.ctx, models.OneTimeToken{
+		BaseModel: models.NewBaseModel(),
+		TokenHash: HashToken(tokenId),
+		Purpose:   purpose,
+		UserId:    userId,
+		ExpiresAt: now.Add(lifetime),
+	})
+	return token, err
+}
+
+// Consume redeems token, issued for purpose, and returns the id of the user it was issued to
+func (o *oneTimeTokenService) Consume(purpose, token string) (primitive.ObjectID, error) {
+	return o.consume(purpose, token, "")
+}
+
+// ConsumeBound redeems token, issued by IssueBound for purpose, when binding is the one it was issued with. A token
+// presented with another binding is left unused
+func (o *oneTimeTokenService) ConsumeBound(purpose, token, binding string) (primitive.ObjectID, error) {
+	if binding == "" {
+		return primitive.NilObjectID, ErrOneTimeTokenBinding
+	}
+	return o.consume(purpose, token, binding)
+}
+
+func (o *oneTimeTokenService) consume(purpose, token, binding string) (primitive.ObjectID, error) {
+	userId, tokenId, err := o.parse(purpose, token, binding)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	now := time.Now()
+	matched, err := o.tokenRepository.UpdateOne(o.ctx,
+		bson.M{"$set": bson.M{"consumed_at": now, "updated_at": now}},
+		repositories.Filter{Key: "token_hash", Value: HashToken(tokenId)},
+		repositories.Filter{Key: "purpose", Value: purpose},
+		repositories.Filter{Key: "user_id", Value: userId},
+		repositories.Filter{Key: "consumed_at", Value: nil},
+		repositories.Filter{Key: "expires_at", Value: bson.M{"$gt": now}},
+	)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	if matched == 0 {
+		return primitive.NilObjectID, ErrInvalidOneTimeToken
+	}
+	return userId, nil
+}
+
+// Peek returns the id of the user token was issued to for purpose, when Consume would redeem it, without redeeming it
+func (o *oneTimeTokenService) Peek(purpose, token string) (primitive.ObjectID, error) {
+	userId, tokenId, err := o.parse(purpose, token, "")
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	var unused models.OneTimeToken
+	if !o.tokenRepository.FindOne(o.ctx, &unused,
+		repositories.Filter{Key: "token_hash", Value: HashToken(tokenId)},
+		repositories.Filter{Key: "purpose", Value: purpose},
+		repositories.Filter{Key: "user_id", Value: userId},
+		repositories.Filter{Key: "consumed_at", Value: nil},
+		repositories.Filter{Key: "expires_at", Value: bson.M{"$gt": time.Now()}},
+	) {
+		if err = o.ctx.Err(); err != nil {
+			return primitive.NilObjectID, err
+		}
+		return primitive.NilObjectID, ErrInvalidOneTimeToken
+	}
+	return userId, nil
+}
+
+// parse verifies the signature, purpose and binding of token and returns the user it was issued to and its id. Bound
+// tokens only parse along with their binding, unbound ones without any
+func (o *oneTimeTokenService) parse(purpose, token, binding string) (primitive.ObjectID, string, error) {
+	var subject string
+	claims, err := o.jwtService.ClaimToken(token, &subject)
+	if err != nil {
+		return primitive.NilObjectID, "", ErrInvalidOneTimeToken
+	}
+	typ, _ := claims.(jwt.MapClaims)["typ"].(string)
+	tokenId, _ := claims.(jwt.MapClaims)["jti"].(string)
+	userId, err := primitive.ObjectIDFromHex(subject)
+	if typ != purpose || tokenId == "" || err != nil {
+		return primitive.NilObjectID, "", ErrInvalidOneTimeToken
+	}
+	bound, _ := claims.(jwt.MapClaims)["bnd"].(string)
+	if binding == "" && bound != "" {
+		return primitive.NilObjectID, "", ErrInvalidOneTimeToken
+	}
+	if binding != "" && subtle.ConstantTimeCompare([]byte(bound), []byte(HashToken(binding))) != 1 {
+		return primitive.NilObjectID, "", ErrOneTimeTokenBinding
+	}
+	return userId, tokenId, nil
+}
+
+func (o *oneTimeTokenService) throttle(purpose string, userId primitive.ObjectID, limit oneTimeTokenThrottle) error {
+	var recent []models.OneTimeToken
+	if err := o.tokenRepository.FindAll(o.ctx, &recent,
+		repositories.Filter{Key: "user_id", Value: userId},
+		repositories.Filter{Key: "purpose", Value: purpose},
+		repositories.Filter{Key: "created_at", Value: bson.M{"$gt": time.Now().Add(-limit.window)}},
+	); err != nil {
+		return err
+	}
+	if len(recent) >= limit.perWindow {
+		return ErrOneTimeTokenThrottled
+	}
+	for _, token := range recent {
+		if time.Since(token.CreatedAt) < limit.interval {
+			return ErrOneTimeTokenThrottled
+		}
+	}
+	return nil
+}
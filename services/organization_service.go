@@ -0,0 +1,183 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"regexp"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type (
+	organizationService struct {
+		ctx                    context.Context
+		database               internal.MongoDatabase
+		organizationRepository repositories.CrudOperation
+		userRepository         repositories.CrudOperation
+	}
+	// organizationCache in-process cache of tenant lookups made by the tenant middleware on every request
+	organizationCache struct {
+		mu       sync.Mutex
+		entries  map[string]bool
+		loadedAt time.Time
+	}
+)
+
+const organizationCacheTtl = time.Minute
+
+var organizations = &organizationCache{entries: map[string]bool{}}
+
+// tenantSlug a DNS label, so every tenant can be served from its own subdomain
+var tenantSlug = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+var (
+	ErrOrganizationExists   = errors.New("organization already exists")
+	ErrOrganizationNotFound = errors.New("organization not found")
+	ErrInvalidTenantSlug    = errors.New("slug must be lower case letters, digits and dashes, at most 63 characters")
+	ErrNotMember            = errors.New("user is not a member of this organization")
+)
+
+func NewOrganizationService(ctx context.Context, database internal.MongoDatabase) *organizationService {
+	return &organizationService{
+		ctx:                    ctx,
+		database:               database,
+		organizationRepository: repositories.NewOrganizationRepository(database),
+		userRepository:         repositories.NewUserRepository(database),
+	}
+}
+
+func (o *organizationService) Create(organization models.Organization) (models.Organization, error) {
+	if !tenantSlug.MatchString(organization.Slug) {
+		return organization, ErrInvalidTenantSlug
+	}
+	if exists, err := o.Exists(organization.Slug); err != nil || exists {
+		if err == nil {
+			err = ErrOrganizationExists
+		}
+		return organization, err
+	}
+	organization.BaseModel = models.NewBaseModel()
+	id, err := o.organizationRepository.CreateOne(o.ctx, organization)
+	if err != nil {
+		return organization, err
+	}
+	organization.ID = id
+	organizations.set(organization.Slug, true)
+	return organization, nil
+}
+
+func (o *organizationService) List(currentPage, perPage int) ([]models.Organization, error) {
+	var result = []models.Organization{}
+	err := o.organizationRepository.FindPaginate(o.ctx, currentPage, perPage, &result)
+	return result, err
+}
+
+// Exists reports whether tenant is a registered organization. Answers are cached in-process
+func (o *organizationService) Exists(tenant string) (bool, error) {
+	if exists, ok := organizations.get(tenant); ok {
+		return exists, nil
+	}
+	var organization models.Organization
+	exists := o.organizationRepository.FindOne(o.ctx, &organization, repositories.Filter{Key: "slug", Value: tenant})
+	if err := o.ctx.Err(); err != nil {
+		return false, err
+	}
+	organizations.set(tenant, exists)
+	return exists, nil
+}
+
+// SetMember adds the user to the organization, or replaces the roles they hold in it
+func (o *organizationService) SetMember(tenant string, userId primitive.ObjectID, roles []string) error {
+	if exists, err := o.Exists(tenant); err != nil || !exists {
+		if err == nil {
+			err = ErrOrganizationNotFound
+		}
+		return err
+	}
+	if err := NewRbacService(o.ctx, o.database).rolesExist(roles); err != nil {
+		return err
+	}
+	roles = nonNil(roles)
+	matched, err := o.userRepository.UpdateOne(o.ctx,
+		bson.M{"$set": bson.M{"memberships.$.roles": roles, "updated_at": time.Now()}},
+		repositories.Filter{Key: "_id", Value: userId},
+		repositories.Filter{Key: "memberships.tenant", Value: tenant},
+	)
+	if err != nil || matched > 0 {
+		return err
+	}
+	matched, err = o.userRepository.UpdateOne(o.ctx,
+		bson.M{
+			"$push": bson.M{"memberships": models.Membership{Tenant: tenant, Roles: roles}},
+			"$set":  bson.M{"updated_at": time.Now()},
+		},
+		repositories.Filter{Key: "_id", Value: userId},
+		repositories.Filter{Key: "memberships.tenant", Value: bson.M{"$ne": tenant}},
+	)
+	if err != nil {
+		return err
+	}
+	if matched == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (o *organizationService) RemoveMember(tenant string, userId primitive.ObjectID) error {
+	matched, err := o.userRepository.UpdateOne(o.ctx,
+		bson.M{
+			"$pull": bson.M{"memberships": bson.M{"tenant": tenant}},
+			"$set":  bson.M{"updated_at": time.Now()},
+		},
+		repositories.Filter{Key: "_id", Value: userId},
+		repositories.Filter{Key: "memberships.tenant", Value: tenant},
+	)
+	if err != nil {
+		return err
+	}
+	if matched == 0 {
+		return ErrNotMember
+	}
+	return nil
+}
+
+func (o *organizationService) Members(tenant string, currentPage, perPage int) ([]models.User, error) {
+	var users []models.User
+	err := o.userRepository.FindPaginate(o.ctx, currentPage, perPage, &users, repositories.Filter{Key: "memberships.tenant", Value: tenant})
+	return users, err
+}
+
+// MembershipRoles roles user holds in tenant. ok is false when the user is not a member
+func MembershipRoles(user models.User, tenant string) (roles []string, ok bool) {
+	for i := range user.Memberships {
+		if user.Memberships[i].Tenant == tenant {
+			return user.Memberships[i].Roles, true
+		}
+	}
+	return nil, false
+}
+
+func (c *organizationCache) get(tenant string) (bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.loadedAt) > organizationCacheTtl {
+		c.entries, c.loadedAt = map[string]bool{}, time.Now()
+	}
+	exists, ok := c.entries[tenant]
+	return exists, ok
+}
+
+func (c *organizationCache) set(tenant string, exists bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= revocationCacheMaxEntries {
+		c.entries = map[string]bool{}
+	}
+	c.entries[tenant] = exists
+}
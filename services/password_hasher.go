@@ -0,0 +1,178 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"quickstart-go-jwt-mongodb/models"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type (
+	// PasswordHasher hashes passwords with the algorithm and parameters configured through PASSWORD_HASH_*, and
+	// verifies hashes of every supported algorithm, so stored hashes can be upgraded as users sign in
+	PasswordHasher interface {
+		Hash(password string) (string, error)
+		// Verify reports whether password matches hash, whatever algorithm and parameters it was made with
+		Verify(password, hash string) bool
+		// NeedsRehash reports whether hash was made with another algorithm or other parameters than Hash uses
+		NeedsRehash(hash string) bool
+	}
+	// passwordHashAlgorithm one hashing scheme, holding the parameters new hashes are made with
+	passwordHashAlgorithm interface {
+		hash(password string) (string, error)
+		// verify checks password against hash, made by this algorithm with any parameters
+		verify(password, hash string) bool
+		// current reports whether hash was made by this algorithm with the same parameters
+		current(hash string) bool
+	}
+	passwordHasher struct {
+		preferred passwordHashAlgorithm
+	}
+	bcryptAlgorithm struct {
+		cost int
+	}
+	// argon2idAlgorithm Argon2id (RFC 9106) with hashes encoded as PHC strings:
+	// `$argon2id$v=19$m={memory KiB},t={iterations},p={parallelism}${salt}${key}`, salt and key in unpadded base64
+	argon2idAlgorithm struct {
+		memory      uint32
+		iterations  uint32
+		parallelism uint8
+	}
+)
+
+const (
+	PasswordHashArgon2id = "argon2id"
+	PasswordHashBcrypt   = "bcrypt"
+
+	// OWASP's baseline for Argon2id: 19 MiB, 2 iterations, 1 lane
+	defaultArgon2Memory      = 19 * 1024
+	defaultArgon2Iterations  = 2
+	defaultArgon2Parallelism = 1
+	argon2SaltLength         = 16
+	argon2KeyLength          = 32
+)
+
+// NewPasswordHasher hashes with PASSWORD_HASH_ALGORITHM, `argon2id` (the default) tuned by PASSWORD_ARGON2_MEMORY
+// (KiB), PASSWORD_ARGON2_ITERATIONS and PASSWORD_ARGON2_PARALLELISM, or `bcrypt` tuned by PASSWORD_BCRYPT_COST.
+// Unset or invalid values keep their default
+func NewPasswordHasher(envVar models.EnvVar) PasswordHasher {
+	if bcryptPreferred(envVar) {
+		algorithm := bcryptAlgorithm{cost: bcrypt.DefaultCost}
+		if cost, err := strconv.Atoi(envVar.PasswordBcryptCost); err == nil && cost >= bcrypt.MinCost && cost <= bcrypt.MaxCost {
+			algorithm.cost = cost
+		}
+		return &passwordHasher{preferred: algorithm}
+	}
+	algorithm := argon2idAlgorithm{memory: defaultArgon2Memory, iterations: defaultArgon2Iterations, parallelism: defaultArgon2Parallelism}
+	if memory, err := strconv.ParseUint(envVar.PasswordArgon2Memory, 10, 32); err == nil && memory >= 8 {
+		algorithm.memory = uint32(memory)
+	}
+	if iterations, err := strconv.ParseUint(envVar.PasswordArgon2Iterations, 10, 32); err == nil && iterations > 0 {
+		algorithm.iterations = uint32(iterations)
+	}
+	if parallelism, err := strconv.ParseUint(envVar.PasswordArgon2Parallelism, 10, 8); err == nil && parallelism > 0 {
+		algorithm.parallelism = uint8(parallelism)
+	}
+	return &passwordHasher{preferred: algorithm}
+}
+
+func (p *passwordHasher) Hash(password string) (string, error) {
+	return p.preferred.hash(password)
+}
+
+func (p *passwordHasher) Verify(password, hash string) bool {
+	algorithm := passwordHashAlgorithmOf(hash)
+	return algorithm != nil && algorithm.verify(password, hash)
+}
+
+func (p *passwordHasher) NeedsRehash(hash string) bool {
+	return !p.preferred.current(hash)
+}
+
+func bcryptPreferred(envVar models.EnvVar) bool {
+	return strings.EqualFold(strings.TrimSpace(envVar.PasswordHashAlgorithm), PasswordHashBcrypt)
+}
+
+// passwordHashAlgorithmOf algorithm hash was made by, nil when unsupported
+func passwordHashAlgorithmOf(hash string) passwordHashAlgorithm {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return argon2idAlgorithm{}
+	case strings.HasPrefix(hash, "$2"):
+		return bcryptAlgorithm{}
+	default:
+		return nil
+	}
+}
+
+func (b bcryptAlgorithm) hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.cost)
+	return string(hash), err
+}
+
+func (b bcryptAlgorithm) verify(password, hash string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (b bcryptAlgorithm) current(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err == nil && cost == b.cost
+}
+
+func (a argon2idAlgorithm) hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.iterations, a.memory, a.parallelism, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, a.memory, a.iterations, a.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (a argon2idAlgorithm) verify(password, hash string) bool {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return false
+	}
+	candidate := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(candidate, key) == 1
+}
+
+func (a argon2idAlgorithm) current(hash string) bool {
+	params, _, key, err := decodeArgon2id(hash)
+	return err == nil && params == a && len(key) == argon2KeyLength
+}
+
+// decodeArgon2id parameters, salt and key of an Argon2id PHC string
+func decodeArgon2id(hash string) (argon2idAlgorithm, []byte, []byte, error) {
+	var (
+		params  argon2idAlgorithm
+		version int
+	)
+	fields := strings.Split(hash, "$")
+	if len(fields) != 6 || fields[1] != PasswordHashArgon2id {
+		return params, nil, nil, fmt.Errorf("not an argon2id hash")
+	}
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %q", fields[2])
+	}
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism); err != nil ||
+		params.iterations == 0 || params.parallelism == 0 {
+		return params, nil, nil, fmt.Errorf("invalid argon2 parameters %q", fields[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, fmt.Errorf("invalid argon2 key")
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,199 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2id parameters cheap enough for tests
+var testArgon2id = argon2idAlgorithm{memory: 64, iterations: 1, parallelism: 1}
+
+func hashWith(t *testing.T, algorithm passwordHashAlgorithm, password string) string {
+	hash, err := algorithm.hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestNewPasswordHasher(t *testing.T) {
+	tests := []struct {
+		name   string
+		envVar models.EnvVar
+		want   passwordHashAlgorithm
+	}{
+		{"defaults", models.EnvVar{}, argon2idAlgorithm{memory: defaultArgon2Memory, iterations: defaultArgon2Iterations, parallelism: defaultArgon2Parallelism}},
+		{"argon2id parameters", models.EnvVar{PasswordHashAlgorithm: "argon2id", PasswordArgon2Memory: "65536", PasswordArgon2Iterations: "3", PasswordArgon2Parallelism: "4"},
+			argon2idAlgorithm{memory: 65536, iterations: 3, parallelism: 4}},
+		{"invalid argon2id parameters", models.EnvVar{PasswordArgon2Memory: "4", PasswordArgon2Iterations: "0", PasswordArgon2Parallelism: "256"},
+			argon2idAlgorithm{memory: defaultArgon2Memory, iterations: defaultArgon2Iterations, parallelism: defaultArgon2Parallelism}},
+		{"bcrypt", models.EnvVar{PasswordHashAlgorithm: " BCrypt ", PasswordBcryptCost: "12"}, bcryptAlgorithm{cost: 12}},
+		{"bcrypt cost out of range", models.EnvVar{PasswordHashAlgorithm: "bcrypt", PasswordBcryptCost: "3"}, bcryptAlgorithm{cost: bcrypt.DefaultCost}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if preferred := NewPasswordHasher(test.envVar).(*passwordHasher).preferred; preferred != test.want {
+				t.Fatalf("hashes with %+v, want %+v", preferred, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeArgon2id(t *testing.T) {
+	salt := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	key := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	tests := []struct {
+		name  string
+		hash  string
+		valid bool
+		want  argon2idAlgorithm
+	}{
+		{"valid", "$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$" + key, true, argon2idAlgorithm{memory: 19456, iterations: 2, parallelism: 1}},
+		{"padded base64", "$argon2id$v=19$m=19456,t=2,p=1$" + salt + "==$" + key, false, argon2idAlgorithm{}},
+		{"too few fields", "$argon2id$v=19$m=19456,t=2,p=1$" + salt, false, argon2idAlgorithm{}},
+		{"too many fields", "$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$" + key + "$", false, argon2idAlgorithm{}},
+		{"argon2i", "$argon2i$v=19$m=19456,t=2,p=1$" + salt + "$" + key, false, argon2idAlgorithm{}},
+		{"older version", "$argon2id$v=16$m=19456,t=2,p=1$" + salt + "$" + key, false, argon2idAlgorithm{}},
+		{"missing version", "$argon2id$m=19456,t=2,p=1$" + salt + "$" + key + "$x", false, argon2idAlgorithm{}},
+		{"missing parameter", "$argon2id$v=19$m=19456,t=2$" + salt + "$" + key, false, argon2idAlgorithm{}},
+		{"zero iterations", "$argon2id$v=19$m=19456,t=0,p=1$" + salt + "$" + key, false, argon2idAlgorithm{}},
+		{"zero parallelism", "$argon2id$v=19$m=19456,t=2,p=0$" + salt + "$" + key, false, argon2idAlgorithm{}},
+		{"parallelism overflow", "$argon2id$v=19$m=19456,t=2,p=256$" + salt + "$" + key, false, argon2idAlgorithm{}},
+		{"negative memory", "$argon2id$v=19$m=-1,t=2,p=1$" + salt + "$" + key, false, argon2idAlgorithm{}},
+		{"salt not base64", "$argon2id$v=19$m=19456,t=2,p=1$not*base64$" + key, false, argon2idAlgorithm{}},
+		{"empty key", "$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$", false, argon2idAlgorithm{}},
+		{"key not base64", "$argon2id$v=19$m=19456,t=2,p=1$" + salt + "$not*base64", false, argon2idAlgorithm{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params, decodedSalt, decodedKey, err := decodeArgon2id(test.hash)
+			if (err == nil) != test.valid {
+				t.Fatalf("error %v, want valid %v", err, test.valid)
+			}
+			if test.valid && (params != test.want || string(decodedSalt) != "0123456789abcdef" || len(decodedKey) != argon2KeyLength) {
+				t.Fatalf("decoded %+v, salt %q, key of %d bytes", params, decodedSalt, len(decodedKey))
+			}
+		})
+	}
+}
+
+func TestPasswordHasherVerify(t *testing.T) {
+	hasher := &passwordHasher{preferred: testArgon2id}
+	argon2idHash := hashWith(t, testArgon2id, "correct horse")
+	bcryptHash := hashWith(t, bcryptAlgorithm{cost: bcrypt.MinCost}, "correct horse")
+	tests := []struct {
+		name     string
+		password string
+		hash     string
+		verified bool
+	}{
+		{"argon2id", "correct horse", argon2idHash, true},
+		{"argon2id wrong password", "correct horse!", argon2idHash, false},
+		{"argon2id other parameters", "correct horse", hashWith(t, argon2idAlgorithm{memory: 128, iterations: 2, parallelism: 2}, "correct horse"), true},
+		{"bcrypt", "correct horse", bcryptHash, true},
+		{"bcrypt wrong password", "Correct horse", bcryptHash, false},
+		{"empty hash", "", "", false},
+		{"plain text", "correct horse", "correct horse", false},
+		{"unsupported algorithm", "correct horse", "$scrypt$ln=15,r=8,p=1$c2FsdA$a2V5", false},
+		{"truncated argon2id", "correct horse", argon2idHash[:len(argon2idHash)-10], false},
+		{"argon2id without key", "correct horse", argon2idHash[:strings.LastIndex(argon2idHash, "$")+1], false},
+		{"truncated bcrypt", "correct horse", bcryptHash[:20], false},
+		{"bcrypt prefix only", "correct horse", "$2a$", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if verified := hasher.Verify(test.password, test.hash); verified != test.verified {
+				t.Fatalf("verified %v, want %v", verified, test.verified)
+			}
+		})
+	}
+}
+
+func TestPasswordHasherNeedsRehash(t *testing.T) {
+	argon2idHash := hashWith(t, testArgon2id, "correct horse")
+	bcryptHash := hashWith(t, bcryptAlgorithm{cost: bcrypt.MinCost}, "correct horse")
+	// a key shorter than argon2KeyLength, from another implementation
+	salt := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	shortKey := base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("correct horse"), []byte("0123456789abcdef"), 1, 64, 1, 16))
+	tests := []struct {
+		name      string
+		preferred passwordHashAlgorithm
+		hash      string
+		rehash    bool
+	}{
+		{"same argon2id parameters", testArgon2id, argon2idHash, false},
+		{"other memory", argon2idAlgorithm{memory: 128, iterations: 1, parallelism: 1}, argon2idHash, true},
+		{"other iterations", argon2idAlgorithm{memory: 64, iterations: 2, parallelism: 1}, argon2idHash, true},
+		{"other parallelism", argon2idAlgorithm{memory: 64, iterations: 1, parallelism: 2}, argon2idHash, true},
+		{"shorter key", testArgon2id, "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$" + shortKey, true},
+		{"bcrypt to argon2id", testArgon2id, bcryptHash, true},
+		{"argon2id to bcrypt", bcryptAlgorithm{cost: bcrypt.MinCost}, argon2idHash, true},
+		{"same bcrypt cost", bcryptAlgorithm{cost: bcrypt.MinCost}, bcryptHash, false},
+		{"other bcrypt cost", bcryptAlgorithm{cost: bcrypt.MinCost + 1}, bcryptHash, true},
+		{"malformed argon2id", testArgon2id, "$argon2id$v=19$m=64,t=1,p=1$", true},
+		{"malformed bcrypt", bcryptAlgorithm{cost: bcrypt.MinCost}, "$2a$", true},
+		{"empty hash", testArgon2id, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hasher := &passwordHasher{preferred: test.preferred}
+			if rehash := hasher.NeedsRehash(test.hash); rehash != test.rehash {
+				t.Fatalf("needs rehash %v, want %v", rehash, test.rehash)
+			}
+		})
+	}
+}
+
+func TestRehashMigratesBcryptToArgon2id(t *testing.T) {
+	forEachStore(t, repositories.NewUserRepository, func(t *testing.T, users repositories.CrudOperation) {
+		service := &passwordService{
+			ctx:            context.Background(),
+			hasher:         &passwordHasher{preferred: testArgon2id},
+			userRepository: users,
+		}
+		user := models.User{BaseModel: models.NewBaseModel(), Email: "ada@example.com",
+			Password: hashWith(t, bcryptAlgorithm{cost: bcrypt.MinCost}, "correct horse")}
+		var err error
+		if user.ID, err = users.CreateOne(context.Background(), user); err != nil {
+			t.Fatal(err)
+		}
+		stored := func() string {
+			var found models.User
+			users.FindOne(context.Background(), &found, repositories.Filter{Key: "_id", Value: user.ID})
+			return found.Password
+		}
+
+		migrated, err := service.Rehash(user, "correct horse")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(migrated, "$argon2id$v=19$m=64,t=1,p=1$") || stored() != migrated {
+			t.Fatalf("rehashed to %q, stored %q", migrated, stored())
+		}
+		if !service.hasher.Verify("correct horse", migrated) || service.hasher.NeedsRehash(migrated) {
+			t.Fatal("migrated hash does not verify or needs another rehash")
+		}
+
+		user.Password = migrated
+		if again, err := service.Rehash(user, "correct horse"); err != nil || again != migrated {
+			t.Fatalf("current hash rehashed to %q (%v)", again, err)
+		}
+
+		// the password changed since user was read: the newer hash must not be overwritten
+		changed := hashWith(t, bcryptAlgorithm{cost: bcrypt.MinCost}, "battery staple")
+		users.UpdateOne(context.Background(), bson.M{"$set": bson.M{"password": changed}},
+			repositories.Filter{Key: "_id", Value: user.ID})
+		user.Password = hashWith(t, bcryptAlgorithm{cost: bcrypt.MinCost}, "correct horse")
+		if kept, err := service.Rehash(user, "correct horse"); err != nil || kept != user.Password || stored() != changed {
+			t.Fatalf("rehash over a changed password returned %q (%v), stored %q", kept, err, stored())
+		}
+	})
+}
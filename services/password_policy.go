@@ -0,0 +1,228 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"quickstart-go-jwt-mongodb/models"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// PasswordPolicy rules every password set goes through, configured by the PASSWORD_* environment variables
+type PasswordPolicy struct {
+	MinLength int // in characters
+	MaxLength int // in characters
+	// RequiredClasses character classes a password must mix: PasswordClassLower, PasswordClassUpper,
+	// PasswordClassDigit and PasswordClassSymbol
+	RequiredClasses []string
+	// History previous passwords of a user that cannot be reused. The current one never can
+	History int
+	// MaxAge how long a password may be used before it must be changed. Zero never expires passwords
+	MaxAge time.Duration
+	// BreachedList Pwned Passwords SHA-1 list passwords are screened against. See passwordBreached
+	BreachedList string
+	// MaxBytes longest password the hashing algorithm takes in full. Zero for no limit
+	MaxBytes int
+	hasher   PasswordHasher
+}
+
+const (
+	PasswordClassLower  = "lower"
+	PasswordClassUpper  = "upper"
+	PasswordClassDigit  = "digit"
+	PasswordClassSymbol = "symbol"
+
+	defaultPasswordMinLength = 8
+	defaultPasswordMaxLength = 64
+	defaultPasswordHistory   = 5
+	// bcryptMaxBytes bcrypt ignores anything past 72 bytes, so longer passwords would be silently truncated
+	bcryptMaxBytes = 72
+	// personalInfoMinLength names and email parts shorter than this are too common to be refused in passwords
+	personalInfoMinLength = 3
+)
+
+var (
+	ErrWeakPassword     = errors.New("password does not meet the password policy")
+	ErrPasswordReused   = errors.New("password was used recently. Please choose another one")
+	ErrPasswordBreached = errors.New("password appears in a known data breach. Please choose another one")
+	ErrPasswordExpired  = errors.New("password expired. Please change it")
+
+	passwordClasses = map[string]func(r rune) bool{
+		PasswordClassLower:  unicode.IsLower,
+		PasswordClassUpper:  unicode.IsUpper,
+		PasswordClassDigit:  unicode.IsDigit,
+		PasswordClassSymbol: func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) },
+	}
+)
+
+// NewPasswordPolicy policy set by PASSWORD_MIN_LENGTH, PASSWORD_MAX_LENGTH, PASSWORD_REQUIRED_CLASSES,
+// PASSWORD_HISTORY, PASSWORD_MAX_AGE and PASSWORD_BREACHED_LIST. Unset or invalid values keep their default, main
+// refuses to start on invalid ones through CheckPasswordPolicy
+func NewPasswordPolicy(envVar models.EnvVar) PasswordPolicy {
+	policy := PasswordPolicy{
+		MinLength:    defaultPasswordMinLength,
+		MaxLength:    defaultPasswordMaxLength,
+		History:      defaultPasswordHistory,
+		BreachedList: envVar.PasswordBreachedList,
+		hasher:       NewPasswordHasher(envVar),
+	}
+	if bcryptPreferred(envVar) {
+		policy.MaxBytes = bcryptMaxBytes
+	}
+	if length, err := strconv.Atoi(envVar.PasswordMinLength); err == nil && length > 0 {
+		policy.MinLength = length
+	}
+	if length, err := strconv.Atoi(envVar.PasswordMaxLength); err == nil && length >= policy.MinLength {
+		policy.MaxLength = length
+	}
+	if history, err := strconv.Atoi(envVar.PasswordHistory); err == nil && history >= 0 {
+		policy.History = history
+	}
+	if maxAge, err := time.ParseDuration(envVar.PasswordMaxAge); err == nil && maxAge > 0 {
+		policy.MaxAge = maxAge
+	}
+	for _, class := range strings.Split(envVar.PasswordRequiredClasses, ",") {
+		class = strings.ToLower(strings.TrimSpace(class))
+		if _, known := passwordClasses[class]; known {
+			policy.RequiredClasses = append(policy.RequiredClasses, class)
+		}
+	}
+	return policy
+}
+
+// CheckPasswordPolicy error on the first PASSWORD_* value that is invalid or would refuse every password, such as a
+// minimum length above the maximum one or above the 72 bytes bcrypt hashes
+func CheckPasswordPolicy(envVar models.EnvVar) error {
+	minLength, maxLength := defaultPasswordMinLength, defaultPasswordMaxLength
+	if envVar.PasswordMinLength != "" {
+		length, err := strconv.Atoi(envVar.PasswordMinLength)
+		if err != nil || length <= 0 {
+			return fmt.Errorf("invalid `PASSWORD_MIN_LENGTH` %q. Expected a positive number", envVar.PasswordMinLength)
+		}
+		minLength = length
+	}
+	if envVar.PasswordMaxLength != "" {
+		length, err := strconv.Atoi(envVar.PasswordMaxLength)
+		if err != nil || length <= 0 {
+			return fmt.Errorf("invalid `PASSWORD_MAX_LENGTH` %q. Expected a positive number", envVar.PasswordMaxLength)
+		}
+		maxLength = length
+	}
+	if minLength > maxLength {
+		return fmt.Errorf("`PASSWORD_MIN_LENGTH` %d is above `PASSWORD_MAX_LENGTH` %d", minLength, maxLength)
+	}
+	// every character takes at least a byte
+	if bcryptPreferred(envVar) && minLength > bcryptMaxBytes {
+		return fmt.Errorf("`PASSWORD_MIN_LENGTH` %d is above the %d bytes bcrypt hashes", minLength, bcryptMaxBytes)
+	}
+	if envVar.PasswordHistory != "" {
+		if history, err := strconv.Atoi(envVar.PasswordHistory); err != nil || history < 0 {
+			return fmt.Errorf("invalid `PASSWORD_HISTORY` %q. Expected a number", envVar.PasswordHistory)
+		}
+	}
+	if envVar.PasswordMaxAge != "" {
+		if maxAge, err := time.ParseDuration(envVar.PasswordMaxAge); err != nil || maxAge <= 0 {
+			return fmt.Errorf("invalid `PASSWORD_MAX_AGE` %q. Expected a positive duration such as 2160h", envVar.PasswordMaxAge)
+		}
+	}
+	for _, class := range strings.Split(envVar.PasswordRequiredClasses, ",") {
+		class = strings.ToLower(strings.TrimSpace(class))
+		if _, known := passwordClasses[class]; class != "" && !known {
+			return fmt.Errorf("unknown `PASSWORD_REQUIRED_CLASSES` class %q", class)
+		}
+	}
+	return nil
+}
+
+// Validate checks password against the policy before it becomes user's. user may be an account not created yet
+func (p PasswordPolicy) Validate(password string, user models.User) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		return fmt.Errorf("%w: it must be at least %d characters long", ErrWeakPassword, p.MinLength)
+	}
+	if length > p.MaxLength {
+		return fmt.Errorf("%w: it must not be longer than %d characters", ErrWeakPassword, p.MaxLength)
+	}
+	if p.MaxBytes > 0 && len(password) > p.MaxBytes {
+		return fmt.Errorf("%w: it must not be longer than %d bytes", ErrWeakPassword, p.MaxBytes)
+	}
+	for _, class := range p.RequiredClasses {
+		if !strings.ContainsFunc(password, passwordClasses[class]) {
+			return fmt.Errorf("%w: it must contain characters of each class: %s", ErrWeakPassword, strings.Join(p.RequiredClasses, ", "))
+		}
+	}
+	lowered := strings.ToLower(password)
+	for _, personal := range personalInfo(user) {
+		if strings.Contains(lowered, personal) {
+			return fmt.Errorf("%w: it must not contain your name or email", ErrWeakPassword)
+		}
+	}
+	if p.BreachedList != "" {
+		breached, err := passwordBreached(p.BreachedList, password)
+		if err != nil {
+			// a list that cannot be read must not keep everyone from setting a password
+			log.Error("unable to screen password against the breached password list", err)
+		}
+		if breached {
+			return ErrPasswordBreached
+		}
+	}
+	for _, hash := range p.recentHashes(user) {
+		if p.hasher.Verify(password, hash) {
+			return ErrPasswordReused
+		}
+	}
+	return nil
+}
+
+// Expired reports whether user's password is older than MaxAge. Passwords set before their change was recorded
+// count from the creation of the account
+func (p PasswordPolicy) Expired(user models.User) bool {
+	if p.MaxAge == 0 || user.Password == "" {
+		return false
+	}
+	changedAt := user.PasswordChangedAt
+	if changedAt.IsZero() {
+		changedAt = user.CreatedAt
+	}
+	return time.Since(changedAt) > p.MaxAge
+}
+
+// PasswordUpdate $set document giving user passwordHash as password, the replaced one joining the history
+func (p PasswordPolicy) PasswordUpdate(user models.User, passwordHash string) bson.M {
+	now := time.Now()
+	history := p.recentHashes(user)
+	return bson.M{
+		"password":            passwordHash,
+		"password_changed_at": now,
+		"password_history":    history[:min(p.History, len(history))],
+		"updated_at":          now,
+	}
+}
+
+// recentHashes hashes of user's current password and of the History previous ones, latest first
+func (p PasswordPolicy) recentHashes(user models.User) []string {
+	if user.Password == "" {
+		return nil
+	}
+	return append([]string{user.Password}, user.PasswordHistory[:min(p.History, len(user.PasswordHistory))]...)
+}
+
+// personalInfo lowercased names and email parts of user long enough to be refused in a password
+func personalInfo(user models.User) []string {
+	localPart, _, _ := strings.Cut(user.Email, "@")
+	var personal []string
+	for _, value := range []string{user.FirstName, user.LastName, localPart} {
+		value = strings.ToLower(strings.TrimSpace(value))
+		if utf8.RuneCountInString(value) >= personalInfoMinLength {
+			personal = append(personal, value)
+		}
+	}
+	return personal
+}
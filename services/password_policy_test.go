@@ -0,0 +1,213 @@
+package services
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"quickstart-go-jwt-mongodb/models"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:       8,
+		MaxLength:       16,
+		RequiredClasses: []string{PasswordClassLower, PasswordClassDigit},
+		History:         2,
+		hasher:          &passwordHasher{preferred: bcryptAlgorithm{cost: bcrypt.MinCost}},
+	}
+}
+
+func testPasswordHash(t *testing.T, password string) string {
+	hash, err := bcryptAlgorithm{cost: bcrypt.MinCost}.hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestCheckPasswordPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		envVar models.EnvVar
+		valid  bool
+	}{
+		{"defaults", models.EnvVar{}, true},
+		{"full policy", models.EnvVar{PasswordMinLength: "12", PasswordMaxLength: "128", PasswordRequiredClasses: "lower, Upper,digit",
+			PasswordHistory: "0", PasswordMaxAge: "2160h"}, true},
+		{"equal bounds", models.EnvVar{PasswordMinLength: "10", PasswordMaxLength: "10"}, true},
+		{"min above max", models.EnvVar{PasswordMinLength: "20", PasswordMaxLength: "12"}, false},
+		{"min above default max", models.EnvVar{PasswordMinLength: "80"}, false},
+		{"max below default min", models.EnvVar{PasswordMaxLength: "6"}, false},
+		{"min above bcrypt bytes", models.EnvVar{PasswordMinLength: "80", PasswordMaxLength: "100", PasswordHashAlgorithm: "bcrypt"}, false},
+		{"bcrypt at its limit", models.EnvVar{PasswordMinLength: "72", PasswordMaxLength: "100", PasswordHashAlgorithm: "bcrypt"}, true},
+		{"min not a number", models.EnvVar{PasswordMinLength: "eight"}, false},
+		{"zero min", models.EnvVar{PasswordMinLength: "0"}, false},
+		{"negative max", models.EnvVar{PasswordMaxLength: "-1"}, false},
+		{"negative history", models.EnvVar{PasswordHistory: "-1"}, false},
+		{"max age without unit", models.EnvVar{PasswordMaxAge: "90"}, false},
+		{"zero max age", models.EnvVar{PasswordMaxAge: "0s"}, false},
+		{"unknown class", models.EnvVar{PasswordRequiredClasses: "lower,emoji"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := CheckPasswordPolicy(test.envVar); (err == nil) != test.valid {
+				t.Fatalf("error %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestNewPasswordPolicy(t *testing.T) {
+	policy := NewPasswordPolicy(models.EnvVar{PasswordMinLength: "12", PasswordMaxLength: "100", PasswordRequiredClasses: " Upper,symbol ",
+		PasswordHistory: "3", PasswordMaxAge: "720h", PasswordHashAlgorithm: "bcrypt"})
+	if policy.MinLength != 12 || policy.MaxLength != 100 || policy.History != 3 || policy.MaxAge != 720*time.Hour ||
+		policy.MaxBytes != bcryptMaxBytes || strings.Join(policy.RequiredClasses, ",") != "upper,symbol" {
+		t.Fatalf("policy %+v", policy)
+	}
+	policy = NewPasswordPolicy(models.EnvVar{})
+	if policy.MinLength != defaultPasswordMinLength || policy.MaxLength != defaultPasswordMaxLength ||
+		policy.History != defaultPasswordHistory || policy.MaxAge != 0 || policy.MaxBytes != 0 || len(policy.RequiredClasses) != 0 {
+		t.Fatalf("default policy %+v", policy)
+	}
+}
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	user := models.User{FirstName: "Al", LastName: "Lovelace", Email: "countess@example.com"}
+	tests := []struct {
+		name     string
+		maxBytes int
+		password string
+		err      error
+	}{
+		{"valid", 0, "correct4horse", nil},
+		{"too short", 0, "short1", ErrWeakPassword},
+		{"shortest", 0, "abcdefg1", nil},
+		{"longest", 0, "abcdefghijklmno1", nil},
+		{"too long", 0, "abcdefghijklmnop1", ErrWeakPassword},
+		{"length in characters", 0, "ééééééé1", nil},
+		{"over the hashed bytes", 12, "ééééééé1", ErrWeakPassword},
+		{"missing a class", 0, "correcthorse", ErrWeakPassword},
+		{"last name", 0, "lovelace1234", ErrWeakPassword},
+		{"email local part in capitals", 0, "COUNTESS1234x", ErrWeakPassword},
+		{"name too short to refuse", 0, "al123456", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy := testPasswordPolicy()
+			policy.MaxBytes = test.maxBytes
+			if err := policy.Validate(test.password, user); !errors.Is(err, test.err) {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyHistory(t *testing.T) {
+	policy := testPasswordPolicy()
+	user := models.User{
+		Email:    "ada@example.com",
+		Password: testPasswordHash(t, "current1"),
+		PasswordHistory: []string{
+			testPasswordHash(t, "previous1"),
+			testPasswordHash(t, "previous2"),
+			testPasswordHash(t, "forgotten3"),
+		},
+	}
+	tests := []struct {
+		password string
+		err      error
+	}{
+		{"current1", ErrPasswordReused},
+		{"previous1", ErrPasswordReused},
+		{"previous2", ErrPasswordReused},
+		// older than the History kept
+		{"forgotten3", nil},
+		{"brandnew4", nil},
+	}
+	for _, test := range tests {
+		if err := policy.Validate(test.password, user); !errors.Is(err, test.err) {
+			t.Errorf("%s: error %v, want %v", test.password, err, test.err)
+		}
+	}
+
+	update := policy.PasswordUpdate(user, "new hash")
+	history := update["password_history"].([]string)
+	if update["password"] != "new hash" || len(history) != policy.History || history[0] != user.Password ||
+		history[1] != user.PasswordHistory[0] {
+		t.Fatalf("update %+v", update)
+	}
+	if history := policy.PasswordUpdate(models.User{}, "new hash")["password_history"].([]string); len(history) != 0 {
+		t.Fatalf("history %v of a user without password", history)
+	}
+}
+
+func TestPasswordPolicyBreachedList(t *testing.T) {
+	hashOf := func(password string) string {
+		sum := sha1.Sum([]byte(password))
+		return strings.ToUpper(hex.EncodeToString(sum[:]))
+	}
+	breached := hashOf("breached1")
+
+	file := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(file, []byte(breached+":42\n"+hashOf("other1")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ranges := t.TempDir()
+	rangeFile := filepath.Join(ranges, breached[:sha1PrefixLength]+".txt")
+	if err := os.WriteFile(rangeFile, []byte(breached[sha1PrefixLength:]+":42\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, list := range map[string]string{"single file": file, "range files": ranges} {
+		t.Run(name, func(t *testing.T) {
+			policy := testPasswordPolicy()
+			policy.BreachedList = list
+			if err := policy.Validate("breached1", models.User{}); !errors.Is(err, ErrPasswordBreached) {
+				t.Fatalf("breached password: error %v", err)
+			}
+			if err := policy.Validate("unbreached1", models.User{}); err != nil {
+				t.Fatalf("password not in the list: error %v", err)
+			}
+		})
+	}
+
+	// an unreadable list lets passwords through rather than refusing them all
+	policy := testPasswordPolicy()
+	policy.BreachedList = filepath.Join(t.TempDir(), "missing.txt")
+	if err := policy.Validate("breached1", models.User{}); err != nil {
+		t.Fatalf("missing list: error %v", err)
+	}
+}
+
+func TestPasswordPolicyExpired(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		maxAge  time.Duration
+		user    models.User
+		expired bool
+	}{
+		{"no max age", 0, models.User{Password: "hash", PasswordChangedAt: now.Add(-1000 * time.Hour)}, false},
+		{"changed recently", time.Hour, models.User{Password: "hash", PasswordChangedAt: now.Add(-time.Minute)}, false},
+		{"changed long ago", time.Hour, models.User{Password: "hash", PasswordChangedAt: now.Add(-2 * time.Hour)}, true},
+		{"change never recorded", time.Hour,
+			models.User{BaseModel: models.BaseModel{CreatedAt: now.Add(-2 * time.Hour)}, Password: "hash"}, true},
+		{"no password", time.Hour, models.User{PasswordChangedAt: now.Add(-2 * time.Hour)}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy := testPasswordPolicy()
+			policy.MaxAge = test.maxAge
+			if expired := policy.Expired(test.user); expired != test.expired {
+				t.Fatalf("expired %v, want %v", expired, test.expired)
+			}
+		})
+	}
+}
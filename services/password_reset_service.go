@@ -0,0 +1,110 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type passwordResetService struct {
+	ctx            context.Context
+	mailer         Mailer
+	tokens         *oneTimeTokenService
+	sessions       *sessionService
+	policy         PasswordPolicy
+	userRepository repositories.CrudOperation
+}
+
+const (
+	// TokenTypePasswordReset `typ` of the token emailed to reset a forgotten password
+	TokenTypePasswordReset = "password_reset"
+
+	passwordResetLifetime = 30 * time.Minute
+)
+
+func NewPasswordResetService(ctx context.Context, database internal.MongoDatabase, envVar models.EnvVar) *passwordResetService {
+	return &passwordResetService{
+		ctx:            ctx,
+		mailer:         NewMailer(database),
+		tokens:         NewOneTimeTokenService(ctx, database, NewJwtService(ctx, envVar)),
+		sessions:       NewSessionService(ctx, database),
+		policy:         NewPasswordPolicy(envVar),
+		userRepository: repositories.NewUserRepository(database),
+	}
+}
+
+// Request emails the account registered with email a link to resetUrl carrying a reset token. Unknown addresses and
+// throttled requests are ignored without error, so callers cannot tell whether an account exists
+func (p *passwordResetService) Request(email, resetUrl string) error {
+	var user models.User
+	if !p.userRepository.FindOne(p.ctx, &user, repositories.Filter{Key: "email", Value: email}) {
+		return nil
+	}
+	token, err := p.tokens.Issue(TokenTypePasswordReset, user.ID, passwordResetLifetime)
+	if errors.Is(err, ErrOneTimeTokenThrottled) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	mail, err := RenderMail(MailPasswordReset, user.Locale, MailData{
+		Name:     user.FirstName,
+		Link:     resetUrl + "?token=" + url.QueryEscape(token),
+		ValidFor: passwordResetLifetime,
+	})
+	if err != nil {
+		return err
+	}
+	mail.To = user.Email
+	return p.mailer.Send(p.ctx, mail)
+}
+
+// User the user token was issued to, so the new password can be checked against the policy without using the token up
+func (p *passwordResetService) User(token string) (models.User, error) {
+	var user models.User
+	userId, err := p.tokens.Peek(TokenTypePasswordReset, token)
+	if err != nil {
+		return user, err
+	}
+	return user, p.findUser(userId, &user)
+}
+
+// Reset redeems token and replaces the password of the user it was issued to with passwordHash, then signs them out
+// everywhere. The link reached their mailbox, so their email counts as verified from now on
+func (p *passwordResetService) Reset(token, passwordHash string) (primitive.ObjectID, error) {
+	userId, err := p.tokens.Consume(TokenTypePasswordReset, token)
+	if err != nil {
+		return userId, err
+	}
+	var user models.User
+	if err = p.findUser(userId, &user); err != nil {
+		return userId, err
+	}
+	update := p.policy.PasswordUpdate(user, passwordHash)
+	update["email_verified"] = true
+	matched, err := p.userRepository.UpdateOne(p.ctx, bson.M{"$set": update}, repositories.Filter{Key: "_id", Value: userId})
+	if err != nil {
+		return userId, err
+	}
+	if matched == 0 {
+		return userId, ErrUserNotFound
+	}
+	return userId, p.sessions.RevokeUser(userId)
+}
+
+func (p *passwordResetService) findUser(userId primitive.ObjectID, user *models.User) error {
+	if !p.userRepository.FindOne(p.ctx, user, repositories.Filter{Key: "_id", Value: userId}) {
+		if err := p.ctx.Err(); err != nil {
+			return err
+		}
+		return ErrUserNotFound
+	}
+	return nil
+}
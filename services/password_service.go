@@ -0,0 +1,71 @@
+package services
+
+import (
+	"context"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type passwordService struct {
+	ctx            context.Context
+	policy         PasswordPolicy
+	hasher         PasswordHasher
+	sessions       *sessionService
+	userRepository repositories.CrudOperation
+}
+
+func NewPasswordService(ctx context.Context, database internal.MongoDatabase, envVar models.EnvVar) *passwordService {
+	return &passwordService{
+		ctx:            ctx,
+		policy:         NewPasswordPolicy(envVar),
+		hasher:         NewPasswordHasher(envVar),
+		sessions:       NewSessionService(ctx, database),
+		userRepository: repositories.NewUserRepository(database),
+	}
+}
+
+// Validate checks password against the password policy before it becomes user's
+func (p *passwordService) Validate(user models.User, password string) error {
+	return p.policy.Validate(password, user)
+}
+
+// Change replaces the password of user with passwordHash, of a password Validate accepted, and signs them out of
+// every session
+func (p *passwordService) Change(user models.User, passwordHash string) error {
+	matched, err := p.userRepository.UpdateOne(p.ctx,
+		bson.M{"$set": p.policy.PasswordUpdate(user, passwordHash)},
+		repositories.Filter{Key: "_id", Value: user.ID},
+	)
+	if err != nil {
+		return err
+	}
+	if matched == 0 {
+		return ErrUserNotFound
+	}
+	return p.sessions.RevokeUser(user.ID)
+}
+
+// Rehash upgrades the stored hash of user, who just signed in with password, when it was made with another algorithm
+// or other parameters than the preferred ones. It returns the hash stored once done
+func (p *passwordService) Rehash(user models.User, password string) (string, error) {
+	if !p.hasher.NeedsRehash(user.Password) {
+		return user.Password, nil
+	}
+	passwordHash, err := p.hasher.Hash(password)
+	if err != nil {
+		return user.Password, err
+	}
+	// matching the replaced hash keeps a password changed in the meantime from being overwritten
+	matched, err := p.userRepository.UpdateOne(p.ctx,
+		bson.M{"$set": bson.M{"password": passwordHash}},
+		repositories.Filter{Key: "_id", Value: user.ID},
+		repositories.Filter{Key: "password", Value: user.Password},
+	)
+	if err != nil || matched == 0 {
+		return user.Password, err
+	}
+	return passwordHash, nil
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type (
+	// PolicyInput everything a policy may base its decision on
+	PolicyInput struct {
+		UserId      string // empty for machine tokens
+		ClientId    string
+		Roles       []string // effective roles
+		Permissions []string
+		Claims      map[string]interface{}
+		Method      string
+		Path        string
+		PathVars    map[string]string
+		ClientIp    string
+		Time        time.Time
+		// Resource the request targets, when the Controller declares a loader. nil otherwise or when it was not found
+		Resource map[string]interface{}
+	}
+	// Decision outcome of a policy. Reason is returned to the caller and written to the audit log
+	Decision struct {
+		Allow  bool
+		Reason string
+	}
+	// PolicyFunc Go predicate policy
+	PolicyFunc func(input PolicyInput) Decision
+)
+
+var policies = struct {
+	sync.RWMutex
+	byName map[string]PolicyFunc
+}{byName: map[string]PolicyFunc{}}
+
+// RegisterPolicy makes a Go predicate available to Controller.Policy under name, replacing any policy of that name
+func RegisterPolicy(name string, policy PolicyFunc) {
+	policies.Lock()
+	defer policies.Unlock()
+	policies.byName[name] = policy
+}
+
+// EvaluatePolicy runs the policy registered under name. Unknown policies deny, so a typo never opens a route
+func EvaluatePolicy(name string, input PolicyInput) Decision {
+	policies.RLock()
+	policy, ok := policies.byName[name]
+	policies.RUnlock()
+	if !ok {
+		return Decision{Allow: false, Reason: fmt.Sprintf("policy %s is not registered", name)}
+	}
+	return policy(input)
+}
+
+func Allow(reason string) Decision {
+	return Decision{Allow: true, Reason: reason}
+}
+
+func Deny(reason string) Decision {
+	return Decision{Allow: false, Reason: reason}
+}
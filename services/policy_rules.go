@@ -0,0 +1,294 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+type (
+	// RulePolicy declarative policy. Rules are evaluated in order and the first one whose condition matches decides;
+	// when none matches the Default effect applies, which is deny unless set to allow. Example:
+	//
+	//	{
+	//	  "rules": [
+	//	    {"effect": "allow", "reason": "owner", "when": {"attr": "resource.owner_id", "op": "eq", "value_attr": "subject.id"}},
+	//	    {"effect": "allow", "reason": "supervisor in office hours", "when": {"all": [
+	//	      {"attr": "subject.roles", "op": "contains", "value": "SUPERVISOR"},
+	//	      {"attr": "time.hour", "op": "between", "value": [9, 17]},
+	//	      {"attr": "request.ip", "op": "cidr", "value": ["10.0.0.0/8"]}
+	//	    ]}}
+	//	  ]
+	//	}
+	//
+	// Attributes: subject.id, subject.client_id, subject.roles, subject.permissions, subject.claims.<name>,
+	// request.method, request.path, request.ip, request.vars.<name>, time.hour, time.weekday (0 is Sunday) and
+	// resource.<field>. Operators: eq, ne, in, contains, gt, gte, lt, lte, between (inclusive lower, exclusive upper
+	// bound), cidr and exists. A condition compares its attribute with value, or with another attribute (value_attr)
+	RulePolicy struct {
+		Default string `json:"default"`
+		Rules   []Rule `json:"rules"`
+	}
+	Rule struct {
+		Effect string    `json:"effect"`
+		Reason string    `json:"reason"`
+		When   Condition `json:"when"`
+	}
+	// Condition either combines nested conditions (all, any, not) or compares an attribute. An empty condition matches
+	Condition struct {
+		All       []Condition `json:"all,omitempty"`
+		Any       []Condition `json:"any,omitempty"`
+		Not       *Condition  `json:"not,omitempty"`
+		Attr      string      `json:"attr,omitempty"`
+		Op        string      `json:"op,omitempty"`
+		Value     interface{} `json:"value,omitempty"`
+		ValueAttr string      `json:"value_attr,omitempty"`
+	}
+)
+
+const (
+	effectAllow = "allow"
+	effectDeny  = "deny"
+)
+
+var ruleOperators = []string{"eq", "ne", "in", "contains", "gt", "gte", "lt", "lte", "between", "cidr", "exists"}
+
+// RegisterRulePolicy parses a RulePolicy JSON document and registers it under name
+func RegisterRulePolicy(name string, document []byte) error {
+	var policy RulePolicy
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&policy); err != nil {
+		return fmt.Errorf("policy %s: %w", name, err)
+	}
+	if err := policy.validate(); err != nil {
+		return fmt.Errorf("policy %s: %w", name, err)
+	}
+	RegisterPolicy(name, policy.Evaluate)
+	return nil
+}
+
+func (p RulePolicy) Evaluate(input PolicyInput) Decision {
+	for i := range p.Rules {
+		if p.Rules[i].When.matches(input) {
+			return Decision{Allow: p.Rules[i].Effect == effectAllow, Reason: p.Rules[i].Reason}
+		}
+	}
+	if p.Default == effectAllow {
+		return Allow("no rule matched")
+	}
+	return Deny("no rule matched")
+}
+
+func (p RulePolicy) validate() error {
+	if p.Default != "" && p.Default != effectAllow && p.Default != effectDeny {
+		return fmt.Errorf("unknown default effect %q", p.Default)
+	}
+	for i := range p.Rules {
+		if p.Rules[i].Effect != effectAllow && p.Rules[i].Effect != effectDeny {
+			return fmt.Errorf("rule %d: unknown effect %q", i, p.Rules[i].Effect)
+		}
+		if err := p.Rules[i].When.validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (c Condition) validate() error {
+	for _, nested := range append(slices.Clone(c.All), c.Any...) {
+		if err := nested.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Not != nil {
+		if err := c.Not.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Attr == "" {
+		if c.Op != "" {
+			return errors.New("operator without attribute")
+		}
+		return nil
+	}
+	if !slices.Contains(ruleOperators, c.Op) {
+		return fmt.Errorf("unknown operator %q", c.Op)
+	}
+	if c.Op == "cidr" {
+		for _, network := range toList(c.Value) {
+			if _, _, err := net.ParseCIDR(fmt.Sprint(network)); err != nil {
+				return err
+			}
+		}
+	}
+	if c.Op == "between" && len(toList(c.Value)) != 2 {
+		return errors.New("between expects a [lower, upper] value")
+	}
+	return nil
+}
+
+func (c Condition) matches(input PolicyInput) bool {
+	for i := range c.All {
+		if !c.All[i].matches(input) {
+			return false
+		}
+	}
+	if len(c.Any) > 0 && !slices.ContainsFunc(c.Any, func(nested Condition) bool { return nested.matches(input) }) {
+		return false
+	}
+	if c.Not != nil && c.Not.matches(input) {
+		return false
+	}
+	if c.Attr == "" {
+		return true
+	}
+
+	actual, found := input.attribute(c.Attr)
+	if c.Op == "exists" {
+		return found
+	}
+	if !found {
+		return false
+	}
+	expected := c.Value
+	if c.ValueAttr != "" {
+		if expected, found = input.attribute(c.ValueAttr); !found {
+			return false
+		}
+	}
+	switch c.Op {
+	case "eq":
+		return equalValues(actual, expected)
+	case "ne":
+		return !equalValues(actual, expected)
+	case "in":
+		return slices.ContainsFunc(toList(expected), func(v interface{}) bool { return equalValues(actual, v) })
+	case "contains":
+		return slices.ContainsFunc(toList(actual), func(v interface{}) bool { return equalValues(v, expected) })
+	case "gt", "gte", "lt", "lte":
+		a, okA := toNumber(actual)
+		b, okB := toNumber(expected)
+		return okA && okB && compareNumbers(c.Op, a, b)
+	case "between":
+		bounds := toList(expected)
+		value, ok := toNumber(actual)
+		lower, okLower := toNumber(bounds[0])
+		upper, okUpper := toNumber(bounds[1])
+		return ok && okLower && okUpper && value >= lower && value < upper
+	case "cidr":
+		ip := net.ParseIP(fmt.Sprint(actual))
+		return ip != nil && slices.ContainsFunc(toList(expected), func(network interface{}) bool {
+			_, ipNet, err := net.ParseCIDR(fmt.Sprint(network))
+			return err == nil && ipNet.Contains(ip)
+		})
+	}
+	return false
+}
+
+func (input PolicyInput) attribute(path string) (interface{}, bool) {
+	scope, name, _ := strings.Cut(path, ".")
+	switch scope {
+	case "subject":
+		switch {
+		case name == "id":
+			return input.UserId, input.UserId != ""
+		case name == "client_id":
+			return input.ClientId, input.ClientId != ""
+		case name == "roles":
+			return input.Roles, true
+		case name == "permissions":
+			return input.Permissions, true
+		case strings.HasPrefix(name, "claims."):
+			value, ok := input.Claims[strings.TrimPrefix(name, "claims.")]
+			return value, ok
+		}
+	case "request":
+		switch {
+		case name == "method":
+			return input.Method, true
+		case name == "path":
+			return input.Path, true
+		case name == "ip":
+			return input.ClientIp, input.ClientIp != ""
+		case strings.HasPrefix(name, "vars."):
+			value, ok := input.PathVars[strings.TrimPrefix(name, "vars.")]
+			return value, ok
+		}
+	case "time":
+		switch name {
+		case "hour":
+			return input.Time.Hour(), true
+		case "weekday":
+			return int(input.Time.Weekday()), true
+		}
+	case "resource":
+		var value interface{} = input.Resource
+		for _, key := range strings.Split(name, ".") {
+			fields, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if value, ok = fields[key]; !ok {
+				return nil, false
+			}
+		}
+		return value, value != nil
+	}
+	return nil, false
+}
+
+func equalValues(a, b interface{}) bool {
+	if x, ok := toNumber(a); ok {
+		y, ok := toNumber(b)
+		return ok && x == y
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func compareNumbers(op string, a, b float64) bool {
+	switch op {
+	case "gt":
+		return a > b
+	case "gte":
+		return a >= b
+	case "lt":
+		return a < b
+	}
+	return a <= b
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case int:
+		return float64(number), true
+	case int32:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	case float64:
+		return number, true
+	}
+	return 0, false
+}
+
+// toList accepts a single value as a list of one, so `"value": "10.0.0.0/8"` and `"value": ["10.0.0.0/8"]` both work
+func toList(value interface{}) []interface{} {
+	switch list := value.(type) {
+	case []interface{}:
+		return list
+	case []string:
+		values := make([]interface{}, len(list))
+		for i := range list {
+			values[i] = list[i]
+		}
+		return values
+	case nil:
+		return nil
+	}
+	return []interface{}{value}
+}
@@ -0,0 +1,15 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+)
+
+// RandomToken url-safe string of n random bytes, for identifiers that must not be guessable
+func RandomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,319 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type (
+	// RateLimitRule at most Requests per Window, as declared by a server.RateLimit
+	RateLimitRule struct {
+		Requests      int
+		Window        time.Duration
+		Burst         int
+		SlidingWindow bool
+	}
+	// RateLimitResult outcome of counting a request against a RateLimitRule
+	RateLimitResult struct {
+		Allowed   bool
+		Limit     int
+		Remaining int
+		// Reset until the caller has its whole quota back
+		Reset time.Duration
+		// RetryAfter until a refused request would be allowed
+		RetryAfter time.Duration
+	}
+	// RateLimitStore keeps the counters of rate limited callers
+	RateLimitStore interface {
+		// Take counts a request of key against rule, unless rule refuses it, and returns the updated counter
+		Take(ctx context.Context, key string, rule RateLimitRule, now time.Time) (models.RateLimitCounter, error)
+	}
+	// RateLimiter counts requests against rate limits, the global one set by RATE_LIMIT included
+	RateLimiter struct {
+		store  RateLimitStore
+		global RateLimitRule
+	}
+	memoryRateLimitStore struct {
+		mu       sync.Mutex
+		counters map[string]models.RateLimitCounter
+		sweptAt  time.Time
+	}
+	mongoRateLimitStore struct {
+		repository repositories.CrudOperation
+	}
+)
+
+const (
+	RateLimitStoreMemory = "memory"
+	RateLimitStoreMongo  = "mongo"
+
+	memoryRateLimitSweepInterval = time.Minute
+)
+
+// StartRateLimiter creates the process-wide rate limiter. RATE_LIMIT_STORE `memory` (the default) keeps counters in
+// this process, so every instance limits on its own; `mongo` shares them between instances through the `rate_limits`
+// collection, purged of expired counters every hour until ctx is done
+func StartRateLimiter(ctx context.Context, database internal.MongoDatabase, envVar models.EnvVar) (*RateLimiter, error) {
+	limiter := &RateLimiter{}
+	if envVar.RateLimit != "" {
+		global, err := ParseRateLimitRule(envVar.RateLimit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid `RATE_LIMIT` %q. %v", envVar.RateLimit, err)
+		}
+		limiter.global = global
+	}
+	switch envVar.RateLimitStore {
+	case "", RateLimitStoreMemory:
+		limiter.store = &memoryRateLimitStore{counters: map[string]models.RateLimitCounter{}}
+	case RateLimitStoreMongo:
+		store := &mongoRateLimitStore{repository: repositories.NewRateLimitRepository(database)}
+		limiter.store = store
+		go store.sweep(ctx)
+	default:
+		return nil, fmt.Errorf("invalid `RATE_LIMIT_STORE` %q", envVar.RateLimitStore)
+	}
+	return limiter, nil
+}
+
+// ParseRateLimitRule a `{requests}/{window}` rule such as `300/1m`
+func ParseRateLimitRule(value string) (RateLimitRule, error) {
+	requests, window, found := strings.Cut(strings.TrimSpace(value), "/")
+	if !found {
+		return RateLimitRule{}, fmt.Errorf("expected {requests}/{window}")
+	}
+	var (
+		rule RateLimitRule
+		err  error
+	)
+	if rule.Requests, err = strconv.Atoi(requests); err != nil || rule.Requests <= 0 {
+		return RateLimitRule{}, fmt.Errorf("invalid request count %q", requests)
+	}
+	if rule.Window, err = time.ParseDuration(window); err != nil || rule.Window < time.Millisecond {
+		return RateLimitRule{}, fmt.Errorf("invalid window %q", window)
+	}
+	return rule, nil
+}
+
+// Global the RATE_LIMIT rule applied to every request, per client IP. ok is false when there is none
+func (l *RateLimiter) Global() (RateLimitRule, bool) {
+	return l.global, l.global.Enabled()
+}
+
+// Take counts a request of key against rule
+func (l *RateLimiter) Take(ctx context.Context, key string, rule RateLimitRule) (RateLimitResult, error) {
+	now := time.Now()
+	counter, err := l.store.Take(ctx, key, rule, now)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return rule.result(counter, now), nil
+}
+
+// Enabled reports whether the rule limits anything
+func (r RateLimitRule) Enabled() bool {
+	return r.Requests > 0 && r.Window >= time.Millisecond
+}
+
+func (r RateLimitRule) burst() int {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	return r.Requests
+}
+
+// perToken how long the token bucket takes to refill one request
+func (r RateLimitRule) perToken() time.Duration {
+	return r.Window / time.Duration(r.Requests)
+}
+
+// take counts a request against the counter, in memory. mongoRateLimitStore runs the same computation as a pipeline
+func (r RateLimitRule) take(counter *models.RateLimitCounter, now time.Time) {
+	if r.SlidingWindow {
+		windowStart := now.Truncate(r.Window)
+		switch {
+		case counter.WindowStart.Equal(windowStart):
+		case counter.WindowStart.Equal(windowStart.Add(-r.Window)):
+			counter.Previous, counter.Count = counter.Count, 0
+		default:
+			counter.Previous, counter.Count = 0, 0
+		}
+		counter.WindowStart = windowStart
+		counter.ExpiresAt = windowStart.Add(2 * r.Window)
+		counter.Allowed = r.estimate(*counter, now) < float64(r.Requests)
+		if counter.Allowed {
+			counter.Count++
+		}
+		return
+	}
+	burst := float64(r.burst())
+	if counter.UpdatedAt.IsZero() {
+		counter.Tokens = burst
+	} else {
+		counter.Tokens = min(burst, counter.Tokens+float64(max(0, now.Sub(counter.UpdatedAt)))/float64(r.perToken()))
+	}
+	counter.UpdatedAt = now
+	counter.ExpiresAt = now.Add(time.Duration(r.burst()) * r.perToken())
+	counter.Allowed = counter.Tokens >= 1
+	if counter.Allowed {
+		counter.Tokens--
+	}
+}
+
+// pipeline update doing what take does, atomically, on the stored counter
+func (r RateLimitRule) pipeline(now time.Time) bson.A {
+	if r.SlidingWindow {
+		windowStart := now.Truncate(r.Window)
+		currentWindow := bson.M{"$eq": bson.A{"$window_start", windowStart}}
+		return bson.A{
+			bson.M{"$set": bson.M{
+				"previous": bson.M{"$switch": bson.M{
+					"branches": bson.A{
+						bson.M{"case": currentWindow, "then": bson.M{"$ifNull": bson.A{"$previous", 0}}},
+						bson.M{"case": bson.M{"$eq": bson.A{"$window_start", windowStart.Add(-r.Window)}}, "then": bson.M{"$ifNull": bson.A{"$count", 0}}},
+					},
+					"default": 0,
+				}},
+				"count":        bson.M{"$cond": bson.A{currentWindow, bson.M{"$ifNull": bson.A{"$count", 0}}, 0}},
+				"window_start": windowStart,
+				"expires_at":   windowStart.Add(2 * r.Window),
+			}},
+			bson.M{"$set": bson.M{"allowed": bson.M{"$lt": bson.A{
+				bson.M{"$add": bson.A{bson.M{"$multiply": bson.A{"$previous", r.previousWeight(windowStart, now)}}, "$count"}},
+				r.Requests,
+			}}}},
+			bson.M{"$set": bson.M{"count": bson.M{"$cond": bson.A{"$allowed", bson.M{"$add": bson.A{"$count", 1}}, "$count"}}}},
+		}
+	}
+	burst := float64(r.burst())
+	elapsedMs := bson.M{"$max": bson.A{0, bson.M{"$subtract": bson.A{now, bson.M{"$ifNull": bson.A{"$updated_at", now}}}}}}
+	return bson.A{
+		bson.M{"$set": bson.M{
+			"tokens": bson.M{"$min": bson.A{burst, bson.M{"$add": bson.A{
+				bson.M{"$ifNull": bson.A{"$tokens", burst}},
+				bson.M{"$divide": bson.A{elapsedMs, float64(r.perToken()) / float64(time.Millisecond)}},
+			}}}},
+			"updated_at": now,
+			"expires_at": now.Add(time.Duration(r.burst()) * r.perToken()),
+		}},
+		bson.M{"$set": bson.M{
+			"allowed": bson.M{"$gte": bson.A{"$tokens", 1}},
+			"tokens":  bson.M{"$cond": bson.A{bson.M{"$gte": bson.A{"$tokens", 1}}, bson.M{"$subtract": bson.A{"$tokens", 1}}, "$tokens"}},
+		}},
+	}
+}
+
+// estimate requests of the sliding window ending now: those of the current window plus the share of the previous
+// window's still within it
+func (r RateLimitRule) estimate(counter models.RateLimitCounter, now time.Time) float64 {
+	return float64(counter.Previous)*r.previousWeight(counter.WindowStart, now) + float64(counter.Count)
+}
+
+func (r RateLimitRule) previousWeight(windowStart, now time.Time) float64 {
+	return 1 - float64(now.Sub(windowStart))/float64(r.Window)
+}
+
+func (r RateLimitRule) result(counter models.RateLimitCounter, now time.Time) RateLimitResult {
+	result := RateLimitResult{Allowed: counter.Allowed}
+	if r.SlidingWindow {
+		result.Limit = r.Requests
+		result.Remaining = max(0, r.Requests-int(math.Ceil(r.estimate(counter, now))))
+		switch {
+		case counter.Count > 0:
+			result.Reset = counter.WindowStart.Add(2 * r.Window).Sub(now)
+		case counter.Previous > 0:
+			result.Reset = counter.WindowStart.Add(r.Window).Sub(now)
+		}
+		if !counter.Allowed {
+			result.RetryAfter = r.slidingRetryAfter(counter, now)
+		}
+		return result
+	}
+	result.Limit = r.burst()
+	result.Remaining = int(counter.Tokens)
+	result.Reset = time.Duration((float64(r.burst()) - counter.Tokens) * float64(r.perToken()))
+	if !counter.Allowed {
+		result.RetryAfter = ceilMillisecond((1 - counter.Tokens) * float64(r.perToken()))
+	}
+	return result
+}
+
+// slidingRetryAfter until the estimate drops below Requests: once enough of the previous window has slid out or,
+// when the current window alone is full, once enough of it has slid out in the next one. The estimate equals Requests
+// at that instant, so the request is allowed from the next millisecond on
+func (r RateLimitRule) slidingRetryAfter(counter models.RateLimitCounter, now time.Time) time.Duration {
+	window := float64(r.Window)
+	var sinceWindowStart float64
+	if counter.Count < r.Requests && counter.Previous > 0 {
+		sinceWindowStart = window * (1 - float64(r.Requests-counter.Count)/float64(counter.Previous))
+	} else {
+		sinceWindowStart = window + window*(1-float64(r.Requests)/float64(counter.Count))
+	}
+	retryAt := counter.WindowStart.Add(time.Duration(math.Round(sinceWindowStart))).Truncate(time.Millisecond).Add(time.Millisecond)
+	return max(time.Millisecond, retryAt.Sub(now))
+}
+
+// ceilMillisecond nanoseconds rounded up to the millisecond, the precision counters are stored with
+func ceilMillisecond(nanoseconds float64) time.Duration {
+	return time.Duration(math.Ceil(nanoseconds/float64(time.Millisecond))) * time.Millisecond
+}
+
+func (m *memoryRateLimitStore) Take(_ context.Context, key string, rule RateLimitRule, now time.Time) (models.RateLimitCounter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Sub(m.sweptAt) >= memoryRateLimitSweepInterval {
+		for k, counter := range m.counters {
+			if counter.ExpiresAt.Before(now) {
+				delete(m.counters, k)
+			}
+		}
+		m.sweptAt = now
+	}
+	counter := m.counters[key]
+	counter.Key = key
+	rule.take(&counter, now)
+	m.counters[key] = counter
+	return counter, nil
+}
+
+func (m *mongoRateLimitStore) Take(ctx context.Context, key string, rule RateLimitRule, now time.Time) (models.RateLimitCounter, error) {
+	var counter models.RateLimitCounter
+	update := rule.pipeline(now)
+	err := m.repository.UpsertOne(ctx, &counter, update, repositories.Filter{Key: "_id", Value: key})
+	if mongo.IsDuplicateKeyError(err) {
+		// a concurrent request created the counter first; it exists now
+		err = m.repository.UpsertOne(ctx, &counter, update, repositories.Filter{Key: "_id", Value: key})
+	}
+	return counter, err
+}
+
+// sweep deletes expired counters every hour until ctx is done
+func (m *mongoRateLimitStore) sweep(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sweepCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			if _, err := m.repository.DeleteMany(sweepCtx,
+				repositories.Filter{Key: "expires_at", Value: bson.M{"$lt": time.Now()}},
+			); err != nil {
+				log.Error("unable to purge expired rate limits", err)
+			}
+			cancel()
+		}
+	}
+}
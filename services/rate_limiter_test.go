@@ -0,0 +1,168 @@
+package services
+
+import (
+	"context"
+	"math"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"testing"
+	"time"
+)
+
+// rateLimitEpoch start of a window of every rule below, at millisecond precision like stored times
+var rateLimitEpoch = time.UnixMilli(1_699_999_980_000)
+
+type rateLimitStep struct {
+	at         time.Duration // since rateLimitEpoch
+	requests   int
+	allowed    bool // of the last request
+	remaining  int
+	retryAfter time.Duration
+}
+
+// runRateLimitSteps counts the requests of steps in memory and, against the MongoDB of MONGO_TEST_URI, with the
+// pipeline of mongoRateLimitStore
+func runRateLimitSteps(t *testing.T, rule RateLimitRule, steps []rateLimitStep) {
+	t.Run("memory", func(t *testing.T) {
+		var counter models.RateLimitCounter
+		checkRateLimitSteps(t, rule, steps, func(now time.Time) (models.RateLimitCounter, error) {
+			rule.take(&counter, now)
+			return counter, nil
+		})
+	})
+	t.Run("mongo", func(t *testing.T) {
+		store := &mongoRateLimitStore{repository: repositories.NewRateLimitRepository(testMongoDatabase(t))}
+		checkRateLimitSteps(t, rule, steps, func(now time.Time) (models.RateLimitCounter, error) {
+			return store.Take(context.Background(), "ip:192.0.2.1", rule, now)
+		})
+	})
+}
+
+func checkRateLimitSteps(t *testing.T, rule RateLimitRule, steps []rateLimitStep, take func(now time.Time) (models.RateLimitCounter, error)) {
+	for i, step := range steps {
+		now := rateLimitEpoch.Add(step.at)
+		var (
+			counter models.RateLimitCounter
+			err     error
+		)
+		for n := 0; n < max(step.requests, 1); n++ {
+			if counter, err = take(now); err != nil {
+				t.Fatal(err)
+			}
+		}
+		result := rule.result(counter, now)
+		if result.Allowed != step.allowed || result.Remaining != step.remaining || result.RetryAfter != step.retryAfter {
+			t.Fatalf("step %d at %s: allowed %v, remaining %d, retry after %s; want %v, %d, %s", i, step.at,
+				result.Allowed, result.Remaining, result.RetryAfter, step.allowed, step.remaining, step.retryAfter)
+		}
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	// a token every 6s, at most 5 at once
+	rule := RateLimitRule{Requests: 10, Window: time.Minute, Burst: 5}
+	runRateLimitSteps(t, rule, []rateLimitStep{
+		{at: 0, requests: 4, allowed: true, remaining: 1},
+		{at: 0, allowed: true, remaining: 0},
+		{at: 0, allowed: false, remaining: 0, retryAfter: 6 * time.Second},
+		{at: 3 * time.Second, allowed: false, remaining: 0, retryAfter: 3 * time.Second},
+		{at: 6 * time.Second, allowed: true, remaining: 0},
+		{at: 18 * time.Second, allowed: true, remaining: 1},
+		{at: 10 * time.Minute, allowed: true, remaining: 4},
+	})
+
+	var counter models.RateLimitCounter
+	rule.take(&counter, rateLimitEpoch)
+	if reset := rule.result(counter, rateLimitEpoch).Reset; reset != 6*time.Second {
+		t.Fatalf("reset %s after one request, want 6s", reset)
+	}
+}
+
+func TestSlidingWindowWeighting(t *testing.T) {
+	rule := RateLimitRule{Requests: 10, Window: time.Minute, SlidingWindow: true}
+	runRateLimitSteps(t, rule, []rateLimitStep{
+		{at: 10 * time.Second, requests: 10, allowed: true, remaining: 0},
+		// the current window alone is full: wait for 10s of the next one, when the estimate drops below 10
+		{at: 10 * time.Second, allowed: false, remaining: 0, retryAfter: 50*time.Second + time.Millisecond},
+		{at: 30 * time.Second, allowed: false, remaining: 0, retryAfter: 30*time.Second + time.Millisecond},
+		// the previous window still weighs fully when the next starts
+		{at: time.Minute, allowed: false, remaining: 0, retryAfter: time.Millisecond},
+		// half way, the previous window counts for 5
+		{at: 90 * time.Second, allowed: true, remaining: 4},
+		{at: 90 * time.Second, requests: 4, allowed: true, remaining: 0},
+		{at: 90 * time.Second, allowed: false, remaining: 0, retryAfter: time.Millisecond},
+		{at: 105 * time.Second, allowed: true, remaining: 1},
+		// windows older than the previous one are forgotten
+		{at: 4 * time.Minute, allowed: true, remaining: 9},
+	})
+}
+
+// rateLimitRules rules exercised by the property tests, each with requests a little faster than it allows
+var rateLimitRules = map[string]RateLimitRule{
+	"token bucket":          {Requests: 10, Window: time.Minute, Burst: 5},
+	"token bucket no burst": {Requests: 7, Window: time.Second},
+	"sliding window":        {Requests: 10, Window: time.Minute, SlidingWindow: true},
+	"short sliding window":  {Requests: 3, Window: time.Second, SlidingWindow: true},
+}
+
+func rateLimitStride(rule RateLimitRule) time.Duration {
+	return (rule.Window / time.Duration(3*rule.Requests)).Truncate(time.Millisecond) + 7*time.Millisecond
+}
+
+func TestRateLimitRetryAfter(t *testing.T) {
+	for name, rule := range rateLimitRules {
+		t.Run(name, func(t *testing.T) {
+			var counter models.RateLimitCounter
+			refusals := 0
+			for i := 0; i < 500; i++ {
+				now := rateLimitEpoch.Add(time.Duration(i) * rateLimitStride(rule))
+				rule.take(&counter, now)
+				result := rule.result(counter, now)
+				if result.Allowed {
+					continue
+				}
+				refusals++
+				// the counter as it is after the refusal, asked again just before and once Retry-After is over
+				early, onTime := counter, counter
+				if rule.take(&early, now.Add(result.RetryAfter-time.Millisecond)); early.Allowed {
+					t.Fatalf("request %d allowed before its Retry-After of %s", i, result.RetryAfter)
+				}
+				if rule.take(&onTime, now.Add(result.RetryAfter)); !onTime.Allowed {
+					t.Fatalf("request %d still refused after its Retry-After of %s", i, result.RetryAfter)
+				}
+			}
+			if refusals == 0 {
+				t.Fatal("no request refused")
+			}
+		})
+	}
+}
+
+// TestRateLimitStoresAgree the pipeline of mongoRateLimitStore, run by the MongoDB of MONGO_TEST_URI, must count
+// exactly like take
+func TestRateLimitStoresAgree(t *testing.T) {
+	repository := repositories.NewRateLimitRepository(testMongoDatabase(t))
+	for name, rule := range rateLimitRules {
+		t.Run(name, func(t *testing.T) {
+			mongoStore := &mongoRateLimitStore{repository: repository}
+			var counter models.RateLimitCounter
+			now := rateLimitEpoch
+			for i := 0; i < 300; i++ {
+				// bursts and pauses, so counters both run out and refill
+				now = now.Add(time.Duration([]int{0, 1, 0, 2, 0, 0, 1, 40}[i%8]) * rateLimitStride(rule))
+				rule.take(&counter, now)
+				stored, err := mongoStore.Take(context.Background(), "rule:"+name, rule, now)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stored.Allowed != counter.Allowed || stored.Count != counter.Count || stored.Previous != counter.Previous ||
+					!stored.WindowStart.Equal(counter.WindowStart) || math.Abs(stored.Tokens-counter.Tokens) > 1e-9 {
+					t.Fatalf("request %d: stored %+v, in memory %+v", i, stored, counter)
+				}
+				if got, want := rule.result(stored, now), rule.result(counter, now); got != want {
+					t.Fatalf("request %d: stored result %+v, in memory %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
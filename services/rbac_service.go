@@ -0,0 +1,308 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"slices"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type (
+	rbacService struct {
+		ctx                  context.Context
+		roleRepository       repositories.CrudOperation
+		permissionRepository repositories.CrudOperation
+		userRepository       repositories.CrudOperation
+	}
+	// Authorization effective roles and permissions of a caller, once the role hierarchy has been expanded
+	Authorization struct {
+		Roles       []string
+		Permissions []string
+		RequireMfa  bool // one of the roles requires a second factor
+	}
+	// roleGraphCache in-process snapshot of the `roles` collection. SecureMiddleware resolves effective permissions on
+	// every request, so the collection is loaded at most once per roleGraphTtl. Changes made through this instance
+	// invalidate it straight away; other instances pick them up once it expires
+	roleGraphCache struct {
+		mu       sync.Mutex
+		roles    map[string]models.Role
+		loadedAt time.Time
+	}
+)
+
+const roleGraphTtl = time.Minute
+
+var roleGraph = &roleGraphCache{}
+
+var (
+	ErrRoleExists         = errors.New("role already exists")
+	ErrRoleNotFound       = errors.New("role not found")
+	ErrPermissionExists   = errors.New("permission already exists")
+	ErrPermissionNotFound = errors.New("permission not found")
+	ErrUserNotFound       = errors.New("user not found")
+	ErrRoleInheritsItself = errors.New("a role cannot inherit itself")
+)
+
+func NewRbacService(ctx context.Context, database internal.MongoDatabase) *rbacService {
+	return &rbacService{
+		ctx:                  ctx,
+		roleRepository:       repositories.NewRoleRepository(database),
+		permissionRepository: repositories.NewPermissionRepository(database),
+		userRepository:       repositories.NewUserRepository(database),
+	}
+}
+
+// Resolve expands roles through the role hierarchy and collects their permissions. Roles unknown to the `roles`
+// collection are kept as they are but grant no permission
+func (r *rbacService) Resolve(roles []string) (Authorization, error) {
+	graph, err := r.roleGraph()
+	if err != nil {
+		return Authorization{}, err
+	}
+	return resolveRoles(graph, roles), nil
+}
+
+// Seed creates the roles and permissions missing from the database. Existing ones are left untouched so changes made
+// through the admin API survive a restart
+func (r *rbacService) Seed(roles []models.Role, permissions []models.Permission) error {
+	for i := range permissions {
+		if _, err := r.CreatePermission(permissions[i]); err != nil && !errors.Is(err, ErrPermissionExists) {
+			return err
+		}
+	}
+	// inherited roles must exist first, so seed in the order given and skip the existence check of inherits
+	for i := range roles {
+		var existing models.Role
+		if r.roleRepository.FindOne(r.ctx, &existing, repositories.Filter{Key: "name", Value: roles[i].Name}) {
+			continue
+		}
+		roles[i].BaseModel = models.NewBaseModel()
+		if _, err := r.roleRepository.CreateOne(r.ctx, roles[i]); err != nil {
+			return err
+		}
+	}
+	roleGraph.invalidate()
+	return nil
+}
+
+func (r *rbacService) ListRoles() ([]models.Role, error) {
+	var roles = []models.Role{}
+	err := r.roleRepository.FindAll(r.ctx, &roles)
+	return roles, err
+}
+
+func (r *rbacService) ListPermissions() ([]models.Permission, error) {
+	var permissions = []models.Permission{}
+	err := r.permissionRepository.FindAll(r.ctx, &permissions)
+	return permissions, err
+}
+
+func (r *rbacService) CreatePermission(permission models.Permission) (models.Permission, error) {
+	var existing models.Permission
+	if r.permissionRepository.FindOne(r.ctx, &existing, repositories.Filter{Key: "name", Value: permission.Name}) {
+		return existing, ErrPermissionExists
+	}
+	permission.BaseModel = models.NewBaseModel()
+	id, err := r.permissionRepository.CreateOne(r.ctx, permission)
+	if err != nil {
+		return permission, err
+	}
+	permission.ID = id
+	return permission, nil
+}
+
+// CreateRole creates a role. Its inherited roles and permissions must already exist
+func (r *rbacService) CreateRole(role models.Role) (models.Role, error) {
+	var existing models.Role
+	if r.roleRepository.FindOne(r.ctx, &existing, repositories.Filter{Key: "name", Value: role.Name}) {
+		return existing, ErrRoleExists
+	}
+	if slices.Contains(role.Inherits, role.Name) {
+		return role, ErrRoleInheritsItself
+	}
+	if err := r.rolesExist(role.Inherits); err != nil {
+		return role, err
+	}
+	if err := r.permissionsExist(role.Permissions); err != nil {
+		return role, err
+	}
+	role.BaseModel = models.NewBaseModel()
+	role.Inherits, role.Permissions = nonNil(role.Inherits), nonNil(role.Permissions)
+	id, err := r.roleRepository.CreateOne(r.ctx, role)
+	if err != nil {
+		return role, err
+	}
+	role.ID = id
+	roleGraph.invalidate()
+	return role, nil
+}
+
+// AttachPermissions adds permissions to a role. Permissions it already holds are ignored
+func (r *rbacService) AttachPermissions(roleName string, permissions []string) error {
+	if err := r.permissionsExist(permissions); err != nil {
+		return err
+	}
+	return r.updateRole(roleName, bson.M{
+		"$addToSet": bson.M{"permissions": bson.M{"$each": permissions}},
+		"$set":      bson.M{"updated_at": time.Now()},
+	})
+}
+
+func (r *rbacService) DetachPermission(roleName string, permission string) error {
+	return r.updateRole(roleName, bson.M{
+		"$pull": bson.M{"permissions": permission},
+		"$set":  bson.M{"updated_at": time.Now()},
+	})
+}
+
+// RequireMfa sets whether holders of the role must sign in with a second factor. Sessions opened without one are
+// refused from their next request
+func (r *rbacService) RequireMfa(roleName string, required bool) error {
+	return r.updateRole(roleName, bson.M{"$set": bson.M{"require_mfa": required, "updated_at": time.Now()}})
+}
+
+// AssignRoles grants roles to a user. They take effect from the user's next login or token refresh
+func (r *rbacService) AssignRoles(userId primitive.ObjectID, roles []string) error {
+	if err := r.rolesExist(roles); err != nil {
+		return err
+	}
+	return r.updateUser(repositories.Filter{Key: "_id", Value: userId}, bson.M{
+		"$addToSet": bson.M{"roles": bson.M{"$each": roles}},
+		"$set":      bson.M{"updated_at": time.Now()},
+	})
+}
+
+func (r *rbacService) UnassignRole(userId primitive.ObjectID, role string) error {
+	return r.updateUser(repositories.Filter{Key: "_id", Value: userId}, bson.M{
+		"$pull": bson.M{"roles": role},
+		"$set":  bson.M{"updated_at": time.Now()},
+	})
+}
+
+// AssignRolesByEmail same as AssignRoles, for bootstrapping the first administrator
+func (r *rbacService) AssignRolesByEmail(email string, roles []string) error {
+	if err := r.rolesExist(roles); err != nil {
+		return err
+	}
+	return r.updateUser(repositories.Filter{Key: "email", Value: email}, bson.M{
+		"$addToSet": bson.M{"roles": bson.M{"$each": roles}},
+		"$set":      bson.M{"updated_at": time.Now()},
+	})
+}
+
+func (r *rbacService) updateRole(roleName string, update bson.M) error {
+	matched, err := r.roleRepository.UpdateOne(r.ctx, update, repositories.Filter{Key: "name", Value: roleName})
+	if err != nil {
+		return err
+	}
+	if matched == 0 {
+		return ErrRoleNotFound
+	}
+	roleGraph.invalidate()
+	return nil
+}
+
+func (r *rbacService) updateUser(filter repositories.Filter, update bson.M) error {
+	matched, err := r.userRepository.UpdateOne(r.ctx, update, filter)
+	if err != nil {
+		return err
+	}
+	if matched == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (r *rbacService) rolesExist(names []string) error {
+	graph, err := r.roleGraph()
+	if err != nil {
+		return err
+	}
+	for i := range names {
+		if _, ok := graph[names[i]]; !ok {
+			return ErrRoleNotFound
+		}
+	}
+	return nil
+}
+
+func (r *rbacService) permissionsExist(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	var permissions []models.Permission
+	if err := r.permissionRepository.FindAll(r.ctx, &permissions, repositories.Filter{Key: "name", Value: bson.M{"$in": names}}); err != nil {
+		return err
+	}
+	for i := range names {
+		if !slices.ContainsFunc(permissions, func(p models.Permission) bool { return p.Name == names[i] }) {
+			return ErrPermissionNotFound
+		}
+	}
+	return nil
+}
+
+func (r *rbacService) roleGraph() (map[string]models.Role, error) {
+	roleGraph.mu.Lock()
+	defer roleGraph.mu.Unlock()
+	if roleGraph.roles != nil && time.Since(roleGraph.loadedAt) < roleGraphTtl {
+		return roleGraph.roles, nil
+	}
+	var roles []models.Role
+	if err := r.roleRepository.FindAll(r.ctx, &roles); err != nil {
+		return nil, err
+	}
+	graph := make(map[string]models.Role, len(roles))
+	for i := range roles {
+		graph[roles[i].Name] = roles[i]
+	}
+	roleGraph.roles, roleGraph.loadedAt = graph, time.Now()
+	return graph, nil
+}
+
+func (c *roleGraphCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roles = nil
+}
+
+// resolveRoles breadth-first walk of the role hierarchy. Each role is visited once, so an inheritance cycle
+// cannot loop forever
+func resolveRoles(graph map[string]models.Role, roles []string) Authorization {
+	var authorization Authorization
+	queue := slices.Clone(roles)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if slices.Contains(authorization.Roles, name) {
+			continue
+		}
+		authorization.Roles = append(authorization.Roles, name)
+		role, ok := graph[name]
+		if !ok {
+			continue
+		}
+		for _, permission := range role.Permissions {
+			if !slices.Contains(authorization.Permissions, permission) {
+				authorization.Permissions = append(authorization.Permissions, permission)
+			}
+		}
+		authorization.RequireMfa = authorization.RequireMfa || role.RequireMfa
+		queue = append(queue, role.Inherits...)
+	}
+	return authorization
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
@@ -0,0 +1,323 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type (
+	roleGrantService struct {
+		ctx                 context.Context
+		database            internal.MongoDatabase
+		tenant              string
+		roleGrantRepository repositories.CrudOperation
+	}
+	grantEntry struct {
+		grant    models.RoleGrant
+		found    bool
+		loadedAt time.Time
+	}
+	// grantCache in-process cache of the grants listed in tokens, so SecureMiddleware can drop revoked grants without
+	// hitting Mongo on every request. Expiry is checked against the cached window, so it is exact
+	grantCache struct {
+		mu      sync.Mutex
+		entries map[string]grantEntry
+	}
+)
+
+const (
+	// ClaimGrants `role: grant id` of the roles a token holds through a RoleGrant
+	ClaimGrants              = "grants"
+	defaultRoleGrantDuration = 8 * time.Hour
+	grantCacheTtl            = 30 * time.Second
+	grantSweepInterval       = time.Minute
+)
+
+var grants = &grantCache{entries: map[string]grantEntry{}}
+
+var (
+	ErrGrantNotFound     = errors.New("role grant not found")
+	ErrGrantNotPending   = errors.New("role request has already been decided")
+	ErrGrantSelfApproval = errors.New("role requests cannot be decided by the requester")
+	ErrGrantDuplicate    = errors.New("an active or pending grant for this role already exists")
+	ErrInvalidGrantRange = errors.New("expires_at must be in the future and after not_before")
+	ErrGrantTooLong      = errors.New("grant lasts longer than allowed")
+)
+
+// NewRoleGrantService grants of the organization tenant, or of the platform when tenant is empty
+func NewRoleGrantService(ctx context.Context, database internal.MongoDatabase, tenant string) *roleGrantService {
+	roleGrantRepository := repositories.ForPlatform(repositories.NewRoleGrantRepository(database))
+	if tenant != "" {
+		roleGrantRepository = repositories.ForTenant(repositories.NewRoleGrantRepository(database), tenant)
+	}
+	return &roleGrantService{
+		ctx:                 ctx,
+		database:            database,
+		tenant:              tenant,
+		roleGrantRepository: roleGrantRepository,
+	}
+}
+
+// Request files a pending request for role, to be decided by an approver
+func (g *roleGrantService) Request(userId primitive.ObjectID, role string, notBefore, expiresAt time.Time, justification string) (models.RoleGrant, error) {
+	return g.create(models.RoleGrant{
+		UserId:        userId,
+		Role:          role,
+		NotBefore:     notBefore,
+		ExpiresAt:     expiresAt,
+		Status:        models.GrantPending,
+		Justification: justification,
+	})
+}
+
+// Grant assigns role to the user for the given window without going through approval
+func (g *roleGrantService) Grant(userId primitive.ObjectID, role string, notBefore, expiresAt time.Time, grantedBy primitive.ObjectID) (models.RoleGrant, error) {
+	now := time.Now()
+	return g.create(models.RoleGrant{
+		UserId:    userId,
+		Role:      role,
+		NotBefore: notBefore,
+		ExpiresAt: expiresAt,
+		Status:    models.GrantApproved,
+		DecidedBy: grantedBy,
+		DecidedAt: &now,
+	})
+}
+
+// Approve approves a pending request. An approver can never decide their own request
+func (g *roleGrantService) Approve(id, approverId primitive.ObjectID, note string) error {
+	return g.decide(id, approverId, models.GrantApproved, note)
+}
+
+func (g *roleGrantService) Deny(id, approverId primitive.ObjectID, note string) error {
+	return g.decide(id, approverId, models.GrantDenied, note)
+}
+
+// Revoke ends an approved or pending grant ahead of time
+func (g *roleGrantService) Revoke(id, revokedBy primitive.ObjectID) error {
+	now := time.Now()
+	matched, err := g.roleGrantRepository.UpdateOne(g.ctx,
+		bson.M{"$set": bson.M{"status": models.GrantRevoked, "decided_by": revokedBy, "decided_at": now, "updated_at": now}},
+		repositories.Filter{Key: "_id", Value: id},
+		repositories.Filter{Key: "status", Value: bson.M{"$in": []string{models.GrantPending, models.GrantApproved}}},
+	)
+	if err != nil {
+		return err
+	}
+	if matched == 0 {
+		return ErrGrantNotFound
+	}
+	grants.forget(id.Hex())
+	return nil
+}
+
+// List grants in status, or every grant when status is empty
+func (g *roleGrantService) List(status string, currentPage, perPage int) ([]models.RoleGrant, error) {
+	var filters []repositories.Filter
+	if status != "" {
+		filters = append(filters, repositories.Filter{Key: "status", Value: status})
+	}
+	var result = []models.RoleGrant{}
+	err := g.roleGrantRepository.FindPaginate(g.ctx, currentPage, perPage, &result, filters...)
+	return result, err
+}
+
+func (g *roleGrantService) ListForUser(userId primitive.ObjectID, currentPage, perPage int) ([]models.RoleGrant, error) {
+	var result = []models.RoleGrant{}
+	err := g.roleGrantRepository.FindPaginate(g.ctx, currentPage, perPage, &result, repositories.Filter{Key: "user_id", Value: userId})
+	return result, err
+}
+
+// ActiveGrants approved grants of the user whose window includes now
+func (g *roleGrantService) ActiveGrants(userId primitive.ObjectID) ([]models.RoleGrant, error) {
+	now := time.Now()
+	var result []models.RoleGrant
+	err := g.roleGrantRepository.FindAll(g.ctx, &result,
+		repositories.Filter{Key: "user_id", Value: userId},
+		repositories.Filter{Key: "status", Value: models.GrantApproved},
+		repositories.Filter{Key: "not_before", Value: bson.M{"$lte": now}},
+		repositories.Filter{Key: "expires_at", Value: bson.M{"$gt": now}},
+	)
+	return result, err
+}
+
+// DropInactiveGrants removes from roles those the token holds through a grant (ClaimGrants) that has since expired,
+// been revoked or was never active. Roles not held through a grant are kept
+func (g *roleGrantService) DropInactiveGrants(roles []string, grantClaim map[string]interface{}) ([]string, error) {
+	var inactive []string
+	for role, id := range grantClaim {
+		grantId, _ := id.(string)
+		active, err := g.isActive(grantId)
+		if err != nil {
+			return nil, err
+		}
+		if !active {
+			inactive = append(inactive, role)
+		}
+	}
+	if len(inactive) == 0 {
+		return roles, nil
+	}
+	kept := make([]string, 0, len(roles))
+	for i := range roles {
+		if !slices.Contains(inactive, roles[i]) {
+			kept = append(kept, roles[i])
+		}
+	}
+	return kept, nil
+}
+
+// SweepExpiredGrants marks approved grants past their window, and pending requests that were never decided in time,
+// as expired, in every organization. Expired grants are already ignored when tokens are issued and checked; sweeping
+// keeps the listings honest
+func SweepExpiredGrants(ctx context.Context, database internal.MongoDatabase) (int64, error) {
+	now := time.Now()
+	return repositories.NewRoleGrantRepository(database).UpdateMany(ctx,
+		bson.M{"$set": bson.M{"status": models.GrantExpired, "updated_at": now}},
+		repositories.Filter{Key: "status", Value: bson.M{"$in": []string{models.GrantPending, models.GrantApproved}}},
+		repositories.Filter{Key: "expires_at", Value: bson.M{"$lte": now}},
+	)
+}
+
+// StartGrantSweeper runs SweepExpiredGrants until ctx is cancelled
+func StartGrantSweeper(ctx context.Context, database internal.MongoDatabase) {
+	go func() {
+		ticker := time.NewTicker(grantSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sweepCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+				swept, err := SweepExpiredGrants(sweepCtx, database)
+				cancel()
+				if err != nil {
+					log.Error("unable to sweep expired role grants", err)
+				} else if swept > 0 {
+					log.Infof("%d role grants expired", swept)
+				}
+			}
+		}
+	}()
+}
+
+// MaxRoleGrantDuration longest window a grant may span, from ROLE_GRANT_MAX_DURATION (8h by default)
+func MaxRoleGrantDuration(envVar models.EnvVar) time.Duration {
+	if duration, err := time.ParseDuration(envVar.RoleGrantMaxDuration); err == nil && duration > 0 {
+		return duration
+	}
+	return defaultRoleGrantDuration
+}
+
+func (g *roleGrantService) create(grant models.RoleGrant) (models.RoleGrant, error) {
+	now := time.Now()
+	if grant.NotBefore.IsZero() || grant.NotBefore.Before(now) {
+		grant.NotBefore = now
+	}
+	if !grant.ExpiresAt.After(grant.NotBefore) {
+		return grant, ErrInvalidGrantRange
+	}
+	if maxDuration := MaxRoleGrantDuration(models.LoadEnvironmentVariables()); grant.ExpiresAt.Sub(grant.NotBefore) > maxDuration {
+		return grant, fmt.Errorf("%w. Grants cannot last longer than %s", ErrGrantTooLong, maxDuration)
+	}
+	if err := NewRbacService(g.ctx, g.database).rolesExist([]string{grant.Role}); err != nil {
+		return grant, err
+	}
+	var existing models.RoleGrant
+	if g.roleGrantRepository.FindOne(g.ctx, &existing,
+		repositories.Filter{Key: "user_id", Value: grant.UserId},
+		repositories.Filter{Key: "role", Value: grant.Role},
+		repositories.Filter{Key: "status", Value: bson.M{"$in": []string{models.GrantPending, models.GrantApproved}}},
+		repositories.Filter{Key: "expires_at", Value: bson.M{"$gt": now}},
+	) {
+		return grant, ErrGrantDuplicate
+	}
+
+	grant.BaseModel = models.NewBaseModel()
+	grant.TenantId = g.tenant
+	id, err := g.roleGrantRepository.CreateOne(g.ctx, grant)
+	if err != nil {
+		return grant, err
+	}
+	grant.ID = id
+	return grant, nil
+}
+
+func (g *roleGrantService) decide(id, approverId primitive.ObjectID, status, note string) error {
+	now := time.Now()
+	matched, err := g.roleGrantRepository.UpdateOne(g.ctx,
+		bson.M{"$set": bson.M{"status": status, "decided_by": approverId, "decided_at": now, "decision_note": note, "updated_at": now}},
+		repositories.Filter{Key: "_id", Value: id},
+		repositories.Filter{Key: "status", Value: models.GrantPending},
+		repositories.Filter{Key: "user_id", Value: bson.M{"$ne": approverId}},
+		repositories.Filter{Key: "expires_at", Value: bson.M{"$gt": now}},
+	)
+	if err != nil || matched > 0 {
+		return err
+	}
+	var grant models.RoleGrant
+	switch {
+	case !g.roleGrantRepository.FindOne(g.ctx, &grant, repositories.Filter{Key: "_id", Value: id}):
+		return ErrGrantNotFound
+	case grant.UserId == approverId:
+		return ErrGrantSelfApproval
+	default:
+		return ErrGrantNotPending
+	}
+}
+
+func (g *roleGrantService) isActive(grantId string) (bool, error) {
+	entry, ok := grants.get(grantId)
+	if !ok {
+		id, err := primitive.ObjectIDFromHex(grantId)
+		if err != nil {
+			return false, nil
+		}
+		entry = grantEntry{loadedAt: time.Now()}
+		entry.found = g.roleGrantRepository.FindOne(g.ctx, &entry.grant, repositories.Filter{Key: "_id", Value: id})
+		if err = g.ctx.Err(); err != nil {
+			return false, err
+		}
+		grants.set(grantId, entry)
+	}
+	now := time.Now()
+	return entry.found && entry.grant.Status == models.GrantApproved &&
+		!now.Before(entry.grant.NotBefore) && now.Before(entry.grant.ExpiresAt), nil
+}
+
+func (c *grantCache) get(id string) (grantEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[id]
+	if !ok || time.Since(entry.loadedAt) > grantCacheTtl {
+		return grantEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *grantCache) set(id string, entry grantEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= revocationCacheMaxEntries {
+		c.entries = map[string]grantEntry{}
+	}
+	c.entries[id] = entry
+}
+
+func (c *grantCache) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, id)
+}
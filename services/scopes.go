@@ -0,0 +1,48 @@
+package services
+
+import (
+	"quickstart-go-jwt-mongodb/models"
+	"slices"
+	"strings"
+)
+
+// RoleScopes scopes implied by each role. User tokens issued without an explicit scope carry the scopes of their
+// roles, so a controller can require a scope and still admit every user whose role grants it. Populated at startup
+var RoleScopes = map[string][]string{}
+
+// ScopesForRoles union of the scopes implied by roles, in the order they are first met
+func ScopesForRoles(roles []string) []string {
+	var scopes []string
+	for i := range roles {
+		for _, scope := range RoleScopes[roles[i]] {
+			if !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return scopes
+}
+
+// NarrowScopes keeps the space-delimited requested scopes found in permitted. RFC 6749 section 3.3 allows the server
+// to issue a narrower scope than requested, as long as the granted scope is returned to the client
+func NarrowScopes(requested string, permitted []string) string {
+	var granted []string
+	for _, scope := range strings.Fields(requested) {
+		if slices.Contains(permitted, scope) && !slices.Contains(granted, scope) {
+			granted = append(granted, scope)
+		}
+	}
+	return strings.Join(granted, " ")
+}
+
+// subjectRoles roles of the token subject, used to derive its scope
+func subjectRoles(sub interface{}, claims map[string]any) []string {
+	switch subject := sub.(type) {
+	case models.User:
+		return subject.Roles
+	case *models.User:
+		return subject.Roles
+	}
+	roles, _ := claims["roles"].([]string)
+	return roles
+}
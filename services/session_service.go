@@ -0,0 +1,299 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type (
+	sessionService struct {
+		ctx             context.Context
+		tokenRepository repositories.CrudOperation
+	}
+	revocationEntry struct {
+		revoked   bool
+		expiresAt time.Time
+	}
+	// revocationCache in-process cache of revocation lookups so SecureMiddleware does not hit Mongo on every request.
+	// Revocations made through another instance are picked up once the cached entry expires, so other instances keep
+	// accepting a revoked session for up to revocationCacheTtl
+	revocationCache struct {
+		mu      sync.Mutex
+		entries map[string]revocationEntry
+	}
+)
+
+const (
+	revocationCacheTtl        = 30 * time.Second
+	revokedCacheTtl           = 30 * time.Minute
+	revocationCacheMaxEntries = 10000
+)
+
+var revocations = &revocationCache{entries: map[string]revocationEntry{}}
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token already used. Every session issued from this login has been revoked")
+	ErrSessionRevoked      = errors.New("session has been revoked")
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrRefreshTokenClient  = errors.New("refresh token was issued to another client")
+)
+
+func NewSessionService(ctx context.Context, database internal.MongoDatabase) *sessionService {
+	return &sessionService{
+		ctx:             ctx,
+		tokenRepository: repositories.NewTokenRepository(database),
+	}
+}
+
+// NewFamilyId starts a new refresh token family, one per successful login
+func NewFamilyId() string {
+	return RandomToken(16)
+}
+
+// ConsumeRefreshToken marks refreshToken, issued to clientId (empty for first-party logins), as used and returns its
+// record, whose FamilyId the replacement must carry. A refresh token can only be consumed once: replaying it revokes
+// the whole family, because either the legitimate client or an attacker is holding a stolen copy and there is no way
+// to tell which. A token presented by another client is left untouched, so it cannot be burnt by a party not holding it
+// legitimately
+func (s *sessionService) ConsumeRefreshToken(refreshToken, clientId string) (models.Token, error) {
+	var token models.Token
+	if !s.tokenRepository.FindOne(s.ctx, &token, repositories.Filter{Key: "refresh_token", Value: refreshToken}) {
+		return token, ErrInvalidRefreshToken
+	}
+	if token.ClientId != clientId {
+		return token, ErrRefreshTokenClient
+	}
+	if token.RevokedAt != nil {
+		return token, ErrSessionRevoked
+	}
+	if !token.ExpiresAt.IsZero() && time.Now().After(token.ExpiresAt) {
+		return token, ErrInvalidRefreshToken
+	}
+
+	now := time.Now()
+	matched, err := s.tokenRepository.UpdateOne(s.ctx,
+		bson.M{"$set": bson.M{"consumed_at": now, "updated_at": now}},
+		repositories.Filter{Key: "_id", Value: token.ID},
+		repositories.Filter{Key: "consumed_at", Value: nil},
+	)
+	if err != nil {
+		return token, err
+	}
+	if matched == 0 {
+		log.Warnf("refresh token reuse detected for token family %s. Revoking family", token.FamilyId)
+		if err = s.revokeFamilyOf(token); err != nil {
+			log.Error("unable to revoke token family", err)
+		}
+		return token, ErrRefreshTokenReused
+	}
+	if token.FamilyId == "" {
+		// issued before token families existed; it becomes the root of a new family
+		token.FamilyId = NewFamilyId()
+	}
+	return token, nil
+}
+
+// RevokeFamily revokes every access/refresh pair issued from the same login
+func (s *sessionService) RevokeFamily(familyId string) error {
+	if familyId == "" {
+		return errors.New("token family id is required")
+	}
+	now := time.Now()
+	_, err := s.tokenRepository.UpdateMany(s.ctx,
+		bson.M{"$set": bson.M{"revoked_at": now, "updated_at": now}},
+		repositories.Filter{Key: "family_id", Value: familyId},
+		repositories.Filter{Key: "revoked_at", Value: nil},
+	)
+	if err == nil {
+		revocations.set(familyId, true)
+	}
+	return err
+}
+
+// RevokeAccessToken revokes the access/refresh pair an access token (identified by its `jti`) was issued with.
+// Only needed for tokens issued before sessions carried a `sid`
+func (s *sessionService) RevokeAccessToken(accessTokenId string) error {
+	if accessTokenId == "" {
+		return errors.New("token id is required")
+	}
+	now := time.Now()
+	_, err := s.tokenRepository.UpdateOne(s.ctx,
+		bson.M{"$set": bson.M{"revoked_at": now, "updated_at": now}},
+		repositories.Filter{Key: "access_token_id", Value: accessTokenId},
+	)
+	if err == nil {
+		revocations.set("jti:"+accessTokenId, true)
+	}
+	return err
+}
+
+// RevokeRefreshToken revokes the session a refresh token belongs to
+func (s *sessionService) RevokeRefreshToken(refreshToken string) error {
+	var token models.Token
+	if !s.tokenRepository.FindOne(s.ctx, &token, repositories.Filter{Key: "refresh_token", Value: refreshToken}) {
+		return ErrInvalidRefreshToken
+	}
+	return s.revokeFamilyOf(token)
+}
+
+// IsRefreshTokenActive reports whether refreshToken can still be exchanged, i.e. is neither consumed nor revoked
+func (s *sessionService) IsRefreshTokenActive(refreshToken string) bool {
+	var token models.Token
+	return s.tokenRepository.FindOne(s.ctx, &token,
+		repositories.Filter{Key: "refresh_token", Value: refreshToken},
+		repositories.Filter{Key: "consumed_at", Value: nil},
+		repositories.Filter{Key: "revoked_at", Value: nil},
+	)
+}
+
+// RevokeUser revokes every session of the user, i.e. logout everywhere. It takes effect at once on this instance; the
+// others keep accepting the user's access tokens until their cached answers expire, for up to revocationCacheTtl
+func (s *sessionService) RevokeUser(userId primitive.ObjectID) error {
+	if userId.IsZero() {
+		return errors.New("user id is required")
+	}
+	now := time.Now()
+	_, err := s.tokenRepository.UpdateMany(s.ctx,
+		bson.M{"$set": bson.M{"revoked_at": now, "updated_at": now}},
+		repositories.Filter{Key: "user_id", Value: userId},
+		repositories.Filter{Key: "revoked_at", Value: nil},
+	)
+	// the cache is keyed by session, so forget everything rather than look up each of the user's sessions
+	revocations.clear()
+	return err
+}
+
+// IsRevoked reports whether the session (`sid` claim) or, for tokens without one, the access token (`jti` claim)
+// has been revoked. Answers are cached in-process, except when the lookup fails: the error is returned so callers
+// refuse the token rather than treat it as live
+func (s *sessionService) IsRevoked(sessionId, accessTokenId string) (bool, error) {
+	var key string
+	var filter repositories.Filter
+	switch {
+	case sessionId != "":
+		key, filter = sessionId, repositories.Filter{Key: "family_id", Value: sessionId}
+	case accessTokenId != "":
+		key, filter = "jti:"+accessTokenId, repositories.Filter{Key: "access_token_id", Value: accessTokenId}
+	default:
+		return false, nil
+	}
+	if revoked, ok := revocations.get(key); ok {
+		return revoked, nil
+	}
+	// FindOne would report a failed lookup as nothing found, i.e. not revoked
+	var tokens []models.Token
+	if err := s.tokenRepository.FindPaginate(s.ctx, 1, 1, &tokens, filter,
+		repositories.Filter{Key: "revoked_at", Value: bson.M{"$ne": nil}},
+	); err != nil {
+		return false, err
+	}
+	revoked := len(tokens) > 0
+	revocations.set(key, revoked)
+	if !revoked && sessionId != "" {
+		// piggyback on the cache miss so last-used time stays fresh without a write on every request
+		now := time.Now()
+		_, _ = s.tokenRepository.UpdateOne(s.ctx,
+			bson.M{"$set": bson.M{"last_used_at": now}},
+			repositories.Filter{Key: "family_id", Value: sessionId},
+			repositories.Filter{Key: "consumed_at", Value: nil},
+		)
+	}
+	return revoked, nil
+}
+
+// ActiveSessions live sessions of the user, most recent first. Each session is represented by the latest
+// (not yet rotated) token of its refresh family. Impersonation tokens are not sessions of the user and are left out
+func (s *sessionService) ActiveSessions(userId primitive.ObjectID, currentPage, perPage int) ([]models.Token, error) {
+	var tokens []models.Token
+	err := s.tokenRepository.FindPaginate(s.ctx, currentPage, perPage, &tokens,
+		repositories.Filter{Key: "user_id", Value: userId},
+		repositories.Filter{Key: "consumed_at", Value: nil},
+		repositories.Filter{Key: "revoked_at", Value: nil},
+		repositories.Filter{Key: "expires_at", Value: bson.M{"$gt": time.Now()}},
+		repositories.Filter{Key: "actor_id", Value: nil},
+	)
+	return tokens, err
+}
+
+// FindSession current (unconsumed, unrevoked) refresh token of a session, identified by its refresh family id
+func (s *sessionService) FindSession(sessionId string) (models.Token, bool) {
+	var token models.Token
+	found := sessionId != "" && s.tokenRepository.FindOne(s.ctx, &token,
+		repositories.Filter{Key: "family_id", Value: sessionId},
+		repositories.Filter{Key: "consumed_at", Value: nil},
+		repositories.Filter{Key: "revoked_at", Value: nil},
+		repositories.Filter{Key: "expires_at", Value: bson.M{"$gt": time.Now()}},
+	)
+	return token, found
+}
+
+// RevokeSession revokes one of the user's sessions, identified by its refresh family id
+func (s *sessionService) RevokeSession(userId primitive.ObjectID, sessionId string) error {
+	var token models.Token
+	if sessionId == "" || !s.tokenRepository.FindOne(s.ctx, &token,
+		repositories.Filter{Key: "family_id", Value: sessionId},
+		repositories.Filter{Key: "user_id", Value: userId},
+	) {
+		return ErrSessionNotFound
+	}
+	return s.RevokeFamily(sessionId)
+}
+
+func (s *sessionService) revokeFamilyOf(token models.Token) error {
+	if token.FamilyId != "" {
+		return s.RevokeFamily(token.FamilyId)
+	}
+	now := time.Now()
+	_, err := s.tokenRepository.UpdateOne(s.ctx,
+		bson.M{"$set": bson.M{"revoked_at": now, "updated_at": now}},
+		repositories.Filter{Key: "_id", Value: token.ID},
+	)
+	return err
+}
+
+func (c *revocationCache) get(key string) (bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return false, false
+	}
+	return entry.revoked, true
+}
+
+func (c *revocationCache) set(key string, revoked bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= revocationCacheMaxEntries {
+		now := time.Now()
+		for k, entry := range c.entries {
+			if now.After(entry.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= revocationCacheMaxEntries {
+			c.entries = map[string]revocationEntry{}
+		}
+	}
+	ttl := revocationCacheTtl
+	if revoked {
+		ttl = revokedCacheTtl
+	}
+	c.entries[key] = revocationEntry{revoked: revoked, expiresAt: time.Now().Add(ttl)}
+}
+
+func (c *revocationCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]revocationEntry{}
+}
@@ -0,0 +1,66 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"testing"
+	"time"
+)
+
+// unreachableRepository fails every lookup, like a collection whose database is down
+type unreachableRepository struct {
+	*memoryRepository
+}
+
+func (unreachableRepository) FindOne(context.Context, interface{}, ...repositories.Filter) bool {
+	return false
+}
+
+func (unreachableRepository) FindPaginate(context.Context, int, int, interface{}, ...repositories.Filter) error {
+	return errors.New("server selection timeout")
+}
+
+func TestIsRevokedFailsClosed(t *testing.T) {
+	tokens := newMemoryRepository()
+	now := time.Now()
+	if _, err := tokens.CreateOne(context.Background(), models.Token{BaseModel: models.NewBaseModel(), FamilyId: "revoked-family", RevokedAt: &now}); err != nil {
+		t.Fatal(err)
+	}
+	sessions := &sessionService{ctx: context.Background(), tokenRepository: unreachableRepository{tokens}}
+	if _, err := sessions.IsRevoked("revoked-family", ""); err == nil {
+		t.Fatal("failed lookup reported as an answer")
+	}
+
+	// the failure was not cached: the next lookup reaches the database
+	sessions.tokenRepository = tokens
+	if revoked, err := sessions.IsRevoked("revoked-family", ""); err != nil || !revoked {
+		t.Fatalf("revoked %v (%v), want revoked", revoked, err)
+	}
+	if revoked, err := sessions.IsRevoked("live-family", ""); err != nil || revoked {
+		t.Fatalf("revoked %v (%v), want live", revoked, err)
+	}
+}
+
+func TestConsumeRefreshTokenOfAnotherClient(t *testing.T) {
+	forEachStore(t, repositories.NewTokenRepository, func(t *testing.T, tokens repositories.CrudOperation) {
+		if _, err := tokens.CreateOne(context.Background(), models.Token{BaseModel: models.NewBaseModel(), RefreshToken: "victim-refresh",
+			FamilyId: "victim-family", ClientId: "victim-app", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+		sessions := &sessionService{ctx: context.Background(), tokenRepository: tokens}
+		for _, clientId := range []string{"attacker-app", "", "attacker-app"} {
+			if _, err := sessions.ConsumeRefreshToken("victim-refresh", clientId); !errors.Is(err, ErrRefreshTokenClient) {
+				t.Fatalf("consumed by client %q: error %v", clientId, err)
+			}
+		}
+		// neither consumed nor revoked by the attempts
+		if token, err := sessions.ConsumeRefreshToken("victim-refresh", "victim-app"); err != nil || token.FamilyId != "victim-family" {
+			t.Fatalf("owner refresh failed: %v", err)
+		}
+		if _, err := sessions.ConsumeRefreshToken("victim-refresh", "victim-app"); !errors.Is(err, ErrRefreshTokenReused) {
+			t.Fatalf("replay by the owner: error %v", err)
+		}
+	})
+}
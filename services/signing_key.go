@@ -0,0 +1,298 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"quickstart-go-jwt-mongodb/models"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type (
+	// SigningKey is the key material used to sign and verify JWTs. Kid is stamped on the header of every token
+	// signed with it, so verifiers can select the matching public key from the JWKS endpoint
+	SigningKey struct {
+		Kid        string
+		Method     jwt.SigningMethod
+		privateKey crypto.PrivateKey
+		publicKey  crypto.PublicKey
+	}
+	// JsonWebKey RFC 7517 representation of a public key
+	JsonWebKey struct {
+		Kty string `json:"kty"`
+		Use string `json:"use,omitempty"`
+		Alg string `json:"alg,omitempty"`
+		Kid string `json:"kid,omitempty"`
+		Crv string `json:"crv,omitempty"`
+		N   string `json:"n,omitempty"`
+		E   string `json:"e,omitempty"`
+		X   string `json:"x,omitempty"`
+		Y   string `json:"y,omitempty"`
+	}
+	JsonWebKeySet struct {
+		Keys []JsonWebKey `json:"keys"`
+	}
+)
+
+const defaultHmacAlg = "HS256"
+
+// LoadSigningKey reads the PEM private key at JWT_PRIVATE_KEY_PATH when set, otherwise falls back to HMAC with JWT_SECRET
+func LoadSigningKey(envVar models.EnvVar) (*SigningKey, error) {
+	if envVar.JwtPrivateKeyPath == "" {
+		if envVar.JwtSecret == "" {
+			return nil, errors.New("neither `JWT_PRIVATE_KEY_PATH` nor `JWT_SECRET` found in the environment variable")
+		}
+		return NewHmacSigningKey(envVar.JwtSigningAlg, envVar.JwtKeyId, []byte(envVar.JwtSecret))
+	}
+	pemBytes, err := os.ReadFile(envVar.JwtPrivateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read jwt private key. %w", err)
+	}
+	return ParseSigningKeyFromPEM(envVar.JwtSigningAlg, envVar.JwtKeyId, pemBytes)
+}
+
+// NewHmacSigningKey shared-secret key. HMAC keys are never published on the JWKS endpoint
+func NewHmacSigningKey(alg, kid string, secret []byte) (*SigningKey, error) {
+	if alg == "" {
+		alg = defaultHmacAlg
+	}
+	method, ok := jwt.GetSigningMethod(alg).(*jwt.SigningMethodHMAC)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a supported HMAC signing algorithm", alg)
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("hmac signing secret must not be empty")
+	}
+	if kid == "" {
+		sum := sha256.Sum256(secret)
+		kid = hex.EncodeToString(sum[:8])
+	}
+	return &SigningKey{Kid: kid, Method: method, privateKey: secret, publicKey: secret}, nil
+}
+
+// ParseSigningKeyFromPEM supports RSA (RS*/PS*), ECDSA (ES*) and Ed25519 (EdDSA) private keys.
+// When alg is empty it is inferred from the key type. When kid is empty the RFC 7638 thumbprint is used
+func ParseSigningKeyFromPEM(alg, kid string, pemBytes []byte) (*SigningKey, error) {
+	privateKey, err := parsePrivateKeyPEM(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	return NewSigningKey(alg, kid, privateKey)
+}
+
+// NewSigningKey wraps an asymmetric private key, checking it is usable with alg
+func NewSigningKey(alg, kid string, privateKey crypto.PrivateKey) (*SigningKey, error) {
+	var key = SigningKey{privateKey: privateKey}
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		if alg == "" {
+			alg = "RS256"
+		}
+		if !strings.HasPrefix(alg, "RS") && !strings.HasPrefix(alg, "PS") {
+			return nil, fmt.Errorf("%s cannot be used with an RSA key", alg)
+		}
+		key.publicKey = &k.PublicKey
+	case *ecdsa.PrivateKey:
+		curveAlg, err := ecdsaAlgForCurve(k.Curve)
+		if err != nil {
+			return nil, err
+		}
+		if alg == "" {
+			alg = curveAlg
+		}
+		if alg != curveAlg {
+			return nil, fmt.Errorf("%s cannot be used with an ECDSA %s key", alg, k.Curve.Params().Name)
+		}
+		key.publicKey = &k.PublicKey
+	case ed25519.PrivateKey:
+		if alg == "" {
+			alg = jwt.SigningMethodEdDSA.Alg()
+		}
+		if alg != jwt.SigningMethodEdDSA.Alg() {
+			return nil, fmt.Errorf("%s cannot be used with an Ed25519 key", alg)
+		}
+		key.publicKey = k.Public()
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", privateKey)
+	}
+
+	key.Method = jwt.GetSigningMethod(alg)
+	if key.Method == nil {
+		return nil, fmt.Errorf("%s is not a supported signing algorithm", alg)
+	}
+	key.Kid = kid
+	if key.Kid == "" {
+		jwk, _ := key.JWK()
+		key.Kid = jwk.Thumbprint()
+	}
+	return &key, nil
+}
+
+// JWK public part of the key. ok is false for HMAC keys, which must never be published
+func (k *SigningKey) JWK() (JsonWebKey, bool) {
+	jwk := JsonWebKey{Use: "sig", Alg: k.Method.Alg(), Kid: k.Kid}
+	switch pub := k.publicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	default:
+		return JsonWebKey{}, false
+	}
+	return jwk, true
+}
+
+// Thumbprint RFC 7638 JWK thumbprint
+func (jwk JsonWebKey) Thumbprint() string {
+	var members any
+	switch jwk.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Crv, jwk.Kty, jwk.X, jwk.Y}
+	default:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	}
+	marshal, _ := json.Marshal(members)
+	sum := sha256.Sum256(marshal)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// GenerateSigningKey creates fresh key material for alg. Used by the KeyRing on rotation
+func GenerateSigningKey(alg string) (*SigningKey, error) {
+	switch {
+	case strings.HasPrefix(alg, "HS"):
+		method, ok := jwt.GetSigningMethod(alg).(*jwt.SigningMethodHMAC)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a supported HMAC signing algorithm", alg)
+		}
+		secret := make([]byte, method.Hash.Size())
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		return NewHmacSigningKey(alg, "", secret)
+	case strings.HasPrefix(alg, "RS"), strings.HasPrefix(alg, "PS"):
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		return NewSigningKey(alg, "", privateKey)
+	case alg == jwt.SigningMethodEdDSA.Alg():
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return NewSigningKey(alg, "", privateKey)
+	}
+	var curve elliptic.Curve
+	switch alg {
+	case "ES256":
+		curve = elliptic.P256()
+	case "ES384":
+		curve = elliptic.P384()
+	case "ES512":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("%s is not a supported signing algorithm", alg)
+	}
+	privateKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return NewSigningKey(alg, "", privateKey)
+}
+
+// MarshalPrivateKey PKCS#8 PEM for asymmetric keys, base64 for HMAC secrets
+func (k *SigningKey) MarshalPrivateKey() (string, error) {
+	if secret, ok := k.privateKey.([]byte); ok {
+		return base64.StdEncoding.EncodeToString(secret), nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(k.privateKey)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// UnmarshalSigningKey reverse of MarshalPrivateKey
+func UnmarshalSigningKey(alg, kid, privateKey string) (*SigningKey, error) {
+	if strings.HasPrefix(alg, "HS") {
+		secret, err := base64.StdEncoding.DecodeString(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		return NewHmacSigningKey(alg, kid, secret)
+	}
+	return ParseSigningKeyFromPEM(alg, kid, []byte(privateKey))
+}
+
+func (k *SigningKey) signingKey() interface{} {
+	return k.privateKey
+}
+
+func (k *SigningKey) verificationKey() interface{} {
+	return k.publicKey
+}
+
+func parsePrivateKeyPEM(pemBytes []byte) (crypto.PrivateKey, error) {
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM(pemBytes); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPrivateKeyFromPEM(pemBytes); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseEdPrivateKeyFromPEM(pemBytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unable to parse jwt private key. Expecting a PEM encoded RSA, ECDSA or Ed25519 private key")
+}
+
+func ecdsaAlgForCurve(curve elliptic.Curve) (string, error) {
+	switch curve {
+	case elliptic.P256():
+		return "ES256", nil
+	case elliptic.P384():
+		return "ES384", nil
+	case elliptic.P521():
+		return "ES512", nil
+	}
+	return "", fmt.Errorf("unsupported ECDSA curve %s", curve.Params().Name)
+}
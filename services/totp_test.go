@@ -0,0 +1,135 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret the SHA-1 seed of the RFC 6238 test vectors, "12345678901234567890", base32 encoded
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestValidateTotpRfc6238Vectors(t *testing.T) {
+	// RFC 6238 appendix B gives 8 digit values; authenticator apps use their last 6 digits
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, vector := range vectors {
+		step, ok := ValidateTotp(rfc6238Secret, vector.code, time.Unix(vector.unix, 0))
+		if !ok {
+			t.Errorf("code %s refused at %d", vector.code, vector.unix)
+			continue
+		}
+		if want := vector.unix / totpPeriod; step != want {
+			t.Errorf("code %s at %d matched step %d, want %d", vector.code, vector.unix, step, want)
+		}
+	}
+}
+
+func TestValidateTotpSkew(t *testing.T) {
+	key, _ := totpEncoding.DecodeString(rfc6238Secret)
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+	tests := []struct {
+		name   string
+		offset int64
+		valid  bool
+	}{
+		{"current step", 0, true},
+		{"previous step", -1, true},
+		{"next step", 1, true},
+		{"two steps behind", -2, false},
+		{"two steps ahead", 2, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			step, ok := ValidateTotp(rfc6238Secret, totpCode(key, current+test.offset), now)
+			if ok != test.valid {
+				t.Fatalf("valid = %v, want %v", ok, test.valid)
+			}
+			if ok && step != current+test.offset {
+				t.Fatalf("matched step %d, want %d", step, current+test.offset)
+			}
+		})
+	}
+}
+
+func TestValidateTotpRejectsMalformedInput(t *testing.T) {
+	now := time.Unix(59, 0)
+	tests := []struct {
+		name, secret, code string
+	}{
+		{"short code", rfc6238Secret, "28708"},
+		{"long code", rfc6238Secret, "94287082"},
+		{"wrong code", rfc6238Secret, "287083"},
+		{"invalid secret", "not base32!", "287082"},
+		{"empty code", rfc6238Secret, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, ok := ValidateTotp(test.secret, test.code, now); ok {
+				t.Fatal("code accepted")
+			}
+		})
+	}
+}
+
+// TestMfaVerifyRefusesReplayedCodes against the MongoDB of MONGO_TEST_URI, which applies the conditional update on the
+// last used step and the `$pull` of recovery codes
+func TestMfaVerifyRefusesReplayedCodes(t *testing.T) {
+	users := repositories.NewUserRepository(testMongoDatabase(t))
+	mfa := &mfaService{ctx: context.Background(), userRepository: users}
+	codes, hashes := newRecoveryCodes()
+	user := models.User{BaseModel: models.NewBaseModel(), Email: "ada@example.com", Mfa: &models.Mfa{
+		Enabled:       true,
+		Secret:        rfc6238Secret,
+		RecoveryCodes: hashes,
+	}}
+	user.ID, _ = users.CreateOne(context.Background(), user)
+	key, _ := totpEncoding.DecodeString(rfc6238Secret)
+	current := time.Now().Unix() / totpPeriod
+
+	verify := func(code string) error {
+		// Verify is given the user as last loaded, like the controllers do
+		loaded, err := mfa.user(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mfa.Verify(loaded, code)
+	}
+
+	if err := verify(totpCode(key, current-1)); err != nil {
+		t.Fatalf("fresh code refused: %v", err)
+	}
+	if err := verify(totpCode(key, current-1)); !errors.Is(err, ErrInvalidMfaCode) {
+		t.Fatalf("replayed code: got %v, want ErrInvalidMfaCode", err)
+	}
+	if err := verify(totpCode(key, current)); err != nil {
+		t.Fatalf("code of a later step refused: %v", err)
+	}
+	if err := verify(totpCode(key, current-1)); !errors.Is(err, ErrInvalidMfaCode) {
+		t.Fatalf("code older than the last used one: got %v, want ErrInvalidMfaCode", err)
+	}
+	loaded, _ := mfa.user(user.ID)
+	if loaded.Mfa.LastUsedStep != current {
+		t.Fatalf("last_used_step = %d, want %d", loaded.Mfa.LastUsedStep, current)
+	}
+
+	if err := verify(codes[0]); err != nil {
+		t.Fatalf("recovery code refused: %v", err)
+	}
+	if err := verify(codes[0]); !errors.Is(err, ErrInvalidMfaCode) {
+		t.Fatalf("reused recovery code: got %v, want ErrInvalidMfaCode", err)
+	}
+}
@@ -0,0 +1,320 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"quickstart-go-jwt-mongodb/internal"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type (
+	webAuthnService struct {
+		ctx               context.Context
+		relyingParty      *webauthn.WebAuthn
+		userRepository    repositories.CrudOperation
+		sessionRepository repositories.CrudOperation
+	}
+	// webAuthnUser adapts models.User to the user of the WebAuthn library. The user handle is the user's id, which is
+	// stable and carries no personal information
+	webAuthnUser struct {
+		user models.User
+	}
+)
+
+const (
+	// AmrHardwareKey authentication method (RFC 8176) of a WebAuthn login
+	AmrHardwareKey = "hwk"
+
+	webAuthnCeremonyRegistration = "registration"
+	webAuthnCeremonyLogin        = "login"
+	webAuthnSessionLifetime      = 5 * time.Minute
+)
+
+var (
+	ErrWebAuthnSession      = errors.New("passkey ceremony expired or already completed. Please start again")
+	ErrWebAuthnVerification = errors.New("passkey could not be verified")
+	ErrWebAuthnCloned       = errors.New("passkey signature counter went backwards. The authenticator may have been cloned")
+	ErrCredentialNotFound   = errors.New("passkey not found")
+)
+
+// NewWebAuthnService ceremonies are run for relyingParty, whose id and origins must match the site the browser is on
+func NewWebAuthnService(ctx context.Context, database internal.MongoDatabase, relyingParty *webauthn.WebAuthn) *webAuthnService {
+	return &webAuthnService{
+		ctx:               ctx,
+		relyingParty:      relyingParty,
+		userRepository:    repositories.NewUserRepository(database),
+		sessionRepository: repositories.NewWebAuthnSessionRepository(database),
+	}
+}
+
+// BeginRegistration creation options for navigator.credentials.create() and the id of the ceremony, which
+// FinishRegistration needs. Credentials the user already registered are excluded. The credential must be discoverable,
+// logins never list a user's credentials
+func (s *webAuthnService) BeginRegistration(user models.User) (*protocol.CredentialCreation, string, error) {
+	adapter := webAuthnUser{user: user}
+	var exclusions []protocol.CredentialDescriptor
+	for _, credential := range adapter.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+	creation, session, err := s.relyingParty.BeginRegistration(adapter,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	sessionId, err := s.saveSession(webAuthnCeremonyRegistration, user.ID, session)
+	return creation, sessionId, err
+}
+
+// FinishRegistration verifies the authenticator's response (the JSON of the PublicKeyCredential) and stores the
+// credential under name
+func (s *webAuthnService) FinishRegistration(user models.User, sessionId, name string, response io.Reader) (models.WebAuthnCredential, error) {
+	session, err := s.consumeSession(webAuthnCeremonyRegistration, sessionId, user.ID)
+	if err != nil {
+		return models.WebAuthnCredential{}, err
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(response)
+	if err != nil {
+		return models.WebAuthnCredential{}, verificationError(err)
+	}
+	created, err := s.relyingParty.CreateCredential(webAuthnUser{user: user}, session, parsed)
+	if err != nil {
+		return models.WebAuthnCredential{}, verificationError(err)
+	}
+
+	credential := models.WebAuthnCredential{
+		Id:              created.ID,
+		Name:            name,
+		PublicKey:       created.PublicKey,
+		AttestationType: created.AttestationType,
+		Aaguid:          created.Authenticator.AAGUID,
+		SignCount:       created.Authenticator.SignCount,
+		UserVerified:    created.Flags.UserVerified,
+		BackupEligible:  created.Flags.BackupEligible,
+		BackupState:     created.Flags.BackupState,
+		CreatedAt:       time.Now(),
+	}
+	for _, transport := range created.Transport {
+		credential.Transports = append(credential.Transports, string(transport))
+	}
+	_, err = s.userRepository.UpdateOne(s.ctx,
+		bson.M{"$push": bson.M{"webauthn_credentials": credential}, "$set": bson.M{"updated_at": time.Now()}},
+		repositories.Filter{Key: "_id", Value: user.ID},
+		repositories.Filter{Key: "webauthn_credentials.id", Value: bson.M{"$ne": credential.Id}},
+	)
+	return credential, err
+}
+
+// BeginLogin request options for navigator.credentials.get(). Any discoverable credential (passkey) of this site is
+// accepted and none is listed, so the options are the same for every visitor and reveal no account
+func (s *webAuthnService) BeginLogin() (*protocol.CredentialAssertion, string, error) {
+	assertion, session, err := s.relyingParty.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationPreferred))
+	if err != nil {
+		return nil, "", err
+	}
+	sessionId, err := s.saveSession(webAuthnCeremonyLogin, primitive.NilObjectID, session)
+	return assertion, sessionId, err
+}
+
+// FinishLogin verifies the assertion and returns the user it authenticates along with the credential used
+func (s *webAuthnService) FinishLogin(sessionId string, response io.Reader) (models.User, models.WebAuthnCredential, error) {
+	var user models.User
+	stored, session, err := s.findSession(webAuthnCeremonyLogin, sessionId)
+	if err != nil {
+		return user, models.WebAuthnCredential{}, err
+	}
+	if err = s.deleteSession(stored); err != nil {
+		return user, models.WebAuthnCredential{}, err
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(response)
+	if err != nil {
+		return user, models.WebAuthnCredential{}, verificationError(err)
+	}
+
+	validated, err := s.relyingParty.ValidateDiscoverableLogin(func(rawId, userHandle []byte) (webauthn.User, error) {
+		if len(userHandle) != len(primitive.NilObjectID) {
+			return nil, ErrWebAuthnVerification
+		}
+		if !s.userRepository.FindOne(s.ctx, &user, repositories.Filter{Key: "_id", Value: primitive.ObjectID(userHandle)}) {
+			return nil, ErrWebAuthnVerification
+		}
+		return webAuthnUser{user: user}, nil
+	}, session, parsed)
+	if err != nil {
+		return user, models.WebAuthnCredential{}, verificationError(err)
+	}
+	if validated.Authenticator.CloneWarning {
+		log.Warnf("signature counter of a passkey of user %s went backwards", user.ID.Hex())
+		return user, models.WebAuthnCredential{}, ErrWebAuthnCloned
+	}
+
+	now := time.Now()
+	if _, err = s.userRepository.UpdateOne(s.ctx,
+		bson.M{"$set": bson.M{
+			"webauthn_credentials.$.sign_count":   validated.Authenticator.SignCount,
+			"webauthn_credentials.$.backup_state": validated.Flags.BackupState,
+			"webauthn_credentials.$.last_used_at": now,
+		}},
+		repositories.Filter{Key: "_id", Value: user.ID},
+		repositories.Filter{Key: "webauthn_credentials.id", Value: validated.ID},
+	); err != nil {
+		return user, models.WebAuthnCredential{}, err
+	}
+	for _, credential := range user.WebAuthnCredentials {
+		if bytes.Equal(credential.Id, validated.ID) {
+			credential.SignCount, credential.LastUsedAt = validated.Authenticator.SignCount, &now
+			credential.UserVerified = validated.Flags.UserVerified
+			return user, credential, nil
+		}
+	}
+	return user, models.WebAuthnCredential{}, ErrWebAuthnVerification
+}
+
+// RemoveCredential deletes one of the user's credentials
+func (s *webAuthnService) RemoveCredential(userId primitive.ObjectID, credentialId []byte) error {
+	matched, err := s.userRepository.UpdateOne(s.ctx,
+		bson.M{"$pull": bson.M{"webauthn_credentials": bson.M{"id": credentialId}}, "$set": bson.M{"updated_at": time.Now()}},
+		repositories.Filter{Key: "_id", Value: userId},
+		repositories.Filter{Key: "webauthn_credentials.id", Value: credentialId},
+	)
+	if err != nil {
+		return err
+	}
+	if matched == 0 {
+		return ErrCredentialNotFound
+	}
+	return nil
+}
+
+// WebAuthnAmr authentication methods of a WebAuthn login. A credential that verified the user (PIN, biometrics) is
+// a second factor on its own
+func WebAuthnAmr(credential models.WebAuthnCredential) []string {
+	if credential.UserVerified {
+		return []string{AmrHardwareKey, AmrMfa}
+	}
+	return []string{AmrHardwareKey}
+}
+
+// WebAuthnNeedsSecondFactor whether a login with credential must still pass the user's MFA challenge: they enabled
+// MFA and the authenticator did not verify them, so the passkey is a single factor
+func WebAuthnNeedsSecondFactor(user models.User, credential models.WebAuthnCredential) bool {
+	return MfaEnabled(user) && !credential.UserVerified
+}
+
+func (s *webAuthnService) saveSession(ceremony string, userId primitive.ObjectID, session *webauthn.SessionData) (string, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	sessionId := RandomToken(32)
+	_, err = s.sessionRepository.CreateOne(s.ctx, models.WebAuthnSession{
+		BaseModel:   models.NewBaseModel(),
+		SessionHash: HashToken(sessionId),
+		Ceremony:    ceremony,
+		UserId:      userId,
+		Data:        data,
+		ExpiresAt:   time.Now().Add(webAuthnSessionLifetime),
+	})
+	return sessionId, err
+}
+
+func (s *webAuthnService) findSession(ceremony, sessionId string) (models.WebAuthnSession, webauthn.SessionData, error) {
+	var stored models.WebAuthnSession
+	var session webauthn.SessionData
+	if sessionId == "" || !s.sessionRepository.FindOne(s.ctx, &stored,
+		repositories.Filter{Key: "session_hash", Value: HashToken(sessionId)},
+		repositories.Filter{Key: "ceremony", Value: ceremony},
+		repositories.Filter{Key: "expires_at", Value: bson.M{"$gt": time.Now()}},
+	) {
+		return stored, session, ErrWebAuthnSession
+	}
+	if err := json.Unmarshal(stored.Data, &session); err != nil {
+		return stored, session, err
+	}
+	return stored, session, nil
+}
+
+// consumeSession redeems the registration ceremony sessionId, which must have been started by userId
+func (s *webAuthnService) consumeSession(ceremony, sessionId string, userId primitive.ObjectID) (webauthn.SessionData, error) {
+	stored, session, err := s.findSession(ceremony, sessionId)
+	if err != nil {
+		return session, err
+	}
+	if stored.UserId != userId {
+		return session, ErrWebAuthnSession
+	}
+	return session, s.deleteSession(stored)
+}
+
+// deleteSession makes a ceremony single use. Losing the race to another request redeeming it fails the ceremony
+func (s *webAuthnService) deleteSession(stored models.WebAuthnSession) error {
+	deleted, err := s.sessionRepository.DeleteMany(s.ctx, repositories.Filter{Key: "_id", Value: stored.ID})
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrWebAuthnSession
+	}
+	return nil
+}
+
+// verificationError keeps the library's explanation in the logs; callers only learn the ceremony failed
+func verificationError(err error) error {
+	var protocolErr *protocol.Error
+	if errors.As(err, &protocolErr) {
+		log.Info("webauthn verification failed: ", protocolErr.Details, " ", protocolErr.DevInfo)
+	} else {
+		log.Info("webauthn verification failed: ", err)
+	}
+	return ErrWebAuthnVerification
+}
+
+func (u webAuthnUser) WebAuthnID() []byte {
+	return u.user.ID[:]
+}
+
+func (u webAuthnUser) WebAuthnName() string {
+	return u.user.Email
+}
+
+func (u webAuthnUser) WebAuthnDisplayName() string {
+	return u.user.FirstName + " " + u.user.LastName
+}
+
+func (u webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.user.WebAuthnCredentials))
+	for _, stored := range u.user.WebAuthnCredentials {
+		credential := webauthn.Credential{
+			ID:              stored.Id,
+			PublicKey:       stored.PublicKey,
+			AttestationType: stored.AttestationType,
+			Flags: webauthn.CredentialFlags{
+				UserVerified:   stored.UserVerified,
+				BackupEligible: stored.BackupEligible,
+				BackupState:    stored.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{AAGUID: stored.Aaguid, SignCount: stored.SignCount},
+		}
+		for _, transport := range stored.Transports {
+			credential.Transport = append(credential.Transport, protocol.AuthenticatorTransport(transport))
+		}
+		credentials = append(credentials, credential)
+	}
+	return credentials
+}
@@ -0,0 +1,323 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"quickstart-go-jwt-mongodb/models"
+	"quickstart-go-jwt-mongodb/repositories"
+	"slices"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	testRpId   = "example.com"
+	testOrigin = "https://example.com"
+)
+
+// softwareAuthenticator virtual WebAuthn authenticator holding one ES256 passkey, answering ceremonies the way a
+// browser returns a PublicKeyCredential
+type softwareAuthenticator struct {
+	t            *testing.T
+	origin       string
+	key          *ecdsa.PrivateKey
+	credentialId []byte
+	userHandle   []byte
+	signCount    uint32
+	userVerified bool
+}
+
+func newSoftwareAuthenticator(t *testing.T, userVerified bool) *softwareAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialId := make([]byte, 16)
+	if _, err = rand.Read(credentialId); err != nil {
+		t.Fatal(err)
+	}
+	return &softwareAuthenticator{t: t, origin: testOrigin, key: key, credentialId: credentialId, userVerified: userVerified}
+}
+
+// create answers navigator.credentials.create() with a `none` attestation of a new resident key for user
+func (a *softwareAuthenticator) create(creation *protocol.CredentialCreation, user models.User) []byte {
+	a.userHandle = user.ID[:]
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1, // P-256
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	attested := make([]byte, 16) // AAGUID, all zero for a software authenticator
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialId)))
+	attested = append(append(attested, a.credentialId...), publicKey...)
+	attestation, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authenticatorData(0x40, attested),
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return a.credential(map[string]any{
+		"clientDataJSON":    a.clientData("webauthn.create", creation.Response.Challenge),
+		"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+	})
+}
+
+// get answers navigator.credentials.get(), counting the signature like hardware does
+func (a *softwareAuthenticator) get(assertion *protocol.CredentialAssertion) []byte {
+	a.signCount++
+	authenticatorData := a.authenticatorData(0, nil)
+	clientData := a.clientData("webauthn.get", assertion.Response.Challenge)
+	clientDataJSON, _ := base64.RawURLEncoding.DecodeString(clientData)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(slices.Clone(authenticatorData), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return a.credential(map[string]any{
+		"clientDataJSON":    clientData,
+		"authenticatorData": base64.RawURLEncoding.EncodeToString(authenticatorData),
+		"signature":         base64.RawURLEncoding.EncodeToString(signature),
+		"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+	})
+}
+
+func (a *softwareAuthenticator) authenticatorData(flags byte, attested []byte) []byte {
+	flags |= 0x01 // user present
+	if a.userVerified {
+		flags |= 0x04
+	}
+	rpIdHash := sha256.Sum256([]byte(testRpId))
+	data := append(rpIdHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	return append(data, attested...)
+}
+
+func (a *softwareAuthenticator) clientData(ceremony string, challenge protocol.URLEncodedBase64) string {
+	clientData, err := json.Marshal(map[string]any{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    a.origin,
+	})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(clientData)
+}
+
+func (a *softwareAuthenticator) credential(response map[string]any) []byte {
+	id := base64.RawURLEncoding.EncodeToString(a.credentialId)
+	body, err := json.Marshal(map[string]any{"id": id, "rawId": id, "type": "public-key", "response": response})
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return body
+}
+
+// newTestWebAuthnService service storing users and sessions in the MongoDB of MONGO_TEST_URI, which pushes, updates
+// through the positional `$` and pulls credentials
+func newTestWebAuthnService(t *testing.T) (*webAuthnService, repositories.CrudOperation) {
+	relyingParty, err := webauthn.New(&webauthn.Config{RPID: testRpId, RPDisplayName: "Example", RPOrigins: []string{testOrigin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	database := testMongoDatabase(t)
+	users := repositories.NewUserRepository(database)
+	return &webAuthnService{
+		ctx:               context.Background(),
+		relyingParty:      relyingParty,
+		userRepository:    users,
+		sessionRepository: repositories.NewWebAuthnSessionRepository(database),
+	}, users
+}
+
+func newTestWebAuthnUser(t *testing.T, users repositories.CrudOperation) models.User {
+	user := models.User{BaseModel: models.NewBaseModel(), Email: "ada@example.com", FirstName: "Ada", LastName: "Lovelace"}
+	var err error
+	if user.ID, err = users.CreateOne(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// register runs a registration ceremony of authenticator for user and returns the user as stored afterwards
+func register(t *testing.T, service *webAuthnService, authenticator *softwareAuthenticator, user models.User) models.User {
+	creation, sessionId, err := service.BeginRegistration(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = service.FinishRegistration(user, sessionId, "laptop", bytes.NewReader(authenticator.create(creation, user))); err != nil {
+		t.Fatalf("registration refused: %v", err)
+	}
+	if !service.userRepository.FindOne(service.ctx, &user, repositories.Filter{Key: "_id", Value: user.ID}) {
+		t.Fatal("user not found")
+	}
+	return user
+}
+
+func login(t *testing.T, service *webAuthnService, authenticator *softwareAuthenticator) (models.User, models.WebAuthnCredential, error) {
+	assertion, sessionId, err := service.BeginLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service.FinishLogin(sessionId, bytes.NewReader(authenticator.get(assertion)))
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	service, users := newTestWebAuthnService(t)
+	user := newTestWebAuthnUser(t, users)
+	authenticator := newSoftwareAuthenticator(t, true)
+
+	creation, _, err := service.BeginRegistration(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creation.Response.AuthenticatorSelection.ResidentKey != protocol.ResidentKeyRequirementRequired {
+		t.Fatalf("resident key %q, want required", creation.Response.AuthenticatorSelection.ResidentKey)
+	}
+	user = register(t, service, authenticator, user)
+	if len(user.WebAuthnCredentials) != 1 || !bytes.Equal(user.WebAuthnCredentials[0].Id, authenticator.credentialId) {
+		t.Fatalf("stored credentials %+v", user.WebAuthnCredentials)
+	}
+
+	assertion, sessionId, err := service.BeginLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assertion.Response.AllowedCredentials) != 0 {
+		t.Fatal("login options list credentials")
+	}
+	response := authenticator.get(assertion)
+	loggedIn, credential, err := service.FinishLogin(sessionId, bytes.NewReader(response))
+	if err != nil {
+		t.Fatalf("login refused: %v", err)
+	}
+	if loggedIn.ID != user.ID {
+		t.Fatalf("logged in %s, want %s", loggedIn.ID.Hex(), user.ID.Hex())
+	}
+	if amr := WebAuthnAmr(credential); !slices.Equal(amr, []string{AmrHardwareKey, AmrMfa}) {
+		t.Fatalf("amr %v, want a second factor", amr)
+	}
+	service.userRepository.FindOne(service.ctx, &user, repositories.Filter{Key: "_id", Value: user.ID})
+	if stored := user.WebAuthnCredentials[0]; stored.SignCount != 1 || stored.LastUsedAt == nil {
+		t.Fatalf("sign count %d and last use %v not recorded", stored.SignCount, stored.LastUsedAt)
+	}
+
+	if _, _, err = service.FinishLogin(sessionId, bytes.NewReader(response)); !errors.Is(err, ErrWebAuthnSession) {
+		t.Fatalf("replayed assertion: got %v, want ErrWebAuthnSession", err)
+	}
+}
+
+func TestPasskeyLoginRefusesSignCountRegression(t *testing.T) {
+	service, users := newTestWebAuthnService(t)
+	authenticator := newSoftwareAuthenticator(t, true)
+	register(t, service, authenticator, newTestWebAuthnUser(t, users))
+	authenticator.signCount = 41
+	if _, _, err := login(t, service, authenticator); err != nil {
+		t.Fatalf("login refused: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		signCount uint32
+	}{
+		{"same count", 41},
+		{"lower count", 10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// get counts the signature, so it signs test.signCount
+			authenticator.signCount = test.signCount - 1
+			if _, _, err := login(t, service, authenticator); !errors.Is(err, ErrWebAuthnCloned) {
+				t.Fatalf("got %v, want ErrWebAuthnCloned", err)
+			}
+		})
+	}
+}
+
+func TestPasskeyCeremoniesRefuseWrongOrigin(t *testing.T) {
+	t.Run("registration", func(t *testing.T) {
+		service, users := newTestWebAuthnService(t)
+		user := newTestWebAuthnUser(t, users)
+		authenticator := newSoftwareAuthenticator(t, true)
+		authenticator.origin = "https://example.com.evil.test"
+		creation, sessionId, err := service.BeginRegistration(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = service.FinishRegistration(user, sessionId, "laptop", bytes.NewReader(authenticator.create(creation, user))); !errors.Is(err, ErrWebAuthnVerification) {
+			t.Fatalf("got %v, want ErrWebAuthnVerification", err)
+		}
+	})
+	t.Run("login", func(t *testing.T) {
+		service, users := newTestWebAuthnService(t)
+		authenticator := newSoftwareAuthenticator(t, true)
+		register(t, service, authenticator, newTestWebAuthnUser(t, users))
+		authenticator.origin = "https://example.com.evil.test"
+		if _, _, err := login(t, service, authenticator); !errors.Is(err, ErrWebAuthnVerification) {
+			t.Fatalf("got %v, want ErrWebAuthnVerification", err)
+		}
+	})
+}
+
+func TestPasskeyUserVerification(t *testing.T) {
+	mfa := &models.Mfa{Enabled: true, Secret: rfc6238Secret}
+	tests := []struct {
+		name              string
+		userVerified      bool
+		mfa               *models.Mfa
+		amr               []string
+		needsSecondFactor bool
+	}{
+		{"verified", true, nil, []string{AmrHardwareKey, AmrMfa}, false},
+		{"verified with mfa enabled", true, mfa, []string{AmrHardwareKey, AmrMfa}, false},
+		{"not verified", false, nil, []string{AmrHardwareKey}, false},
+		{"not verified with mfa enabled", false, mfa, []string{AmrHardwareKey}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service, users := newTestWebAuthnService(t)
+			user := newTestWebAuthnUser(t, users)
+			if test.mfa != nil {
+				users.UpdateOne(service.ctx, bson.M{"$set": bson.M{"mfa": test.mfa}}, repositories.Filter{Key: "_id", Value: user.ID})
+			}
+			authenticator := newSoftwareAuthenticator(t, true)
+			register(t, service, authenticator, user)
+			// a passkey registered with a PIN may later sign without one
+			authenticator.userVerified = test.userVerified
+
+			loggedIn, credential, err := login(t, service, authenticator)
+			if err != nil {
+				t.Fatalf("login refused: %v", err)
+			}
+			if amr := WebAuthnAmr(credential); !slices.Equal(amr, test.amr) {
+				t.Fatalf("amr %v, want %v", amr, test.amr)
+			}
+			if needs := WebAuthnNeedsSecondFactor(loggedIn, credential); needs != test.needsSecondFactor {
+				t.Fatalf("needs second factor = %v, want %v", needs, test.needsSecondFactor)
+			}
+		})
+	}
+}